@@ -0,0 +1,203 @@
+package goauth2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The default and largest number of tokens of a page of the AdminHandler
+const (
+	DefaultAdminPageSize = 100
+	MaxAdminPageSize     = 1000
+)
+
+// AdminHandler
+// Serve the admin API, for inspecting and revoking the grants of clients
+// during an incident. The routes may be mounted under any prefix:
+//
+//	GET    /clients/{id}/tokens  list the tokens of a client, a page at a time
+//	DELETE /clients/{id}/tokens  revoke all the tokens of a client
+//	DELETE /tokens/{token}       revoke a single token
+//
+// Listed tokens are identified by their TokenID, never by their value. The
+// pages are given by the "offset" and "limit" query parameters, and the
+// response has the "next_offset" of the next page if there is one.
+//
+// Every request must be allowed by the Server's AdminAuthorizer. The
+// routes of a Store that doesn't support them give 501 Not Implemented.
+func (s *Server) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminAuthorizer == nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		} else if err := s.AdminAuthorizer(r); err != nil {
+			s.logger().Println("OAuth Handler: Forbidden admin access!", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var res interface{}
+		var err error
+		segments := adminPathSegments(r)
+		n := len(segments)
+		switch {
+		case n >= 3 && segments[n-3] == "clients" && segments[n-1] == "tokens":
+			if !s.allowMethod(w, r, "GET", "DELETE") {
+				return
+			}
+			if r.Method == "GET" {
+				res, err = s.adminListTokens(r, segments[n-2])
+			} else {
+				res, err = s.adminRevokeClient(segments[n-2])
+			}
+		case n >= 2 && segments[n-2] == "tokens":
+			if !s.allowMethod(w, r, "DELETE") {
+				return
+			}
+			res, err = s.adminRevokeToken(segments[n-1])
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		if errors.Is(err, ErrNotSupported) {
+			http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		} else if err != nil {
+			e := s.InterpretError(err)
+			writeJSON(w, errorStatus(e), s.errorResponse(e))
+		} else {
+			writeJSON(w, http.StatusOK, res)
+		}
+	})
+}
+
+// The unescaped segments of the path of an admin request
+func adminPathSegments(r *http.Request) []string {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segment = unescaped
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// List a page of the tokens of a client, ordered by TokenID
+func (s *Server) adminListTokens(r *http.Request, clientID string) (interface{}, error) {
+	offset, limit, err := s.adminPage(r)
+	if err != nil {
+		return nil, err
+	}
+	lister, ok := s.Store.(ClientTokenLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	tokens, err := lister.ListTokensByClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].ID != tokens[j].ID {
+			return tokens[i].ID < tokens[j].ID
+		}
+		return tokens[i].IssuedAt.Before(tokens[j].IssuedAt)
+	})
+
+	res := map[string]interface{}{"total": len(tokens)}
+	if offset > len(tokens) {
+		offset = len(tokens)
+	}
+	end := offset + limit
+	if end < len(tokens) {
+		res["next_offset"] = end
+	} else {
+		end = len(tokens)
+	}
+	list := make([]map[string]interface{}, 0, end-offset)
+	for _, summary := range tokens[offset:end] {
+		list = append(list, tokenSummaryResponse(summary))
+	}
+	res["tokens"] = list
+	return res, nil
+}
+
+// The offset and limit of a page of the admin API
+func (s *Server) adminPage(r *http.Request) (offset, limit int, err error) {
+	q := r.URL.Query()
+	limit = DefaultAdminPageSize
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > MaxAdminPageSize {
+			return 0, 0, s.NewError(ErrorCodeInvalidRequest,
+				fmt.Sprintf("The \"limit\" parameter must be between 1 and %d.", MaxAdminPageSize))
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, s.NewError(ErrorCodeInvalidRequest,
+				"The \"offset\" parameter must be a non-negative integer.")
+		}
+	}
+	return offset, limit, nil
+}
+
+// Revoke all the tokens of a client
+func (s *Server) adminRevokeClient(clientID string) (interface{}, error) {
+	revoker, ok := s.Store.(BulkRevoker)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	n, err := revoker.RevokeByClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"revoked": n}, nil
+}
+
+// Revoke a single token
+func (s *Server) adminRevokeToken(token string) (interface{}, error) {
+	revoker, ok := s.Store.(TokenRevoker)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if err := revoker.RevokeToken(token); err != nil {
+		return nil, err
+	}
+	return map[string]string{"token_id": TokenID(token)}, nil
+}
+
+// The JSON representation of the summary of a token
+func tokenSummaryResponse(info TokenSummary) map[string]interface{} {
+	res := map[string]interface{}{
+		"token_id":  info.ID,
+		"client_id": info.ClientID,
+		"scope":     info.Scope,
+	}
+	if info.UserID != "" {
+		res["user_id"] = info.UserID
+	}
+	if !info.ExpiresAt.IsZero() {
+		res["expires_at"] = info.ExpiresAt.Unix()
+	}
+	if !info.IssuedAt.IsZero() {
+		res["issued_at"] = info.IssuedAt.Unix()
+	}
+	return res
+}
+
+// Write a JSON response that must not be cached
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	setQueryPairs(w.Header(),
+		"Content-Type", "application/json",
+		"Cache-Control", "no-store",
+		"Pragma", "no-cache",
+	)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
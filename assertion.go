@@ -0,0 +1,225 @@
+package goauth2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The client_assertion_type of JWT client assertions, for the
+// private_key_jwt client authentication
+// http://tools.ietf.org/html/rfc7523#section-2.2
+const ClientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// The signature algorithms of client assertions
+var clientAssertionAlgs = []string{"RS256", "ES256"}
+
+// ClientKeyStore is implemented by a ClientStore that keeps the public keys
+// clients sign their assertions with
+type ClientKeyStore interface {
+	// The public key of a client, an *rsa.PublicKey or *ecdsa.PublicKey
+	// Returns nil if the client has no key.
+	ClientPublicKey(clientID string) (crypto.PublicKey, error)
+}
+
+// AssertionAuthenticator is implemented by a Store that can authenticate
+// clients by a signed JWT assertion rather than a secret
+type AssertionAuthenticator interface {
+	// Return the client if the assertion is valid for one of the
+	// audiences, or an invalid_client ServerError
+	AuthenticateClientAssertion(assertion string, audiences []string) (Client, error)
+}
+
+// The claims of a client assertion
+// http://tools.ietf.org/html/rfc7523#section-3
+type assertionClaims struct {
+	Issuer    string       `json:"iss"`
+	Subject   string       `json:"sub"`
+	Audience  jwtAudiences `json:"aud"`
+	ExpiresAt int64        `json:"exp"`
+	NotBefore int64        `json:"nbf"`
+	ID        string       `json:"jti"`
+}
+
+// The "aud" claim, a string or an array of strings
+type jwtAudiences []string
+
+func (a *jwtAudiences) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = jwtAudiences{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Check a client assertion: its signature by the key of its client, its
+// audience and its lifetime. An assertion may be used once: its identifier
+// is kept in the Backend, which must be a CodeAdder, until it expires.
+func (s *StoreImpl) AuthenticateClientAssertion(assertion string, audiences []string) (Client, error) {
+	invalid := func(description string) error {
+		return NewServerError(ErrorCodeInvalidClient, description, "")
+	}
+
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return nil, invalid("The client assertion is not a JWT.")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims assertionClaims
+	if decodeJWTPart(parts[0], &header) != nil || decodeJWTPart(parts[1], &claims) != nil {
+		return nil, invalid("The client assertion is malformed.")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("The client assertion is malformed.")
+	}
+
+	// The client is both the issuer and the subject
+	if claims.Subject == "" || claims.Issuer != claims.Subject {
+		return nil, invalid("The client assertion has a bad issuer or subject.")
+	}
+	keys, ok := s.Clients.(ClientKeyStore)
+	if !ok {
+		return nil, invalid("The client assertion can't be checked.")
+	}
+	key, err := keys.ClientPublicKey(claims.Subject)
+	if err != nil {
+		return nil, err
+	} else if key == nil {
+		return nil, invalid("The client has no key.")
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, NewServerError(ErrorCodeInvalidClient,
+			"The client assertion signature is invalid.", "").WithCause(err)
+	}
+
+	now, leeway := s.now().Unix(), int64(s.Leeway/time.Second)
+	switch {
+	case claims.ExpiresAt == 0:
+		return nil, invalid("The client assertion has no expiration time.")
+	case now >= claims.ExpiresAt+leeway:
+		return nil, invalid("The client assertion has expired.")
+	case now+leeway < claims.NotBefore:
+		return nil, invalid("The client assertion is not valid yet.")
+	case !matchAudience(claims.Audience, audiences):
+		return nil, invalid("The client assertion is meant for another audience.")
+	case claims.ID == "":
+		return nil, invalid("The client assertion has no identifier.")
+	}
+
+	client, err := s.GetClient(claims.Subject)
+	if err != nil {
+		return nil, NewServerError(ErrorCodeInvalidClient,
+			"The client is unknown.", "").WithCause(err)
+	}
+
+	// Mark the assertion as used until it expires, keyed by its client and
+	// identifier
+	// http://tools.ietf.org/html/rfc7523#section-3
+	lifetime := time.Unix(claims.ExpiresAt, 0).Add(s.Leeway).Sub(s.now())
+	id := sha256.Sum256([]byte(claims.Subject + " " + claims.ID))
+	marker := "assertion:" + base64.RawURLEncoding.EncodeToString(id[:])
+	added, err := s.addAuthCode(marker, AuthCodeInfo{ClientID: claims.Subject}, lifetime)
+	if errors.Is(err, ErrNotSupported) {
+		return nil, invalid("The client assertion can't be checked.")
+	} else if err != nil {
+		return nil, err
+	} else if !added {
+		return nil, invalid("The client assertion was already used.")
+	}
+	return client, nil
+}
+
+// Decode a base64url part of a JWT into v
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Check the signature of a JWT, which must use the algorithm of the key
+func verifyJWTSignature(alg string, key crypto.PublicKey, input, sig []byte) error {
+	hash := sha256.Sum256(input)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig)
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" {
+			if len(sig) != 64 {
+				return errors.New("ES256 signatures are 64 bytes long")
+			}
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			if !ecdsa.Verify(k, hash[:], r, s) {
+				return errors.New("ECDSA verification failed")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("The algorithm %q can't be used with a %T", alg, key)
+}
+
+// Whether one of the audiences of an assertion is accepted
+func matchAudience(claimed jwtAudiences, accepted []string) bool {
+	for _, c := range claimed {
+		for _, a := range accepted {
+			if c == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------
+
+// The credentials of the client of a token request, from a client
+// assertion if there is one
+func (s *Server) tokenClientInfo(r *http.Request, req *AccessTokenRequest) (ClientInfo, error) {
+	if req.ClientAssertion == "" && req.ClientAssertionType == "" {
+		return requestClientInfo(r), nil
+	}
+	if req.ClientAssertionType != ClientAssertionTypeJWTBearer {
+		return ClientInfo{}, s.NewError(ErrorCodeInvalidClient,
+			"The client assertion type is not supported.")
+	}
+	// The audience must not be taken from the request, whose Host header
+	// the sender chooses
+	a, ok := s.Store.(AssertionAuthenticator)
+	if !ok || s.Issuer == "" {
+		return ClientInfo{}, s.NewError(ErrorCodeInvalidClient,
+			"Client assertions are not supported.")
+	}
+
+	// The assertion is meant for the token endpoint, or the server
+	issuer := s.issuer(r)
+	path := s.Endpoints.Token
+	if path == "" {
+		path = r.URL.Path
+	}
+	client, err := a.AuthenticateClientAssertion(req.ClientAssertion, []string{issuer + path, issuer})
+	if err != nil {
+		return ClientInfo{}, s.InterpretError(err)
+	}
+	if id := req.Values.Get("client_id"); id != "" && id != client.ID() {
+		return ClientInfo{}, s.NewError(ErrorCodeInvalidClient,
+			"The client assertion is for another client.")
+	}
+	return ClientInfo{ID: client.ID(), Authenticated: true}, nil
+}
@@ -0,0 +1,117 @@
+package goauth2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// The types of audit events
+const (
+	AuditCodeIssued     = "code_issued"
+	AuditCodeExchanged  = "code_exchanged"
+	AuditTokenIssued    = "token_issued"
+	AuditTokenValidated = "token_validated"
+	AuditTokenRevoked   = "token_revoked"
+	AuditAuthDenied     = "auth_denied"
+	AuditTokenDenied    = "token_denied"
+)
+
+// The length of the token hashes of audit events, in hex digits
+const auditTokenHashLength = 16
+
+// AuditLogger receives the security-relevant events of a Server and its
+// Store, for an audit trail. The fields include the client_id and, when they
+// are known, the user_id, the remote "ip" and the "token_hash" of the token
+// given by AuditTokenHash, but never a code or token. Implementations must
+// be safe for concurrent use.
+type AuditLogger interface {
+	Event(ctx context.Context, eventType string, fields map[string]interface{})
+}
+
+// NopAuditLogger drops every event. A nil AuditLogger does the same.
+type NopAuditLogger struct{}
+
+func (NopAuditLogger) Event(ctx context.Context, eventType string, fields map[string]interface{}) {
+}
+
+// JSONAuditLogger writes each event to a writer as a line of JSON, with
+// its fields, its type under "event" and its RFC 3339 time under "time"
+type JSONAuditLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Create an AuditLogger writing JSON lines to w
+func NewJSONAuditLogger(w io.Writer) *JSONAuditLogger {
+	return &JSONAuditLogger{w: w}
+}
+
+func (l *JSONAuditLogger) Event(ctx context.Context, eventType string, fields map[string]interface{}) {
+	line := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		line[k] = v
+	}
+	line["event"] = eventType
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	json.NewEncoder(l.w).Encode(line)
+}
+
+// AuditTokenHash returns the prefix of the SHA-256 hash of a token sent in
+// audit events, which identifies the token without revealing it
+func AuditTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])[:auditTokenHashLength]
+}
+
+// ----------------------------------------------------------------------------
+
+// Send an event to an AuditLogger, if there is one. Empty fields are left
+// out.
+func audit(l AuditLogger, ctx context.Context, eventType string, fields map[string]interface{}) {
+	if l == nil {
+		return
+	}
+	for k, v := range fields {
+		if v == "" {
+			delete(fields, k)
+		}
+	}
+	l.Event(ctx, eventType, fields)
+}
+
+// Send an event of the Server. s may be nil.
+func (s *Server) audit(ctx context.Context, eventType string, fields map[string]interface{}) {
+	if s != nil {
+		audit(s.AuditLogger, ctx, eventType, fields)
+	}
+}
+
+// Send an event about an access token, with the client, user and scope of
+// the token if it is valid
+func (s *Server) auditToken(ctx context.Context, eventType, token string, fields map[string]interface{}) {
+	if s.AuditLogger == nil {
+		return
+	}
+	info, _ := s.Store.ValidateAccessTokenInfo(token)
+	s.auditTokenInfo(ctx, eventType, token, info, fields)
+}
+
+// Send an event about an access token whose information was looked up
+// already. info is nil for an invalid token.
+func (s *Server) auditTokenInfo(ctx context.Context, eventType, token string, info *TokenInfo, fields map[string]interface{}) {
+	fields["token_hash"] = AuditTokenHash(token)
+	if info != nil {
+		fields["client_id"] = info.ClientID
+		fields["user_id"] = info.UserID
+		fields["scope"] = info.Scope
+	}
+	s.audit(ctx, eventType, fields)
+}
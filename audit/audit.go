@@ -0,0 +1,272 @@
+// Package goauth2/audit writes the audit events of a goauth2 Server to a
+// file of JSON lines, rotated by size.
+//
+// The events are written asynchronously from a bounded queue, so that a
+// slow disk doesn't slow the requests down. The events sent while the queue
+// is full are dropped and counted:
+//
+//	logger, err := audit.NewFileLogger("/var/log/oauth2/audit.log", audit.FileOptions{
+//		MaxBytes:   100 << 20,
+//		MaxBackups: 5,
+//	})
+//	server, err := goauth2.NewServerOptions(
+//		goauth2.WithAuthCache(cache),
+//		goauth2.WithAuthHandler(auth),
+//		goauth2.WithAuditLogger(logger),
+//	)
+//	...
+//	defer logger.Close()
+//	dropped := logger.Dropped()
+//
+// The events carry the client, user, scope, remote IP and outcome of the
+// requests, and the token_hash of goauth2.AuditTokenHash, but never a code
+// or token.
+package audit
+
+import (
+	"context"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// AuditLogger receives the audit events of a Server and its Store
+type AuditLogger = goauth2.AuditLogger
+
+// The defaults of FileOptions
+const (
+	DefaultMaxBytes   = 10 << 20
+	DefaultMaxBackups = 3
+	DefaultQueueSize  = 1024
+)
+
+// ----------------------------------------------------------------------------
+
+// RotatingFile is an io.Writer appending to a file. When a write would grow
+// the file past MaxBytes, the file is renamed to path.1, the older backups
+// to path.2 and so on, and a new file is started. The backups past
+// MaxBackups are removed. A single write is never split across files.
+type RotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open a RotatingFile at path, appending to the file if it exists
+func OpenRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close the current file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Open the file at the path, for appending
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Shift the backups, move the current file to the first backup and start a
+// new file
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	if f.maxBackups <= 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+	os.Remove(backupPath(f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(f.path, i), backupPath(f.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, backupPath(f.path, 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.open()
+}
+
+// The path of the nth backup of a file
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// ----------------------------------------------------------------------------
+
+// An event waiting in the queue of an AsyncLogger
+type queuedEvent struct {
+	ctx       context.Context
+	eventType string
+	fields    map[string]interface{}
+}
+
+// AsyncLogger sends the events to another AuditLogger from a goroutine,
+// through a bounded queue. The events sent while the queue is full, or
+// after Close, are dropped.
+type AsyncLogger struct {
+	next    AuditLogger
+	queue   chan queuedEvent
+	done    chan struct{}
+	dropped uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Create an AsyncLogger sending to next, with a queue of queueSize events
+// (DefaultQueueSize if 0)
+func NewAsyncLogger(next AuditLogger, queueSize int) *AsyncLogger {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	l := &AsyncLogger{
+		next:  next,
+		queue: make(chan queuedEvent, queueSize),
+		done:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Event queues an event, or drops it if the queue is full. The fields are
+// copied, so the caller may keep using them.
+func (l *AsyncLogger) Event(ctx context.Context, eventType string, fields map[string]interface{}) {
+	copied := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		copied[k] = v
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		atomic.AddUint64(&l.dropped, 1)
+		return
+	}
+	select {
+	case l.queue <- queuedEvent{ctx, eventType, copied}:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped so far
+func (l *AsyncLogger) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Close writes the queued events, then closes the next AuditLogger if it
+// is an io.Closer
+func (l *AsyncLogger) Close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mu.Unlock()
+
+	<-l.done
+	if closer, ok := l.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Send the queued events to the next AuditLogger, until the queue is closed
+func (l *AsyncLogger) run() {
+	defer close(l.done)
+	for e := range l.queue {
+		l.next.Event(e.ctx, e.eventType, e.fields)
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// FileOptions are the options of NewFileLogger. The zero values are
+// replaced by the defaults.
+type FileOptions struct {
+	// The size past which the file is rotated
+	MaxBytes int64
+	// The number of rotated files kept
+	MaxBackups int
+	// The number of events waiting to be written
+	QueueSize int
+}
+
+// A JSON-lines AuditLogger closing its file
+type fileLogger struct {
+	*goauth2.JSONAuditLogger
+	file *RotatingFile
+}
+
+func (l fileLogger) Close() error {
+	return l.file.Close()
+}
+
+// NewFileLogger
+// Create an AuditLogger writing the events as JSON lines to a RotatingFile
+// at path, through an AsyncLogger. Close the logger to write the queued
+// events and close the file.
+func NewFileLogger(path string, opts FileOptions) (*AsyncLogger, error) {
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.MaxBackups == 0 {
+		opts.MaxBackups = DefaultMaxBackups
+	}
+	file, err := OpenRotatingFile(path, opts.MaxBytes, opts.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return NewAsyncLogger(fileLogger{goauth2.NewJSONAuditLogger(file), file}, opts.QueueSize), nil
+}
@@ -2,94 +2,446 @@
 package authcache
 
 import (
-	"errors"
+	"context"
+	"github.com/yanatan16/goauth2"
+	"sync"
 	"time"
 )
 
+// Default expiration times, in seconds
 const (
-	CodeExpiry  int64 = 100
+	CodeExpiry int64 = 100
 	// No expiration of Tokens
-	TokenExpiry int64 = 0 
+	TokenExpiry int64 = 0
 )
 
 type CacheEntry struct {
 	ClientID, Scope, RedirectURI string
+	// Zero if the entry does not expire. Expired codes are kept for another
+	// CodeExpiry, so that they can be told apart from unknown ones.
+	ExpiresAt time.Time
+	// Issue time and requesting IP of authorization codes
+	IssuedAt  time.Time
+	RequestIP string
+	// The resource of codes, or the audience of tokens
+	Audience string
+	// The user who authorized the code or token, and the issue time of
+	// tokens
+	UserID string
+	// The time the session of a token was authorized
+	AuthTime time.Time
+	// The delegation chain of tokens issued by token exchange
+	Delegation string
+	// The extra token response parameters of codes
+	Extra map[string]string
+}
+
+// A pushed authorization request
+type PushedRequest struct {
+	Data      []byte
+	ExpiresAt time.Time
 }
 
 // This is a struct that implements the AuthCache interface
 // Note: It only handles bearer tokens
-// This auth cache does not use expiration times
 type BasicAuthCache struct {
+	// Expiration times of codes and tokens in seconds, CodeExpiry and
+	// TokenExpiry by default. Zero means no expiration.
+	CodeExpiry, TokenExpiry int64
+	// The time of expirations, goauth2.RealClock by default
+	Clock goauth2.Clock
+
 	AuthCodes    map[string]*CacheEntry
 	AccessTokens map[string]*CacheEntry
+	// Pushed authorization requests
+	PushedRequests map[string]*PushedRequest
+	// Tokens of a user issued before the user's cutoff are not valid
+	UserCutoffs map[string]time.Time
+
+	// Guards the maps, and the LRU lists
+	mu sync.RWMutex
+	// The codes and tokens from the most to the least recently used, and
+	// the caps of the other maps, if the cache is bounded
+	codeLRU, tokenLRU                 *lruList
+	maxPushedRequests, maxUserCutoffs int
+	// Closed by Close to stop the delayed deletions
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // Create a new Basic Auth Cache
 func NewBasicAuthCache() *BasicAuthCache {
 	return &BasicAuthCache{
-		AuthCodes:    make(map[string]*CacheEntry),
-		AccessTokens: make(map[string]*CacheEntry),
+		CodeExpiry:     CodeExpiry,
+		TokenExpiry:    TokenExpiry,
+		Clock:          goauth2.RealClock,
+		AuthCodes:      make(map[string]*CacheEntry),
+		AccessTokens:   make(map[string]*CacheEntry),
+		PushedRequests: make(map[string]*PushedRequest),
+		UserCutoffs:    make(map[string]time.Time),
+		done:           make(chan struct{}),
 	}
 }
 
 // Register an authorization code into the cache
-// ClientID is the client requesting
-// Scope is the requested access scope
-// Redirect_uri is the redirect URI to save for checking on lookup
 // Code is a generated random string to register with the request
-func (ac *BasicAuthCache) RegisterAuthCode(clientID, scope, redirect_uri, code string) (err error) {
-	entry := &CacheEntry{
-		ClientID:    clientID,
-		Scope:       scope,
-		RedirectURI: redirect_uri,
-	}
+// Info is the information on the request to save for checking on lookup
+func (ac *BasicAuthCache) RegisterAuthCode(code string, info goauth2.AuthCodeInfo) (err error) {
+	entry := ac.codeEntry(info, ac.CodeExpiry)
+	ac.mu.Lock()
 	ac.AuthCodes[code] = entry
+	ac.added(true, code)
+	ac.mu.Unlock()
 
-	if CodeExpiry > 0 {
-		go DelayedDelete(ac.AuthCodes, code, CodeExpiry)
+	if ac.CodeExpiry > 0 {
+		go ac.delayedDelete(true, code, 2*ac.CodeExpiry)
 	}
 
 	return nil
 }
 
+// Register an authorization code for lifetime, or CodeExpiry if it is 0,
+// unless the cache holds it already, even expired, in a single locked step
+// Returns whether the code was registered.
+func (ac *BasicAuthCache) AddAuthCode(code string, info goauth2.AuthCodeInfo, lifetime time.Duration) (bool, error) {
+	secs := ac.CodeExpiry
+	if lifetime > 0 {
+		secs = int64((lifetime + time.Second - 1) / time.Second)
+	}
+	entry := ac.codeEntry(info, secs)
+	ac.mu.Lock()
+	if _, ok := ac.AuthCodes[code]; ok {
+		ac.mu.Unlock()
+		return false, nil
+	}
+	ac.AuthCodes[code] = entry
+	ac.added(true, code)
+	ac.mu.Unlock()
+
+	if secs > 0 {
+		go ac.delayedDelete(true, code, 2*secs)
+	}
+	return true, nil
+}
+
+// The entry of a new code expiring in secs seconds, or never if it is 0
+func (ac *BasicAuthCache) codeEntry(info goauth2.AuthCodeInfo, secs int64) *CacheEntry {
+	entry := &CacheEntry{
+		ClientID:    info.ClientID,
+		Scope:       info.Scope,
+		RedirectURI: info.RedirectURI,
+		IssuedAt:    info.IssuedAt,
+		RequestIP:   info.RequestIP,
+		Audience:    info.Resource,
+		UserID:      info.UserID,
+		Extra:       info.Extra,
+	}
+	if secs > 0 {
+		entry.ExpiresAt = ac.Clock.Now().Add(time.Duration(secs) * time.Second)
+	}
+	return entry
+}
+
 // Register an access token into the cache
-// ClientID is the client requesting
-// Scope is the requested access scope
 // Token is a generated random string to register with the request
+// Info is the client, scope and audience of the token
 // Returns the token type, expiration time (in seconds), and possibly an error
-func (ac *BasicAuthCache) RegisterAccessToken(clientID, scope, token string) (ttype string, expiry int64, err error) {
+func (ac *BasicAuthCache) RegisterAccessToken(token string, info goauth2.TokenInfo, lifetime goauth2.TokenLifetime) (ttype string, expiry int64, err error) {
 	entry := &CacheEntry{
-		ClientID: clientID,
-		Scope:    scope,
+		ClientID:   info.ClientID,
+		Scope:      info.Scope,
+		Audience:   info.Audience,
+		UserID:     info.UserID,
+		IssuedAt:   info.IssuedAt,
+		AuthTime:   info.AuthTime,
+		Delegation: info.Delegation,
+	}
+	now := ac.Clock.Now()
+	expiry = lifetime.Seconds(now, ac.TokenExpiry)
+	if expiry > 0 {
+		entry.ExpiresAt = now.Add(time.Duration(expiry) * time.Second)
 	}
+	ac.mu.Lock()
 	ac.AccessTokens[token] = entry
+	ac.added(false, token)
+	ac.mu.Unlock()
 
-	if TokenExpiry > 0 {
-		go DelayedDelete(ac.AccessTokens, token, TokenExpiry)
+	if expiry > 0 {
+		go ac.delayedDelete(false, token, expiry)
 	}
 
-	return "bearer", TokenExpiry, nil
+	return "bearer", expiry, nil
 }
 
-// Lookup access token
+// Lookup an authorization code
 // Code is the code passed from the user
-// Returns the clientID, scope, and redirect URI registered with that code
-func (ac *BasicAuthCache) LookupAuthCode(code string) (clientID, scope, redirect_uri string, err error) {
+// Returns the information registered with that code
+func (ac *BasicAuthCache) LookupAuthCode(code string) (*goauth2.AuthCodeInfo, error) {
+	ac.mu.RLock()
 	entry, ok := ac.AuthCodes[code]
+	ac.mu.RUnlock()
+	ac.used(true, code)
 	if !ok {
-		return "", "", "", errors.New("AuthCode not found in Cache!")
+		return nil, goauth2.ErrCodeNotFound
+	} else if ac.expired(entry) {
+		return nil, goauth2.ErrCodeExpired
 	}
 
-	return entry.ClientID, entry.Scope, entry.RedirectURI, nil
+	return entry.codeInfo(), nil
+}
+
+// Remove an authorization code and return the information registered with
+// it, in a single locked step, so that a code is only ever taken once
+func (ac *BasicAuthCache) TakeAuthCode(code string) (*goauth2.AuthCodeInfo, error) {
+	ac.mu.Lock()
+	entry, ok := ac.AuthCodes[code]
+	delete(ac.AuthCodes, code)
+	ac.removed(true, code)
+	ac.mu.Unlock()
+	if !ok {
+		return nil, goauth2.ErrCodeNotFound
+	} else if ac.expired(entry) {
+		return nil, goauth2.ErrCodeExpired
+	}
+	return entry.codeInfo(), nil
 }
 
 // Lookup an Access Token
 // Token is the token passed from the client
-// Return whether the token is valid
-func (ac *BasicAuthCache) LookupAccessToken(token string) (bool, error) {
-	_, ok := ac.AccessTokens[token]
+// Return the information registered with the token, or nil if it is not valid
+func (ac *BasicAuthCache) LookupAccessToken(token string) (*goauth2.TokenInfo, error) {
+	defer ac.used(false, token)
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	entry, ok := ac.AccessTokens[token]
+	if !ok || ac.expired(entry) || ac.cutOff(entry) {
+		return nil, nil
+	}
+
+	return entry.tokenInfo(token), nil
+}
+
+// Check an Access Token without copying its information
+func (ac *BasicAuthCache) CheckAccessToken(token string) (bool, error) {
+	defer ac.used(false, token)
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	entry, ok := ac.AccessTokens[token]
+	return ok && !ac.expired(entry) && !ac.cutOff(entry), nil
+}
+
+// Lookup several Access Tokens in a single locked pass
+// Return whether each token is valid. Unknown tokens map to false.
+func (ac *BasicAuthCache) LookupAccessTokens(tokens []string) (map[string]bool, error) {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+
+	valid := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		entry, ok := ac.AccessTokens[token]
+		valid[token] = ok && !ac.expired(entry) && !ac.cutOff(entry)
+	}
+	return valid, nil
+}
+
+// List the tokens issued to a client
+func (ac *BasicAuthCache) ListTokensByClient(clientID string) ([]goauth2.TokenInfo, error) {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+
+	var tokens []goauth2.TokenInfo
+	for token, entry := range ac.AccessTokens {
+		if entry.ClientID == clientID && !ac.expired(entry) && !ac.cutOff(entry) {
+			tokens = append(tokens, *entry.tokenInfo(token))
+		}
+	}
+	return tokens, nil
+}
+
+// List the tokens authorized by a user
+func (ac *BasicAuthCache) ListUserTokens(userID string) ([]goauth2.TokenSummary, error) {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+
+	var tokens []goauth2.TokenSummary
+	for token, entry := range ac.AccessTokens {
+		if entry.UserID == userID && !ac.expired(entry) && !ac.cutOff(entry) {
+			tokens = append(tokens, entry.tokenInfo(token).Summary())
+		}
+	}
+	return tokens, nil
+}
+
+// Revoke an access token
+func (ac *BasicAuthCache) RevokeToken(token string) error {
+	ac.mu.Lock()
+	delete(ac.AccessTokens, token)
+	ac.removed(false, token)
+	ac.mu.Unlock()
+	return nil
+}
 
-	return ok, nil
+// Revoke every token issued to a client
+// Returns the number of tokens revoked
+func (ac *BasicAuthCache) RevokeByClient(clientID string) (int, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	n := 0
+	for token, entry := range ac.AccessTokens {
+		if entry.ClientID == clientID {
+			delete(ac.AccessTokens, token)
+			ac.removed(false, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Invalidate the tokens a user authorized before t
+// If the cache is bounded and holds as many cutoffs as it may, the tokens
+// are revoked instead.
+func (ac *BasicAuthCache) SetUserCutoff(userID string, t time.Time) error {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if ac.roomForUserCutoff(userID) {
+		ac.UserCutoffs[userID] = t
+		return nil
+	}
+	for token, entry := range ac.AccessTokens {
+		if entry.UserID == userID && entry.IssuedAt.Before(t) {
+			delete(ac.AccessTokens, token)
+			ac.removed(false, token)
+		}
+	}
+	return nil
+}
+
+// Whether an entry expired, even if it wasn't deleted yet
+func (ac *BasicAuthCache) expired(entry *CacheEntry) bool {
+	return !entry.ExpiresAt.IsZero() && !ac.Clock.Now().Before(entry.ExpiresAt)
+}
+
+// Whether a token was issued before its user's cutoff
+// The caller must hold the lock.
+func (ac *BasicAuthCache) cutOff(entry *CacheEntry) bool {
+	if entry.UserID == "" {
+		return false
+	}
+	cutoff, ok := ac.UserCutoffs[entry.UserID]
+	return ok && entry.IssuedAt.Before(cutoff)
+}
+
+// Register a pushed authorization request until it expires
+// Expired requests are dropped when another one is registered.
+func (ac *BasicAuthCache) RegisterPushedRequest(id string, data []byte, expiry time.Duration) error {
+	now := ac.Clock.Now()
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	for key, p := range ac.PushedRequests {
+		if !now.Before(p.ExpiresAt) {
+			delete(ac.PushedRequests, key)
+		}
+	}
+	if _, ok := ac.PushedRequests[id]; !ok {
+		ac.makeRoomForPushedRequest()
+	}
+	ac.PushedRequests[id] = &PushedRequest{Data: data, ExpiresAt: now.Add(expiry)}
+	return nil
+}
+
+// Remove and return a pushed authorization request
+// Return nil if it is unknown, expired or already taken.
+func (ac *BasicAuthCache) TakePushedRequest(id string) ([]byte, error) {
+	ac.mu.Lock()
+	p, ok := ac.PushedRequests[id]
+	delete(ac.PushedRequests, id)
+	ac.mu.Unlock()
+
+	if !ok || !ac.Clock.Now().Before(p.ExpiresAt) {
+		return nil, nil
+	}
+	return p.Data, nil
+}
+
+// Set the lifetime of the tokens registered from now on, in seconds
+// It is not safe to call while the cache is in use.
+func (ac *BasicAuthCache) SetTokenExpiry(secs int64) {
+	ac.TokenExpiry = secs
+}
+
+// Set the lifetime of the codes registered from now on, in seconds
+// It is not safe to call while the cache is in use.
+func (ac *BasicAuthCache) SetCodeExpiry(secs int64) {
+	ac.CodeExpiry = secs
+}
+
+// Set the clock of the expirations
+// It is not safe to call while the cache is in use.
+func (ac *BasicAuthCache) SetClock(clock goauth2.Clock) {
+	ac.Clock = clock
+}
+
+// Ping always succeeds, since the cache lives in memory
+func (ac *BasicAuthCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+// The information of the code of an entry
+func (entry *CacheEntry) codeInfo() *goauth2.AuthCodeInfo {
+	return &goauth2.AuthCodeInfo{
+		ClientID:    entry.ClientID,
+		Scope:       entry.Scope,
+		RedirectURI: entry.RedirectURI,
+		IssuedAt:    entry.IssuedAt,
+		RequestIP:   entry.RequestIP,
+		Resource:    entry.Audience,
+		UserID:      entry.UserID,
+		Extra:       entry.Extra,
+	}
+}
+
+// The information of the token of an entry
+func (entry *CacheEntry) tokenInfo(token string) *goauth2.TokenInfo {
+	return &goauth2.TokenInfo{
+		Token:      token,
+		ClientID:   entry.ClientID,
+		Scope:      entry.Scope,
+		Audience:   entry.Audience,
+		ExpiresAt:  entry.ExpiresAt,
+		UserID:     entry.UserID,
+		IssuedAt:   entry.IssuedAt,
+		AuthTime:   entry.AuthTime,
+		Delegation: entry.Delegation,
+	}
+}
+
+// Close stops the delayed deletions of expired codes and tokens. The cache
+// can still be used, but expired entries are then only deleted when they
+// are replaced or revoked.
+func (ac *BasicAuthCache) Close() error {
+	ac.closeOnce.Do(func() {
+		if ac.done != nil {
+			close(ac.done)
+		}
+	})
+	return nil
+}
+
+// Wait secs seconds before deleting a code or token, unless the cache is
+// closed first
+func (ac *BasicAuthCache) delayedDelete(code bool, key string, secs int64) {
+	select {
+	case <-ac.Clock.After(time.Duration(secs) * time.Second):
+	case <-ac.done:
+		return
+	}
+	ac.mu.Lock()
+	delete(ac.entries(code), key)
+	ac.removed(code, key)
+	ac.mu.Unlock()
 }
 
 // DelayedDelete will way secs seconds before deleting key from map m
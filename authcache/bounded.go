@@ -0,0 +1,155 @@
+package authcache
+
+import (
+	"container/list"
+	"time"
+)
+
+// BoundedLimits are the capacities of a bounded cache. Each kind of entry
+// has its own, so that a flood of one kind can't evict the others: bogus
+// authorization requests can evict codes, but never the tokens.
+type BoundedLimits struct {
+	// The numbers of codes and tokens. When one is reached, the least
+	// recently used entries of its kind are evicted: an evicted code or
+	// token is simply no longer valid.
+	Codes, Tokens int
+	// The number of pushed authorization requests. When it is reached, the
+	// request expiring first is evicted.
+	PushedRequests int
+	// The number of users with a cutoff. When it is reached, the cutoff of
+	// another user revokes the tokens it covers instead of being kept.
+	UserCutoffs int
+}
+
+// An LRU list of the keys of codes or tokens
+type lruList struct {
+	max   int
+	list  *list.List
+	elems map[string]*list.Element
+}
+
+func newLRUList(max int) *lruList {
+	if max < 1 {
+		max = 1
+	}
+	return &lruList{max: max, list: list.New(), elems: make(map[string]*list.Element)}
+}
+
+// NewBoundedAuthCache
+// Create a Basic Auth Cache holding at most maxEntries codes, and as many
+// tokens, pushed requests and user cutoffs, so that bogus requests can't
+// grow it without bound. maxEntries must be positive.
+func NewBoundedAuthCache(maxEntries int) *BasicAuthCache {
+	return NewBoundedAuthCacheWithLimits(BoundedLimits{
+		Codes:          maxEntries,
+		Tokens:         maxEntries,
+		PushedRequests: maxEntries,
+		UserCutoffs:    maxEntries,
+	})
+}
+
+// Create a Basic Auth Cache bounded by limits, whose capacities must be
+// positive
+func NewBoundedAuthCacheWithLimits(limits BoundedLimits) *BasicAuthCache {
+	ac := NewBasicAuthCache()
+	ac.codeLRU = newLRUList(limits.Codes)
+	ac.tokenLRU = newLRUList(limits.Tokens)
+	ac.maxPushedRequests = limits.PushedRequests
+	if ac.maxPushedRequests < 1 {
+		ac.maxPushedRequests = 1
+	}
+	ac.maxUserCutoffs = limits.UserCutoffs
+	if ac.maxUserCutoffs < 1 {
+		ac.maxUserCutoffs = 1
+	}
+	return ac
+}
+
+// The map of codes or tokens
+func (ac *BasicAuthCache) entries(code bool) map[string]*CacheEntry {
+	if code {
+		return ac.AuthCodes
+	}
+	return ac.AccessTokens
+}
+
+// The LRU list of codes or tokens, nil if the cache is not bounded
+func (ac *BasicAuthCache) lru(code bool) *lruList {
+	if code {
+		return ac.codeLRU
+	}
+	return ac.tokenLRU
+}
+
+// Make a registered entry the most recently used, and evict the least
+// recently used ones of its kind over the cap, if the cache is bounded
+// The caller must hold the lock.
+func (ac *BasicAuthCache) added(code bool, key string) {
+	l := ac.lru(code)
+	if l == nil {
+		return
+	}
+	if e, ok := l.elems[key]; ok {
+		l.list.MoveToFront(e)
+	} else {
+		l.elems[key] = l.list.PushFront(key)
+	}
+	for l.list.Len() > l.max {
+		oldest := l.list.Remove(l.list.Back()).(string)
+		delete(l.elems, oldest)
+		delete(ac.entries(code), oldest)
+	}
+}
+
+// Make an entry that was looked up the most recently used, if the cache is
+// bounded and still holds it
+func (ac *BasicAuthCache) used(code bool, key string) {
+	l := ac.lru(code)
+	if l == nil {
+		return
+	}
+	ac.mu.Lock()
+	if e, ok := l.elems[key]; ok {
+		l.list.MoveToFront(e)
+	}
+	ac.mu.Unlock()
+}
+
+// Drop a deleted entry from the LRU list, if the cache is bounded
+// The caller must hold the lock.
+func (ac *BasicAuthCache) removed(code bool, key string) {
+	l := ac.lru(code)
+	if l == nil {
+		return
+	}
+	if e, ok := l.elems[key]; ok {
+		l.list.Remove(e)
+		delete(l.elems, key)
+	}
+}
+
+// Make room for a new pushed request, once the expired ones were dropped,
+// by evicting the request expiring first if the cache is full
+// The caller must hold the lock.
+func (ac *BasicAuthCache) makeRoomForPushedRequest() {
+	if ac.maxPushedRequests == 0 || len(ac.PushedRequests) < ac.maxPushedRequests {
+		return
+	}
+	var first string
+	var at time.Time
+	for key, p := range ac.PushedRequests {
+		if at.IsZero() || p.ExpiresAt.Before(at) {
+			first, at = key, p.ExpiresAt
+		}
+	}
+	delete(ac.PushedRequests, first)
+}
+
+// Whether a new user cutoff can be kept, rather than applied at once
+// The caller must hold the lock.
+func (ac *BasicAuthCache) roomForUserCutoff(userID string) bool {
+	if _, ok := ac.UserCutoffs[userID]; ok || ac.maxUserCutoffs == 0 {
+		return true
+	}
+	return len(ac.UserCutoffs) < ac.maxUserCutoffs
+}
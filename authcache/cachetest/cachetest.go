@@ -0,0 +1,505 @@
+// Package goauth2/authcache/cachetest checks that an implementation of the
+// goauth2.AuthCache interface keeps its contract, so that backend authors
+// don't have to rewrite the tests.
+//
+// Run the suite from a test of the package of the cache, with a factory
+// returning a new, empty cache on every call:
+//
+//	func TestSuite(t *testing.T) {
+//		cachetest.RunAuthCacheSuite(t, func() goauth2.AuthCache {
+//			return NewMyAuthCache(...)
+//		})
+//	}
+//
+// The suite runs the conformance checks of RunAuthCacheConformance, which
+// call the cache directly, then the OAuth 2.0 flows of a Server built on
+// the cache: the authorization code and implicit grants, the single use of
+// codes, the validation of the tokens by TokenVerifier, and their
+// revocation.
+//
+// The factory is called once per subtest, and a cache implementing
+// io.Closer is closed at the end of its subtest. Caches sharing a backend
+// must not see each other's entries, such as by using a new key prefix or
+// database each time.
+//
+// The cache must implement goauth2.CodeConsumer, with which the Store
+// exchanges codes. The other optional interfaces of goauth2, such as
+// TokenRevoker or UserCutoffSetter, are checked when the cache implements
+// them, and their subtests are skipped otherwise. Expiry is checked by
+// setting a token lifetime of one second, through goauth2.TokenExpirySetter
+// or the lifetime of a registration, and waiting for it to pass.
+package cachetest
+
+import (
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// The lifetime of the tokens of the expiry checks
+const shortTokenExpiry int64 = 1
+
+// RunAuthCacheConformance
+// Run the conformance checks as subtests of t, each on a cache made by
+// factory
+func RunAuthCacheConformance(t *testing.T, factory func() goauth2.AuthCache) {
+	checks := []struct {
+		name  string
+		check func(t *testing.T, ac goauth2.AuthCache)
+	}{
+		{"AuthCode", testAuthCode},
+		{"UnknownAuthCode", testUnknownAuthCode},
+		{"ConcurrentTakeAuthCode", testConcurrentTakeAuthCode},
+		{"AddAuthCode", testAddAuthCode},
+		{"AccessToken", testAccessToken},
+		{"UnknownAccessToken", testUnknownAccessToken},
+		{"LookupAccessTokens", testLookupAccessTokens},
+		{"TokenExpiry", testTokenExpiry},
+		{"TokenLifetime", testTokenLifetime},
+		{"RevokeToken", testRevokeToken},
+		{"RevokeByClient", testRevokeByClient},
+		{"ListTokensByClient", testListTokensByClient},
+		{"ListUserTokens", testListUserTokens},
+		{"UserCutoff", testUserCutoff},
+		{"PushedRequest", testPushedRequest},
+	}
+	for _, c := range checks {
+		check := c.check
+		t.Run(c.name, func(t *testing.T) {
+			ac := factory()
+			if closer, ok := ac.(io.Closer); ok {
+				defer closer.Close()
+			}
+			check(t, ac)
+		})
+	}
+}
+
+// A time with a fractional second, which must survive the round trip
+var issued = time.Date(2012, 10, 1, 12, 30, 0, 42, time.UTC)
+
+// Register a token, failing the test on errors
+func register(t *testing.T, ac goauth2.AuthCache, token string, info goauth2.TokenInfo) {
+	t.Helper()
+	if _, _, err := ac.RegisterAccessToken(token, info, goauth2.TokenLifetime{}); err != nil {
+		t.Fatalf("RegisterAccessToken(%q, goauth2.TokenLifetime{}) failed: %v", token, err)
+	}
+}
+
+// Whether a token is valid, failing the test on errors
+func valid(t *testing.T, ac goauth2.AuthCache, token string) bool {
+	t.Helper()
+	info, err := ac.LookupAccessToken(token)
+	if err != nil {
+		t.Fatalf("LookupAccessToken(%q) failed: %v", token, err)
+	}
+	return info != nil
+}
+
+// Every field of a code is returned by its lookup, and by taking it, after
+// which the code is gone
+func testAuthCode(t *testing.T, ac goauth2.AuthCache) {
+	want := goauth2.AuthCodeInfo{
+		ClientID:    "client1",
+		Scope:       "read write",
+		RedirectURI: "http://localhost/redirect",
+		IssuedAt:    issued,
+		RequestIP:   "10.0.0.2",
+		Resource:    "https://api.example.com",
+		UserID:      "user1",
+		Extra:       map[string]string{"tenant_id": "t1"},
+	}
+	if err := ac.RegisterAuthCode("code1", want); err != nil {
+		t.Fatal("RegisterAuthCode failed:", err)
+	}
+	consumer := codeConsumer(t, ac)
+
+	check := func(name string, got *goauth2.AuthCodeInfo, err error) {
+		t.Helper()
+		if err != nil || got == nil {
+			t.Fatalf("%s of a registered code returned %v, %v", name, got, err)
+		}
+		if !got.IssuedAt.Equal(want.IssuedAt) {
+			t.Errorf("%s returned the issue time %s, want %s", name, got.IssuedAt, want.IssuedAt)
+		}
+		got.IssuedAt = want.IssuedAt
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s returned %+v, want %+v", name, *got, want)
+		}
+	}
+	got, err := ac.LookupAuthCode("code1")
+	check("LookupAuthCode", got, err)
+	got, err = consumer.TakeAuthCode("code1")
+	check("TakeAuthCode", got, err)
+
+	if info, err := consumer.TakeAuthCode("code1"); info != nil || !errors.Is(err, goauth2.ErrCodeNotFound) {
+		t.Errorf("TakeAuthCode of a taken code returned %v, %v; want ErrCodeNotFound", info, err)
+	}
+	if info, err := ac.LookupAuthCode("code1"); info != nil || !errors.Is(err, goauth2.ErrCodeNotFound) {
+		t.Errorf("LookupAuthCode of a taken code returned %v, %v; want ErrCodeNotFound", info, err)
+	}
+}
+
+// The CodeConsumer of a cache, which the Store needs to exchange codes
+func codeConsumer(t *testing.T, ac goauth2.AuthCache) goauth2.CodeConsumer {
+	t.Helper()
+	consumer, ok := ac.(goauth2.CodeConsumer)
+	if !ok {
+		t.Fatal("The cache doesn't implement goauth2.CodeConsumer")
+	}
+	return consumer
+}
+
+// Of several concurrent takes of a code, only one gets it
+func testConcurrentTakeAuthCode(t *testing.T, ac goauth2.AuthCache) {
+	consumer := codeConsumer(t, ac)
+	if err := ac.RegisterAuthCode("code1", goauth2.AuthCodeInfo{ClientID: "client1"}); err != nil {
+		t.Fatal("RegisterAuthCode failed:", err)
+	}
+
+	const takers = 8
+	taken := make(chan bool, takers)
+	for i := 0; i < takers; i++ {
+		go func() {
+			info, err := consumer.TakeAuthCode("code1")
+			if err != nil && !errors.Is(err, goauth2.ErrCodeNotFound) {
+				t.Error("TakeAuthCode failed:", err)
+			}
+			taken <- info != nil
+		}()
+	}
+	n := 0
+	for i := 0; i < takers; i++ {
+		if <-taken {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("The code was taken %d times by concurrent calls, want once", n)
+	}
+}
+
+// A code is added once, even by concurrent calls, and then registered for
+// its lifetime
+func testAddAuthCode(t *testing.T, ac goauth2.AuthCache) {
+	adder, ok := ac.(goauth2.CodeAdder)
+	if !ok {
+		t.Skip("The cache doesn't implement goauth2.CodeAdder")
+	}
+
+	const adders = 8
+	added := make(chan bool, adders)
+	for i := 0; i < adders; i++ {
+		go func() {
+			ok, err := adder.AddAuthCode("code1", goauth2.AuthCodeInfo{ClientID: "client1"}, 0)
+			if err != nil {
+				t.Error("AddAuthCode failed:", err)
+			}
+			added <- ok
+		}()
+	}
+	n := 0
+	for i := 0; i < adders; i++ {
+		if <-added {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("The code was added %d times by concurrent calls, want once", n)
+	}
+
+	if info, err := ac.LookupAuthCode("code1"); err != nil || info == nil || info.ClientID != "client1" {
+		t.Errorf("LookupAuthCode of an added code returned %v, %v", info, err)
+	}
+	if ok, err := adder.AddAuthCode("code1", goauth2.AuthCodeInfo{ClientID: "client2"}, 0); ok || err != nil {
+		t.Errorf("AddAuthCode of a registered code returned %v, %v; want false", ok, err)
+	}
+	if info, _ := ac.LookupAuthCode("code1"); info == nil || info.ClientID != "client1" {
+		t.Errorf("AddAuthCode replaced a registered code: %v", info)
+	}
+
+	// A code added with a lifetime expires after it
+	lifetime := time.Duration(shortTokenExpiry) * time.Second
+	if ok, err := adder.AddAuthCode("code2", goauth2.AuthCodeInfo{ClientID: "client1"}, lifetime); !ok || err != nil {
+		t.Fatalf("AddAuthCode of a new code returned %v, %v", ok, err)
+	}
+	time.Sleep(lifetime + 100*time.Millisecond)
+	if info, err := ac.LookupAuthCode("code2"); info != nil || err == nil {
+		t.Errorf("LookupAuthCode of an expired code returned %v, %v", info, err)
+	}
+}
+
+// Unknown codes are reported with ErrCodeNotFound
+func testUnknownAuthCode(t *testing.T, ac goauth2.AuthCache) {
+	if info, err := ac.LookupAuthCode("unknown"); info != nil || !errors.Is(err, goauth2.ErrCodeNotFound) {
+		t.Errorf("LookupAuthCode of an unknown code returned %v, %v; want ErrCodeNotFound", info, err)
+	}
+}
+
+// Every field of a token is returned by its lookup, with its expiry
+func testAccessToken(t *testing.T, ac goauth2.AuthCache) {
+	want := goauth2.TokenInfo{
+		Token:      "token1",
+		ClientID:   "client1",
+		Scope:      "read",
+		Audience:   "https://api.example.com",
+		UserID:     "user1",
+		IssuedAt:   issued,
+		AuthTime:   issued.Add(-time.Minute),
+		Delegation: "client1 gateway",
+	}
+	ttype, expiry, err := ac.RegisterAccessToken("token1", want, goauth2.TokenLifetime{})
+	if err != nil {
+		t.Fatal("RegisterAccessToken failed:", err)
+	}
+	if ttype == "" || expiry < 0 {
+		t.Errorf("RegisterAccessToken returned the type %q and expiry %d", ttype, expiry)
+	}
+
+	before := time.Now()
+	got, err := ac.LookupAccessToken("token1")
+	if err != nil || got == nil {
+		t.Fatalf("LookupAccessToken of a registered token returned %v, %v", got, err)
+	}
+	if expiry == 0 && !got.ExpiresAt.IsZero() {
+		t.Errorf("Token without expiry expires at %s", got.ExpiresAt)
+	} else if limit := before.Add(time.Duration(expiry) * time.Second); expiry > 0 && got.ExpiresAt.After(limit) {
+		t.Errorf("Token expires at %s, after its lifetime of %ds", got.ExpiresAt, expiry)
+	}
+	if !got.IssuedAt.Equal(want.IssuedAt) {
+		t.Errorf("LookupAccessToken returned the issue time %s, want %s", got.IssuedAt, want.IssuedAt)
+	}
+	if !got.AuthTime.Equal(want.AuthTime) {
+		t.Errorf("LookupAccessToken returned the authorization time %s, want %s", got.AuthTime, want.AuthTime)
+	}
+	got.IssuedAt, got.AuthTime, got.ExpiresAt = want.IssuedAt, want.AuthTime, want.ExpiresAt
+	if *got != want {
+		t.Errorf("LookupAccessToken returned %+v, want %+v", *got, want)
+	}
+}
+
+// Unknown tokens are not valid, without an error
+func testUnknownAccessToken(t *testing.T, ac goauth2.AuthCache) {
+	if info, err := ac.LookupAccessToken("unknown"); info != nil || err != nil {
+		t.Errorf("LookupAccessToken of an unknown token returned %v, %v; want nil, nil", info, err)
+	}
+}
+
+// Bulk lookups report every token, and unknown ones as invalid
+func testLookupAccessTokens(t *testing.T, ac goauth2.AuthCache) {
+	register(t, ac, "token1", goauth2.TokenInfo{ClientID: "client1"})
+	register(t, ac, "token2", goauth2.TokenInfo{ClientID: "client2"})
+
+	got, err := ac.LookupAccessTokens([]string{"token1", "unknown", "token2"})
+	if err != nil {
+		t.Fatal("LookupAccessTokens failed:", err)
+	}
+	want := map[string]bool{"token1": true, "unknown": false, "token2": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LookupAccessTokens returned %v, want %v", got, want)
+	}
+}
+
+// Tokens are not valid once their lifetime has passed
+func testTokenExpiry(t *testing.T, ac goauth2.AuthCache) {
+	setter, ok := ac.(goauth2.TokenExpirySetter)
+	if !ok {
+		t.Skip("The cache doesn't implement TokenExpirySetter")
+	}
+	setter.SetTokenExpiry(shortTokenExpiry)
+
+	_, expiry, err := ac.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	if err != nil {
+		t.Fatal("RegisterAccessToken failed:", err)
+	}
+	if expiry != shortTokenExpiry {
+		t.Errorf("RegisterAccessToken returned the expiry %d, want %d", expiry, shortTokenExpiry)
+	}
+	info, err := ac.LookupAccessToken("token1")
+	if err != nil || info == nil {
+		t.Fatalf("LookupAccessToken of a fresh token returned %v, %v", info, err)
+	}
+	if info.ExpiresAt.IsZero() {
+		t.Error("Expiring token has no expiry time")
+	}
+
+	time.Sleep(time.Duration(shortTokenExpiry)*time.Second + 100*time.Millisecond)
+	if valid(t, ac, "token1") {
+		t.Error("Token is still valid after its lifetime")
+	}
+	if got, err := ac.LookupAccessTokens([]string{"token1"}); err != nil || got["token1"] {
+		t.Errorf("LookupAccessTokens of an expired token returned %v, %v", got, err)
+	}
+}
+
+// Tokens live for the lifetime they are registered with, instead of the
+// cache's own, and expire by its deadline
+func testTokenLifetime(t *testing.T, ac goauth2.AuthCache) {
+	short := goauth2.TokenLifetime{TTL: time.Duration(shortTokenExpiry) * time.Second}
+	_, expiry, err := ac.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1"}, short)
+	if err != nil {
+		t.Fatal("RegisterAccessToken failed:", err)
+	}
+	if expiry != shortTokenExpiry {
+		t.Errorf("RegisterAccessToken returned the expiry %d, want %d", expiry, shortTokenExpiry)
+	}
+
+	deadline := time.Now().Add(time.Hour)
+	capped := goauth2.TokenLifetime{TTL: 2 * time.Hour, Deadline: deadline}
+	_, expiry, err = ac.RegisterAccessToken("token2", goauth2.TokenInfo{ClientID: "client1"}, capped)
+	if err != nil {
+		t.Fatal("RegisterAccessToken failed:", err)
+	}
+	if expiry <= 0 || expiry > int64(time.Hour/time.Second) {
+		t.Errorf("RegisterAccessToken returned the expiry %d, past the deadline in an hour", expiry)
+	}
+	if info, err := ac.LookupAccessToken("token2"); err != nil || info == nil {
+		t.Fatalf("LookupAccessToken of a fresh token returned %v, %v", info, err)
+	} else if info.ExpiresAt.IsZero() || info.ExpiresAt.After(deadline) {
+		t.Errorf("Token expires at %s, after its deadline %s", info.ExpiresAt, deadline)
+	}
+
+	time.Sleep(time.Duration(shortTokenExpiry)*time.Second + 100*time.Millisecond)
+	if valid(t, ac, "token1") {
+		t.Error("Token is still valid after its lifetime")
+	}
+	if !valid(t, ac, "token2") {
+		t.Error("Token expired before its lifetime")
+	}
+}
+
+// Revoked tokens are no longer valid, and the others are kept
+func testRevokeToken(t *testing.T, ac goauth2.AuthCache) {
+	revoker, ok := ac.(goauth2.TokenRevoker)
+	if !ok {
+		t.Skip("The cache doesn't implement TokenRevoker")
+	}
+	register(t, ac, "token1", goauth2.TokenInfo{ClientID: "client1"})
+	register(t, ac, "token2", goauth2.TokenInfo{ClientID: "client1"})
+
+	if err := revoker.RevokeToken("token1"); err != nil {
+		t.Fatal("RevokeToken failed:", err)
+	}
+	if valid(t, ac, "token1") {
+		t.Error("Revoked token is still valid")
+	}
+	if !valid(t, ac, "token2") {
+		t.Error("Another token was revoked")
+	}
+	if err := revoker.RevokeToken("unknown"); err != nil {
+		t.Error("RevokeToken of an unknown token failed:", err)
+	}
+}
+
+// Revoking the tokens of a client counts them, and keeps the others
+func testRevokeByClient(t *testing.T, ac goauth2.AuthCache) {
+	revoker, ok := ac.(goauth2.BulkRevoker)
+	if !ok {
+		t.Skip("The cache doesn't implement BulkRevoker")
+	}
+	register(t, ac, "token1", goauth2.TokenInfo{ClientID: "client1"})
+	register(t, ac, "token2", goauth2.TokenInfo{ClientID: "client1"})
+	register(t, ac, "token3", goauth2.TokenInfo{ClientID: "client2"})
+
+	if n, err := revoker.RevokeByClient("client1"); err != nil || n != 2 {
+		t.Errorf("RevokeByClient returned %d, %v; want 2, nil", n, err)
+	}
+	if valid(t, ac, "token1") || valid(t, ac, "token2") {
+		t.Error("Token of the client is still valid")
+	}
+	if !valid(t, ac, "token3") {
+		t.Error("Token of another client was revoked")
+	}
+}
+
+// The tokens of a client are listed with their information
+func testListTokensByClient(t *testing.T, ac goauth2.AuthCache) {
+	enumerator, ok := ac.(goauth2.TokenEnumerator)
+	if !ok {
+		t.Skip("The cache doesn't implement TokenEnumerator")
+	}
+	register(t, ac, "token1", goauth2.TokenInfo{ClientID: "client1", Scope: "read"})
+	register(t, ac, "token2", goauth2.TokenInfo{ClientID: "client1", Scope: "write"})
+	register(t, ac, "token3", goauth2.TokenInfo{ClientID: "client2"})
+
+	infos, err := enumerator.ListTokensByClient("client1")
+	if err != nil {
+		t.Fatal("ListTokensByClient failed:", err)
+	}
+	var got []string
+	for _, info := range infos {
+		got = append(got, info.Token+" "+info.ClientID+" "+info.Scope)
+	}
+	sort.Strings(got)
+	if want := []string{"token1 client1 read", "token2 client1 write"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListTokensByClient returned %q, want %q", got, want)
+	}
+}
+
+// The tokens of a user are summarized without giving them away
+func testListUserTokens(t *testing.T, ac goauth2.AuthCache) {
+	lister, ok := ac.(goauth2.UserTokenLister)
+	if !ok {
+		t.Skip("The cache doesn't implement UserTokenLister")
+	}
+	register(t, ac, "token1", goauth2.TokenInfo{ClientID: "client1", UserID: "user1", IssuedAt: issued})
+	register(t, ac, "token2", goauth2.TokenInfo{ClientID: "client1", UserID: "user2", IssuedAt: issued})
+
+	summaries, err := lister.ListUserTokens("user1")
+	if err != nil {
+		t.Fatal("ListUserTokens failed:", err)
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("ListUserTokens returned %d tokens, want 1", len(summaries))
+	}
+	if s := summaries[0]; s.ID != goauth2.TokenID("token1") || s.ClientID != "client1" || !s.IssuedAt.Equal(issued) {
+		t.Errorf("ListUserTokens returned %+v, want the summary of token1", s)
+	}
+}
+
+// Tokens a user authorized before the user's cutoff are no longer valid
+func testUserCutoff(t *testing.T, ac goauth2.AuthCache) {
+	setter, ok := ac.(goauth2.UserCutoffSetter)
+	if !ok {
+		t.Skip("The cache doesn't implement UserCutoffSetter")
+	}
+	cutoff := time.Now()
+	register(t, ac, "before", goauth2.TokenInfo{ClientID: "client1", UserID: "user1", IssuedAt: cutoff.Add(-time.Minute)})
+	register(t, ac, "after", goauth2.TokenInfo{ClientID: "client1", UserID: "user1", IssuedAt: cutoff.Add(time.Minute)})
+	register(t, ac, "other", goauth2.TokenInfo{ClientID: "client1", UserID: "user2", IssuedAt: cutoff.Add(-time.Minute)})
+
+	if err := setter.SetUserCutoff("user1", cutoff); err != nil {
+		t.Fatal("SetUserCutoff failed:", err)
+	}
+	if valid(t, ac, "before") {
+		t.Error("Token issued before the cutoff is still valid")
+	}
+	if !valid(t, ac, "after") || !valid(t, ac, "other") {
+		t.Error("Token issued after the cutoff, or to another user, is not valid")
+	}
+	got, err := ac.LookupAccessTokens([]string{"before", "after"})
+	if err != nil || got["before"] || !got["after"] {
+		t.Errorf("LookupAccessTokens after the cutoff returned %v, %v", got, err)
+	}
+}
+
+// Pushed requests can be taken once
+func testPushedRequest(t *testing.T, ac goauth2.AuthCache) {
+	cache, ok := ac.(goauth2.PushedRequestCache)
+	if !ok {
+		t.Skip("The cache doesn't implement PushedRequestCache")
+	}
+	if err := cache.RegisterPushedRequest("request1", []byte("data"), time.Minute); err != nil {
+		t.Fatal("RegisterPushedRequest failed:", err)
+	}
+	if data, err := cache.TakePushedRequest("request1"); err != nil || string(data) != "data" {
+		t.Errorf("TakePushedRequest returned %q, %v; want \"data\"", data, err)
+	}
+	if data, err := cache.TakePushedRequest("request1"); err != nil || data != nil {
+		t.Errorf("Second TakePushedRequest returned %q, %v; want nil", data, err)
+	}
+}
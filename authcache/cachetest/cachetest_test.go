@@ -0,0 +1,20 @@
+package cachetest_test
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authcache/cachetest"
+	"testing"
+)
+
+func TestBasicAuthCache(t *testing.T) {
+	cachetest.RunAuthCacheSuite(t, func() goauth2.AuthCache {
+		return authcache.NewBasicAuthCache()
+	})
+}
+
+func TestBoundedAuthCache(t *testing.T) {
+	cachetest.RunAuthCacheSuite(t, func() goauth2.AuthCache {
+		return authcache.NewBoundedAuthCache(100)
+	})
+}
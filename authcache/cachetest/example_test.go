@@ -0,0 +1,19 @@
+package cachetest_test
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authcache/cachetest"
+	"testing"
+)
+
+// The factory makes a new, empty cache for each subtest
+func ExampleRunAuthCacheConformance() {
+	// In a _test.go file of the package of the cache
+	TestConformance := func(t *testing.T) {
+		cachetest.RunAuthCacheConformance(t, func() goauth2.AuthCache {
+			return authcache.NewBasicAuthCache()
+		})
+	}
+	_ = TestConformance
+}
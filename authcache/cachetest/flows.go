@@ -0,0 +1,154 @@
+package cachetest
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authhandler"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// The redirect URI of the test client
+const redirectURI = "http://localhost/redirect"
+
+// RunAuthCacheSuite
+// Run the conformance checks, then the flows of a Server built on the
+// cache, as subtests of t, each on a cache made by factory
+func RunAuthCacheSuite(t *testing.T, factory func() goauth2.AuthCache) {
+	t.Run("Interface", func(t *testing.T) {
+		RunAuthCacheConformance(t, factory)
+	})
+
+	flows := []struct {
+		name string
+		flow func(t *testing.T, server *goauth2.Server)
+	}{
+		{"AuthorizationCodeFlow", testAuthorizationCodeFlow},
+		{"ImplicitFlow", testImplicitFlow},
+		{"UnknownCode", testUnknownCode},
+		{"CodeReuse", testCodeReuse},
+		{"Revocation", testRevocation},
+	}
+	for _, f := range flows {
+		flow := f.flow
+		t.Run(f.name, func(t *testing.T) {
+			cache := factory()
+			if closer, ok := cache.(io.Closer); ok {
+				defer closer.Close()
+			}
+			flow(t, goauth2.NewServer(cache, authhandler.NewWhiteList("client1")))
+		})
+	}
+}
+
+// Send an authorization request of client1, and return where the server
+// redirected to
+func authorize(t *testing.T, server *goauth2.Server, responseType string) *url.URL {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/oauth2?"+url.Values{
+		"client_id":     {"client1"},
+		"response_type": {responseType},
+		"redirect_uri":  {redirectURI},
+	}.Encode(), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil {
+		t.Fatalf("Authorization request was not redirected: %d %s", w.Code, w.Body)
+	}
+	return loc
+}
+
+// Post a token request for a code, and return the JSON response
+func exchange(server *goauth2.Server, code string) map[string]string {
+	req := httptest.NewRequest("POST", "/oauth2", strings.NewReader(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	return ret
+}
+
+// The status of an API call with a token
+func apiStatus(server *goauth2.Server, token string) int {
+	api := server.TokenVerifier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	return w.Code
+}
+
+// Codes are exchanged for tokens that the API accepts
+func testAuthorizationCodeFlow(t *testing.T, server *goauth2.Server) {
+	code := authorize(t, server, "code").Query().Get("code")
+	if code == "" {
+		t.Fatal("No code was issued")
+	}
+	ret := exchange(server, code)
+	if ret["token"] == "" || ret["token_type"] == "" {
+		t.Fatalf("Code exchange failed: %v", ret)
+	}
+	if status := apiStatus(server, ret["token"]); status != http.StatusOK {
+		t.Errorf("Token of the code was refused by the API: %d", status)
+	}
+	if status := apiStatus(server, "unknown"); status != http.StatusUnauthorized {
+		t.Errorf("Unknown token was accepted by the API: %d", status)
+	}
+}
+
+// Implicit grant tokens are accepted by the API
+func testImplicitFlow(t *testing.T, server *goauth2.Server) {
+	frag, _ := url.ParseQuery(authorize(t, server, "token").Fragment)
+	token := frag.Get("access_token")
+	if token == "" || frag.Get("error") != "" {
+		t.Fatalf("No token was issued: %v", frag)
+	}
+	if status := apiStatus(server, token); status != http.StatusOK {
+		t.Errorf("Implicit grant token was refused by the API: %d", status)
+	}
+}
+
+// Unknown codes are refused with invalid_grant
+func testUnknownCode(t *testing.T, server *goauth2.Server) {
+	if ret := exchange(server, "unknown"); ret["error"] != "invalid_grant" || ret["token"] != "" {
+		t.Errorf("Unknown code was not refused with invalid_grant: %v", ret)
+	}
+}
+
+// A code is exchanged once, and its second exchange is refused with
+// invalid_grant
+func testCodeReuse(t *testing.T, server *goauth2.Server) {
+	code := authorize(t, server, "code").Query().Get("code")
+	if ret := exchange(server, code); ret["token"] == "" {
+		t.Fatalf("Code exchange failed: %v", ret)
+	}
+	if ret := exchange(server, code); ret["error"] != "invalid_grant" || ret["token"] != "" {
+		t.Errorf("Second exchange of a code was not refused with invalid_grant: %v", ret)
+	}
+}
+
+// Tokens revoked through the Store are refused by the API
+func testRevocation(t *testing.T, server *goauth2.Server) {
+	store := server.Store.(*goauth2.StoreImpl)
+	if _, ok := store.Backend.(goauth2.TokenRevoker); !ok {
+		t.Skip("The cache doesn't implement TokenRevoker")
+	}
+	frag, _ := url.ParseQuery(authorize(t, server, "token").Fragment)
+	token := frag.Get("access_token")
+	if err := store.RevokeToken(token); err != nil {
+		t.Fatal("RevokeToken failed:", err)
+	}
+	if status := apiStatus(server, token); status != http.StatusUnauthorized {
+		t.Errorf("Revoked token was accepted by the API: %d", status)
+	}
+}
@@ -0,0 +1,23 @@
+package authcache
+
+import (
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"strconv"
+)
+
+// The BasicAuthCache is the "memory" backend of goauth2.NewServerFromConfig.
+// Its "max_entries" option bounds each kind of its entries, as
+// NewBoundedAuthCache.
+func init() {
+	goauth2.RegisterCacheBackend("memory", func(options map[string]string) (goauth2.AuthCache, error) {
+		if max, ok := options["max_entries"]; ok {
+			n, err := strconv.Atoi(max)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("Invalid max_entries %q", max)
+			}
+			return NewBoundedAuthCache(n), nil
+		}
+		return NewBasicAuthCache(), nil
+	})
+}
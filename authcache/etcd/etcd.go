@@ -0,0 +1,337 @@
+// Package goauth2/authcache/etcd provides an implementation of goauth2.AuthCache on etcd.
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// Implementation of the goauth2.AuthCache
+// Codes and tokens are stored as JSON under keys attached to a lease whose
+// TTL is their expiry, so that etcd deletes them when they expire.
+// Note: Currently only supports bearer tokens
+type EtcdAuthCache struct {
+	client                  *clientv3.Client
+	CodeExpiry, TokenExpiry int64
+	// KeyPrefix is prepended to every key the cache reads or writes
+	KeyPrefix string
+	// Timeout of each request to etcd
+	Timeout time.Duration
+}
+
+// Create an etcd-based implementation of goauth2.AuthCache
+func NewEtcdAuthCache(client *clientv3.Client) *EtcdAuthCache {
+	return &EtcdAuthCache{
+		client:      client,
+		CodeExpiry:  120,
+		TokenExpiry: 3600,
+		KeyPrefix:   "goauth2/",
+		Timeout:     5 * time.Second,
+	}
+}
+
+func (ac *EtcdAuthCache) codeKey(code string) string {
+	return ac.KeyPrefix + "code/" + code
+}
+
+func (ac *EtcdAuthCache) tokenKey(token string) string {
+	return ac.KeyPrefix + "token/" + token
+}
+
+// Mark errors reaching etcd as an unavailable backend
+func backendError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.Unavailable {
+		return fmt.Errorf("%w: %v", goauth2.ErrBackendUnavailable, err)
+	}
+	return err
+}
+
+// Put a value under a key, with a new lease of secs seconds if secs > 0
+func (ac *EtcdAuthCache) put(key string, val interface{}, secs int64) error {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ac.Timeout)
+	defer cancel()
+
+	var opts []clientv3.OpOption
+	if secs > 0 {
+		lease, err := ac.client.Grant(ctx, secs)
+		if err != nil {
+			return backendError(err)
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+
+	_, err = ac.client.Put(ctx, key, string(b), opts...)
+	return backendError(err)
+}
+
+// Get the value under a key into val
+// Returns false if the key does not exist
+func (ac *EtcdAuthCache) get(key string, val interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ac.Timeout)
+	defer cancel()
+
+	res, err := ac.client.Get(ctx, key)
+	if err != nil {
+		return false, backendError(err)
+	} else if len(res.Kvs) == 0 {
+		return false, nil
+	}
+	return true, json.Unmarshal(res.Kvs[0].Value, val)
+}
+
+// The JSON value of an authorization code
+type codeValue struct {
+	ClientID    string    `json:"clientID"`
+	Scope       string    `json:"scope"`
+	RedirectURI string    `json:"redirect_uri"`
+	IssuedAt    time.Time `json:"issued_at"`
+	RequestIP   string    `json:"request_ip"`
+	Resource    string    `json:"resource"`
+	UserID      string    `json:"user_id,omitempty"`
+	// The extra token response parameters
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// The JSON value of an access token
+type tokenValue struct {
+	ClientID  string    `json:"clientID"`
+	Scope     string    `json:"scope"`
+	Audience  string    `json:"audience"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UserID    string    `json:"user_id,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	AuthTime  time.Time `json:"auth_time"`
+	// The delegation chain of tokens issued by token exchange
+	Delegation string `json:"delegation,omitempty"`
+}
+
+// Register an authorization code into the cache
+// Code is a generated random string to register with the request
+// Info is the information on the request to save for checking on lookup
+func (ac *EtcdAuthCache) RegisterAuthCode(code string, info goauth2.AuthCodeInfo) error {
+	return ac.put(ac.codeKey(code), newCodeValue(info), ac.CodeExpiry)
+}
+
+// Register an authorization code for lifetime, or CodeExpiry if it is 0,
+// unless it is registered already, with a transaction putting it only if
+// it doesn't exist
+// Returns whether the code was registered.
+func (ac *EtcdAuthCache) AddAuthCode(code string, info goauth2.AuthCodeInfo, lifetime time.Duration) (bool, error) {
+	b, err := json.Marshal(newCodeValue(info))
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ac.Timeout)
+	defer cancel()
+
+	secs := ac.CodeExpiry
+	if lifetime > 0 {
+		secs = int64((lifetime + time.Second - 1) / time.Second)
+	}
+	var opts []clientv3.OpOption
+	if secs > 0 {
+		lease, err := ac.client.Grant(ctx, secs)
+		if err != nil {
+			return false, backendError(err)
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+
+	key := ac.codeKey(code)
+	res, err := ac.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(b), opts...)).
+		Commit()
+	if err != nil {
+		return false, backendError(err)
+	}
+	return res.Succeeded, nil
+}
+
+// The value of a new code
+func newCodeValue(info goauth2.AuthCodeInfo) codeValue {
+	return codeValue{
+		ClientID:    info.ClientID,
+		Scope:       info.Scope,
+		RedirectURI: info.RedirectURI,
+		IssuedAt:    info.IssuedAt,
+		RequestIP:   info.RequestIP,
+		Resource:    info.Resource,
+		UserID:      info.UserID,
+		Extra:       info.Extra,
+	}
+}
+
+// Register an access token into the cache
+// Token is a generated random string to register with the request
+// Info is the client, scope and audience of the token
+// Returns the token type, expiration time (in seconds), and possibly an error
+func (ac *EtcdAuthCache) RegisterAccessToken(token string, info goauth2.TokenInfo, lifetime goauth2.TokenLifetime) (ttype string, expiry int64, err error) {
+	val := tokenValue{
+		ClientID:   info.ClientID,
+		Scope:      info.Scope,
+		Audience:   info.Audience,
+		UserID:     info.UserID,
+		IssuedAt:   info.IssuedAt,
+		AuthTime:   info.AuthTime,
+		Delegation: info.Delegation,
+	}
+	now := time.Now()
+	expiry = lifetime.Seconds(now, ac.TokenExpiry)
+	if expiry > 0 {
+		val.ExpiresAt = now.Add(time.Duration(expiry) * time.Second)
+	}
+
+	if err := ac.put(ac.tokenKey(token), val, expiry); err != nil {
+		return "", 0, err
+	}
+	return "bearer", expiry, nil
+}
+
+// Lookup an authorization code
+// Code is the code passed from the user
+// Returns the information registered with that code
+func (ac *EtcdAuthCache) LookupAuthCode(code string) (*goauth2.AuthCodeInfo, error) {
+	var val codeValue
+	if ok, err := ac.get(ac.codeKey(code), &val); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, goauth2.ErrCodeNotFound
+	}
+	return val.info(), nil
+}
+
+// Remove an authorization code and return the information registered with
+// it, with a single delete returning the previous value
+func (ac *EtcdAuthCache) TakeAuthCode(code string) (*goauth2.AuthCodeInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ac.Timeout)
+	defer cancel()
+
+	res, err := ac.client.Delete(ctx, ac.codeKey(code), clientv3.WithPrevKV())
+	if err != nil {
+		return nil, backendError(err)
+	} else if len(res.PrevKvs) == 0 {
+		return nil, goauth2.ErrCodeNotFound
+	}
+	var val codeValue
+	if err := json.Unmarshal(res.PrevKvs[0].Value, &val); err != nil {
+		return nil, err
+	}
+	return val.info(), nil
+}
+
+// The information of a code
+func (val codeValue) info() *goauth2.AuthCodeInfo {
+	return &goauth2.AuthCodeInfo{
+		ClientID:    val.ClientID,
+		Scope:       val.Scope,
+		RedirectURI: val.RedirectURI,
+		IssuedAt:    val.IssuedAt,
+		RequestIP:   val.RequestIP,
+		Resource:    val.Resource,
+		UserID:      val.UserID,
+		Extra:       val.Extra,
+	}
+}
+
+// Lookup an Access Token
+// Token is the token passed from the client
+// Return the information registered with the token, or nil if it is not
+// valid, which is the case once its lease expired
+func (ac *EtcdAuthCache) LookupAccessToken(token string) (*goauth2.TokenInfo, error) {
+	var val tokenValue
+	if ok, err := ac.get(ac.tokenKey(token), &val); err != nil || !ok {
+		return nil, err
+	}
+
+	return &goauth2.TokenInfo{
+		Token:      token,
+		ClientID:   val.ClientID,
+		Scope:      val.Scope,
+		Audience:   val.Audience,
+		ExpiresAt:  val.ExpiresAt,
+		UserID:     val.UserID,
+		IssuedAt:   val.IssuedAt,
+		AuthTime:   val.AuthTime,
+		Delegation: val.Delegation,
+	}, nil
+}
+
+// Maximum number of operations in a transaction of a default etcd server
+const maxTxnOps = 128
+
+// Lookup several Access Tokens at once, with one transaction per batch of
+// maxTxnOps tokens
+// Return whether each token is valid. Unknown tokens map to false.
+func (ac *EtcdAuthCache) LookupAccessTokens(tokens []string) (map[string]bool, error) {
+	valid := make(map[string]bool, len(tokens))
+	for start := 0; start < len(tokens); start += maxTxnOps {
+		batch := tokens[start:]
+		if len(batch) > maxTxnOps {
+			batch = batch[:maxTxnOps]
+		}
+
+		ops := make([]clientv3.Op, len(batch))
+		for i, token := range batch {
+			ops[i] = clientv3.OpGet(ac.tokenKey(token), clientv3.WithCountOnly())
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ac.Timeout)
+		res, err := ac.client.Txn(ctx).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			return nil, backendError(err)
+		}
+		for i, token := range batch {
+			valid[token] = res.Responses[i].GetResponseRange().Count > 0
+		}
+	}
+	return valid, nil
+}
+
+// Revoke an access token
+// Its lease is left to expire.
+func (ac *EtcdAuthCache) RevokeToken(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ac.Timeout)
+	defer cancel()
+
+	_, err := ac.client.Delete(ctx, ac.tokenKey(token))
+	return backendError(err)
+}
+
+// Set the lifetime of the tokens registered from now on, in seconds
+// It is not safe to call while the cache is in use.
+func (ac *EtcdAuthCache) SetTokenExpiry(secs int64) {
+	ac.TokenExpiry = secs
+}
+
+// Set the lifetime of the codes registered from now on, in seconds
+// It is not safe to call while the cache is in use.
+func (ac *EtcdAuthCache) SetCodeExpiry(secs int64) {
+	ac.CodeExpiry = secs
+}
+
+// Ping checks that etcd is reachable by reading a key
+func (ac *EtcdAuthCache) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ac.Timeout)
+	defer cancel()
+
+	_, err := ac.client.Get(ctx, ac.KeyPrefix+"ping")
+	return backendError(err)
+}
@@ -0,0 +1,149 @@
+package etcd
+
+import (
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Start an embedded etcd server and connect to it
+func newTestCache(t *testing.T) *EtcdAuthCache {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal("Error starting etcd", err)
+	}
+	t.Cleanup(server.Close)
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd did not start in time")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{server.Clients[0].Addr().String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal("Error connecting to etcd", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return NewEtcdAuthCache(client)
+}
+
+func TestAuthCode(t *testing.T) {
+	ac := newTestCache(t)
+
+	issued := time.Now().Round(time.Second)
+	if err := ac.RegisterAuthCode("code1", goauth2.AuthCodeInfo{
+		ClientID:    "client1",
+		Scope:       "read",
+		RedirectURI: "http://localhost/redirect",
+		IssuedAt:    issued,
+	}); err != nil {
+		t.Fatal("Error registering auth code", err)
+	}
+
+	info, err := ac.LookupAuthCode("code1")
+	if err != nil {
+		t.Fatal("Error looking up auth code", err)
+	}
+	if info.ClientID != "client1" || info.Scope != "read" ||
+		info.RedirectURI != "http://localhost/redirect" || !info.IssuedAt.Equal(issued) {
+		t.Error("Bad auth code info", info)
+	}
+
+	if _, err := ac.LookupAuthCode("unknown"); err == nil {
+		t.Error("Unknown auth code was found")
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	ac := newTestCache(t)
+
+	ttype, expiry, err := ac.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1", Scope: "read"}, goauth2.TokenLifetime{})
+	if err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+	if ttype != "bearer" || expiry != ac.TokenExpiry {
+		t.Error("Bad token type or expiry", ttype, expiry)
+	}
+
+	info, err := ac.LookupAccessToken("token1")
+	if err != nil || info == nil {
+		t.Fatal("Registered token is not valid", err)
+	}
+	if info.ClientID != "client1" || info.Scope != "read" || info.ExpiresAt.IsZero() {
+		t.Error("Bad token info", info)
+	}
+
+	if err := ac.RevokeToken("token1"); err != nil {
+		t.Fatal("Error revoking token", err)
+	}
+	if info, err := ac.LookupAccessToken("token1"); err != nil || info != nil {
+		t.Error("Revoked token is still valid", err)
+	}
+}
+
+func TestLookupAccessTokens(t *testing.T) {
+	ac := newTestCache(t)
+
+	var tokens []string
+	for i := 0; i < maxTxnOps+2; i++ {
+		token := fmt.Sprintf("token%d", i)
+		tokens = append(tokens, token)
+		if i%2 == 0 {
+			ac.RegisterAccessToken(token, goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+		}
+	}
+
+	valid, err := ac.LookupAccessTokens(tokens)
+	if err != nil {
+		t.Fatal("Error looking up tokens", err)
+	}
+	if len(valid) != len(tokens) {
+		t.Error("Bad number of lookups", len(valid))
+	}
+	for i, token := range tokens {
+		if valid[token] != (i%2 == 0) {
+			t.Error("Bad lookup of", token, valid[token])
+		}
+	}
+}
+
+// Tokens disappear when their lease expires
+func TestLeaseExpiry(t *testing.T) {
+	ac := newTestCache(t)
+	ac.TokenExpiry = 1
+
+	if _, _, err := ac.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+	if info, _ := ac.LookupAccessToken("token1"); info == nil {
+		t.Fatal("Registered token is not valid")
+	}
+
+	// Leases expire within a few seconds of their TTL
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		if info, err := ac.LookupAccessToken("token1"); err != nil {
+			t.Fatal("Error looking up token", err)
+		} else if info == nil {
+			return
+		}
+	}
+	t.Error("Token did not expire with its lease")
+}
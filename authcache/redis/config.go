@@ -0,0 +1,29 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"strconv"
+)
+
+// The RedisAuthCache is the "redis" backend of goauth2.NewServerFromConfig.
+// Its options are the "addr" of the server, required, and the "db",
+// "password" and key "prefix".
+func init() {
+	goauth2.RegisterCacheBackend("redis", func(options map[string]string) (goauth2.AuthCache, error) {
+		addr := options["addr"]
+		if addr == "" {
+			return nil, errors.New("The addr option is required")
+		}
+		db := 0
+		if s, ok := options["db"]; ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid db %q", s)
+			}
+			db = n
+		}
+		return NewRedisAuthCacheWithPrefix(addr, db, options["password"], options["prefix"]), nil
+	})
+}
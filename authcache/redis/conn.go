@@ -0,0 +1,468 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	redis "github.com/simonz05/godis"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Conn sends commands to a Redis server
+type Conn interface {
+	Send(name string, args ...string) *redis.Reply
+}
+
+// A Conn backed by a godis client
+type clientConn struct {
+	client *redis.Client
+}
+
+func (c clientConn) Send(name string, args ...string) *redis.Reply {
+	return redis.SendStr(c.client.Rw, name, args...)
+}
+
+// Close the connections of the client, if they can be closed
+func (c clientConn) Close() error {
+	return closeConn(c.client.Rw)
+}
+
+// Close a connection if it is an io.Closer
+func closeConn(conn interface{}) error {
+	if c, ok := conn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Dial a godis client for a server address such as "tcp:127.0.0.1:6379"
+func dialClient(addr string, dbnum int, pass string) Conn {
+	return clientConn{redis.New(addr, dbnum, pass)}
+}
+
+// RedisOptions describe how a RedisAuthCache connects to Redis.
+// Exactly one of Addr, SentinelAddrs or ClusterAddrs should be set.
+type RedisOptions struct {
+	// Address of a single server, such as "tcp:127.0.0.1:6379"
+	Addr string
+	// Database number and password, used by all modes.
+	// Redis Cluster only supports database 0.
+	DB       int
+	Password string
+
+	// Addresses of Sentinels monitoring the master named MasterName.
+	// The master is rediscovered through them after a failover.
+	SentinelAddrs []string
+	MasterName    string
+
+	// Addresses of some nodes of a Redis Cluster. Commands are sent to the
+	// node owning their key, following MOVED and ASK redirections.
+	ClusterAddrs []string
+
+	// Allow token lookups to be served by a replica of the master.
+	// Replicas may lag behind, so a token that was just issued can be
+	// missing for a moment.
+	ReadFromReplicas bool
+
+	// Dial connects to a server address. Defaults to a godis client.
+	Dial func(addr string, dbnum int, pass string) Conn
+}
+
+// Build the connection for the options, and one for replica reads if they
+// are allowed
+func (opts RedisOptions) connect() (conn, replica Conn, err error) {
+	if opts.Dial == nil {
+		opts.Dial = dialClient
+	}
+
+	switch {
+	case len(opts.SentinelAddrs) > 0:
+		if opts.MasterName == "" {
+			return nil, nil, errors.New("A master name is required with sentinels.")
+		}
+		conn = &sentinelConn{opts: opts}
+		if opts.ReadFromReplicas {
+			replica = &sentinelConn{opts: opts, replica: true}
+		}
+	case len(opts.ClusterAddrs) > 0:
+		if opts.DB != 0 {
+			return nil, nil, errors.New("Redis Cluster only supports database 0.")
+		}
+		conn = &clusterConn{
+			opts:  opts,
+			nodes: make(map[string]Conn),
+			slots: make(map[uint16]string),
+		}
+		// Cluster replicas would need READONLY on each connection, so
+		// reads always go to the masters.
+	case opts.Addr != "":
+		conn = opts.Dial(opts.Addr, opts.DB, opts.Password)
+		if opts.ReadFromReplicas {
+			replica = &replicaConn{master: conn, opts: opts}
+		}
+	default:
+		return nil, nil, errors.New("No Redis address configured.")
+	}
+
+	return conn, replica, nil
+}
+
+// isFailover reports whether a reply error means the server is no longer
+// the master, either because it is unreachable or because it was demoted
+func isFailover(err error) bool {
+	return isConnError(err) || strings.HasPrefix(err.Error(), "READONLY")
+}
+
+// ----------------------------------------------------------------------------
+
+// sentinelConn sends commands to the master (or a replica of it) currently
+// reported by the sentinels, rediscovering it after a failover
+type sentinelConn struct {
+	opts    RedisOptions
+	replica bool
+
+	mu      sync.Mutex
+	current Conn
+}
+
+// Close the connection to the current server
+func (c *sentinelConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	if c.current != nil {
+		err = closeConn(c.current)
+	}
+	c.current = nil
+	return err
+}
+
+func (c *sentinelConn) Send(name string, args ...string) *redis.Reply {
+	conn, err := c.get()
+	if err != nil {
+		return &redis.Reply{Err: err}
+	}
+
+	r := conn.Send(name, args...)
+	if r.Err != nil && isFailover(r.Err) {
+		// The master may have changed: rediscover it and try once more
+		c.reset(conn)
+		if conn, err = c.get(); err != nil {
+			return &redis.Reply{Err: err}
+		}
+		r = conn.Send(name, args...)
+	}
+	return r
+}
+
+// Get the current connection, discovering the server if needed
+func (c *sentinelConn) get() (Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.current != nil {
+		return c.current, nil
+	}
+
+	addr, err := c.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	master := c.opts.Dial(addr, c.opts.DB, c.opts.Password)
+	c.current = master
+
+	if c.replica {
+		if raddr, err := replicaAddr(master); err == nil && raddr != "" {
+			c.current = c.opts.Dial(raddr, c.opts.DB, c.opts.Password)
+		}
+	}
+
+	return c.current, nil
+}
+
+// Forget a connection that failed, unless it was already replaced
+func (c *sentinelConn) reset(failed Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == failed {
+		c.current = nil
+	}
+}
+
+// Ask the sentinels, in order, for the address of the master
+func (c *sentinelConn) masterAddr() (string, error) {
+	var lastErr error
+	for _, saddr := range c.opts.SentinelAddrs {
+		sentinel := c.opts.Dial(saddr, 0, "")
+		r := sentinel.Send("SENTINEL", "get-master-addr-by-name", c.opts.MasterName)
+		if r.Err != nil {
+			lastErr = r.Err
+			continue
+		}
+		if len(r.Elems) != 2 {
+			lastErr = fmt.Errorf("Sentinel %s does not know master %q.",
+				saddr, c.opts.MasterName)
+			continue
+		}
+		return "tcp:" + string(r.Elems[0].Elem) + ":" + string(r.Elems[1].Elem), nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("No sentinel could be reached.")
+	}
+	return "", lastErr
+}
+
+// ----------------------------------------------------------------------------
+
+// replicaConn sends commands to a replica of a single master, falling back
+// to the master if it has no replica online
+type replicaConn struct {
+	master Conn
+	opts   RedisOptions
+
+	mu      sync.Mutex
+	current Conn
+}
+
+// Close the replica connection, but not the master's, which the cache
+// closes itself
+func (c *replicaConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	if c.current != nil && c.current != c.master {
+		err = closeConn(c.current)
+	}
+	c.current = nil
+	return err
+}
+
+func (c *replicaConn) Send(name string, args ...string) *redis.Reply {
+	c.mu.Lock()
+	if c.current == nil {
+		c.current = c.master
+		if addr, err := replicaAddr(c.master); err == nil && addr != "" {
+			c.current = c.opts.Dial(addr, c.opts.DB, c.opts.Password)
+		}
+	}
+	conn := c.current
+	c.mu.Unlock()
+
+	r := conn.Send(name, args...)
+	if r.Err != nil && isConnError(r.Err) && conn != c.master {
+		// Forget the replica and read from the master instead
+		c.mu.Lock()
+		c.current = nil
+		c.mu.Unlock()
+		r = c.master.Send(name, args...)
+	}
+	return r
+}
+
+// Find the address of an online replica from the master's replication
+// info, or "" if there is none
+func replicaAddr(master Conn) (string, error) {
+	r := master.Send("INFO", "replication")
+	if r.Err != nil {
+		return "", r.Err
+	}
+
+	// Replicas are listed as lines like
+	// slave0:ip=10.0.0.2,port=6379,state=online,offset=42,lag=0
+	for _, line := range strings.Split(string(r.Elem), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "slave") || !strings.Contains(line, ":ip=") {
+			continue
+		}
+		fields := make(map[string]string)
+		for _, kv := range strings.Split(line[strings.Index(line, ":")+1:], ",") {
+			if i := strings.Index(kv, "="); i > 0 {
+				fields[kv[:i]] = kv[i+1:]
+			}
+		}
+		if fields["state"] == "online" {
+			return "tcp:" + fields["ip"] + ":" + fields["port"], nil
+		}
+	}
+	return "", nil
+}
+
+// ----------------------------------------------------------------------------
+
+// Number of hash slots in a Redis Cluster
+const clusterSlots = 16384
+
+// Maximum number of redirections followed for one command
+const maxRedirects = 5
+
+// clusterConn sends commands to the node of a Redis Cluster that owns the
+// command's key. Slot owners are learned from MOVED redirections.
+type clusterConn struct {
+	opts RedisOptions
+
+	mu    sync.Mutex
+	nodes map[string]Conn
+	slots map[uint16]string
+}
+
+// Close the connections to every node
+func (c *clusterConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for addr, node := range c.nodes {
+		if e := closeConn(node); e != nil && err == nil {
+			err = e
+		}
+		delete(c.nodes, addr)
+	}
+	return err
+}
+
+func (c *clusterConn) Send(name string, args ...string) *redis.Reply {
+	key, keyed := commandKey(name, args)
+	slot := uint16(0)
+	if keyed {
+		slot = keySlot(key)
+	}
+	addr := c.addrFor(slot, keyed, 0)
+
+	var r *redis.Reply
+	for i := 0; i < maxRedirects; i++ {
+		r = c.node(addr).Send(name, args...)
+		if r.Err == nil {
+			return r
+		}
+
+		msg := r.Err.Error()
+		switch {
+		case strings.HasPrefix(msg, "MOVED "):
+			// The slot has a new owner for good
+			moved, to, err := parseRedirect(msg)
+			if err != nil {
+				return r
+			}
+			c.learn(moved, to)
+			addr = to
+		case strings.HasPrefix(msg, "ASK "):
+			// The key is being migrated: ask the target node this once
+			_, to, err := parseRedirect(msg)
+			if err != nil {
+				return r
+			}
+			conn := c.node(to)
+			if rr := conn.Send("ASKING"); rr.Err != nil {
+				return rr
+			}
+			return conn.Send(name, args...)
+		case isConnError(r.Err):
+			// Forget the node and start again from another seed
+			c.forget(addr)
+			addr = c.addrFor(slot, keyed, i+1)
+		default:
+			return r
+		}
+	}
+	return r
+}
+
+// The first key of a command, which decides the node it is sent to
+func commandKey(name string, args []string) (string, bool) {
+	if name == "EVAL" || name == "EVALSHA" {
+		// The script, the number of keys and then the keys
+		if len(args) > 2 && args[1] != "0" {
+			return args[2], true
+		}
+		return "", false
+	}
+	if len(args) > 0 {
+		return args[0], true
+	}
+	return "", false
+}
+
+// Address of the node owning a slot, or of a seed node if it is unknown
+func (c *clusterConn) addrFor(slot uint16, keyed bool, attempt int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if addr, ok := c.slots[slot]; ok && keyed {
+		return addr
+	}
+	return c.opts.ClusterAddrs[attempt%len(c.opts.ClusterAddrs)]
+}
+
+// Get (or dial) the connection to a node
+func (c *clusterConn) node(addr string) Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, ok := c.nodes[addr]
+	if !ok {
+		conn = c.opts.Dial(addr, 0, c.opts.Password)
+		c.nodes[addr] = conn
+	}
+	return conn
+}
+
+func (c *clusterConn) learn(slot uint16, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slots[slot] = addr
+}
+
+// Close the connection to a node that failed, and forget the slots it owns
+func (c *clusterConn) forget(addr string) {
+	c.mu.Lock()
+	conn, ok := c.nodes[addr]
+	delete(c.nodes, addr)
+	for slot, owner := range c.slots {
+		if owner == addr {
+			delete(c.slots, slot)
+		}
+	}
+	c.mu.Unlock()
+
+	if ok {
+		closeConn(conn)
+	}
+}
+
+// Parse a "MOVED 3999 127.0.0.1:6381" or "ASK ..." error
+func parseRedirect(msg string) (uint16, string, error) {
+	parts := strings.Fields(msg)
+	if len(parts) != 3 {
+		return 0, "", fmt.Errorf("Malformed cluster redirection: %q.", msg)
+	}
+	slot, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, "", fmt.Errorf("Malformed cluster redirection: %q.", msg)
+	}
+	return uint16(slot), "tcp:" + parts[2], nil
+}
+
+// keySlot computes the cluster hash slot of a key, honoring hash tags
+func keySlot(key string) uint16 {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return crc16(key) % clusterSlots
+}
+
+// crc16 is the CRC-16/XMODEM checksum used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
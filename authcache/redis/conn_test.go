@@ -0,0 +1,885 @@
+package redis
+
+import (
+	"errors"
+	redis "github.com/simonz05/godis"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache/cachetest"
+	"io"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeData is the keyspace of a fake Redis server. Connections sharing it
+// behave like a master and its replicas.
+type fakeData struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]bool
+	// The expiration times of the keys that expire
+	expires map[string]time.Time
+}
+
+func newFakeData() *fakeData {
+	return &fakeData{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		sets:    make(map[string]map[string]bool),
+		expires: make(map[string]time.Time),
+	}
+}
+
+func status(s string) *redis.Reply {
+	return &redis.Reply{Elem: redis.Elem(s)}
+}
+
+func wrongType() *redis.Reply {
+	return &redis.Reply{Err: errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")}
+}
+
+func (d *fakeData) exec(name string, args []string) *redis.Reply {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for key, at := range d.expires {
+		if !now.Before(at) {
+			d.del(key)
+		}
+	}
+	return d.run(now, name, args)
+}
+
+// Run a command at now
+// The caller must hold the lock.
+func (d *fakeData) run(now time.Time, name string, args []string) *redis.Reply {
+	switch name {
+	case "PING":
+		return status("PONG")
+	case "SET":
+		// The options of SET are EX followed by seconds, and NX
+		var expiry time.Duration
+		for i := 2; i < len(args); i++ {
+			switch args[i] {
+			case "NX":
+				_, isString := d.strings[args[0]]
+				_, isHash := d.hashes[args[0]]
+				if isString || isHash {
+					return &redis.Reply{}
+				}
+			case "EX":
+				i++
+				secs, _ := strconv.ParseInt(args[i], 10, 64)
+				expiry = time.Duration(secs) * time.Second
+			}
+		}
+		d.del(args[0])
+		d.strings[args[0]] = args[1]
+		if expiry > 0 {
+			d.expires[args[0]] = now.Add(expiry)
+		}
+		return status("OK")
+	case "GET":
+		if _, ok := d.hashes[args[0]]; ok {
+			return wrongType()
+		}
+		v, ok := d.strings[args[0]]
+		if !ok {
+			return &redis.Reply{}
+		}
+		return status(v)
+	case "HMSET":
+		h := make(map[string]string)
+		for i := 1; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		d.hashes[args[0]] = h
+		return status("OK")
+	case "HGETALL":
+		if _, ok := d.strings[args[0]]; ok {
+			return wrongType()
+		}
+		r := &redis.Reply{}
+		for k, v := range d.hashes[args[0]] {
+			r.Elems = append(r.Elems, status(k), status(v))
+		}
+		return r
+	case "SADD":
+		if d.sets[args[0]] == nil {
+			d.sets[args[0]] = make(map[string]bool)
+		}
+		d.sets[args[0]][args[1]] = true
+		return status("1")
+	case "SREM":
+		delete(d.sets[args[0]], args[1])
+		return status("1")
+	case "SMEMBERS":
+		r := &redis.Reply{}
+		for m := range d.sets[args[0]] {
+			r.Elems = append(r.Elems, status(m))
+		}
+		return r
+	case "DEL":
+		_, isString := d.strings[args[0]]
+		_, isHash := d.hashes[args[0]]
+		_, isSet := d.sets[args[0]]
+		d.del(args[0])
+		if isString || isHash || isSet {
+			return status("1")
+		}
+		return status("0")
+	case "EXPIRE":
+		_, isString := d.strings[args[0]]
+		_, isHash := d.hashes[args[0]]
+		_, isSet := d.sets[args[0]]
+		if !isString && !isHash && !isSet {
+			return status("0")
+		}
+		secs, _ := strconv.ParseInt(args[1], 10, 64)
+		d.expires[args[0]] = now.Add(time.Duration(secs) * time.Second)
+		return status("1")
+	case "EVAL":
+		if args[0] == setTokenScript {
+			return d.setToken(now, args)
+		} else if args[0] == takeScript {
+			v, ok := d.strings[args[2]]
+			if !ok {
+				return &redis.Reply{}
+			}
+			d.del(args[2])
+			return status(v)
+		} else if args[0] != existsScript {
+			return &redis.Reply{Err: errors.New("NOSCRIPT unknown script")}
+		}
+		n, _ := strconv.Atoi(args[1])
+		r := &redis.Reply{}
+		for _, key := range args[2 : 2+n] {
+			_, isString := d.strings[key]
+			h, isHash := d.hashes[key]
+			valid := isString || isHash
+			if isHash && h["user_id"] != "" {
+				if c, ok := d.strings[args[2+n]+h["user_id"]]; ok && h["issued_at"] < c {
+					valid = false
+				}
+			}
+			if valid {
+				r.Elems = append(r.Elems, status("1"))
+			} else {
+				r.Elems = append(r.Elems, status("0"))
+			}
+		}
+		return r
+	case "PTTL":
+		_, isString := d.strings[args[0]]
+		_, isHash := d.hashes[args[0]]
+		_, isSet := d.sets[args[0]]
+		if !isString && !isHash && !isSet {
+			return status("-2")
+		} else if at, ok := d.expires[args[0]]; ok {
+			return status(strconv.FormatInt(int64(at.Sub(now)/time.Millisecond), 10))
+		}
+		return status("-1")
+	case "KEYS":
+		// path.Match has the escapes and metacharacters of Redis patterns
+		r := &redis.Reply{}
+		for key := range d.keys() {
+			if ok, _ := path.Match(args[0], key); ok {
+				r.Elems = append(r.Elems, status(key))
+			}
+		}
+		return r
+	case "RENAME":
+		if !d.keys()[args[0]] {
+			return &redis.Reply{Err: errors.New("ERR no such key")}
+		}
+		d.del(args[1])
+		if v, ok := d.strings[args[0]]; ok {
+			d.strings[args[1]] = v
+		}
+		if h, ok := d.hashes[args[0]]; ok {
+			d.hashes[args[1]] = h
+		}
+		if s, ok := d.sets[args[0]]; ok {
+			d.sets[args[1]] = s
+		}
+		if at, ok := d.expires[args[0]]; ok {
+			d.expires[args[1]] = at
+		}
+		d.del(args[0])
+		return status("OK")
+	case "PERSIST":
+		if _, ok := d.expires[args[0]]; !ok {
+			return status("0")
+		}
+		delete(d.expires, args[0])
+		return status("1")
+	}
+	return &redis.Reply{Err: errors.New("ERR unknown command '" + name + "'")}
+}
+
+// Run setTokenScript, whose arguments follow the script
+// The caller must hold the lock.
+func (d *fakeData) setToken(now time.Time, args []string) *redis.Reply {
+	n, _ := strconv.Atoi(args[1])
+	keys, argv := args[2:2+n], args[2+n:]
+	expiry, _ := strconv.ParseInt(argv[1], 10, 64)
+	d.run(now, "HMSET", append([]string{keys[0]}, argv[2:]...))
+	if expiry > 0 {
+		d.run(now, "EXPIRE", []string{keys[0], argv[1]})
+	}
+	for _, key := range keys[1:] {
+		ttl, _ := strconv.ParseInt(string(d.run(now, "PTTL", []string{key}).Elem), 10, 64)
+		d.run(now, "SADD", []string{key, argv[0]})
+		if expiry <= 0 && ttl >= 0 {
+			d.run(now, "PERSIST", []string{key})
+		} else if expiry > 0 && (ttl == -2 || ttl >= 0 && ttl < expiry*1000) {
+			d.run(now, "EXPIRE", []string{key, argv[1]})
+		}
+	}
+	return status("OK")
+}
+
+// The keys of every type
+// The caller must hold the lock.
+func (d *fakeData) keys() map[string]bool {
+	keys := make(map[string]bool)
+	for key := range d.strings {
+		keys[key] = true
+	}
+	for key := range d.hashes {
+		keys[key] = true
+	}
+	for key := range d.sets {
+		keys[key] = true
+	}
+	return keys
+}
+
+// Delete a key of any type
+// The caller must hold the lock.
+func (d *fakeData) del(key string) {
+	delete(d.strings, key)
+	delete(d.hashes, key)
+	delete(d.sets, key)
+	delete(d.expires, key)
+}
+
+// fakeConn is a connection to a fake server. A down connection fails like
+// a closed socket, and handle can override the replies.
+type fakeConn struct {
+	data   *fakeData
+	down   bool
+	handle func(name string, args []string) *redis.Reply
+	// Guards sent, since commands may be sent concurrently
+	mu     sync.Mutex
+	sent   int
+	closed int
+}
+
+func (c *fakeConn) Close() error {
+	c.closed++
+	return nil
+}
+
+func (c *fakeConn) Send(name string, args ...string) *redis.Reply {
+	c.mu.Lock()
+	c.sent++
+	c.mu.Unlock()
+	if c.down {
+		return &redis.Reply{Err: io.EOF}
+	}
+	if c.handle != nil {
+		if r := c.handle(name, args); r != nil {
+			return r
+		}
+	}
+	return c.data.exec(name, args)
+}
+
+// A dial function connecting to a fixed set of fake servers
+func fakeDial(conns map[string]*fakeConn) func(string, int, string) Conn {
+	return func(addr string, dbnum int, pass string) Conn {
+		if c, ok := conns[addr]; ok {
+			return c
+		}
+		return &fakeConn{down: true}
+	}
+}
+
+// After a failover the cache follows the sentinels to the new master
+func TestSentinelFailover(t *testing.T) {
+	data := newFakeData()
+	masterA := &fakeConn{data: data}
+	masterB := &fakeConn{data: data}
+	master := []string{"10.0.0.1", "6379"}
+	sentinel := &fakeConn{handle: func(name string, args []string) *redis.Reply {
+		return &redis.Reply{Elems: []*redis.Reply{status(master[0]), status(master[1])}}
+	}}
+
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		SentinelAddrs: []string{"tcp:10.0.0.9:26379"},
+		MasterName:    "mymaster",
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.9:26379": sentinel,
+			"tcp:10.0.0.1:6379":  masterA,
+			"tcp:10.0.0.2:6379":  masterB,
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	if _, _, err := ac.RegisterAccessToken("failovertoken", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+	if masterA.sent == 0 {
+		t.Fatal("Token was not registered on the first master")
+	}
+
+	// Fail over to the second master mid-test
+	masterA.down = true
+	master[0] = "10.0.0.2"
+
+	if info, err := ac.LookupAccessToken("failovertoken"); err != nil || info == nil {
+		t.Fatal("Token lookup failed after failover", err)
+	}
+	if masterB.sent == 0 {
+		t.Error("Lookup was not sent to the new master")
+	}
+	if _, _, err := ac.RegisterAccessToken("failovertoken2", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); err != nil {
+		t.Error("Error registering access token after failover", err)
+	}
+}
+
+// Token lookups can be served by a replica, and fall back to the master
+func TestReadFromReplicas(t *testing.T) {
+	data := newFakeData()
+	replica := &fakeConn{data: data}
+	master := &fakeConn{data: data, handle: func(name string, args []string) *redis.Reply {
+		if name == "INFO" {
+			return status("# Replication\r\nrole:master\r\nconnected_slaves:1\r\n" +
+				"slave0:ip=10.0.0.3,port=6379,state=online,offset=42,lag=0\r\n")
+		}
+		return nil
+	}}
+
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr:             "tcp:10.0.0.1:6379",
+		ReadFromReplicas: true,
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.1:6379": master,
+			"tcp:10.0.0.3:6379": replica,
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	if _, _, err := ac.RegisterAccessToken("replicatoken", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+	if replica.sent != 0 {
+		t.Error("A write was sent to the replica")
+	}
+
+	if info, err := ac.LookupAccessToken("replicatoken"); err != nil || info == nil {
+		t.Fatal("Token lookup on the replica failed", err)
+	}
+	if replica.sent == 0 {
+		t.Error("Lookup was not sent to the replica")
+	}
+
+	replica.down = true
+	if info, err := ac.LookupAccessToken("replicatoken"); err != nil || info == nil {
+		t.Error("Token lookup did not fall back to the master", err)
+	}
+}
+
+// Cluster commands follow MOVED redirections and remember the slot owner
+func TestClusterRedirect(t *testing.T) {
+	nodeB := &fakeConn{data: newFakeData()}
+	nodeA := &fakeConn{handle: func(name string, args []string) *redis.Reply {
+		key, _ := commandKey(name, args)
+		slot := strconv.Itoa(int(keySlot(key)))
+		return &redis.Reply{Err: errors.New("MOVED " + slot + " 10.0.0.2:7000")}
+	}}
+
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		ClusterAddrs: []string{"tcp:10.0.0.1:7000"},
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.1:7000": nodeA,
+			"tcp:10.0.0.2:7000": nodeB,
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+	ac.TokenExpiry = 60
+
+	if _, _, err := ac.RegisterAccessToken("clustertoken", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+	sent := nodeA.sent
+	if info, err := ac.LookupAccessToken("clustertoken"); err != nil || info == nil {
+		t.Fatal("Token lookup in the cluster failed", err)
+	}
+	if nodeA.sent != sent {
+		t.Error("Commands kept going to the wrong node:", nodeA.sent-sent)
+	}
+}
+
+// The connection to a failed cluster node is closed when it is forgotten
+func TestClusterForgetCloses(t *testing.T) {
+	nodeA := &fakeConn{down: true}
+	nodeB := &fakeConn{data: newFakeData()}
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		ClusterAddrs: []string{"tcp:10.0.0.1:7000", "tcp:10.0.0.2:7000"},
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.1:7000": nodeA,
+			"tcp:10.0.0.2:7000": nodeB,
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	if _, _, err := ac.RegisterAccessToken("clustertoken", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Registration did not move on to another node", err)
+	}
+	if nodeA.closed != 1 || nodeB.closed != 0 {
+		t.Error("Bad closing of the cluster connections", nodeA.closed, nodeB.closed)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	if slot := keySlot("foo"); slot != 12182 {
+		t.Error("Bad slot for foo:", slot)
+	}
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Error("Keys with the same hash tag are in different slots")
+	}
+}
+
+// Revoking a client's tokens leaves other clients' tokens intact
+func TestFakeRevokeByClient(t *testing.T) {
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.1:6379": &fakeConn{data: newFakeData()},
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		ac.RegisterAccessToken("c1token"+strconv.Itoa(i), goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+		ac.RegisterAccessToken("c2token"+strconv.Itoa(i), goauth2.TokenInfo{ClientID: "client2"}, goauth2.TokenLifetime{})
+	}
+
+	if tokens, err := ac.ListTokensByClient("client1"); err != nil || len(tokens) != 3 {
+		t.Fatal("Bad listing of client1 tokens", tokens, err)
+	}
+	if n, err := ac.RevokeByClient("client1"); err != nil || n != 3 {
+		t.Fatal("Bad revocation of client1 tokens", n, err)
+	}
+	if tokens, err := ac.ListTokensByClient("client1"); err != nil || len(tokens) != 0 {
+		t.Error("client1 still has tokens after revocation", tokens, err)
+	}
+	if tokens, err := ac.ListTokensByClient("client2"); err != nil || len(tokens) != 3 {
+		t.Error("client2 tokens were affected by the revocation", tokens, err)
+	}
+	if info, _ := ac.LookupAccessToken("c2token0"); info == nil {
+		t.Error("client2 token is no longer valid")
+	}
+}
+
+// The issue time and address of a code survive the round trip
+func TestFakeAuthCodeIssueInfo(t *testing.T) {
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.1:6379": &fakeConn{data: newFakeData()},
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	issued := time.Date(2012, 10, 1, 12, 30, 0, 42, time.UTC)
+	if err := ac.RegisterAuthCode("code1", goauth2.AuthCodeInfo{
+		ClientID:    "client1",
+		RedirectURI: "http://localhost/redirect",
+		IssuedAt:    issued,
+		RequestIP:   "10.0.0.2",
+		Resource:    "https://api.example.com",
+	}); err != nil {
+		t.Fatal("Error registering auth code", err)
+	}
+
+	info, err := ac.LookupAuthCode("code1")
+	if err != nil {
+		t.Fatal("Error looking up auth code", err)
+	}
+	if !info.IssuedAt.Equal(issued) {
+		t.Error("Bad issue time", info.IssuedAt)
+	}
+	if info.RequestIP != "10.0.0.2" || info.ClientID != "client1" ||
+		info.RedirectURI != "http://localhost/redirect" ||
+		info.Resource != "https://api.example.com" {
+		t.Error("Bad auth code info", info)
+	}
+}
+
+// The audience of a token survives the round trip
+func TestFakeTokenAudience(t *testing.T) {
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.1:6379": &fakeConn{data: newFakeData()},
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	if _, _, err := ac.RegisterAccessToken("audiencetoken", goauth2.TokenInfo{
+		ClientID: "client1",
+		Audience: "https://api.example.com",
+	}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+	if info, err := ac.LookupAccessToken("audiencetoken"); err != nil || info == nil ||
+		info.Audience != "https://api.example.com" {
+		t.Error("Bad token info", info, err)
+	}
+}
+
+// Tokens are looked up in one request, and unknown ones are invalid
+func TestFakeLookupAccessTokens(t *testing.T) {
+	conn := &fakeConn{data: newFakeData()}
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{"tcp:10.0.0.1:6379": conn}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	ac.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	ac.RegisterAccessToken("token2", goauth2.TokenInfo{ClientID: "client2"}, goauth2.TokenLifetime{})
+
+	sent := conn.sent
+	valid, err := ac.LookupAccessTokens([]string{"token1", "unknown", "token2"})
+	if err != nil {
+		t.Fatal("Error looking up tokens", err)
+	}
+	if !valid["token1"] || !valid["token2"] || valid["unknown"] || len(valid) != 3 {
+		t.Error("Bad token lookup", valid)
+	}
+	if conn.sent-sent != 1 {
+		t.Error("Tokens were not looked up in one request", conn.sent-sent)
+	}
+
+	// Without scripts, the tokens are looked up one by one
+	conn.handle = func(name string, args []string) *redis.Reply {
+		if name == "EVAL" {
+			return &redis.Reply{Err: errors.New("ERR unknown command 'EVAL'")}
+		}
+		return nil
+	}
+	valid, err = ac.LookupAccessTokens([]string{"token1", "unknown"})
+	if err != nil || !valid["token1"] || valid["unknown"] {
+		t.Error("Bad token lookup without scripts", valid, err)
+	}
+}
+
+// The tokens of a user are listed by their identifiers, and expired ones
+// leave the user's set
+func TestFakeListUserTokens(t *testing.T) {
+	conn := &fakeConn{data: newFakeData()}
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{"tcp:10.0.0.1:6379": conn}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	issued := time.Date(2012, 10, 1, 12, 30, 0, 42, time.UTC)
+	ac.RegisterAccessToken("usertoken1", goauth2.TokenInfo{
+		ClientID: "client1", Scope: "read", UserID: "user1", IssuedAt: issued}, goauth2.TokenLifetime{})
+	ac.RegisterAccessToken("usertoken2", goauth2.TokenInfo{ClientID: "client2", UserID: "user1"}, goauth2.TokenLifetime{})
+	ac.RegisterAccessToken("usertoken3", goauth2.TokenInfo{ClientID: "client1", UserID: "user2"}, goauth2.TokenLifetime{})
+
+	tokens, err := ac.ListUserTokens("user1")
+	if err != nil || len(tokens) != 2 {
+		t.Fatal("Bad listing of user1 tokens", tokens, err)
+	}
+	for _, summary := range tokens {
+		if summary.ID != goauth2.TokenID("usertoken1") {
+			t.Error("Bad token ID", summary.ID)
+		}
+		if summary.ClientID == "client1" && (summary.Scope != "read" || !summary.IssuedAt.Equal(issued)) {
+			t.Error("Bad token summary", summary)
+		}
+	}
+
+	ac.RevokeToken("usertoken1")
+	if tokens, err := ac.ListUserTokens("user1"); err != nil || len(tokens) != 1 || tokens[0].ClientID != "client2" {
+		t.Error("Revoked token is still listed", tokens, err)
+	}
+}
+
+// Pushed requests can only be taken once
+func TestFakePushedRequest(t *testing.T) {
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.1:6379": &fakeConn{data: newFakeData()},
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	if err := ac.RegisterPushedRequest("request1", []byte(`{"client_id":"client1"}`), time.Minute); err != nil {
+		t.Fatal("Error registering pushed request", err)
+	}
+	if data, err := ac.TakePushedRequest("request1"); err != nil || string(data) != `{"client_id":"client1"}` {
+		t.Error("Bad pushed request", string(data), err)
+	}
+	if data, err := ac.TakePushedRequest("request1"); err != nil || data != nil {
+		t.Error("Pushed request was taken twice", string(data), err)
+	}
+}
+
+// A token is registered with its sets in a single command, or one by one
+// with the token expiring first when the script can't run
+func TestFakeRegisterAccessToken(t *testing.T) {
+	var crossSlot bool
+	var commands []string
+	conn := &fakeConn{data: newFakeData(), handle: func(name string, args []string) *redis.Reply {
+		commands = append(commands, name)
+		if name == "EVAL" && crossSlot {
+			return &redis.Reply{Err: errors.New("CROSSSLOT Keys in request don't hash to the same slot")}
+		}
+		return nil
+	}}
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{"tcp:10.0.0.1:6379": conn}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+	ac.TokenExpiry = 60
+
+	for _, crossSlot = range []bool{false, true} {
+		commands = nil
+		token := "token-" + strconv.FormatBool(crossSlot)
+		if _, _, err := ac.RegisterAccessToken(token, goauth2.TokenInfo{ClientID: "client1", UserID: "user1"}, goauth2.TokenLifetime{}); err != nil {
+			t.Fatal("Error registering access token", err)
+		}
+		if !crossSlot && len(commands) != 1 {
+			t.Error("Token was not registered in a single command", commands)
+		} else if crossSlot && (len(commands) < 3 || commands[1] != "HMSET" || commands[2] != "EXPIRE") {
+			t.Error("Token did not expire before joining its sets", commands)
+		}
+		if r := conn.data.exec("PTTL", []string{ac.tokenKey(token)}); string(r.Elem) == "-1" {
+			t.Error("Token doesn't expire")
+		}
+		// The sets hold the tokens registered so far
+		members := 1
+		if crossSlot {
+			members = 2
+		}
+		for _, key := range []string{ac.clientTokensKey("client1"), ac.userTokensKey("user1")} {
+			if r := conn.data.exec("SMEMBERS", []string{key}); len(r.Elems) != members {
+				t.Error("Token was not added to", key, len(r.Elems))
+			}
+			if r := conn.data.exec("PTTL", []string{key}); string(r.Elem) == "-1" {
+				t.Error("Set of tokens doesn't expire", key)
+			}
+		}
+	}
+}
+
+// Every kind of key moves to the new prefix, and only the keys of the old
+// prefix do, even if it has glob metacharacters
+func TestFakeMigrateKeys(t *testing.T) {
+	data := newFakeData()
+	newCache := func(prefix string) *RedisAuthCache {
+		ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+			Addr: "tcp:10.0.0.1:6379",
+			Dial: fakeDial(map[string]*fakeConn{"tcp:10.0.0.1:6379": &fakeConn{data: data}}),
+		})
+		if err != nil {
+			t.Fatal("Error creating cache", err)
+		}
+		ac.KeyPrefix = prefix
+		return ac
+	}
+
+	old, other := newCache("old*"), newCache("old-other:")
+	old.RegisterAuthCode("code1", goauth2.AuthCodeInfo{ClientID: "client1"})
+	old.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1", UserID: "user1"}, goauth2.TokenLifetime{})
+	old.RegisterPushedRequest("request1", []byte(`{"client_id":"client1"}`), time.Minute)
+	old.SetUserCutoff("user2", time.Now())
+	other.RegisterAccessToken("token2", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+
+	ac := newCache("new:")
+	if n, err := ac.MigrateKeys("old*"); err != nil || n != 6 {
+		t.Fatal("Bad migration", n, err)
+	}
+	if info, err := ac.LookupAuthCode("code1"); err != nil || info == nil {
+		t.Error("Code was not migrated", err)
+	}
+	if info, err := ac.LookupAccessToken("token1"); err != nil || info == nil {
+		t.Error("Token was not migrated", err)
+	}
+	if tokens, err := ac.ListTokensByClient("client1"); err != nil || len(tokens) != 1 {
+		t.Error("Client tokens were not migrated", tokens, err)
+	}
+	if data, err := ac.TakePushedRequest("request1"); err != nil || data == nil {
+		t.Error("Pushed request was not migrated", err)
+	}
+	if info, err := other.LookupAccessToken("token2"); err != nil || info == nil {
+		t.Error("Token of another prefix was migrated", err)
+	}
+}
+
+// Unknown codes are reported as such
+func TestFakeAuthCodeNotFound(t *testing.T) {
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.1:6379": &fakeConn{data: newFakeData()},
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+	if _, err := ac.LookupAuthCode("unknown"); !errors.Is(err, goauth2.ErrCodeNotFound) {
+		t.Error("Bad error for an unknown code", err)
+	}
+}
+
+// Tokens of a user issued before the user's cutoff are invalid, one by one
+// and in batches
+func TestFakeUserCutoff(t *testing.T) {
+	conn := &fakeConn{data: newFakeData()}
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{"tcp:10.0.0.1:6379": conn}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+
+	cutoff := time.Date(2012, 10, 1, 12, 0, 0, 0, time.UTC)
+	ac.RegisterAccessToken("old", goauth2.TokenInfo{
+		ClientID: "client1", UserID: "user1", IssuedAt: cutoff.Add(-time.Nanosecond)}, goauth2.TokenLifetime{})
+	ac.RegisterAccessToken("new", goauth2.TokenInfo{
+		ClientID: "client1", UserID: "user1", IssuedAt: cutoff.Add(time.Hour)}, goauth2.TokenLifetime{})
+	ac.RegisterAccessToken("other", goauth2.TokenInfo{
+		ClientID: "client1", UserID: "user2", IssuedAt: cutoff.Add(-time.Hour)}, goauth2.TokenLifetime{})
+
+	if err := ac.SetUserCutoff("user1", cutoff.In(time.FixedZone("", 3600))); err != nil {
+		t.Fatal("Error setting cutoff", err)
+	}
+	for token, want := range map[string]bool{"old": false, "new": true, "other": true} {
+		if info, err := ac.LookupAccessToken(token); err != nil || (info != nil) != want {
+			t.Error("Bad lookup after the cutoff", token, info, err)
+		}
+	}
+	valid, err := ac.LookupAccessTokens([]string{"old", "new", "other"})
+	if err != nil || valid["old"] || !valid["new"] || !valid["other"] {
+		t.Error("Bad batch lookup after the cutoff", valid, err)
+	}
+	if tokens, err := ac.ListUserTokens("user1"); err != nil || len(tokens) != 1 {
+		t.Error("Token issued before the cutoff is listed", tokens, err)
+	}
+}
+
+// A user's cutoff outlives the user's tokens whose lifetime is longer than
+// the cache's
+func TestFakeUserCutoffLifetime(t *testing.T) {
+	conn := &fakeConn{data: newFakeData()}
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr: "tcp:10.0.0.1:6379",
+		Dial: fakeDial(map[string]*fakeConn{"tcp:10.0.0.1:6379": conn}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+	ac.SetTokenExpiry(60)
+
+	info := goauth2.TokenInfo{ClientID: "client1", UserID: "user1", IssuedAt: time.Now()}
+	if _, _, err := ac.RegisterAccessToken("long", info, goauth2.TokenLifetime{TTL: 8 * time.Hour}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+	info.UserID = "user2"
+	ac.RegisterAccessToken("short", info, goauth2.TokenLifetime{})
+
+	for user, lifetime := range map[string]time.Duration{"user1": 8 * time.Hour, "user2": time.Minute, "user3": time.Minute} {
+		if err := ac.SetUserCutoff(user, time.Now()); err != nil {
+			t.Fatal("Error setting cutoff", err)
+		}
+		left := time.Until(conn.data.expires[ac.userCutoffKey(user)])
+		if left < lifetime-time.Second || left > lifetime+time.Second {
+			t.Error("Bad lifetime of the cutoff of", user, left)
+		}
+	}
+}
+
+// Closing the cache closes the master and replica connections once
+func TestFakeClose(t *testing.T) {
+	data := newFakeData()
+	replica := &fakeConn{data: data}
+	master := &fakeConn{data: data, handle: func(name string, args []string) *redis.Reply {
+		if name == "INFO" {
+			return status("slave0:ip=10.0.0.3,port=6379,state=online,offset=42,lag=0\r\n")
+		}
+		return nil
+	}}
+	ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+		Addr:             "tcp:10.0.0.1:6379",
+		ReadFromReplicas: true,
+		Dial: fakeDial(map[string]*fakeConn{
+			"tcp:10.0.0.1:6379": master,
+			"tcp:10.0.0.3:6379": replica,
+		}),
+	})
+	if err != nil {
+		t.Fatal("Error creating cache", err)
+	}
+	ac.LookupAccessToken("token1")
+
+	if err := ac.Close(); err != nil {
+		t.Fatal("Error closing the cache", err)
+	}
+	if master.closed != 1 || replica.closed != 1 {
+		t.Error("Connections were not closed once", master.closed, replica.closed)
+	}
+}
+
+// The cache passes the AuthCache suite on a fake server
+func TestFakeSuite(t *testing.T) {
+	cachetest.RunAuthCacheSuite(t, func() goauth2.AuthCache {
+		ac, err := NewRedisAuthCacheFromOptions(RedisOptions{
+			Addr: "tcp:10.0.0.1:6379",
+			Dial: fakeDial(map[string]*fakeConn{
+				"tcp:10.0.0.1:6379": &fakeConn{data: newFakeData()},
+			}),
+		})
+		if err != nil {
+			t.Fatal("Error creating cache", err)
+		}
+		return ac
+	})
+}
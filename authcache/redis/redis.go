@@ -1,165 +1,817 @@
 package redis
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	redis "github.com/simonz05/godis"
+	"github.com/yanatan16/goauth2"
+	"io"
 	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Implementation of the goauth2.AuthCache
 // Note: Currently only supports bearer tokens
 type RedisAuthCache struct {
-	db                      *redis.Client
+	conn Conn
+	// Connection used for token lookups when reads from replicas are
+	// allowed, otherwise nil
+	replica                 Conn
 	CodeExpiry, TokenExpiry int64
+	// KeyPrefix is prepended to every key the cache reads or writes so that
+	// several applications can share one Redis database.
+	// The default is empty, which keeps the "code:" and "token:" format.
+	KeyPrefix string
+	// Number of times RegisterAccessToken retries after a connection error,
+	// waiting RetryBackoff before the first retry and doubling it each time
+	Retries      int
+	RetryBackoff time.Duration
 }
 
 // Create a redis-based implementation of goauth2.AuthCache
 // By default, it will not have token expiration times
 func NewRedisAuthCache(addr string, dbnum int, pass string) *RedisAuthCache {
 	return &RedisAuthCache{
-		db:          redis.New(addr, dbnum, pass),
-		CodeExpiry:  120,
-		TokenExpiry: 0,
+		conn:         clientConn{redis.New(addr, dbnum, pass)},
+		CodeExpiry:   120,
+		TokenExpiry:  0,
+		Retries:      2,
+		RetryBackoff: 50 * time.Millisecond,
 	}
 }
 
-// Create a redis-based implementation of goauth2.AuthCache with 
+// Create a redis-based implementation of goauth2.AuthCache with
 // an already existing connection to Redis
-func NewRedisAuthCacheWithClient(client  *redis.Client) *RedisAuthCache {
+func NewRedisAuthCacheWithClient(client *redis.Client) *RedisAuthCache {
 	return &RedisAuthCache{
-		db:          client,
-		CodeExpiry:  120,
-		TokenExpiry: 3600,
+		conn:         clientConn{client},
+		CodeExpiry:   120,
+		TokenExpiry:  3600,
+		Retries:      2,
+		RetryBackoff: 50 * time.Millisecond,
 	}
 }
 
-func codeKey(code string) string {
-	return fmt.Sprintf("code:%s", code)
+// Create a redis-based implementation of goauth2.AuthCache whose keys
+// all live under prefix
+func NewRedisAuthCacheWithPrefix(addr string, dbnum int, pass, prefix string) *RedisAuthCache {
+	ac := NewRedisAuthCache(addr, dbnum, pass)
+	ac.KeyPrefix = prefix
+	return ac
 }
-func tokenKey(token string) string {
-	return fmt.Sprintf("token:%s", token)
+
+// Create a redis-based implementation of goauth2.AuthCache from options,
+// which may describe a single server, a Sentinel deployment or a cluster
+func NewRedisAuthCacheFromOptions(opts RedisOptions) (*RedisAuthCache, error) {
+	conn, replica, err := opts.connect()
+	if err != nil {
+		return nil, err
+	}
+	return &RedisAuthCache{
+		conn:         conn,
+		replica:      replica,
+		CodeExpiry:   120,
+		TokenExpiry:  0,
+		Retries:      2,
+		RetryBackoff: 50 * time.Millisecond,
+	}, nil
+}
+
+// Send a command, marking connection errors as an unavailable backend
+func (ac *RedisAuthCache) do(name string, args ...string) *redis.Reply {
+	r := ac.conn.Send(name, args...)
+	if r.Err != nil {
+		r.Err = backendError(r.Err)
+	}
+	return r
+}
+
+// Send a read-only command, to a replica if that is allowed
+func (ac *RedisAuthCache) read(name string, args ...string) *redis.Reply {
+	if ac.replica == nil {
+		return ac.do(name, args...)
+	}
+	r := ac.replica.Send(name, args...)
+	if r.Err != nil {
+		r.Err = backendError(r.Err)
+	}
+	return r
+}
+
+// Set the expiration time of a key in seconds
+func (ac *RedisAuthCache) expire(key string, secs int64) error {
+	r := ac.do("EXPIRE", key, strconv.FormatInt(secs, 10))
+	if r.Err != nil {
+		return r.Err
+	} else if string(r.Elem) != "1" {
+		return errors.New("Invalid return from setting code expiration.")
+	}
+	return nil
+}
+
+func (ac *RedisAuthCache) codeKey(code string) string {
+	return fmt.Sprintf("%scode:%s", ac.KeyPrefix, code)
+}
+func (ac *RedisAuthCache) tokenKey(token string) string {
+	return fmt.Sprintf("%stoken:%s", ac.KeyPrefix, token)
+}
+func (ac *RedisAuthCache) clientTokensKey(clientID string) string {
+	return fmt.Sprintf("%sclient_tokens:%s", ac.KeyPrefix, clientID)
+}
+func (ac *RedisAuthCache) pushedRequestKey(id string) string {
+	return fmt.Sprintf("%spushed_request:%s", ac.KeyPrefix, id)
+}
+func (ac *RedisAuthCache) userTokensKey(userID string) string {
+	return fmt.Sprintf("%suser_tokens:%s", ac.KeyPrefix, userID)
+}
+func (ac *RedisAuthCache) userCutoffKey(userID string) string {
+	return fmt.Sprintf("%suser_cutoff:%s", ac.KeyPrefix, userID)
+}
+
+// Format of the issue times of tokens and the user cutoffs. It is fixed
+// width and in UTC, so that the lookup script can compare them as strings.
+const timeFormat = "2006-01-02T15:04:05.000000000Z"
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+// isConnError reports whether err came from the connection to Redis rather
+// than from a Redis reply
+func isConnError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// backendError marks connection errors with goauth2.ErrBackendUnavailable
+// so the server can tell an outage apart from an invalid code or token
+func backendError(err error) error {
+	if err != nil && isConnError(err) {
+		return fmt.Errorf("%w: %v", goauth2.ErrBackendUnavailable, err)
+	}
+	return err
+}
+
+// The kinds of keys of the cache, which follow its KeyPrefix
+var keyKinds = []string{"code:", "token:", "client_tokens:", "pushed_request:", "user_tokens:", "user_cutoff:"}
+
+// Escape the glob metacharacters of a KEYS pattern, so that it matches them
+// literally
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// MigrateKeys moves every key of the cache stored under oldPrefix into the
+// cache's current KeyPrefix, keeping their expiration times.
+// It returns the number of keys moved.
+// Note: This uses KEYS, so it should be run during maintenance rather than
+// against a busy server.
+func (ac *RedisAuthCache) MigrateKeys(oldPrefix string) (int, error) {
+	if oldPrefix == ac.KeyPrefix {
+		return 0, nil
+	}
+
+	moved := 0
+	for _, kind := range keyKinds {
+		r := ac.do("KEYS", globEscaper.Replace(oldPrefix+kind)+"*")
+		if r.Err != nil {
+			return moved, r.Err
+		}
+		for _, elem := range r.Elems {
+			oldKey := string(elem.Elem)
+			newKey := ac.KeyPrefix + oldKey[len(oldPrefix):]
+			if rr := ac.do("RENAME", oldKey, newKey); rr.Err != nil {
+				return moved, rr.Err
+			}
+			moved++
+		}
+	}
+
+	return moved, nil
 }
 
 // Register an authorization code into the cache
-// ClientID is the client requesting
-// Scope is the requested access scope
-// Redirect_uri is the redirect URI to save for checking on lookup
 // Code is a generated random string to register with the request
-func (ac *RedisAuthCache) RegisterAuthCode(clientID, scope, redirect_uri, code string) error {
-	vars := map[string]string{
-		"clientID":     clientID,
-		"scope":        scope,
-		"redirect_uri": redirect_uri,
-	}
-	val, err := json.Marshal(vars)
+// Info is the information on the request to save for checking on lookup
+func (ac *RedisAuthCache) RegisterAuthCode(code string, info goauth2.AuthCodeInfo) error {
+	val, err := codeValue(info)
 	if err != nil {
 		return err
 	}
 
-	key := codeKey(code)
+	key := ac.codeKey(code)
 
-	err = ac.db.Set(key, val)
+	if r := ac.do("SET", key, string(val)); r.Err != nil {
+		return r.Err
+	}
+
+	return ac.expire(key, ac.CodeExpiry)
+}
+
+// Register an authorization code for lifetime, or CodeExpiry if it is 0,
+// unless it is registered already, with a single SET NX
+// Returns whether the code was registered.
+func (ac *RedisAuthCache) AddAuthCode(code string, info goauth2.AuthCodeInfo, lifetime time.Duration) (bool, error) {
+	val, err := codeValue(info)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	if valid, err := ac.db.Expire(key, int64(ac.CodeExpiry)); err != nil {
-		return err
-	} else if !valid {
-		return errors.New("Invalid return from setting code expiration.")
+	secs := ac.CodeExpiry
+	if lifetime > 0 {
+		secs = int64((lifetime + time.Second - 1) / time.Second)
+	}
+	args := []string{ac.codeKey(code), string(val)}
+	if secs > 0 {
+		args = append(args, "EX", strconv.FormatInt(secs, 10))
 	}
+	r := ac.do("SET", append(args, "NX")...)
+	if r.Err != nil {
+		return false, r.Err
+	}
+	// The reply is nil if the key exists
+	return r.Elem != nil, nil
+}
 
-	return nil
+// The JSON value of a code
+func codeValue(info goauth2.AuthCodeInfo) ([]byte, error) {
+	vars := map[string]string{
+		"clientID":     info.ClientID,
+		"scope":        info.Scope,
+		"redirect_uri": info.RedirectURI,
+		"request_ip":   info.RequestIP,
+		"resource":     info.Resource,
+		"user_id":      info.UserID,
+	}
+	if !info.IssuedAt.IsZero() {
+		vars["issued_at"] = info.IssuedAt.Format(time.RFC3339Nano)
+	}
+	if len(info.Extra) > 0 {
+		extra, err := json.Marshal(info.Extra)
+		if err != nil {
+			return nil, err
+		}
+		vars["extra"] = string(extra)
+	}
+	return json.Marshal(vars)
 }
 
 // Register an access token into the cache
-// ClientID is the client requesting
-// Scope is the requested access scope
 // Token is a generated random string to register with the request
+// Info is the client, scope and audience of the token
 // Returns the token type, expiration time (in seconds), and possibly an error
-func (ac *RedisAuthCache) RegisterAccessToken(clientID, scope, token string) (ttype string, expiry int64, err error) {
+func (ac *RedisAuthCache) RegisterAccessToken(token string, info goauth2.TokenInfo, lifetime goauth2.TokenLifetime) (ttype string, expiry int64, err error) {
+	expiry = lifetime.Seconds(time.Now(), ac.TokenExpiry)
 
-	vars := map[string]string{
-		"clientID": clientID,
-		"scope":    scope,
+	// Retry transient connection errors with an exponential backoff
+	backoff := ac.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = ac.setAccessToken(token, info, expiry)
+		if err == nil || attempt >= ac.Retries ||
+			!errors.Is(err, goauth2.ErrBackendUnavailable) {
+			break
+		}
+		log.Println("Retrying Redis registration of access token", err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	val, err := json.Marshal(vars)
 	if err != nil {
-		log.Println("Error Marshalling variables for Redis Set", err)
 		return "", 0, err
 	}
 
-	key := tokenKey(token)
+	return "bearer", expiry, nil
+}
 
-	err = ac.db.Set(key, val)
-	if err != nil {
-		log.Println("Error performing Redis-Set", err)
-		return "", 0, err
+// Script storing an access token as a hash expiring in ARGV[2] seconds, if
+// they are positive, and adding it to the sets of tokens of the other keys
+// like addToSet does, in one atomic step. ARGV[1] is the token, and the
+// fields of the hash follow.
+const setTokenScript = `local expiry = tonumber(ARGV[2])
+redis.call('HMSET', KEYS[1], unpack(ARGV, 3))
+if expiry > 0 then redis.call('EXPIRE', KEYS[1], expiry) end
+for i = 2, #KEYS do
+  local ttl = redis.call('PTTL', KEYS[i])
+  redis.call('SADD', KEYS[i], ARGV[1])
+  if expiry <= 0 and ttl >= 0 then
+    redis.call('PERSIST', KEYS[i])
+  elseif expiry > 0 and (ttl == -2 or (ttl >= 0 and ttl < expiry * 1000)) then
+    redis.call('EXPIRE', KEYS[i], expiry)
+  end
+end
+return 'OK'`
+
+// Store an access token as a hash, set its expiration time in seconds and
+// add it to the sets of its client's and user's tokens, with a single
+// script so that a failure can't leave some of them behind
+func (ac *RedisAuthCache) setAccessToken(token string, info goauth2.TokenInfo, expiry int64) error {
+	key := ac.tokenKey(token)
+	fields := []string{
+		"clientID", info.ClientID,
+		"scope", info.Scope,
+		"audience", info.Audience,
+		"user_id", info.UserID,
+	}
+	if !info.IssuedAt.IsZero() {
+		fields = append(fields, "issued_at", formatTime(info.IssuedAt))
+	}
+	if !info.AuthTime.IsZero() {
+		fields = append(fields, "auth_time", formatTime(info.AuthTime))
+	}
+	if info.Delegation != "" {
+		fields = append(fields, "delegation", info.Delegation)
+	}
+	setKeys := []string{ac.clientTokensKey(info.ClientID)}
+	if info.UserID != "" {
+		setKeys = append(setKeys, ac.userTokensKey(info.UserID))
+	}
+
+	args := []string{setTokenScript, strconv.Itoa(1 + len(setKeys)), key}
+	args = append(args, setKeys...)
+	args = append(args, token, strconv.FormatInt(expiry, 10))
+	args = append(args, fields...)
+	r := ac.do("EVAL", args...)
+	if r.Err == nil || errors.Is(r.Err, goauth2.ErrBackendUnavailable) {
+		return r.Err
+	}
+
+	// The keys may live on several cluster nodes, or scripts may be
+	// disabled: send the commands one by one, expiring the token first
+	if r := ac.do("HMSET", append([]string{key}, fields...)...); r.Err != nil {
+		log.Println("Error performing Redis-HMSet", r.Err)
+		return r.Err
+	}
+	if expiry > 0 {
+		if err := ac.expire(key, expiry); err != nil {
+			log.Println("Error performing Redis-Expire", err)
+			return err
+		}
+	}
+	for _, setKey := range setKeys {
+		if err := ac.addToSet(setKey, token, expiry); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	valid, err := ac.db.Expire(key, int64(ac.TokenExpiry))
+// Add a token expiring in expiry seconds to a set of tokens. Since tokens
+// have different lifetimes, the set expires with its longest-lived token,
+// and not at all if one of its tokens doesn't expire.
+func (ac *RedisAuthCache) addToSet(key, token string, expiry int64) error {
+	// -2 if the set doesn't exist yet, -1 if it doesn't expire
+	r := ac.do("PTTL", key)
+	if r.Err != nil {
+		return r.Err
+	}
+	ttl, err := strconv.ParseInt(string(r.Elem), 10, 64)
 	if err != nil {
-		log.Println("Error performing Redis-Expire", err)
-		return "", 0, err
-	} else if !valid {
-		err = errors.New("Invalid return from setting code expiration.")
-		log.Println("Error performing Redis-Expire", err)
-		return "", 0, err
+		return err
 	}
 
-	return "bearer", ac.TokenExpiry, nil
+	if r := ac.do("SADD", key, token); r.Err != nil {
+		log.Println("Error performing Redis-SAdd", r.Err)
+		return r.Err
+	}
+
+	switch {
+	case expiry <= 0 && ttl >= 0:
+		if r := ac.do("PERSIST", key); r.Err != nil {
+			log.Println("Error performing Redis-Persist", r.Err)
+			return r.Err
+		}
+	case expiry > 0 && (ttl == -2 || ttl >= 0 && ttl < expiry*1000):
+		if err := ac.expire(key, expiry); err != nil {
+			log.Println("Error performing Redis-Expire", err)
+			return err
+		}
+	}
+	return nil
 }
 
-// Lookup access token
+// Lookup an authorization code
 // Code is the code passed from the user
-// Returns the clientID, scope, and redirect URI registered with that code
-func (ac *RedisAuthCache) LookupAuthCode(code string) (clientID, scope, redirect_uri string, err error) {
+// Returns the information registered with that code
+func (ac *RedisAuthCache) LookupAuthCode(code string) (*goauth2.AuthCodeInfo, error) {
 
-	key := codeKey(code)
+	key := ac.codeKey(code)
 
-	val, err := ac.db.Get(key)
-	if err != nil {
-		return
+	r := ac.do("GET", key)
+	if r.Err != nil {
+		return nil, r.Err
+	} else if r.Elem == nil {
+		return nil, goauth2.ErrCodeNotFound
 	}
+	return parseCode(r.Elem)
+}
+
+// Script deleting a key and returning its value, so that only one caller
+// gets it
+const takeScript = `local v = redis.call('GET', KEYS[1])
+if v then redis.call('DEL', KEYS[1]) end
+return v`
 
+// Remove an authorization code and return the information registered with
+// it, in one atomic step
+func (ac *RedisAuthCache) TakeAuthCode(code string) (*goauth2.AuthCodeInfo, error) {
+	r := ac.do("EVAL", takeScript, "1", ac.codeKey(code))
+	if r.Err != nil {
+		return nil, r.Err
+	} else if r.Elem == nil {
+		return nil, goauth2.ErrCodeNotFound
+	}
+	return parseCode(r.Elem)
+}
+
+// The information of a code from its JSON value
+func parseCode(val []byte) (*goauth2.AuthCodeInfo, error) {
 	vars := make(map[string]string)
-	err = json.Unmarshal(val, &vars)
-	if err != nil {
-		return
+	if err := json.Unmarshal(val, &vars); err != nil {
+		return nil, err
 	}
 
-	clientID, ok := vars["clientID"]
-	if !ok {
-		err = errors.New("ClientID not found in code lookup!")
+	info := new(goauth2.AuthCodeInfo)
+	var ok bool
+	if info.ClientID, ok = vars["clientID"]; !ok {
+		return nil, errors.New("ClientID not found in code lookup!")
+	}
+	if info.Scope, ok = vars["scope"]; !ok {
+		return nil, errors.New("Scope not found in code lookup!")
 	}
-	scope, ok = vars["scope"]
-	if !ok {
-		err = errors.New("Scope not found in code lookup!")
+	if info.RedirectURI, ok = vars["redirect_uri"]; !ok {
+		return nil, errors.New("RedirectURI not found in code lookup!")
 	}
-	redirect_uri, ok = vars["redirect_uri"]
-	if !ok {
-		err = errors.New("RedirectURI not found in code lookup!")
+
+	// Codes registered by older versions have no issue information
+	info.RequestIP = vars["request_ip"]
+	info.Resource = vars["resource"]
+	info.UserID = vars["user_id"]
+	if issued, ok := vars["issued_at"]; ok {
+		t, err := time.Parse(time.RFC3339Nano, issued)
+		if err != nil {
+			return nil, err
+		}
+		info.IssuedAt = t
+	}
+	if extra, ok := vars["extra"]; ok {
+		if err := json.Unmarshal([]byte(extra), &info.Extra); err != nil {
+			return nil, err
+		}
 	}
 
-	return
+	return info, nil
 }
 
 // Lookup an Access Token
 // Token is the token passed from the client
-// Return whether the token is valid
-func (ac *RedisAuthCache) LookupAccessToken(token string) (bool, error) {
+// Return the information registered with the token, or nil if it is not valid
+func (ac *RedisAuthCache) LookupAccessToken(token string) (*goauth2.TokenInfo, error) {
+
+	key := ac.tokenKey(token)
+
+	fields, err := ac.tokenFields(key)
+	if err != nil || fields == nil {
+		return nil, err
+	}
+
+	info := &goauth2.TokenInfo{
+		Token:    token,
+		ClientID: fields["clientID"],
+		Scope:    fields["scope"],
+		Audience: fields["audience"],
+		UserID:   fields["user_id"],
+
+		Delegation: fields["delegation"],
+	}
+	if issued, ok := fields["issued_at"]; ok {
+		t, err := time.Parse(time.RFC3339Nano, issued)
+		if err != nil {
+			return nil, err
+		}
+		info.IssuedAt = t
+	}
+	if authTime, ok := fields["auth_time"]; ok {
+		t, err := time.Parse(time.RFC3339Nano, authTime)
+		if err != nil {
+			return nil, err
+		}
+		info.AuthTime = t
+	}
+	if info.UserID != "" {
+		if cutOff, err := ac.cutOff(info); err != nil || cutOff {
+			return nil, err
+		}
+	}
+
+	// Remaining time to live in milliseconds
+	r := ac.read("PTTL", key)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	ttl, err := strconv.ParseInt(string(r.Elem), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case ttl == -2:
+		// Expired since it was read
+		return nil, nil
+	case ttl >= 0:
+		info.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+
+	return info, nil
+}
 
-	key := tokenKey(token)
+// Script checking which of its keys are valid tokens, in one round trip:
+// they exist and weren't issued before the cutoff of their user, whose key
+// is ARGV[1] followed by the user.
+// MGET can't be used since tokens are hashes, for which it returns nil.
+const existsScript = `local r = {}
+for i, k in ipairs(KEYS) do
+  r[i] = redis.call('EXISTS', k)
+  if r[i] == 1 and redis.call('TYPE', k).ok == 'hash' then
+    local u = redis.call('HGET', k, 'user_id')
+    if u and u ~= '' then
+      local c = redis.call('GET', ARGV[1] .. u)
+      if c and (redis.call('HGET', k, 'issued_at') or '') < c then r[i] = 0 end
+    end
+  end
+end
+return r`
 
-	// Using a special form of Get to check for nil without error
-	if r := redis.SendStr(ac.db.Rw, "GET", key); r.Err != nil {
+// Lookup several Access Tokens at once
+// Tokens are the tokens passed from the clients
+// Return whether each token is valid. Unknown tokens map to false.
+func (ac *RedisAuthCache) LookupAccessTokens(tokens []string) (map[string]bool, error) {
+	valid := make(map[string]bool, len(tokens))
+	if len(tokens) == 0 {
+		return valid, nil
+	}
+
+	args := []string{existsScript, strconv.Itoa(len(tokens))}
+	for _, token := range tokens {
+		args = append(args, ac.tokenKey(token))
+	}
+	args = append(args, ac.userCutoffKey(""))
+	r := ac.read("EVAL", args...)
+	if r.Err != nil && !errors.Is(r.Err, goauth2.ErrBackendUnavailable) {
+		// The keys may live on several cluster nodes, or scripts may be
+		// disabled: look the tokens up one by one
+		return ac.lookupEach(tokens)
+	} else if r.Err != nil {
+		return nil, r.Err
+	} else if len(r.Elems) != len(tokens) {
+		return nil, errors.New("Invalid return from looking up tokens.")
+	}
+
+	for i, token := range tokens {
+		valid[token] = string(r.Elems[i].Elem) == "1"
+	}
+	return valid, nil
+}
+
+// Lookup several Access Tokens with one request each
+func (ac *RedisAuthCache) lookupEach(tokens []string) (map[string]bool, error) {
+	valid := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		info, err := ac.LookupAccessToken(token)
+		if err != nil {
+			return nil, err
+		}
+		valid[token] = info != nil
+	}
+	return valid, nil
+}
+
+// List the tokens issued to a client
+// Expired tokens are removed from the client's set as they are found
+func (ac *RedisAuthCache) ListTokensByClient(clientID string) ([]goauth2.TokenInfo, error) {
+	return ac.listTokens(ac.clientTokensKey(clientID))
+}
+
+// List the tokens authorized by a user
+// Expired tokens are removed from the user's set as they are found
+func (ac *RedisAuthCache) ListUserTokens(userID string) ([]goauth2.TokenSummary, error) {
+	tokens, err := ac.listTokens(ac.userTokensKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]goauth2.TokenSummary, 0, len(tokens))
+	for _, info := range tokens {
+		summaries = append(summaries, info.Summary())
+	}
+	return summaries, nil
+}
+
+// List the valid tokens of a set, removing the expired ones from it
+func (ac *RedisAuthCache) listTokens(setKey string) ([]goauth2.TokenInfo, error) {
+	r := ac.read("SMEMBERS", setKey)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+
+	var tokens []goauth2.TokenInfo
+	for _, elem := range r.Elems {
+		token := string(elem.Elem)
+		info, err := ac.LookupAccessToken(token)
+		if err != nil {
+			return nil, err
+		} else if info == nil {
+			ac.do("SREM", setKey, token)
+			continue
+		}
+		tokens = append(tokens, *info)
+	}
+	return tokens, nil
+}
+
+// Invalidate the tokens a user authorized before t
+// The cutoff is kept as long as the user's longest-lived token, whose
+// lifetime may be longer than TokenExpiry, and at least for TokenExpiry.
+// It is kept forever if tokens don't expire.
+func (ac *RedisAuthCache) SetUserCutoff(userID string, t time.Time) error {
+	key := ac.userCutoffKey(userID)
+	if r := ac.do("SET", key, formatTime(t)); r.Err != nil {
+		return r.Err
+	}
+	if ac.TokenExpiry <= 0 {
+		return nil
+	}
+
+	// The set of the user's tokens expires with the longest-lived one: -2
+	// if the user has no tokens, -1 if one of them doesn't expire
+	r := ac.do("PTTL", ac.userTokensKey(userID))
+	if r.Err != nil {
+		return r.Err
+	}
+	ttl, err := strconv.ParseInt(string(r.Elem), 10, 64)
+	if err != nil {
+		return err
+	}
+	secs := ac.TokenExpiry
+	switch {
+	case ttl == -1:
+		return nil
+	case (ttl+999)/1000 > secs:
+		secs = (ttl + 999) / 1000
+	}
+	return ac.expire(key, secs)
+}
+
+// Whether a token was issued before the cutoff of its user
+func (ac *RedisAuthCache) cutOff(info *goauth2.TokenInfo) (bool, error) {
+	r := ac.read("GET", ac.userCutoffKey(info.UserID))
+	if r.Err != nil || r.Elem == nil {
 		return false, r.Err
+	}
+	cutoff, err := time.Parse(time.RFC3339Nano, string(r.Elem))
+	if err != nil {
+		return false, err
+	}
+	return info.IssuedAt.Before(cutoff), nil
+}
+
+// Revoke an access token
+// It stays in its client's and user's sets until they are next listed
+func (ac *RedisAuthCache) RevokeToken(token string) error {
+	return ac.do("DEL", ac.tokenKey(token)).Err
+}
+
+// Revoke every token issued to a client
+// Returns the number of tokens revoked
+func (ac *RedisAuthCache) RevokeByClient(clientID string) (int, error) {
+	setKey := ac.clientTokensKey(clientID)
+	r := ac.do("SMEMBERS", setKey)
+	if r.Err != nil {
+		return 0, r.Err
+	}
+
+	n := 0
+	for _, elem := range r.Elems {
+		rr := ac.do("DEL", ac.tokenKey(string(elem.Elem)))
+		if rr.Err != nil {
+			return n, rr.Err
+		}
+		// Tokens that already expired don't count
+		if string(rr.Elem) == "1" {
+			n++
+		}
+	}
+
+	if rr := ac.do("DEL", setKey); rr.Err != nil {
+		return n, rr.Err
+	}
+	return n, nil
+}
+
+// Read the fields stored with an access token, or nil if it does not exist.
+// Tokens are stored as hashes, but tokens registered by older versions are
+// JSON strings, which are still understood.
+func (ac *RedisAuthCache) tokenFields(key string) (map[string]string, error) {
+	r := ac.read("HGETALL", key)
+	if r.Err != nil && strings.HasPrefix(r.Err.Error(), "WRONGTYPE") {
+		return ac.legacyTokenFields(key)
+	} else if r.Err != nil {
+		return nil, r.Err
+	} else if len(r.Elems) == 0 {
+		// Key does not exist
+		return nil, nil
+	}
+
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(r.Elems); i += 2 {
+		fields[string(r.Elems[i].Elem)] = string(r.Elems[i+1].Elem)
+	}
+	return fields, nil
+}
+
+// Read the fields of an access token stored as a JSON string
+func (ac *RedisAuthCache) legacyTokenFields(key string) (map[string]string, error) {
+	r := ac.read("GET", key)
+	if r.Err != nil {
+		return nil, r.Err
 	} else if r.Elem == nil {
 		// Key does not exist
-		return false, nil
+		return nil, nil
+	}
+
+	fields := make(map[string]string)
+	if err := json.Unmarshal(r.Elem, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// Register a pushed authorization request until it expires
+func (ac *RedisAuthCache) RegisterPushedRequest(id string, data []byte, expiry time.Duration) error {
+	key := ac.pushedRequestKey(id)
+	if r := ac.do("SET", key, string(data)); r.Err != nil {
+		return r.Err
+	}
+	secs := int64(expiry / time.Second)
+	if expiry%time.Second != 0 {
+		secs++
+	}
+	return ac.expire(key, secs)
+}
+
+// Remove and return a pushed authorization request
+// Return nil if it is unknown, expired or already taken.
+func (ac *RedisAuthCache) TakePushedRequest(id string) ([]byte, error) {
+	key := ac.pushedRequestKey(id)
+	r := ac.do("GET", key)
+	if r.Err != nil || r.Elem == nil {
+		return nil, r.Err
 	}
 
-	return true, nil
+	// Only the caller that deletes the key may use the request
+	rr := ac.do("DEL", key)
+	if rr.Err != nil {
+		return nil, rr.Err
+	} else if string(rr.Elem) != "1" {
+		return nil, nil
+	}
+	return r.Elem, nil
+}
+
+// Set the lifetime of the tokens registered from now on, in seconds
+// It is not safe to call while the cache is in use.
+func (ac *RedisAuthCache) SetTokenExpiry(secs int64) {
+	ac.TokenExpiry = secs
+}
+
+// Set the lifetime of the codes registered from now on, in seconds
+// It is not safe to call while the cache is in use.
+func (ac *RedisAuthCache) SetCodeExpiry(secs int64) {
+	ac.CodeExpiry = secs
+}
+
+// Close the connections to Redis. The cache can't be used afterwards.
+func (ac *RedisAuthCache) Close() error {
+	err := closeConn(ac.replica)
+	if e := closeConn(ac.conn); e != nil {
+		err = e
+	}
+	return err
+}
+
+// Ping checks that Redis is reachable by sending a PING
+func (ac *RedisAuthCache) Ping(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- ac.do("PING").Err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", goauth2.ErrBackendUnavailable, ctx.Err())
+	}
 }
@@ -2,110 +2,83 @@ package redis
 
 import (
 	. "./../../tests"
-	"github.com/yanatan16/goauth2"
-	"github.com/yanatan16/goauth2/authhandler"
+	"errors"
 	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache/cachetest"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"testing"
 	"time"
 )
 
 const (
-	auth_port   int    = 15697
 	redis_addr  string = "tcp:127.0.0.1:6379"
 	redis_dbnum int    = 0
 	redis_pass  string = ""
-)
 
-var (
-	api_url string
+	// The redirect URI of the test client, which no server needs to
+	// listen at
+	redirect_url string = "http://localhost/redirect"
 )
 
-// Example way to run an goauth2 server
-func ExampleRunGoauth2ServerWithRedis(port int) {
-	// Create your implementations of AuthCache
-	ac := NewRedisAuthCache(redis_addr, redis_dbnum, redis_pass)
-
-	// Create your implementation of AuthHandler
-	auth := authhandler.NewWhiteList("client1")
-
-	// Create the store and the server
-	server := goauth2.NewServer(ac, auth)
-
-	// Create the Serve Mux for http serving
-	sm := http.NewServeMux()
-	sm.Handle("/authorize", server.MasterHandler())
-
-	// You might have multiple uses, each should be wrapped using TokenVerifier
-	sm.Handle("/api", server.TokenVerifier(http.HandlerFunc(TestApiHandler)))
-
-	// Create the http server
-	httpd := &http.Server{
-		Addr:           fmt.Sprintf(":%d", port),
-		Handler:        sm,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-	}
-
-	// Start the server
-	log.Fatal(httpd.ListenAndServe())
+// Start the example server on Redis, returning the URLs of its
+// authorization endpoint and API
+func startRedisServer(t *testing.T) (authURL, apiURL string) {
+	base := StartExampleServer(t, NewRedisAuthCache(redis_addr, redis_dbnum, redis_pass))
+	return base + "/authorize", base + "/api"
 }
 
-func init() {
-	go ExampleRunGoauth2ServerWithRedis(auth_port)
-	InitTests("127.0.0.1",
-		fmt.Sprintf("http://%s:%d/authorize", "127.0.0.1", auth_port))
-
-	api_url = fmt.Sprintf("http://%s:%d/api", "127.0.0.1", auth_port)
-}
-
-func apiUseTest(t *testing.T, token string) {
-	req, err := http.NewRequest("GET", api_url, nil)
-	if err != nil {
-		t.Fatal("Error creating API Use Request", err)
-	}
-
-	req.Header.Add("Authorization", token)
-
-	client := &http.Client{}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		t.Fatal("Error making GET request for API with authorization", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		t.Fatal("API Response Status code is bad", resp.Status)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatal("API response body could not be read", err)
-	}
-	if string(body) != "OK" {
-		t.Error("API Response body is bad", body)
+// Check that a token gives access to the API at apiURL
+func apiUseTest(apiURL string) ApiCheck {
+	return func(t *testing.T, token string) {
+		req, err := http.NewRequest("GET", apiURL, nil)
+		if err != nil {
+			t.Fatal("Error creating API Use Request", err)
+		}
+
+		req.Header.Add("Authorization", token)
+
+		client := &http.Client{}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal("Error making GET request for API with authorization", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatal("API Response Status code is bad", resp.Status)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal("API response body could not be read", err)
+		}
+		if string(body) != "OK" {
+			t.Error("API Response body is bad", body)
+		}
 	}
 }
 
 // Test the implicit grant flow of OAuth 2.0
 func TestImplicitGrant(t *testing.T) {
-	DoTestImplicitGrant(t, ApiCheck(apiUseTest))
+	authURL, apiURL := startRedisServer(t)
+	DoTestImplicitGrant(t, authURL, redirect_url, apiUseTest(apiURL))
 }
 
 // Test the authorization code grant flow of OAuth 2.0
 func TestAuthCodeGrant(t *testing.T) {
-	DoTestAuthCodeGrant(t, ApiCheck(apiUseTest))
+	authURL, apiURL := startRedisServer(t)
+	DoTestAuthCodeGrant(t, authURL, redirect_url, apiUseTest(apiURL))
 }
 
 // Use a bad token to try and access the api
 func TestBadTokenUse(t *testing.T) {
+	_, apiURL := startRedisServer(t)
 	token := "avpneqp984hrlkfzd"
 
-	req, err := http.NewRequest("GET", api_url, nil)
+	req, err := http.NewRequest("GET", apiURL, nil)
 	if err != nil {
 		t.Fatal("Error creating API Use Request", err)
 	}
@@ -127,9 +100,127 @@ func TestBadTokenUse(t *testing.T) {
 
 // Test what happend when an auth code request fails
 func TestFailedAuthCodeRequest(t *testing.T) {
-	DoTestFailedAuthCodeRequest(t)
+	authURL, _ := startRedisServer(t)
+	DoTestFailedAuthCodeRequest(t, authURL, redirect_url)
 }
 
 func TestFailedImplicitGrant(t *testing.T) {
-	DoTestFailedImplicitGrant(t)
+	authURL, _ := startRedisServer(t)
+	DoTestFailedImplicitGrant(t, authURL, redirect_url)
+}
+
+// Two caches with different prefixes on the same database must not see
+// each other's tokens
+func TestKeyPrefixIsolation(t *testing.T) {
+	ac1 := NewRedisAuthCacheWithPrefix(redis_addr, redis_dbnum, redis_pass, "app1:")
+	ac2 := NewRedisAuthCacheWithPrefix(redis_addr, redis_dbnum, redis_pass, "app2:")
+	ac1.TokenExpiry = 60
+	ac2.TokenExpiry = 60
+
+	if _, _, err := ac1.RegisterAccessToken("prefixtoken1", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+	if _, _, err := ac2.RegisterAccessToken("prefixtoken2", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+
+	if info, err := ac1.LookupAccessToken("prefixtoken1"); err != nil || info == nil {
+		t.Error("Cache could not find its own token", err)
+	}
+	if info, err := ac2.LookupAccessToken("prefixtoken1"); err != nil || info != nil {
+		t.Error("Cache found a token registered under another prefix", info, err)
+	}
+	if info, err := ac1.LookupAccessToken("prefixtoken2"); err != nil || info != nil {
+		t.Error("Cache found a token registered under another prefix", info, err)
+	}
+}
+
+// The cache passes the AuthCache suite, each subtest under its own prefix
+func TestSuite(t *testing.T) {
+	n := 0
+	cachetest.RunAuthCacheSuite(t, func() goauth2.AuthCache {
+		n++
+		prefix := fmt.Sprintf("suite%d-%d:", time.Now().UnixNano(), n)
+		return NewRedisAuthCacheWithPrefix(redis_addr, redis_dbnum, redis_pass, prefix)
+	})
+}
+
+// Keys registered without a prefix can be moved under one
+func TestMigrateKeys(t *testing.T) {
+	old := NewRedisAuthCache(redis_addr, redis_dbnum, redis_pass)
+	old.TokenExpiry = 60
+	if _, _, err := old.RegisterAccessToken("migratetoken", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+
+	ac := NewRedisAuthCacheWithPrefix(redis_addr, redis_dbnum, redis_pass, "migrated:")
+	if n, err := ac.MigrateKeys(""); err != nil {
+		t.Fatal("Error migrating keys", err)
+	} else if n == 0 {
+		t.Error("No keys were migrated")
+	}
+
+	if info, err := ac.LookupAccessToken("migratetoken"); err != nil || info == nil {
+		t.Error("Migrated token not found under the new prefix", err)
+	}
+	if info, err := old.LookupAccessToken("migratetoken"); err != nil || info != nil {
+		t.Error("Migrated token still found under the old prefix", info, err)
+	}
+}
+
+// A cache that cannot reach Redis reports the backend as unavailable
+// rather than the token as invalid
+func TestClosedConnection(t *testing.T) {
+	ac := NewRedisAuthCache("tcp:127.0.0.1:1", redis_dbnum, redis_pass)
+	ac.RetryBackoff = time.Millisecond
+
+	if _, err := ac.LookupAccessToken("closedtoken"); !errors.Is(err, goauth2.ErrBackendUnavailable) {
+		t.Error("Lookup on a closed connection did not report an unavailable backend", err)
+	}
+	if _, _, err := ac.RegisterAccessToken("closedtoken", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); !errors.Is(err, goauth2.ErrBackendUnavailable) {
+		t.Error("Register on a closed connection did not report an unavailable backend", err)
+	}
+}
+
+// Tokens are stored as hashes and looked up with their metadata
+func TestLookupAccessTokenInfo(t *testing.T) {
+	ac := NewRedisAuthCache(redis_addr, redis_dbnum, redis_pass)
+	ac.TokenExpiry = 60
+	if _, _, err := ac.RegisterAccessToken("hashtoken", goauth2.TokenInfo{ClientID: "client1", Scope: "read"}, goauth2.TokenLifetime{}); err != nil {
+		t.Fatal("Error registering access token", err)
+	}
+
+	info, err := ac.LookupAccessToken("hashtoken")
+	if err != nil || info == nil {
+		t.Fatal("Registered token not found", err)
+	}
+	if info.ClientID != "client1" || info.Scope != "read" {
+		t.Error("Token lookup returned the wrong metadata", info)
+	}
+	if left := info.ExpiresAt.Sub(time.Now()); left <= 0 || left > time.Minute {
+		t.Error("Token lookup returned a bad expiration time", info.ExpiresAt)
+	}
+}
+
+// Tokens stored as JSON strings by older versions can still be looked up
+func TestLookupLegacyAccessToken(t *testing.T) {
+	ac := NewRedisAuthCache(redis_addr, redis_dbnum, redis_pass)
+	key := ac.tokenKey("legacytoken")
+	if r := ac.do("SET", key, `{"clientID":"client1","scope":"read"}`); r.Err != nil {
+		t.Fatal("Error setting legacy token", r.Err)
+	}
+	if err := ac.expire(key, 60); err != nil {
+		t.Fatal("Error setting legacy token expiration", err)
+	}
+
+	info, err := ac.LookupAccessToken("legacytoken")
+	if err != nil || info == nil {
+		t.Fatal("Legacy token not found", err)
+	}
+	if info.ClientID != "client1" || info.Scope != "read" {
+		t.Error("Legacy token lookup returned the wrong metadata", info)
+	}
+	if info.ExpiresAt.IsZero() {
+		t.Error("Legacy token lookup did not return an expiration time")
+	}
 }
@@ -3,22 +3,41 @@
 package authhandler
 
 import (
+	"encoding/json"
 	"github.com/yanatan16/goauth2"
 	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 )
 
-// ApprovalList is an AuthHandler that will automatically accept or 
+// ApprovalList is an AuthHandler that will automatically accept or
 // reject a client based on the policy given to the ApprovalList
+// Entries of the List may be glob patterns, such as "internal-*". A client
+// listed by its ID follows its entry, otherwise the longest pattern it
+// matches decides, and otherwise the Default policy.
+// Approved clients may further be limited to some scopes: their requests
+// are then only granted the allowed part of the requested scope.
 type ApprovalList struct {
 	Default bool
+	// The policy of each client or pattern. Use Allow, Deny and Remove to
+	// change it while serving requests.
 	List map[string]bool
+	// The scopes each client may be granted, by client ID. Clients without
+	// an entry may be granted any scope. Use SetScopes to change it while
+	// serving requests.
+	Scopes map[string][]string
+
+	// Guards the List and Scopes
+	mu sync.RWMutex
 }
 
 // Create an ApprovalList AuthHandler that has an auto-deny default policy
 func NewWhiteList(list ...string) *ApprovalList {
 	al := &ApprovalList{
 		Default: false,
-		List: make(map[string]bool),
+		List:    make(map[string]bool),
 	}
 	for _, name := range list {
 		al.List[name] = true
@@ -30,7 +49,7 @@ func NewWhiteList(list ...string) *ApprovalList {
 func NewBlackList(list ...string) *ApprovalList {
 	al := &ApprovalList{
 		Default: true,
-		List: make(map[string]bool),
+		List:    make(map[string]bool),
 	}
 	for _, name := range list {
 		al.List[name] = false
@@ -38,31 +57,162 @@ func NewBlackList(list ...string) *ApprovalList {
 	return al
 }
 
+// Allow a client, or the clients matching a pattern
+func (a *ApprovalList) Allow(clientID string) {
+	a.set(clientID, true)
+}
 
-func (a *ApprovalList) Authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
-	valid, ok := a.List[oar.ClientID]
-	if !ok {
-		valid = a.Default
+// Deny a client, or the clients matching a pattern
+func (a *ApprovalList) Deny(clientID string) {
+	a.set(clientID, false)
+}
+
+// Remove a client or pattern, so that the default policy applies to it
+func (a *ApprovalList) Remove(clientID string) {
+	a.mu.Lock()
+	delete(a.List, clientID)
+	a.mu.Unlock()
+}
+
+// Limit the scopes a client may be granted, or lift the limit if scopes
+// is nil
+func (a *ApprovalList) SetScopes(clientID string, scopes ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if scopes == nil {
+		delete(a.Scopes, clientID)
+		return
+	}
+	if a.Scopes == nil {
+		a.Scopes = make(map[string][]string)
+	}
+	a.Scopes[clientID] = scopes
+}
+
+func (a *ApprovalList) set(clientID string, valid bool) {
+	a.mu.Lock()
+	if a.List == nil {
+		a.List = make(map[string]bool)
 	}
+	a.List[clientID] = valid
+	a.mu.Unlock()
+}
 
-	var err error
-	if !valid {
-		err = goauth2.NewServerError(goauth2.ErrorCodeAccessDenied, "access denied", "")
+// Whether the policy approves a client
+func (a *ApprovalList) Approves(clientID string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if valid, ok := a.List[clientID]; ok {
+		return valid
 	}
 
-	oar.AuthCodeRedirect(w, r, err)
+	valid, longest := a.Default, ""
+	found := false
+	for pattern, v := range a.List {
+		if ok, _ := path.Match(pattern, clientID); !ok {
+			continue
+		}
+		// Ties between patterns of the same length go to the first in
+		// alphabetical order, so that the result doesn't depend on the map
+		if !found || len(pattern) > len(longest) ||
+			(len(pattern) == len(longest) && pattern < longest) {
+			valid, longest, found = v, pattern, true
+		}
+	}
+	return valid
+}
+
+func (a *ApprovalList) Authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	oar.AuthCodeRedirect(w, r, a.check(oar))
 }
 
 func (a *ApprovalList) AuthorizeImplicit(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
-	valid, ok := a.List[oar.ClientID]
-	if !ok {
-		valid = a.Default
+	oar.ImplicitRedirect(w, r, a.check(oar))
+}
+
+// Return an access_denied error if the client is not approved, and
+// downgrade the scope of the request to the allowed one
+func (a *ApprovalList) check(oar *goauth2.OAuthRequest) error {
+	if !a.Approves(oar.ClientID) {
+		return goauth2.NewServerError(goauth2.ErrorCodeAccessDenied, "access denied", "")
+	}
+
+	a.mu.RLock()
+	allowed, limited := a.Scopes[oar.ClientID]
+	a.mu.RUnlock()
+	if !limited {
+		return nil
+	}
+
+	// A request without scope gets all the allowed scopes
+	requested := strings.Fields(oar.Scope)
+	if len(requested) == 0 {
+		requested = allowed
+	}
+	var granted []string
+	for _, scope := range requested {
+		for _, s := range allowed {
+			if scope == s {
+				granted = append(granted, scope)
+				break
+			}
+		}
+	}
+	if len(granted) == 0 {
+		return goauth2.NewServerError(goauth2.ErrorCodeInvalidScope,
+			"None of the requested scopes may be granted.", "")
+	}
+	oar.Scope = strings.Join(granted, " ")
+	return nil
+}
+
+// The JSON form of an ApprovalList, as in a config file:
+//
+//	{"default": false, "allow": ["client1", "internal-*"], "deny": ["internal-test"],
+//	 "scopes": {"client1": ["read"]}}
+type approvalListJSON struct {
+	Default bool                `json:"default"`
+	Allow   []string            `json:"allow,omitempty"`
+	Deny    []string            `json:"deny,omitempty"`
+	Scopes  map[string][]string `json:"scopes,omitempty"`
+}
+
+func (a *ApprovalList) MarshalJSON() ([]byte, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	v := approvalListJSON{Default: a.Default, Scopes: a.Scopes}
+	for name, valid := range a.List {
+		if valid {
+			v.Allow = append(v.Allow, name)
+		} else {
+			v.Deny = append(v.Deny, name)
+		}
 	}
+	sort.Strings(v.Allow)
+	sort.Strings(v.Deny)
+	return json.Marshal(v)
+}
 
-	var err error
-	if !valid {
-		err = goauth2.NewServerError(goauth2.ErrorCodeAccessDenied, "access denied", "")
+func (a *ApprovalList) UnmarshalJSON(b []byte) error {
+	var v approvalListJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
 	}
 
-	oar.ImplicitRedirect(w, r, err)
-}
\ No newline at end of file
+	list := make(map[string]bool)
+	for _, name := range v.Allow {
+		list[name] = true
+	}
+	for _, name := range v.Deny {
+		list[name] = false
+	}
+
+	a.mu.Lock()
+	a.Default = v.Default
+	a.List = list
+	a.Scopes = v.Scopes
+	a.mu.Unlock()
+	return nil
+}
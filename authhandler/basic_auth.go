@@ -0,0 +1,67 @@
+package authhandler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"net/http"
+)
+
+// CredentialValidator checks the user name and password of a user
+type CredentialValidator func(user, pass string) bool
+
+// BasicAuth is an AuthHandler that challenges the user with HTTP Basic
+// authentication, and approves the request for the user if the credentials
+// are valid
+type BasicAuth struct {
+	// The realm of the challenge
+	Realm     string
+	Validator CredentialValidator
+}
+
+// Create a BasicAuth AuthHandler
+func NewBasicAuth(realm string, validator CredentialValidator) *BasicAuth {
+	return &BasicAuth{
+		Realm:     realm,
+		Validator: validator,
+	}
+}
+
+func (b *BasicAuth) Authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	b.authorize(w, r, oar)
+}
+
+func (b *BasicAuth) AuthorizeImplicit(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	b.authorize(w, r, oar)
+}
+
+// Approve the request for a valid user, or challenge for credentials
+func (b *BasicAuth) authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	user, pass, ok := r.BasicAuth()
+	if ok && b.Validator(user, pass) {
+		oar.UserID = user
+		redirect(w, r, oar, nil)
+		return
+	} else if !ok && oar.HasPrompt("none") {
+		oar.InteractionRequired(w, r)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", b.Realm))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// Create a CredentialValidator of a fixed set of users and their passwords
+func StaticCredentials(users map[string]string) CredentialValidator {
+	hashes := make(map[string][sha256.Size]byte, len(users))
+	for user, pass := range users {
+		hashes[user] = sha256.Sum256([]byte(pass))
+	}
+	return func(user, pass string) bool {
+		want, ok := hashes[user]
+		// Compare digests so that the time doesn't depend on the password
+		got := sha256.Sum256([]byte(pass))
+		return subtle.ConstantTimeCompare(got[:], want[:]) == 1 && ok
+	}
+}
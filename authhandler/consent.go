@@ -0,0 +1,221 @@
+package authhandler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/yanatan16/goauth2"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default lifetime of a pending consent request
+const DefaultConsentExpiry = 5 * time.Minute
+
+// Name of the cookie holding the CSRF token of the consent form
+const consentCSRFCookie = "goauth2_consent_csrf"
+
+// DefaultConsentTemplate is the consent page used by a new ConsentHandler
+var DefaultConsentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Authorize {{.ClientID}}</title></head>
+<body>
+<h1>Authorize {{.ClientID}}?</h1>
+{{if .Scopes}}<p>The application is requesting access to:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+{{else}}<p>The application is requesting access to your account.</p>
+{{end}}<form method="POST" action="{{.Action}}">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+// ConsentPage is the data the consent template is executed with.
+// The form must post the Nonce and CSRFToken as the "nonce" and
+// "csrf_token" fields to Action, with an "action" field set to "approve"
+// or "deny".
+type ConsentPage struct {
+	ClientID  string
+	Scopes    []string
+	Action    string
+	Nonce     string
+	CSRFToken string
+}
+
+// ConsentHandler is an AuthHandler that asks the user to approve or deny
+// each request on a consent page. The pending requests are kept in memory
+// until the form is submitted to the handler returned by CallbackHandler.
+type ConsentHandler struct {
+	// The consent page, executed with a ConsentPage
+	Template *template.Template
+	// The path the consent form is posted to, where CallbackHandler is mounted
+	CallbackPath string
+	// How long a consent page can be answered
+	Expiry time.Duration
+
+	// Signs the nonces of pending requests
+	key []byte
+
+	mu      sync.Mutex
+	pending map[string]*pendingConsent
+}
+
+type pendingConsent struct {
+	oar      *goauth2.OAuthRequest
+	implicit bool
+	csrf     string
+	expires  time.Time
+}
+
+// Create a ConsentHandler whose form posts to callbackPath
+func NewConsentHandler(callbackPath string) *ConsentHandler {
+	return &ConsentHandler{
+		Template:     DefaultConsentTemplate,
+		CallbackPath: callbackPath,
+		Expiry:       DefaultConsentExpiry,
+		key:          randomBytes(32),
+		pending:      make(map[string]*pendingConsent),
+	}
+}
+
+func (c *ConsentHandler) Authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	c.ask(w, r, oar, false)
+}
+
+func (c *ConsentHandler) AuthorizeImplicit(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	c.ask(w, r, oar, true)
+}
+
+// Keep the request pending and render the consent page
+func (c *ConsentHandler) ask(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+	id := hex.EncodeToString(randomBytes(16))
+	nonce := id + "." + sign(c.key, id)
+	csrf := hex.EncodeToString(randomBytes(16))
+
+	now := time.Now()
+	c.mu.Lock()
+	for key, p := range c.pending {
+		if now.After(p.expires) {
+			delete(c.pending, key)
+		}
+	}
+	c.pending[id] = &pendingConsent{
+		oar:      oar,
+		implicit: implicit,
+		csrf:     csrf,
+		expires:  now.Add(c.Expiry),
+	}
+	c.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     consentCSRFCookie,
+		Value:    csrf,
+		Path:     c.CallbackPath,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	err := c.Template.Execute(w, ConsentPage{
+		ClientID:  oar.ClientID,
+		Scopes:    strings.Fields(oar.Scope),
+		Action:    c.CallbackPath,
+		Nonce:     nonce,
+		CSRFToken: csrf,
+	})
+	if err != nil {
+		log.Println("OAuth Consent: Error rendering consent page!", err)
+	}
+}
+
+// CallbackHandler completes the pending request the consent form was
+// posted for, by redirecting to the client with a code or token if the
+// user approved, or with an access_denied error otherwise.
+func (c *ConsentHandler) CallbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		p := c.take(r.PostFormValue("nonce"))
+		if p == nil {
+			http.Error(w, "The consent request is unknown or expired.", http.StatusBadRequest)
+			return
+		}
+
+		// The form and the cookie must both hold the token of the page
+		cookie, err := r.Cookie(consentCSRFCookie)
+		if err != nil || !equal(cookie.Value, p.csrf) ||
+			!equal(r.PostFormValue("csrf_token"), p.csrf) {
+			log.Println("OAuth Consent: CSRF check failed for client", p.oar.ClientID)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var deny error
+		if r.PostFormValue("action") != "approve" {
+			deny = goauth2.NewServerError(goauth2.ErrorCodeAccessDenied,
+				"The user denied the request.", "")
+		}
+		if p.implicit {
+			p.oar.ImplicitRedirect(w, r, deny)
+		} else {
+			p.oar.AuthCodeRedirect(w, r, deny)
+		}
+	})
+}
+
+// Remove and return the pending request of a nonce, if it is valid and
+// not expired
+func (c *ConsentHandler) take(nonce string) *pendingConsent {
+	i := strings.Index(nonce, ".")
+	if i < 0 || !hmac.Equal([]byte(nonce[i+1:]), []byte(sign(c.key, nonce[:i]))) {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[nonce[:i]]
+	if !ok {
+		return nil
+	}
+	delete(c.pending, nonce[:i])
+	if time.Now().After(p.expires) {
+		return nil
+	}
+	return p
+}
+
+// Sign an identifier with a key
+func sign(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("authhandler: can't read random bytes: " + err.Error())
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+package authhandler
+
+import (
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// DefaultCSRFField is the form field a CSRF token is posted in
+const DefaultCSRFField = "csrf_token"
+
+// CSRFTokenSource returns the CSRF token of the user's session, such as a
+// random value kept with the session. It may start a session by setting a
+// cookie on w.
+type CSRFTokenSource func(w http.ResponseWriter, r *http.Request) (string, error)
+
+// CSRF protects the forms posted by the user, such as a consent page,
+// against cross-site request forgery. Each form embeds the token of the
+// user's session, which must come back with the POST.
+type CSRF struct {
+	Source CSRFTokenSource
+	// The form field of the token
+	Field string
+}
+
+// Create a CSRF protection using the tokens of source
+func NewCSRF(source CSRFTokenSource) *CSRF {
+	return &CSRF{
+		Source: source,
+		Field:  DefaultCSRFField,
+	}
+}
+
+// FormField returns the hidden input to embed in a form, holding the token
+// of the request's session
+func (c *CSRF) FormField(w http.ResponseWriter, r *http.Request) (template.HTML, error) {
+	token, err := c.Source(w, r)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(c.Field) +
+		`" value="` + template.HTMLEscapeString(token) + `">`), nil
+}
+
+// Protect decorates a handler so that it only receives the POST requests
+// holding the token of their session. Other requests get a 403 response.
+// Requests with other methods are passed through.
+func (c *CSRF) Protect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := c.Source(w, r)
+		if err != nil {
+			log.Println("OAuth CSRF: Error getting session token!", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if posted := r.PostFormValue(c.Field); token == "" || !equal(posted, token) {
+			log.Println("OAuth CSRF: Token mismatch on", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// CookieCSRFSource keeps the token in a cookie, creating it if the request
+// has none, for applications without server-side sessions
+func CookieCSRFSource(name, path string) CSRFTokenSource {
+	return func(w http.ResponseWriter, r *http.Request) (string, error) {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return c.Value, nil
+		}
+		token := hex.EncodeToString(randomBytes(16))
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    token,
+			Path:     path,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		// Later calls for the same request see the new token
+		r.AddCookie(&http.Cookie{Name: name, Value: token})
+		return token, nil
+	}
+}
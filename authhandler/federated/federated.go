@@ -0,0 +1,264 @@
+// Package goauth2/authhandler/federated provides an AuthHandler that
+// delegates the login of users to an upstream OpenID Connect provider.
+package federated
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default lifetime of a request waiting for the upstream login
+const DefaultExpiry = 10 * time.Minute
+
+// FederatedHandler is an AuthHandler that sends the user to log in at an
+// upstream OpenID Connect provider, such as Google or Okta. The provider
+// redirects back to the handler returned by CallbackHandler, which
+// completes the original request for the user once the login succeeded.
+type FederatedHandler struct {
+	// The authorization and token endpoints of the provider
+	AuthURL, TokenURL string
+	// The credentials of this server at the provider
+	ClientID, ClientSecret string
+	// The path the provider redirects to, where CallbackHandler is mounted
+	CallbackPath string
+	// The absolute URL of the callback registered at the provider. If it
+	// is empty, it is built from the host of the request and CallbackPath.
+	RedirectURL string
+	// The scope requested from the provider
+	Scope string
+	// How long a user has to log in at the provider
+	Expiry time.Duration
+	// The client used to reach the token endpoint
+	HTTPClient *http.Client
+
+	mu      sync.Mutex
+	pending map[string]*pendingRequest
+}
+
+type pendingRequest struct {
+	oar         *goauth2.OAuthRequest
+	implicit    bool
+	redirectURL string
+	expires     time.Time
+}
+
+// Create a FederatedHandler for a provider
+func NewFederatedHandler(upstreamAuthURL, tokenURL, clientID, clientSecret, callbackPath string) *FederatedHandler {
+	return &FederatedHandler{
+		AuthURL:      upstreamAuthURL,
+		TokenURL:     tokenURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		CallbackPath: callbackPath,
+		Scope:        "openid",
+		Expiry:       DefaultExpiry,
+		HTTPClient:   http.DefaultClient,
+		pending:      make(map[string]*pendingRequest),
+	}
+}
+
+func (f *FederatedHandler) Authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	f.login(w, r, oar, false)
+}
+
+func (f *FederatedHandler) AuthorizeImplicit(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	f.login(w, r, oar, true)
+}
+
+// Keep the request pending and redirect to the provider
+func (f *FederatedHandler) login(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+	u, err := url.Parse(f.AuthURL)
+	if err != nil {
+		log.Println("OAuth Federated: Bad upstream authorization URL!", err)
+		complete(w, r, oar, implicit, goauth2.NewServerError(goauth2.ErrorCodeServerError,
+			"The upstream provider is misconfigured.", ""))
+		return
+	}
+
+	state := randomState()
+	redirectURL := f.redirectURL(r)
+	now := time.Now()
+	f.mu.Lock()
+	for key, p := range f.pending {
+		if now.After(p.expires) {
+			delete(f.pending, key)
+		}
+	}
+	f.pending[state] = &pendingRequest{
+		oar:         oar,
+		implicit:    implicit,
+		redirectURL: redirectURL,
+		expires:     now.Add(f.Expiry),
+	}
+	f.mu.Unlock()
+
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", f.ClientID)
+	query.Set("redirect_uri", redirectURL)
+	query.Set("scope", f.Scope)
+	query.Set("state", state)
+	if oar.Prompt != "" {
+		query.Set("prompt", oar.Prompt)
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// The URL the provider redirects back to
+func (f *FederatedHandler) redirectURL(r *http.Request) string {
+	if f.RedirectURL != "" {
+		return f.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + f.CallbackPath
+}
+
+// CallbackHandler completes the pending request of the state the provider
+// redirected with. Once the login succeeded, the user of the provider's ID
+// token is set on the request, which is redirected to the client with a
+// code or token. Failed logins are redirected with access_denied.
+func (f *FederatedHandler) CallbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		p := f.take(query.Get("state"))
+		if p == nil {
+			http.Error(w, "The login request is unknown or expired.", http.StatusBadRequest)
+			return
+		}
+
+		if e := query.Get("error"); e != "" {
+			log.Println("OAuth Federated: Upstream login failed!", e, query.Get("error_description"))
+			switch e {
+			case "login_required", "interaction_required", "consent_required", "account_selection_required":
+				p.oar.InteractionRequired(w, r)
+			default:
+				complete(w, r, p.oar, p.implicit, goauth2.NewServerError(goauth2.ErrorCodeAccessDenied,
+					"The user could not log in.", ""))
+			}
+			return
+		}
+
+		userID, err := f.exchange(query.Get("code"), p.redirectURL)
+		if err != nil {
+			log.Println("OAuth Federated: Error exchanging upstream code!", err)
+			complete(w, r, p.oar, p.implicit, goauth2.NewServerError(goauth2.ErrorCodeAccessDenied,
+				"The user could not log in.", ""))
+			return
+		}
+
+		p.oar.UserID = userID
+		complete(w, r, p.oar, p.implicit, nil)
+	})
+}
+
+// Remove and return the pending request of a state, if it is not expired
+func (f *FederatedHandler) take(state string) *pendingRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.pending[state]
+	if !ok {
+		return nil
+	}
+	delete(f.pending, state)
+	if time.Now().After(p.expires) {
+		return nil
+	}
+	return p
+}
+
+// The response of the provider's token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+}
+
+// Exchange an upstream code for tokens and return the user of the ID token
+func (f *FederatedHandler) exchange(code, redirectURL string) (string, error) {
+	if code == "" {
+		return "", errors.New("No code in the upstream callback")
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	}
+	req, err := http.NewRequest("POST", f.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(f.ClientID), url.QueryEscape(f.ClientSecret))
+
+	res, err := f.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var tr tokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return "", err
+	} else if res.StatusCode != http.StatusOK || tr.Error != "" {
+		return "", fmt.Errorf("Upstream token request failed: %s %s", res.Status, tr.Error)
+	}
+	return subject(tr.IDToken)
+}
+
+// The subject of an ID token
+// The signature is not checked: the token comes straight from the token
+// endpoint, which is enough per OpenID Connect Core 1.0 section 3.1.3.7.
+func subject(idToken string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("Malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", err
+	} else if claims.Subject == "" {
+		return "", errors.New("ID token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// Complete a request with the redirect of its flow
+func complete(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool, err error) {
+	if implicit {
+		oar.ImplicitRedirect(w, r, err)
+	} else {
+		oar.AuthCodeRedirect(w, r, err)
+	}
+}
+
+func randomState() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("federated: can't read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,76 @@
+package authhandler
+
+import (
+	"github.com/yanatan16/goauth2"
+	"net/http"
+)
+
+// Func is an AuthHandler calling a function for both flows
+// Implicit is true for requests of the Implicit Grant Flow.
+type Func func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool)
+
+func (f Func) Authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	f(w, r, oar, false)
+}
+
+func (f Func) AuthorizeImplicit(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	f(w, r, oar, true)
+}
+
+// Chain creates an AuthHandler running handlers in order until one of them
+// writes a response, such as a redirect. A handler defers to the next one
+// by returning without writing anything. The request is denied if none of
+// them writes a response.
+func Chain(handlers ...goauth2.AuthHandler) goauth2.AuthHandler {
+	return Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		rw := &recordingWriter{ResponseWriter: w}
+		for _, h := range handlers {
+			if implicit {
+				h.AuthorizeImplicit(rw, r, oar)
+			} else {
+				h.Authorize(rw, r, oar)
+			}
+			if rw.written {
+				return
+			}
+		}
+
+		redirect(w, r, oar, goauth2.NewServerError(goauth2.ErrorCodeAccessDenied,
+			"No handler authorized the request.", ""))
+	})
+}
+
+// Conditional creates an AuthHandler passing the requests for which
+// predicate is true to a, and the others to b
+func Conditional(predicate func(oar *goauth2.OAuthRequest) bool, a, b goauth2.AuthHandler) goauth2.AuthHandler {
+	return Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		h := b
+		if predicate(oar) {
+			h = a
+		}
+		if implicit {
+			h.AuthorizeImplicit(w, r, oar)
+		} else {
+			h.Authorize(w, r, oar)
+		}
+	})
+}
+
+// recordingWriter is a http.ResponseWriter recording whether a response,
+// such as a redirect, was written
+type recordingWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
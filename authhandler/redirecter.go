@@ -1,14 +1,32 @@
 package authhandler
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"github.com/yanatan16/goauth2"
-	"net/url"
+	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
+// Default time an external UI has to return its verdict
+const DefaultVerdictExpiry = 10 * time.Minute
+
 // Redirecter is an AuthHandler that will redirect the request to another URI
+// If a Key is set, the external UI also receives the request in a
+// "request" parameter, and completes the flow by sending back a verdict
+// signed with the Key to the handler returned by CallbackHandler.
 type Redirecter struct {
 	AuthCode, Implicit *url.URL
+	// The key of the HMAC signing verdicts, shared with the external UI
+	Key []byte
+	// How long a verdict signed with SignVerdict is valid
+	Expiry time.Duration
 }
 
 // Create an Redirecter AuthHandler
@@ -24,18 +42,130 @@ func NewRedirecter(authCodeUrl, implicitUrl string) (*Redirecter, error) {
 	re := &Redirecter{
 		AuthCode: acurl,
 		Implicit: impurl,
+		Expiry:   DefaultVerdictExpiry,
 	}
 	return re, nil
 }
 
 func (re *Redirecter) Authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
-	redirect := re.AuthCode
-	redirect.RawQuery = r.URL.RawQuery
-	http.Redirect(w, r, redirect.String(), 303)
+	re.redirect(w, r, oar, re.AuthCode)
 }
 
 func (re *Redirecter) AuthorizeImplicit(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
-	redirect := re.Implicit
+	re.redirect(w, r, oar, re.Implicit)
+}
+
+// Forward the request to the external UI
+func (re *Redirecter) redirect(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, to *url.URL) {
+	redirect := *to
 	redirect.RawQuery = r.URL.RawQuery
+	if len(re.Key) > 0 {
+		data, err := oar.MarshalBinary()
+		if err != nil {
+			log.Println("OAuth Redirecter: Error serializing request!", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		query := redirect.Query()
+		query.Set("request", base64.RawURLEncoding.EncodeToString(data))
+		redirect.RawQuery = query.Encode()
+	}
 	http.Redirect(w, r, redirect.String(), 303)
-}
\ No newline at end of file
+}
+
+// A verdict of the external UI on a request
+type verdict struct {
+	// The "request" parameter the UI received
+	Request  string `json:"request"`
+	Approved bool   `json:"approved"`
+	UserID   string `json:"user_id"`
+	// Unix time after which the verdict is refused
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// SignVerdict creates the verdict of an external UI written in Go on a
+// request, given the "request" parameter the UI received.
+//
+// Other UIs create it as the base64url encoding, without padding, of the
+// JSON object {"request": ..., "approved": ..., "user_id": ...,
+// "expires_at": <unix time>}, followed by a "." and the base64url encoding
+// of its HMAC-SHA256 with the Key.
+func (re *Redirecter) SignVerdict(request string, approved bool, userID string) (string, error) {
+	if len(re.Key) == 0 {
+		return "", errors.New("The Redirecter has no key")
+	}
+	b, err := json.Marshal(verdict{
+		Request:   request,
+		Approved:  approved,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(re.Expiry).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + re.sign(payload), nil
+}
+
+func (re *Redirecter) sign(payload string) string {
+	mac := hmac.New(sha256.New, re.Key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature and expiry of a verdict
+func (re *Redirecter) verify(signed string) (*verdict, error) {
+	i := strings.LastIndex(signed, ".")
+	if len(re.Key) == 0 || i < 0 ||
+		!hmac.Equal([]byte(signed[i+1:]), []byte(re.sign(signed[:i]))) {
+		return nil, errors.New("Bad verdict signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(signed[:i])
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(verdict)
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, err
+	} else if time.Now().Unix() > v.ExpiresAt {
+		return nil, errors.New("Expired verdict")
+	}
+	return v, nil
+}
+
+// CallbackHandler completes the request of the signed verdict in its
+// "verdict" parameter, by redirecting to the client with a code or token
+// for the user if it was approved, or with access_denied otherwise.
+// Forged or expired verdicts are denied without redirecting.
+func (re *Redirecter) CallbackHandler(server *goauth2.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, err := re.verify(r.FormValue("verdict"))
+		if err != nil {
+			log.Println("OAuth Redirecter: Refused verdict!", err)
+			denied(w, "The verdict is invalid or expired.")
+			return
+		}
+
+		data, err := base64.RawURLEncoding.DecodeString(v.Request)
+		if err != nil {
+			denied(w, "The verdict is invalid or expired.")
+			return
+		}
+		// The client may have changed since the request was forwarded
+		oar, err := server.UnmarshalOAuthRequest(data)
+		if err != nil {
+			log.Println("OAuth Redirecter: Request is no longer valid!", err)
+			denied(w, "The request is no longer valid.")
+			return
+		}
+
+		if !v.Approved {
+			redirect(w, r, oar, goauth2.NewServerError(goauth2.ErrorCodeAccessDenied,
+				"The user denied the request.", ""))
+			return
+		}
+		oar.UserID = v.UserID
+		redirect(w, r, oar, nil)
+	})
+}
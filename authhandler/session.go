@@ -0,0 +1,220 @@
+package authhandler
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default lifetime of a request waiting for the user to log in
+const DefaultSessionExpiry = 10 * time.Minute
+
+// SessionChecker returns the user logged in with the session of a request,
+// and false if there is none
+type SessionChecker func(r *http.Request) (userID string, ok bool)
+
+// PendingStore keeps the serialized requests waiting for the user to log in
+type PendingStore interface {
+	// Save a request under id until it expires
+	Save(id string, data []byte, expires time.Time) error
+	// Remove and return the request saved under id
+	// Return nil if it is unknown or expired.
+	Take(id string) ([]byte, error)
+}
+
+// SessionAuth is an AuthHandler for an existing login system. Requests of
+// logged in users are approved for them. Otherwise the user is redirected
+// to the login page with a return-to parameter, which must lead back to the
+// handler returned by ResumeHandler once the user logged in.
+type SessionAuth struct {
+	// Returns the user of the session
+	Checker SessionChecker
+	// The login page of the login system
+	LoginURL string
+	// The query parameter of LoginURL holding the URL to return to
+	ReturnParam string
+	// The URL of the ResumeHandler
+	ResumeURL string
+	// Keeps the requests while the user logs in
+	Pending PendingStore
+	// How long a user has to log in
+	Expiry time.Duration
+
+	// Signs the identifiers of pending requests
+	key []byte
+}
+
+// Create a SessionAuth that keeps the pending requests in memory
+func NewSessionAuth(checker SessionChecker, loginURL, resumeURL string) *SessionAuth {
+	return &SessionAuth{
+		Checker:     checker,
+		LoginURL:    loginURL,
+		ReturnParam: "return_to",
+		ResumeURL:   resumeURL,
+		Pending:     NewMemoryPendingStore(),
+		Expiry:      DefaultSessionExpiry,
+		key:         randomBytes(32),
+	}
+}
+
+func (a *SessionAuth) Authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	a.authorize(w, r, oar)
+}
+
+func (a *SessionAuth) AuthorizeImplicit(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	a.authorize(w, r, oar)
+}
+
+// Approve the request for the user of the session, or send the user to log in
+func (a *SessionAuth) authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	if userID, ok := a.Checker(r); ok {
+		oar.UserID = userID
+		redirect(w, r, oar, nil)
+		return
+	} else if oar.HasPrompt("none") {
+		oar.InteractionRequired(w, r)
+		return
+	}
+
+	data, err := oar.MarshalBinary()
+	if err == nil {
+		id := hex.EncodeToString(randomBytes(16))
+		err = a.Pending.Save(id, data, time.Now().Add(a.Expiry))
+		if err == nil {
+			http.Redirect(w, r, a.loginURL(id+"."+sign(a.key, id)), http.StatusFound)
+			return
+		}
+	}
+
+	log.Println("OAuth Session: Error saving pending request!", err)
+	redirect(w, r, oar, goauth2.NewServerError(goauth2.ErrorCodeServerError,
+		"The request can't be kept while logging in.", ""))
+}
+
+// The login URL, returning to the ResumeURL of a pending request
+func (a *SessionAuth) loginURL(nonce string) string {
+	resume, _ := url.Parse(a.ResumeURL)
+	query := resume.Query()
+	query.Set("request", nonce)
+	resume.RawQuery = query.Encode()
+
+	login, _ := url.Parse(a.LoginURL)
+	query = login.Query()
+	query.Set(a.ReturnParam, resume.String())
+	login.RawQuery = query.Encode()
+	return login.String()
+}
+
+// ResumeHandler completes the pending request of its "request" parameter
+// once the user logged in, by redirecting to the client with the user
+// attached. Unknown, expired or tampered requests are denied.
+func (a *SessionAuth) ResumeHandler(server *goauth2.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := a.take(r.URL.Query().Get("request"))
+		if err != nil {
+			log.Println("OAuth Session: Error loading pending request!", err)
+		}
+		if data == nil {
+			denied(w, "The request is unknown or expired.")
+			return
+		}
+
+		// The client may have changed while the user logged in
+		oar, err := server.UnmarshalOAuthRequest(data)
+		if err != nil {
+			log.Println("OAuth Session: Pending request is no longer valid!", err)
+			denied(w, "The request is no longer valid.")
+			return
+		}
+
+		userID, ok := a.Checker(r)
+		if !ok {
+			redirect(w, r, oar, goauth2.NewServerError(goauth2.ErrorCodeAccessDenied,
+				"The user did not log in.", ""))
+			return
+		}
+		oar.UserID = userID
+		redirect(w, r, oar, nil)
+	})
+}
+
+// Remove and return the pending request of a signed identifier
+func (a *SessionAuth) take(nonce string) ([]byte, error) {
+	i := strings.Index(nonce, ".")
+	if i < 0 || !hmac.Equal([]byte(nonce[i+1:]), []byte(sign(a.key, nonce[:i]))) {
+		return nil, nil
+	}
+	return a.Pending.Take(nonce[:i])
+}
+
+// Complete a request with the redirect of its response type
+func redirect(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, err error) {
+	if oar.IssuesToken() {
+		oar.ImplicitRedirect(w, r, err)
+	} else {
+		oar.AuthCodeRedirect(w, r, err)
+	}
+}
+
+// Respond with an access_denied error when there is no client to redirect to
+func denied(w http.ResponseWriter, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             string(goauth2.ErrorCodeAccessDenied),
+		"error_description": description,
+	})
+}
+
+// ----------------------------------------------------------------------------
+
+// MemoryPendingStore is a PendingStore that keeps the requests in memory
+type MemoryPendingStore struct {
+	mu      sync.Mutex
+	pending map[string]pendingRequest
+}
+
+type pendingRequest struct {
+	data    []byte
+	expires time.Time
+}
+
+// Create an empty MemoryPendingStore
+func NewMemoryPendingStore() *MemoryPendingStore {
+	return &MemoryPendingStore{pending: make(map[string]pendingRequest)}
+}
+
+func (m *MemoryPendingStore) Save(id string, data []byte, expires time.Time) error {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, p := range m.pending {
+		if now.After(p.expires) {
+			delete(m.pending, key)
+		}
+	}
+	m.pending[id] = pendingRequest{data: data, expires: expires}
+	return nil
+}
+
+func (m *MemoryPendingStore) Take(id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pending[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.pending, id)
+	if time.Now().After(p.expires) {
+		return nil, nil
+	}
+	return p.data, nil
+}
@@ -0,0 +1,272 @@
+package goauth2
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackendPolicy bounds the time a Store waits for its AuthCache, so that a
+// struggling backend doesn't stall every request behind it. It applies a
+// timeout to each call, retries the lookups that fail with
+// ErrBackendUnavailable, and stops calling the backend for a while once
+// too many calls in a row failed: the calls then fail at once with
+// ErrBackendUnavailable, which requests get as temporarily_unavailable.
+//
+// The registrations of codes and tokens are not retried, since a write
+// that timed out may still have been applied. Since the AuthCache calls
+// take no context, a call that times out is abandoned rather than
+// cancelled, and finishes in the background.
+//
+// A BackendPolicy keeps the state of its breaker, so each Store needs its
+// own. It is safe for concurrent use.
+type BackendPolicy struct {
+	// The time a call may take, or 0 for no limit
+	Timeout time.Duration
+	// The number of times a failed lookup is retried, waiting RetryBackoff
+	// before the first retry and doubling it each time. The waits are
+	// jittered, between half and all of their length.
+	Retries      int
+	RetryBackoff time.Duration
+	// The number of failed calls in a row that opens the breaker, or 0 to
+	// never open it, and the time it stays open. Once it closes again, a
+	// single failed call reopens it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// Tells the time of the timeouts, waits and breaker, RealClock if nil
+	Clock Clock
+
+	// Guards the state of the breaker
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (p *BackendPolicy) clock() Clock {
+	if p.Clock == nil {
+		return RealClock
+	}
+	return p.Clock
+}
+
+// Run a call of the backend under the policy. Only idempotent calls are
+// retried.
+func (p *BackendPolicy) do(idempotent bool, call func() error) error {
+	if until, open := p.open(); open {
+		return fmt.Errorf("%w: the backend is failing, calls resume at %s",
+			ErrBackendUnavailable, until.Format(time.RFC3339))
+	}
+
+	backoff := p.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.call(call)
+		failed := isBackendFailure(err)
+		p.record(failed)
+		if !failed || !idempotent || attempt >= p.Retries {
+			return err
+		}
+		if backoff > 0 {
+			<-p.clock().After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+			backoff *= 2
+		}
+		if _, open := p.open(); open {
+			return err
+		}
+	}
+}
+
+// Make a single call, within the timeout
+func (p *BackendPolicy) call(call func() error) error {
+	if p.Timeout <= 0 {
+		return call()
+	}
+	// Buffered, so that an abandoned call doesn't block
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-p.clock().After(p.Timeout):
+		return fmt.Errorf("%w: the call timed out after %s", ErrBackendUnavailable, p.Timeout)
+	}
+}
+
+// Whether the breaker is open, and until when
+func (p *BackendPolicy) open() (time.Time, bool) {
+	if p.BreakerThreshold <= 0 {
+		return time.Time{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.openUntil, p.clock().Now().Before(p.openUntil)
+}
+
+// Count a call's outcome, and open the breaker after too many failures
+func (p *BackendPolicy) record(failed bool) {
+	if p.BreakerThreshold <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !failed {
+		p.failures = 0
+		return
+	}
+	p.failures++
+	if p.failures >= p.BreakerThreshold {
+		p.openUntil = p.clock().Now().Add(p.BreakerCooldown)
+		p.failures = p.BreakerThreshold - 1
+	}
+}
+
+// Whether an error of the backend means it is failing, rather than being
+// a result such as an unknown code
+func isBackendFailure(err error) bool {
+	return err != nil && errors.Is(err, ErrBackendUnavailable)
+}
+
+// ----------------------------------------------------------------------------
+
+// The calls of the AuthCache interface, under the Store's BackendPolicy if
+// it has one. Without a policy, the backend is called directly so that
+// verifications stay free of allocations.
+
+func (s *StoreImpl) registerAuthCode(code string, info AuthCodeInfo) error {
+	if s.BackendPolicy == nil {
+		return s.Backend.RegisterAuthCode(code, info)
+	}
+	return s.BackendPolicy.do(false, func() error {
+		return s.Backend.RegisterAuthCode(code, info)
+	})
+}
+
+func (s *StoreImpl) registerAccessToken(token string, info TokenInfo, lifetime TokenLifetime) (string, int64, error) {
+	if s.BackendPolicy == nil {
+		return s.Backend.RegisterAccessToken(token, info, lifetime)
+	}
+	var ttype string
+	var expiry int64
+	err := s.BackendPolicy.do(false, func() (err error) {
+		ttype, expiry, err = s.Backend.RegisterAccessToken(token, info, lifetime)
+		return
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return ttype, expiry, nil
+}
+
+func (s *StoreImpl) lookupAuthCode(code string) (*AuthCodeInfo, error) {
+	if s.BackendPolicy == nil {
+		return s.Backend.LookupAuthCode(code)
+	}
+	var info *AuthCodeInfo
+	err := s.BackendPolicy.do(true, func() (err error) {
+		info, err = s.Backend.LookupAuthCode(code)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (s *StoreImpl) lookupAccessToken(token string) (*TokenInfo, error) {
+	if s.BackendPolicy == nil {
+		return s.Backend.LookupAccessToken(token)
+	}
+	var info *TokenInfo
+	err := s.BackendPolicy.do(true, func() (err error) {
+		info, err = s.Backend.LookupAccessToken(token)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (s *StoreImpl) lookupAccessTokens(tokens []string) (map[string]bool, error) {
+	if s.BackendPolicy == nil {
+		return s.Backend.LookupAccessTokens(tokens)
+	}
+	var found map[string]bool
+	err := s.BackendPolicy.do(true, func() (err error) {
+		found, err = s.Backend.LookupAccessTokens(tokens)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Check an access token with the backend's AccessTokenChecker, or by
+// looking it up
+func (s *StoreImpl) checkAccessToken(token string) (bool, error) {
+	c, ok := s.Backend.(AccessTokenChecker)
+	if !ok {
+		info, err := s.lookupAccessToken(token)
+		return info != nil, err
+	}
+	if s.BackendPolicy == nil {
+		return c.CheckAccessToken(token)
+	}
+	var valid bool
+	err := s.BackendPolicy.do(true, func() (err error) {
+		valid, err = c.CheckAccessToken(token)
+		return
+	})
+	if err != nil {
+		return false, err
+	}
+	return valid, nil
+}
+
+// Take a code with the backend's CodeConsumer. Taking is not retried,
+// since a call that timed out may still have removed the code.
+func (s *StoreImpl) takeAuthCode(code string) (*AuthCodeInfo, error) {
+	c, ok := s.Backend.(CodeConsumer)
+	if !ok {
+		return nil, NewServerError(ErrorCodeServerError,
+			"The authorization codes can't be exchanged.", "").WithCause(ErrNotSupported)
+	}
+	if s.BackendPolicy == nil {
+		return c.TakeAuthCode(code)
+	}
+	var info *AuthCodeInfo
+	err := s.BackendPolicy.do(false, func() (err error) {
+		info, err = c.TakeAuthCode(code)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Add a code with the backend's CodeAdder. Adding is not retried, since a
+// call that timed out may still have added the code.
+func (s *StoreImpl) addAuthCode(code string, info AuthCodeInfo, lifetime time.Duration) (bool, error) {
+	a, ok := s.Backend.(CodeAdder)
+	if !ok {
+		return false, NewServerError(ErrorCodeServerError,
+			"The used authorization codes can't be recorded.", "").WithCause(ErrNotSupported)
+	}
+	if s.BackendPolicy == nil {
+		return a.AddAuthCode(code, info, lifetime)
+	}
+	var added bool
+	err := s.BackendPolicy.do(false, func() (err error) {
+		added, err = a.AddAuthCode(code, info, lifetime)
+		return
+	})
+	if err != nil {
+		return false, err
+	}
+	return added, nil
+}
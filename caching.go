@@ -0,0 +1,288 @@
+package goauth2
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenRevoker is implemented by a Store or an AuthCache that can revoke
+// a single access token
+type TokenRevoker interface {
+	RevokeToken(token string) error
+}
+
+// Number of cached validations between sweeps of the expired ones
+const cacheSweepInterval = 1000
+
+// CachingStore is a Store that remembers the results of ValidateAccessToken
+// and ValidateAccessTokenInfo for a short time, saving a round trip to the
+// backend on every API call.
+// A token revoked through the CachingStore is forgotten at once, but one
+// revoked elsewhere stays valid here until its entry expires.
+type CachingStore struct {
+	Store
+	// Tells the time the cached validations expire, RealClock if nil
+	Clock Clock
+	ttl   time.Duration
+
+	entries sync.Map // authorization field -> cachedValidation
+	stores  uint64
+}
+
+type cachedValidation struct {
+	valid bool
+	// The information of a valid token, if it was looked up
+	info    *TokenInfo
+	expires time.Time
+}
+
+// Create a CachingStore that remembers validations for ttl
+func NewCachingStore(inner Store, ttl time.Duration) *CachingStore {
+	return &CachingStore{
+		Store: inner,
+		ttl:   ttl,
+	}
+}
+
+// Validate an access token, from the cache if it was validated recently
+// Errors are not cached.
+func (s *CachingStore) ValidateAccessToken(authorization_field string) (bool, error) {
+	now := s.now()
+	if v, ok := s.entries.Load(authorization_field); ok {
+		entry := v.(cachedValidation)
+		if now.Before(entry.expires) {
+			return entry.valid, nil
+		}
+		s.entries.Delete(authorization_field)
+	}
+
+	valid, err := s.Store.ValidateAccessToken(authorization_field)
+	if err != nil {
+		return false, err
+	}
+
+	s.remember(authorization_field, cachedValidation{valid: valid, expires: now.Add(s.ttl)}, now)
+	return valid, nil
+}
+
+// Validate an access token and return its information, from the cache if
+// it was validated with its information recently. The cached information
+// is copied, so that callers can't change it.
+// Errors are not cached.
+func (s *CachingStore) ValidateAccessTokenInfo(authorization_field string) (*TokenInfo, error) {
+	now := s.now()
+	if v, ok := s.entries.Load(authorization_field); ok {
+		entry := v.(cachedValidation)
+		if now.Before(entry.expires) && !entry.valid {
+			return nil, nil
+		} else if now.Before(entry.expires) && entry.info != nil {
+			info := *entry.info
+			return &info, nil
+		}
+	}
+
+	info, err := s.Store.ValidateAccessTokenInfo(authorization_field)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := cachedValidation{valid: info != nil, expires: now.Add(s.ttl)}
+	if info != nil {
+		cached := *info
+		entry.info = &cached
+	}
+	s.remember(authorization_field, entry, now)
+	return info, nil
+}
+
+// Cache a validation, sweeping the expired ones every cacheSweepInterval
+func (s *CachingStore) remember(authorization_field string, entry cachedValidation, now time.Time) {
+	s.entries.Store(authorization_field, entry)
+	if atomic.AddUint64(&s.stores, 1)%cacheSweepInterval == 0 {
+		s.sweep(now)
+	}
+}
+
+// Validate several access tokens, from the cache for those validated
+// recently and with one batch to the inner Store for the others
+// Errors are not cached.
+func (s *CachingStore) ValidateAccessTokens(authorization_fields []string) (map[string]bool, error) {
+	now := s.now()
+	res := make(map[string]bool, len(authorization_fields))
+	var missing []string
+	for _, field := range authorization_fields {
+		if v, ok := s.entries.Load(field); ok {
+			entry := v.(cachedValidation)
+			if now.Before(entry.expires) {
+				res[field] = entry.valid
+				continue
+			}
+			s.entries.Delete(field)
+		}
+		missing = append(missing, field)
+	}
+	if len(missing) == 0 {
+		return res, nil
+	}
+
+	valid, err := s.Store.ValidateAccessTokens(missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range missing {
+		res[field] = valid[field]
+		s.entries.Store(field, cachedValidation{valid: valid[field], expires: now.Add(s.ttl)})
+	}
+	// Sweep if the count of stores went past a multiple of the interval
+	added := uint64(len(missing))
+	if n := atomic.AddUint64(&s.stores, added); n/cacheSweepInterval != (n-added)/cacheSweepInterval {
+		s.sweep(now)
+	}
+	return res, nil
+}
+
+// The time of the CachingStore's Clock
+func (s *CachingStore) now() time.Time {
+	if s.Clock == nil {
+		return RealClock.Now()
+	}
+	return s.Clock.Now()
+}
+
+// Revoke an access token and forget its cached validation
+// Returns ErrNotSupported if the inner Store can't revoke tokens
+func (s *CachingStore) RevokeToken(token string) error {
+	s.entries.Delete(token)
+	if r, ok := s.Store.(TokenRevoker); ok {
+		return r.RevokeToken(token)
+	}
+	return ErrNotSupported
+}
+
+// Revoke every token issued to a client and forget all cached validations,
+// since the cache doesn't know which tokens were the client's
+// Returns ErrNotSupported if the inner Store can't revoke them
+func (s *CachingStore) RevokeByClient(clientID string) (int, error) {
+	r, ok := s.Store.(BulkRevoker)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	n, err := r.RevokeByClient(clientID)
+	s.entries.Range(func(key, _ interface{}) bool {
+		s.entries.Delete(key)
+		return true
+	})
+	return n, err
+}
+
+// Invalidate the tokens a user authorized before t and forget all cached
+// validations, since the cache doesn't know which tokens were the user's
+// Returns ErrNotSupported if the inner Store doesn't keep user cutoffs
+func (s *CachingStore) SetUserCutoff(userID string, t time.Time) error {
+	c, ok := s.Store.(UserCutoffSetter)
+	if !ok {
+		return ErrNotSupported
+	}
+	err := c.SetUserCutoff(userID, t)
+	s.entries.Range(func(key, _ interface{}) bool {
+		s.entries.Delete(key)
+		return true
+	})
+	return err
+}
+
+// List the tokens issued to a client, from the inner Store
+func (s *CachingStore) ListTokensByClient(clientID string) ([]TokenSummary, error) {
+	if e, ok := s.Store.(ClientTokenLister); ok {
+		return e.ListTokensByClient(clientID)
+	}
+	return nil, ErrNotSupported
+}
+
+// Keep a pushed authorization request in the inner Store
+func (s *CachingStore) PushRequest(data []byte, expiry time.Duration) (string, error) {
+	if p, ok := s.Store.(PushedRequestStore); ok {
+		return p.PushRequest(data, expiry)
+	}
+	return "", ErrNotSupported
+}
+
+// Remove and return a pushed authorization request from the inner Store
+func (s *CachingStore) TakePushedRequest(requestURI string) ([]byte, error) {
+	if p, ok := s.Store.(PushedRequestStore); ok {
+		return p.TakePushedRequest(requestURI)
+	}
+	return nil, ErrNotSupported
+}
+
+// Issue an access token with the inner Store
+func (s *CachingStore) IssueAccessToken(info TokenInfo) (token, token_type string, expiry int64, err error) {
+	if i, ok := s.Store.(TokenIssuer); ok {
+		return i.IssueAccessToken(info)
+	}
+	return "", "", 0, ErrNotSupported
+}
+
+// Keep a request waiting for a login in the inner Store
+func (s *CachingStore) SavePendingRequest(data []byte, expiry time.Duration) (string, error) {
+	if p, ok := s.Store.(PendingRequestStore); ok {
+		return p.SavePendingRequest(data, expiry)
+	}
+	return "", ErrNotSupported
+}
+
+// Remove and return a request waiting for a login from the inner Store
+func (s *CachingStore) TakePendingRequest(id string) ([]byte, error) {
+	if p, ok := s.Store.(PendingRequestStore); ok {
+		return p.TakePendingRequest(id)
+	}
+	return nil, ErrNotSupported
+}
+
+// Check the credentials of a client with the inner Store
+// Returns an invalid_client error if the inner Store can't check them.
+func (s *CachingStore) AuthenticateClient(clientID, secret string) (Client, error) {
+	if a, ok := s.Store.(ClientAuthenticator); ok {
+		return a.AuthenticateClient(clientID, secret)
+	}
+	return nil, NewServerError(ErrorCodeInvalidClient,
+		"The client can't be authenticated.", "")
+}
+
+// Check a client assertion with the inner Store
+func (s *CachingStore) AuthenticateClientAssertion(assertion string, audiences []string) (Client, error) {
+	if a, ok := s.Store.(AssertionAuthenticator); ok {
+		return a.AuthenticateClientAssertion(assertion, audiences)
+	}
+	return nil, NewServerError(ErrorCodeInvalidClient,
+		"Client assertions are not supported.", "")
+}
+
+// Close the inner Store, if it is an io.Closer
+func (s *CachingStore) Close() error {
+	if c, ok := s.Store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Check that the inner Store's backend is reachable
+func (s *CachingStore) Ping(ctx context.Context) error {
+	if p, ok := s.Store.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Drop the expired validations
+func (s *CachingStore) sweep(now time.Time) {
+	s.entries.Range(func(key, v interface{}) bool {
+		if !now.Before(v.(cachedValidation).expires) {
+			s.entries.Delete(key)
+		}
+		return true
+	})
+}
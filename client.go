@@ -0,0 +1,276 @@
+package goauth2
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ClientType tells whether a client can keep its credentials confidential
+// http://tools.ietf.org/html/draft-ietf-oauth-v2-28#section-2.1
+type ClientType string
+
+const (
+	ClientTypePublic       ClientType = "public"
+	ClientTypeConfidential ClientType = "confidential"
+)
+
+// Grant types a client can be allowed to use
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeImplicit          = "implicit"
+	// http://tools.ietf.org/html/rfc8693
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// Client is a client registered with the server
+// Empty lists of redirect URIs, grant types or scopes allow any value.
+type Client interface {
+	// The client identifier
+	ID() string
+	// The client type
+	Type() ClientType
+	// Check that the client may use a redirect URI
+	ValidateRedirectURI(uri string) bool
+	// The registered redirect URIs
+	RedirectURIs() []string
+	// The grant types the client may use
+	AllowedGrantTypes() []string
+	// The scopes the client may request
+	AllowedScopes() []string
+	// The lifetime of the client's access tokens, or 0 for the AuthCache's
+	TokenTTL() time.Duration
+}
+
+// Client Store
+// This is an interface that looks up the clients registered with the server
+type ClientStore interface {
+	// Check that a client is registered and may be used
+	// Returns false if it is not, or an error if the registry could not
+	// be queried
+	ValidClient(clientID string) (bool, error)
+}
+
+// ClientLoader is implemented by a ClientStore that keeps the settings of
+// its clients. Other stores only say which clients are registered.
+type ClientLoader interface {
+	// Load a registered client
+	// Returns nil if it is not registered or may not be used
+	LoadClient(clientID string) (Client, error)
+}
+
+// WritableClientStore is a ClientStore that clients can be registered in
+// and removed from, such as one behind an administration interface
+type WritableClientStore interface {
+	ClientStore
+	ClientLoader
+	// Register a client, or replace a registered one
+	// The secret is empty for public clients. It should not be kept in
+	// plaintext.
+	SaveClient(client Client, secret string) error
+	// Check a client's secret
+	// Returns false for unknown clients and clients without a secret
+	VerifySecret(clientID, secret string) (bool, error)
+	// Remove a client. Removing an unknown client is not an error.
+	RemoveClient(clientID string) error
+}
+
+// ----------------------------------------------------------------------------
+
+// ClientImpl is a basic implementation of a Client
+type ClientImpl struct {
+	ClientID           string
+	ClientType         ClientType
+	ClientRedirectURIs []string
+	ClientGrantTypes   []string
+	ClientScopes       []string
+	ClientTokenTTL     time.Duration
+	// Native clients run on the user's device. They may use registered
+	// private-use URI schemes, and registered loopback URIs on any port.
+	// http://tools.ietf.org/html/rfc8252
+	ClientNative bool
+	// The cap of the client's active access tokens, the Store's default
+	// if zero
+	ClientTokenLimit TokenLimit
+	// The maximum length of the client's sessions, unlimited if zero
+	ClientMaxSession time.Duration
+}
+
+// Create a public client
+func NewClient(clientID string) *ClientImpl {
+	return &ClientImpl{
+		ClientID:   clientID,
+		ClientType: ClientTypePublic,
+	}
+}
+
+func (c *ClientImpl) ID() string {
+	return c.ClientID
+}
+
+func (c *ClientImpl) Type() ClientType {
+	return c.ClientType
+}
+
+// The redirect URI must be one of the registered ones, if there are any.
+// Only native clients may use URIs other than http and https ones, and
+// registered loopback URIs on another port.
+func (c *ClientImpl) ValidateRedirectURI(uri string) bool {
+	if len(c.ClientRedirectURIs) == 0 {
+		return true
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	} else if !c.ClientNative && u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	for _, registered := range c.ClientRedirectURIs {
+		if registered == uri || (c.ClientNative && loopbackMatch(registered, u)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ClientImpl) RedirectURIs() []string {
+	return c.ClientRedirectURIs
+}
+
+func (c *ClientImpl) AllowedGrantTypes() []string {
+	return c.ClientGrantTypes
+}
+
+func (c *ClientImpl) AllowedScopes() []string {
+	return c.ClientScopes
+}
+
+func (c *ClientImpl) TokenTTL() time.Duration {
+	return c.ClientTokenTTL
+}
+
+func (c *ClientImpl) MaxSession() time.Duration {
+	return c.ClientMaxSession
+}
+
+func (c *ClientImpl) TokenLimit() TokenLimit {
+	return c.ClientTokenLimit
+}
+
+// ----------------------------------------------------------------------------
+
+// Check that every value is in a list of allowed values.
+// An empty list allows anything.
+func allowed(list []string, values ...string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range values {
+		found := false
+		for _, a := range list {
+			if a == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Check that a redirect URI is a registered loopback URI with another port,
+// which native apps pick when they start listening
+// http://tools.ietf.org/html/rfc8252#section-7.3
+func loopbackMatch(registered string, u *url.URL) bool {
+	r, err := url.Parse(registered)
+	if err != nil || r.Scheme != "http" || u.Scheme != "http" {
+		return false
+	}
+	return isLoopback(u.Hostname()) && r.Hostname() == u.Hostname() &&
+		r.User == nil && u.User == nil &&
+		r.Path == u.Path && r.RawQuery == u.RawQuery
+}
+
+// Whether a host is a loopback IP literal. The "localhost" name is not, as
+// it may not resolve to the loopback interface.
+func isLoopback(host string) bool {
+	return host == "127.0.0.1" || host == "::1"
+}
+
+// Whether every value of a scope is part of the granted scope
+func subsetScope(scope, granted string) bool {
+	grantedScopes := strings.Fields(granted)
+	for _, v := range strings.Fields(scope) {
+		found := false
+		for _, g := range grantedScopes {
+			if g == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// The values of a scope without duplicates, in their order
+func uniqueScope(scope string) string {
+	var values []string
+	seen := make(map[string]bool)
+	for _, v := range strings.Fields(scope) {
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+// ParseScope splits a scope into its values, without duplicates
+// Values are separated by single spaces and made of printable ASCII other
+// than the double quote and the backslash. Other scopes give an
+// invalid_scope ServerError. The empty scope has no values.
+// http://tools.ietf.org/html/rfc6749#section-3.3
+func ParseScope(scope string) ([]string, error) {
+	if scope == "" {
+		return nil, nil
+	}
+	var values []string
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(scope, " ") {
+		if v == "" {
+			return nil, NewServerError(ErrorCodeInvalidScope,
+				"The scope has an empty value.", "")
+		}
+		for i := 0; i < len(v); i++ {
+			if c := v[i]; c <= 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+				return nil, NewServerError(ErrorCodeInvalidScope,
+					"The scope has an invalid character.", "")
+			}
+		}
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// Check that a client may use a grant type and request a scope
+func checkClientGrant(client Client, grantType, scope string) error {
+	if !allowed(client.AllowedGrantTypes(), grantType) {
+		return NewServerError(ErrorCodeUnauthorizedClient,
+			fmt.Sprintf("The client may not use the %q grant type.", grantType), "")
+	}
+	if !allowed(client.AllowedScopes(), strings.Fields(scope)...) {
+		return NewServerError(ErrorCodeInvalidScope,
+			"The requested scope is not allowed for the client.", "")
+	}
+	return nil
+}
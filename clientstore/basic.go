@@ -0,0 +1,153 @@
+// Package goauth2/clientstore provides a basic implementation of a ClientStore as defined in package goauth2.
+package clientstore
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/yanatan16/goauth2"
+	"sort"
+	"sync"
+)
+
+// A registered client, with the hash of its secret if it has one
+type BasicClientEntry struct {
+	Client     goauth2.Client
+	SecretHash []byte
+	// Disabled clients are kept but may not be used
+	Disabled bool
+	// The key the client signs its assertions with, if any
+	PublicKey crypto.PublicKey
+}
+
+// This is a struct that implements the WritableClientStore interface
+// It is safe for concurrent use.
+type BasicClientStore struct {
+	clients map[string]*BasicClientEntry
+
+	// Guards the map
+	mu sync.RWMutex
+}
+
+// Create a new Basic Client Store
+func NewBasicClientStore() *BasicClientStore {
+	return &BasicClientStore{
+		clients: make(map[string]*BasicClientEntry),
+	}
+}
+
+// Register a client without a secret
+func (cs *BasicClientStore) AddClient(client goauth2.Client) {
+	cs.mu.Lock()
+	cs.clients[client.ID()] = &BasicClientEntry{Client: client}
+	cs.mu.Unlock()
+}
+
+// Register a client, or replace a registered one
+func (cs *BasicClientStore) SaveClient(client goauth2.Client, secret string) error {
+	entry := &BasicClientEntry{Client: client}
+	if secret != "" {
+		hash := sha256.Sum256([]byte(secret))
+		entry.SecretHash = hash[:]
+	}
+	cs.mu.Lock()
+	cs.clients[client.ID()] = entry
+	cs.mu.Unlock()
+	return nil
+}
+
+// Remove a client
+func (cs *BasicClientStore) RemoveClient(clientID string) error {
+	cs.mu.Lock()
+	delete(cs.clients, clientID)
+	cs.mu.Unlock()
+	return nil
+}
+
+// Disable a client, which stays listed but is no longer valid
+// Saving the client again enables it.
+func (cs *BasicClientStore) DisableClient(clientID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if entry, ok := cs.clients[clientID]; ok {
+		disabled := *entry
+		disabled.Disabled = true
+		cs.clients[clientID] = &disabled
+	}
+}
+
+// Set the key a client signs its assertions with, for the private_key_jwt
+// authentication. Unknown clients are ignored, and saving the client again
+// removes its key.
+func (cs *BasicClientStore) SetPublicKey(clientID string, key crypto.PublicKey) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if entry, ok := cs.clients[clientID]; ok {
+		keyed := *entry
+		keyed.PublicKey = key
+		cs.clients[clientID] = &keyed
+	}
+}
+
+// The public key of a registered and enabled client
+func (cs *BasicClientStore) ClientPublicKey(clientID string) (crypto.PublicKey, error) {
+	if entry := cs.enabled(clientID); entry != nil {
+		return entry.PublicKey, nil
+	}
+	return nil, nil
+}
+
+// Check that a client is registered and enabled
+func (cs *BasicClientStore) ValidClient(clientID string) (bool, error) {
+	return cs.enabled(clientID) != nil, nil
+}
+
+// Load a registered and enabled client
+func (cs *BasicClientStore) LoadClient(clientID string) (goauth2.Client, error) {
+	if entry := cs.enabled(clientID); entry != nil {
+		return entry.Client, nil
+	}
+	return nil, nil
+}
+
+// Check a client's secret
+func (cs *BasicClientStore) VerifySecret(clientID, secret string) (bool, error) {
+	entry := cs.enabled(clientID)
+	if entry == nil || entry.SecretHash == nil {
+		return false, nil
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], entry.SecretHash) == 1, nil
+}
+
+// List the registered clients, including the disabled ones, by ID
+// The secret hashes are left out.
+func (cs *BasicClientStore) Clients() []BasicClientEntry {
+	cs.mu.RLock()
+	list := make([]BasicClientEntry, 0, len(cs.clients))
+	for _, entry := range cs.clients {
+		list = append(list, BasicClientEntry{
+			Client:    entry.Client,
+			Disabled:  entry.Disabled,
+			PublicKey: entry.PublicKey,
+		})
+	}
+	cs.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Client.ID() < list[j].Client.ID()
+	})
+	return list
+}
+
+// The entry of a client, or nil if it is unknown or disabled
+// Entries are replaced rather than modified, so they can be read unlocked.
+func (cs *BasicClientStore) enabled(clientID string) *BasicClientEntry {
+	cs.mu.RLock()
+	entry, ok := cs.clients[clientID]
+	cs.mu.RUnlock()
+	if !ok || entry.Disabled {
+		return nil
+	}
+	return entry
+}
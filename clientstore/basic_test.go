@@ -0,0 +1,71 @@
+package clientstore
+
+import (
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/clientstore/storetest"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.RunClientStoreTests(t, func() goauth2.WritableClientStore {
+		return NewBasicClientStore()
+	})
+}
+
+// Disabled clients are listed but not valid
+func TestDisableClient(t *testing.T) {
+	cs := NewBasicClientStore()
+	cs.AddClient(goauth2.NewClient("client1"))
+	cs.SaveClient(goauth2.NewClient("client2"), "secret")
+	cs.DisableClient("client2")
+
+	if valid, _ := cs.ValidClient("client2"); valid {
+		t.Error("Disabled client is valid")
+	}
+	if ok, _ := cs.VerifySecret("client2", "secret"); ok {
+		t.Error("Secret of disabled client was verified")
+	}
+	if valid, _ := cs.ValidClient("client1"); !valid {
+		t.Error("Enabled client is not valid")
+	}
+
+	clients := cs.Clients()
+	if len(clients) != 2 || clients[0].Client.ID() != "client1" ||
+		clients[1].Client.ID() != "client2" || !clients[1].Disabled {
+		t.Error("Bad client list", clients)
+	}
+	if clients[1].SecretHash != nil {
+		t.Error("Client list includes secret hashes")
+	}
+}
+
+// Clients can be added while others are validated. Run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	cs := NewBasicClientStore()
+	done := make(chan bool)
+
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := 0; j < 100; j++ {
+				id := fmt.Sprintf("client%d-%d", i, j)
+				cs.AddClient(goauth2.NewClient(id))
+				if valid, _ := cs.ValidClient(id); !valid {
+					t.Error("Added client is not valid", id)
+				}
+				if j%10 == 0 {
+					cs.DisableClient(id)
+					cs.Clients()
+				}
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	if n := len(cs.Clients()); n != 400 {
+		t.Error("Wrong number of clients", n)
+	}
+}
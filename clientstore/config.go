@@ -0,0 +1,13 @@
+package clientstore
+
+import (
+	"github.com/yanatan16/goauth2"
+)
+
+// The BasicClientStore is the "memory" backend of
+// goauth2.NewServerFromConfig, which takes no options
+func init() {
+	goauth2.RegisterClientStoreBackend("memory", func(options map[string]string) (goauth2.ClientStore, error) {
+		return NewBasicClientStore(), nil
+	})
+}
@@ -0,0 +1,47 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+)
+
+// The dialects of the "dialect" option, by name
+var dialects = map[string]Dialect{
+	"sqlite":     SQLite,
+	"mysql":      MySQL,
+	"postgresql": PostgreSQL,
+}
+
+// The SQLClientStore is the "sql" backend of goauth2.NewServerFromConfig.
+// Its options are the "driver" and "dsn" of the database, whose driver must
+// be imported, and its "dialect", "sqlite" by default. The clients table
+// is created if it doesn't exist.
+func init() {
+	goauth2.RegisterClientStoreBackend("sql", func(options map[string]string) (goauth2.ClientStore, error) {
+		if options["driver"] == "" || options["dsn"] == "" {
+			return nil, errors.New("The driver and dsn options are required")
+		}
+		dialect := SQLite
+		if name, ok := options["dialect"]; ok {
+			if dialect, ok = dialects[name]; !ok {
+				return nil, fmt.Errorf("Unknown dialect %q", name)
+			}
+		}
+		db, err := sql.Open(options["driver"], options["dsn"])
+		if err != nil {
+			return nil, err
+		}
+		if err := EnsureSchema(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+		cs, err := NewSQLClientStoreWithDialect(db, dialect)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return cs, nil
+	})
+}
@@ -0,0 +1,272 @@
+// Package goauth2/clientstore/sql provides a ClientStore backed by a SQL database.
+package sql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"golang.org/x/crypto/bcrypt"
+	"strconv"
+	"strings"
+)
+
+// Dialect is the SQL dialect of a database, which decides the placeholders
+// used in queries
+type Dialect int
+
+const (
+	// SQLite and MySQL use ? placeholders
+	SQLite Dialect = iota
+	MySQL
+	// PostgreSQL uses $1, $2... placeholders
+	PostgreSQL
+)
+
+// Schema creates the clients table used by SQLClientStore.
+// It is valid in every supported dialect.
+const Schema = `CREATE TABLE IF NOT EXISTS clients (
+	id VARCHAR(255) NOT NULL PRIMARY KEY,
+	secret_hash VARCHAR(255) NOT NULL,
+	type VARCHAR(32) NOT NULL,
+	redirect_uris TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	grant_types TEXT NOT NULL
+)`
+
+// ErrClientNotFound is returned when a client is not in the clients table
+var ErrClientNotFound = errors.New("Client not found")
+
+// Create the clients table if it does not exist yet
+func EnsureSchema(db *sql.DB) error {
+	_, err := db.Exec(Schema)
+	return err
+}
+
+// ClientRecord is a row of the clients table
+type ClientRecord struct {
+	ID string
+	// The plaintext secret, which is only stored hashed.
+	// It is empty for public clients and in looked up records.
+	Secret       string
+	Type         goauth2.ClientType
+	RedirectURIs []string
+	Scopes       []string
+	GrantTypes   []string
+}
+
+// This is a struct that implements the ClientStore interface on a clients
+// table, so that several servers can share their client registry
+type SQLClientStore struct {
+	db *sql.DB
+
+	selectClient *sql.Stmt
+	selectSecret *sql.Stmt
+	insertClient *sql.Stmt
+	deleteClient *sql.Stmt
+}
+
+// Create a SQL Client Store on a SQLite or MySQL database holding the
+// clients table
+func NewSQLClientStore(db *sql.DB) (*SQLClientStore, error) {
+	return NewSQLClientStoreWithDialect(db, SQLite)
+}
+
+// Create a SQL Client Store on a database of the given dialect holding the
+// clients table
+func NewSQLClientStoreWithDialect(db *sql.DB, dialect Dialect) (*SQLClientStore, error) {
+	cs := &SQLClientStore{db: db}
+
+	stmts := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&cs.selectClient, "SELECT type, redirect_uris, scopes, grant_types FROM clients WHERE id = ?"},
+		{&cs.selectSecret, "SELECT secret_hash FROM clients WHERE id = ?"},
+		{&cs.insertClient, "INSERT INTO clients (id, secret_hash, type, redirect_uris, scopes, grant_types) VALUES (?, ?, ?, ?, ?, ?)"},
+		{&cs.deleteClient, "DELETE FROM clients WHERE id = ?"},
+	}
+	for _, s := range stmts {
+		stmt, err := db.Prepare(rebind(dialect, s.query))
+		if err != nil {
+			cs.Close()
+			return nil, err
+		}
+		*s.stmt = stmt
+	}
+
+	return cs, nil
+}
+
+// Register a client
+// Its secret, if any, is hashed with bcrypt before it is stored
+func (cs *SQLClientStore) RegisterClient(client ClientRecord) error {
+	return cs.insert(cs.insertClient, client)
+}
+
+// Register a client, or replace a registered one
+func (cs *SQLClientStore) SaveClient(client goauth2.Client, secret string) error {
+	tx, err := cs.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(cs.deleteClient).Exec(client.ID()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := cs.insert(tx.Stmt(cs.insertClient), ClientRecord{
+		ID:           client.ID(),
+		Secret:       secret,
+		Type:         client.Type(),
+		RedirectURIs: client.RedirectURIs(),
+		Scopes:       client.AllowedScopes(),
+		GrantTypes:   client.AllowedGrantTypes(),
+	}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Remove a client
+func (cs *SQLClientStore) RemoveClient(clientID string) error {
+	_, err := cs.deleteClient.Exec(clientID)
+	return err
+}
+
+// Insert a client with the insertClient statement
+func (cs *SQLClientStore) insert(insertClient *sql.Stmt, client ClientRecord) error {
+	var hash []byte
+	if client.Secret != "" {
+		var err error
+		hash, err = bcrypt.GenerateFromPassword([]byte(client.Secret), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+	}
+	if client.Type == "" {
+		client.Type = goauth2.ClientTypePublic
+	}
+
+	var lists [3][]byte
+	for i, list := range [][]string{client.RedirectURIs, client.Scopes, client.GrantTypes} {
+		if list == nil {
+			list = []string{}
+		}
+		b, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		lists[i] = b
+	}
+
+	_, err := insertClient.Exec(client.ID, string(hash), string(client.Type),
+		string(lists[0]), string(lists[1]), string(lists[2]))
+	return err
+}
+
+// Look up a registered client, without its secret
+// Returns ErrClientNotFound if it is not registered
+func (cs *SQLClientStore) Client(clientID string) (*ClientRecord, error) {
+	var ctype, uris, scopes, grants string
+	err := cs.selectClient.QueryRow(clientID).Scan(&ctype, &uris, &scopes, &grants)
+	if err == sql.ErrNoRows {
+		return nil, ErrClientNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	client := &ClientRecord{
+		ID:   clientID,
+		Type: goauth2.ClientType(ctype),
+	}
+	for _, field := range []struct {
+		list *[]string
+		raw  string
+	}{
+		{&client.RedirectURIs, uris},
+		{&client.Scopes, scopes},
+		{&client.GrantTypes, grants},
+	} {
+		if err := json.Unmarshal([]byte(field.raw), field.list); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// Check that a client is registered
+// Database errors are returned, while unknown clients are only invalid
+func (cs *SQLClientStore) ValidClient(clientID string) (bool, error) {
+	if _, err := cs.Client(clientID); err == ErrClientNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Load a registered client with its settings
+func (cs *SQLClientStore) LoadClient(clientID string) (goauth2.Client, error) {
+	record, err := cs.Client(clientID)
+	if err == ErrClientNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &goauth2.ClientImpl{
+		ClientID:           record.ID,
+		ClientType:         record.Type,
+		ClientRedirectURIs: record.RedirectURIs,
+		ClientGrantTypes:   record.GrantTypes,
+		ClientScopes:       record.Scopes,
+	}, nil
+}
+
+// Check a client's secret
+// Returns false for unknown clients and clients without a secret
+func (cs *SQLClientStore) VerifySecret(clientID, secret string) (bool, error) {
+	var hash string
+	err := cs.selectSecret.QueryRow(clientID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if hash == "" {
+		return false, nil
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Release the prepared statements. The database is left open.
+func (cs *SQLClientStore) Close() error {
+	var err error
+	for _, stmt := range []*sql.Stmt{cs.selectClient, cs.selectSecret, cs.insertClient, cs.deleteClient} {
+		if stmt == nil {
+			continue
+		}
+		if e := stmt.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Rewrite the ? placeholders of a query for a dialect
+func rebind(dialect Dialect, query string) string {
+	if dialect != PostgreSQL {
+		return query
+	}
+	parts := strings.Split(query, "?")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = "$" + strconv.Itoa(i) + parts[i]
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,179 @@
+package sql
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/clientstore/storetest"
+	"testing"
+)
+
+// Open an empty in-memory database
+func newEmptyStore(t *testing.T) (*SQLClientStore, *sql.DB) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal("Error opening database", err)
+	}
+	// Each connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+
+	if err := EnsureSchema(db); err != nil {
+		t.Fatal("Error creating clients table", err)
+	}
+	cs, err := NewSQLClientStore(db)
+	if err != nil {
+		t.Fatal("Error creating client store", err)
+	}
+	return cs, db
+}
+
+// Open an in-memory database with a few clients
+func newTestStore(t *testing.T) (*SQLClientStore, *sql.DB) {
+	cs, db := newEmptyStore(t)
+
+	for _, client := range []ClientRecord{
+		{
+			ID:           "client1",
+			RedirectURIs: []string{"http://localhost/redirect"},
+		},
+		{
+			ID:         "client2",
+			Secret:     "s3cret",
+			Type:       goauth2.ClientTypeConfidential,
+			Scopes:     []string{"read", "write"},
+			GrantTypes: []string{"authorization_code"},
+		},
+	} {
+		if err := cs.RegisterClient(client); err != nil {
+			t.Fatal("Error registering client", err)
+		}
+	}
+	return cs, db
+}
+
+func TestValidClient(t *testing.T) {
+	cs, db := newTestStore(t)
+	defer db.Close()
+	defer cs.Close()
+
+	if valid, err := cs.ValidClient("client1"); err != nil || !valid {
+		t.Error("Registered client is not valid", err)
+	}
+	if valid, err := cs.ValidClient("unknown"); err != nil || valid {
+		t.Error("Unknown client is valid", err)
+	}
+}
+
+func TestClientRecord(t *testing.T) {
+	cs, db := newTestStore(t)
+	defer db.Close()
+	defer cs.Close()
+
+	client, err := cs.Client("client2")
+	if err != nil {
+		t.Fatal("Error looking up client", err)
+	}
+	if client.Type != goauth2.ClientTypeConfidential || len(client.Scopes) != 2 ||
+		len(client.GrantTypes) != 1 || len(client.RedirectURIs) != 0 {
+		t.Error("Bad client record", client)
+	}
+	if client.Secret != "" {
+		t.Error("Looked up record contains a secret")
+	}
+
+	if client, err := cs.Client("client1"); err != nil || client.Type != goauth2.ClientTypePublic ||
+		len(client.RedirectURIs) != 1 {
+		t.Error("Bad client record", client, err)
+	}
+	if _, err := cs.Client("unknown"); err != ErrClientNotFound {
+		t.Error("Unknown client was found", err)
+	}
+}
+
+func TestVerifySecret(t *testing.T) {
+	cs, db := newTestStore(t)
+	defer db.Close()
+	defer cs.Close()
+
+	if ok, err := cs.VerifySecret("client2", "s3cret"); err != nil || !ok {
+		t.Error("Correct secret was rejected", err)
+	}
+	if ok, err := cs.VerifySecret("client2", "wrong"); err != nil || ok {
+		t.Error("Wrong secret was accepted", err)
+	}
+	if ok, err := cs.VerifySecret("client1", ""); err != nil || ok {
+		t.Error("Client without a secret was verified", err)
+	}
+	if ok, err := cs.VerifySecret("unknown", "s3cret"); err != nil || ok {
+		t.Error("Unknown client was verified", err)
+	}
+
+	// The secret is not stored in plaintext
+	var hash string
+	db.QueryRow("SELECT secret_hash FROM clients WHERE id = ?", "client2").Scan(&hash)
+	if hash == "" || hash == "s3cret" {
+		t.Error("Secret is not hashed", hash)
+	}
+}
+
+// Database errors are not mistaken for unknown clients
+func TestDatabaseError(t *testing.T) {
+	cs, db := newTestStore(t)
+	defer cs.Close()
+	db.Close()
+
+	if _, err := cs.ValidClient("client1"); err == nil {
+		t.Error("No error with a closed database")
+	}
+
+	store := goauth2.NewStore(authcache.NewBasicAuthCache())
+	store.Clients = cs
+	_, err := store.GetClient("client1")
+	if e, ok := err.(goauth2.ServerError); !ok || e.Code() != goauth2.ErrorCodeServerError {
+		t.Error("Database error is not a server error", err)
+	}
+}
+
+func TestGetClient(t *testing.T) {
+	cs, db := newTestStore(t)
+	defer db.Close()
+	defer cs.Close()
+
+	store := goauth2.NewStore(authcache.NewBasicAuthCache())
+	store.Clients = cs
+
+	client, err := store.GetClient("client2")
+	if err != nil || client.ID() != "client2" {
+		t.Fatal("Error getting registered client", err)
+	}
+	if client.Type() != goauth2.ClientTypeConfidential || len(client.AllowedScopes()) != 2 ||
+		len(client.AllowedGrantTypes()) != 1 {
+		t.Error("Client settings were not loaded", client)
+	}
+	_, err = store.GetClient("unknown")
+	if e, ok := err.(goauth2.ServerError); !ok || e.Code() != goauth2.ErrorCodeUnauthorizedClient {
+		t.Error("Unknown client is not unauthorized", err)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT a FROM b WHERE c = ? AND d = ?"
+	if q := rebind(PostgreSQL, query); q != "SELECT a FROM b WHERE c = $1 AND d = $2" {
+		t.Error("Bad PostgreSQL query", q)
+	}
+	if q := rebind(MySQL, query); q != query {
+		t.Error("Bad MySQL query", q)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunClientStoreTests(t, func() goauth2.WritableClientStore {
+		cs, db := newEmptyStore(t)
+		t.Cleanup(func() {
+			cs.Close()
+			db.Close()
+		})
+		return cs
+	})
+}
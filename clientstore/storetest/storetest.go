@@ -0,0 +1,156 @@
+// Package goauth2/clientstore/storetest checks that a WritableClientStore
+// behaves as the server expects. Implementations run it from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.RunClientStoreTests(t, func() goauth2.WritableClientStore {
+//			return NewMyClientStore()
+//		})
+//	}
+package storetest
+
+import (
+	"github.com/yanatan16/goauth2"
+	"testing"
+)
+
+// Run the conformance tests. newStore must return an empty store, and is
+// called once per test.
+func RunClientStoreTests(t *testing.T, newStore func() goauth2.WritableClientStore) {
+	t.Run("Registration", func(t *testing.T) { testRegistration(t, newStore()) })
+	t.Run("Secrets", func(t *testing.T) { testSecrets(t, newStore()) })
+	t.Run("RedirectURIs", func(t *testing.T) { testRedirectURIs(t, newStore()) })
+	t.Run("Removal", func(t *testing.T) { testRemoval(t, newStore()) })
+}
+
+// A confidential client with a secret and a public one without
+var (
+	confidential = &goauth2.ClientImpl{
+		ClientID:           "confidential-client",
+		ClientType:         goauth2.ClientTypeConfidential,
+		ClientRedirectURIs: []string{"https://app.example.com/cb", "https://app.example.com/cb2"},
+	}
+	confidentialSecret = "s3cret"
+
+	public = goauth2.NewClient("public-client")
+)
+
+func register(t *testing.T, cs goauth2.WritableClientStore) {
+	if err := cs.SaveClient(confidential, confidentialSecret); err != nil {
+		t.Fatalf("SaveClient(%q) failed: %v", confidential.ID(), err)
+	}
+	if err := cs.SaveClient(public, ""); err != nil {
+		t.Fatalf("SaveClient(%q) without a secret failed: %v", public.ID(), err)
+	}
+}
+
+func testRegistration(t *testing.T, cs goauth2.WritableClientStore) {
+	if valid, err := cs.ValidClient(public.ID()); err != nil || valid {
+		t.Errorf("ValidClient(%q) on an empty store = %v, %v; want false, nil",
+			public.ID(), valid, err)
+	}
+
+	register(t, cs)
+
+	for _, id := range []string{confidential.ID(), public.ID()} {
+		if valid, err := cs.ValidClient(id); err != nil || !valid {
+			t.Errorf("ValidClient(%q) of a registered client = %v, %v; want true, nil",
+				id, valid, err)
+		}
+	}
+	if valid, err := cs.ValidClient("unknown"); err != nil || valid {
+		t.Errorf("ValidClient(%q) of an unknown client = %v, %v; want false, nil",
+			"unknown", valid, err)
+	}
+
+	client, err := cs.LoadClient(confidential.ID())
+	if err != nil || client == nil {
+		t.Fatalf("LoadClient(%q) = %v, %v; want the client", confidential.ID(), client, err)
+	}
+	if client.ID() != confidential.ID() || client.Type() != goauth2.ClientTypeConfidential {
+		t.Errorf("LoadClient(%q) returned ID %q and type %q; want %q and %q",
+			confidential.ID(), client.ID(), client.Type(),
+			confidential.ID(), goauth2.ClientTypeConfidential)
+	}
+	if client, err := cs.LoadClient("unknown"); err != nil || client != nil {
+		t.Errorf("LoadClient(%q) of an unknown client = %v, %v; want nil, nil",
+			"unknown", client, err)
+	}
+}
+
+func testSecrets(t *testing.T, cs goauth2.WritableClientStore) {
+	register(t, cs)
+
+	cases := []struct {
+		clientID, secret string
+		want             bool
+	}{
+		{confidential.ID(), confidentialSecret, true},
+		{confidential.ID(), "wrong", false},
+		{confidential.ID(), "", false},
+		{public.ID(), "", false},
+		{"unknown", confidentialSecret, false},
+	}
+	for _, c := range cases {
+		if ok, err := cs.VerifySecret(c.clientID, c.secret); err != nil || ok != c.want {
+			t.Errorf("VerifySecret(%q, %q) = %v, %v; want %v, nil",
+				c.clientID, c.secret, ok, err, c.want)
+		}
+	}
+}
+
+func testRedirectURIs(t *testing.T, cs goauth2.WritableClientStore) {
+	register(t, cs)
+
+	client, err := cs.LoadClient(confidential.ID())
+	if err != nil || client == nil {
+		t.Fatalf("LoadClient(%q) = %v, %v; want the client", confidential.ID(), client, err)
+	}
+	uris := client.RedirectURIs()
+	want := confidential.RedirectURIs()
+	if len(uris) != len(want) {
+		t.Fatalf("RedirectURIs() = %q; want %q", uris, want)
+	}
+	for i := range want {
+		if uris[i] != want[i] {
+			t.Errorf("RedirectURIs() = %q; want %q", uris, want)
+			break
+		}
+	}
+
+	if client, err := cs.LoadClient(public.ID()); err != nil || client == nil {
+		t.Fatalf("LoadClient(%q) = %v, %v; want the client", public.ID(), client, err)
+	} else if len(client.RedirectURIs()) != 0 {
+		t.Errorf("RedirectURIs() of a client without any = %q; want none",
+			client.RedirectURIs())
+	}
+}
+
+func testRemoval(t *testing.T, cs goauth2.WritableClientStore) {
+	register(t, cs)
+
+	if err := cs.RemoveClient(confidential.ID()); err != nil {
+		t.Fatalf("RemoveClient(%q) failed: %v", confidential.ID(), err)
+	}
+	if valid, err := cs.ValidClient(confidential.ID()); err != nil || valid {
+		t.Errorf("ValidClient(%q) of a removed client = %v, %v; want false, nil",
+			confidential.ID(), valid, err)
+	}
+	if client, err := cs.LoadClient(confidential.ID()); err != nil || client != nil {
+		t.Errorf("LoadClient(%q) of a removed client = %v, %v; want nil, nil",
+			confidential.ID(), client, err)
+	}
+	if ok, err := cs.VerifySecret(confidential.ID(), confidentialSecret); err != nil || ok {
+		t.Errorf("VerifySecret(%q) of a removed client = %v, %v; want false, nil",
+			confidential.ID(), ok, err)
+	}
+
+	// Other clients are not affected
+	if valid, err := cs.ValidClient(public.ID()); err != nil || !valid {
+		t.Errorf("ValidClient(%q) after removing another client = %v, %v; want true, nil",
+			public.ID(), valid, err)
+	}
+
+	if err := cs.RemoveClient("unknown"); err != nil {
+		t.Errorf("RemoveClient(%q) of an unknown client failed: %v", "unknown", err)
+	}
+}
@@ -0,0 +1,18 @@
+package goauth2
+
+import "time"
+
+// Clock tells the time to expiry-aware code, so that tests can control it
+type Clock interface {
+	Now() time.Time
+	// Send the time on the returned channel once d has elapsed
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the Clock of the time package
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,274 @@
+package goauth2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// CacheFactory builds an AuthCache from the options of a Config
+type CacheFactory func(options map[string]string) (AuthCache, error)
+
+// ClientStoreFactory builds a ClientStore from the options of a Config
+type ClientStoreFactory func(options map[string]string) (ClientStore, error)
+
+// The backends known to NewServerFromConfig, by name. The packages of the
+// backends register them when they are imported, since this package can't
+// import them.
+var (
+	backendsMu          sync.RWMutex
+	cacheBackends       = make(map[string]CacheFactory)
+	clientStoreBackends = make(map[string]ClientStoreFactory)
+)
+
+// RegisterCacheBackend adds or replaces the AuthCache backend of a name,
+// such as "memory" for the BasicAuthCache of package authcache
+func RegisterCacheBackend(name string, factory CacheFactory) {
+	backendsMu.Lock()
+	cacheBackends[name] = factory
+	backendsMu.Unlock()
+}
+
+// RegisterClientStoreBackend adds or replaces the ClientStore backend of a
+// name, such as "memory" for the BasicClientStore of package clientstore
+func RegisterClientStoreBackend(name string, factory ClientStoreFactory) {
+	backendsMu.Lock()
+	clientStoreBackends[name] = factory
+	backendsMu.Unlock()
+}
+
+// Config describes a Server built by NewServerFromConfig. It can be
+// decoded from JSON by LoadConfig, except for the AuthHandler.
+type Config struct {
+	// The backend of the codes and tokens. Required.
+	Cache BackendConfig `json:"cache"`
+	// The backend of the clients. Any client is accepted if it has no
+	// Backend.
+	Clients BackendConfig `json:"clients"`
+	// Clients saved in the client store when the Server is built, which
+	// must then be a WritableClientStore
+	RegisteredClients []ClientConfig `json:"registered_clients"`
+	// The grant types of the token endpoint, and of the registered clients
+	// that don't list theirs. Every built-in grant type is allowed if it is
+	// empty.
+	GrantTypes []string `json:"grant_types"`
+	// The lifetimes of the codes and tokens in seconds, the cache's if 0
+	CodeExpiry  int64 `json:"code_expiry"`
+	TokenExpiry int64 `json:"token_expiry"`
+	// The URIs of the error codes, as RegisterErrorURI
+	ErrorURIs map[string]string `json:"error_uris"`
+	// The Realm and Issuer of the Server
+	Realm  string `json:"realm"`
+	Issuer string `json:"issuer"`
+	// The status of the redirects to clients, as WithRedirectStatusCode,
+	// 302 if 0
+	RedirectStatusCode int `json:"redirect_status_code"`
+
+	// The AuthHandler of the Server. Required.
+	Auth AuthHandler `json:"-"`
+}
+
+// BackendConfig names a registered backend, and gives it its options
+type BackendConfig struct {
+	Backend string            `json:"backend"`
+	Options map[string]string `json:"options"`
+}
+
+// ClientConfig describes a client registered by NewServerFromConfig
+type ClientConfig struct {
+	ID string `json:"id"`
+	// The secret of confidential clients
+	Secret       string     `json:"secret"`
+	Type         ClientType `json:"type"`
+	RedirectURIs []string   `json:"redirect_uris"`
+	GrantTypes   []string   `json:"grant_types"`
+	Scopes       []string   `json:"scopes"`
+	// The lifetime of the client's tokens in seconds, the cache's if 0
+	TokenTTL int64 `json:"token_ttl"`
+	// The maximum length of the client's sessions in seconds, unlimited if 0
+	MaxSession int64 `json:"max_session"`
+}
+
+// CodeExpirySetter is implemented by an AuthCache whose lifetime of
+// authorization codes can be set, which a Config's CodeExpiry needs
+type CodeExpirySetter interface {
+	// Set the lifetime of the codes registered from now on, in seconds
+	SetCodeExpiry(secs int64)
+}
+
+// LoadConfig decodes a JSON Config. Unknown fields are errors, so that
+// misspelled settings aren't ignored.
+func LoadConfig(r io.Reader) (*Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %s", err)
+	}
+	return &cfg, nil
+}
+
+// NewServerFromConfig
+// Create a new OAuth 2.0 Server from a Config, with its backends built by
+// the factories registered under their names. The Config is checked before
+// anything is built, and unsupported combinations give an error. Use
+// NewServer or NewServerOptions for setups a Config can't describe.
+func NewServerFromConfig(cfg Config) (*Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	backendsMu.RLock()
+	newCache := cacheBackends[cfg.Cache.Backend]
+	newClients := clientStoreBackends[cfg.Clients.Backend]
+	backendsMu.RUnlock()
+
+	cache, err := newCache(cfg.Cache.Options)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating the %q cache: %s", cfg.Cache.Backend, err)
+	}
+	if cfg.CodeExpiry > 0 {
+		setter, ok := cache.(CodeExpirySetter)
+		if !ok {
+			return nil, fmt.Errorf("The %q cache can't set the code lifetime", cfg.Cache.Backend)
+		}
+		setter.SetCodeExpiry(cfg.CodeExpiry)
+	}
+
+	opts := []Option{
+		WithAuthCache(cache),
+		WithAuthHandler(cfg.Auth),
+		WithRealm(cfg.Realm),
+	}
+	if cfg.TokenExpiry > 0 {
+		if _, ok := cache.(TokenExpirySetter); !ok {
+			return nil, fmt.Errorf("The %q cache can't set the token lifetime", cfg.Cache.Backend)
+		}
+		opts = append(opts, WithTokenTTL(time.Duration(cfg.TokenExpiry)*time.Second))
+	}
+	for code, uri := range cfg.ErrorURIs {
+		opts = append(opts, WithErrorURI(errorCode(code), uri))
+	}
+	if cfg.RedirectStatusCode != 0 {
+		opts = append(opts, WithRedirectStatusCode(cfg.RedirectStatusCode))
+	}
+
+	if newClients != nil {
+		clients, err := newClients(cfg.Clients.Options)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating the %q client store: %s", cfg.Clients.Backend, err)
+		}
+		if err := cfg.registerClients(clients); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithClientStore(clients))
+	}
+
+	s, err := NewServerOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.Issuer = cfg.Issuer
+	if len(cfg.GrantTypes) > 0 {
+		for name := range s.grants {
+			if !allowed(cfg.GrantTypes, name) {
+				delete(s.grants, name)
+			}
+		}
+	}
+	return s, nil
+}
+
+// Check a Config without building anything
+func (cfg *Config) validate() error {
+	backendsMu.RLock()
+	_, knownCache := cacheBackends[cfg.Cache.Backend]
+	_, knownClients := clientStoreBackends[cfg.Clients.Backend]
+	backendsMu.RUnlock()
+
+	switch {
+	case cfg.Auth == nil:
+		return errors.New("An AuthHandler is required")
+	case cfg.Cache.Backend == "":
+		return errors.New("A cache backend is required")
+	case !knownCache:
+		return fmt.Errorf("Unknown cache backend %q: is its package imported?", cfg.Cache.Backend)
+	case cfg.Clients.Backend != "" && !knownClients:
+		return fmt.Errorf("Unknown client store backend %q: is its package imported?", cfg.Clients.Backend)
+	case cfg.Clients.Backend == "" && len(cfg.RegisteredClients) > 0:
+		return errors.New("Registered clients require a client store backend")
+	case cfg.CodeExpiry < 0 || cfg.TokenExpiry < 0:
+		return errors.New("The code and token lifetimes can't be negative")
+	}
+
+	for _, grantType := range cfg.GrantTypes {
+		switch grantType {
+		case GrantTypeAuthorizationCode, GrantTypeTokenExchange, GrantTypeImplicit:
+		default:
+			return fmt.Errorf("Unsupported grant type %q: register its handler on the Server instead", grantType)
+		}
+	}
+	for code, uri := range cfg.ErrorURIs {
+		if u, err := url.Parse(uri); err != nil || !u.IsAbs() {
+			return fmt.Errorf("The URI of the error %q is not an absolute URI: %q", code, uri)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range cfg.RegisteredClients {
+		switch {
+		case c.ID == "":
+			return errors.New("A registered client has no ID")
+		case seen[c.ID]:
+			return fmt.Errorf("The client %q is registered twice", c.ID)
+		case c.Type != "" && c.Type != ClientTypePublic && c.Type != ClientTypeConfidential:
+			return fmt.Errorf("The client %q has an unknown type %q", c.ID, c.Type)
+		case c.Type == ClientTypeConfidential && c.Secret == "":
+			return fmt.Errorf("The confidential client %q has no secret", c.ID)
+		case c.Type != ClientTypeConfidential && c.Secret != "":
+			return fmt.Errorf("The public client %q can't have a secret", c.ID)
+		case c.TokenTTL < 0:
+			return fmt.Errorf("The token lifetime of the client %q is negative", c.ID)
+		case c.MaxSession < 0:
+			return fmt.Errorf("The session length of the client %q is negative", c.ID)
+		}
+		seen[c.ID] = true
+	}
+	return nil
+}
+
+// Save the registered clients of a Config in a client store
+func (cfg *Config) registerClients(clients ClientStore) error {
+	if len(cfg.RegisteredClients) == 0 {
+		return nil
+	}
+	w, ok := clients.(WritableClientStore)
+	if !ok {
+		return fmt.Errorf("The %q client store can't register clients", cfg.Clients.Backend)
+	}
+	for _, c := range cfg.RegisteredClients {
+		client := &ClientImpl{
+			ClientID:           c.ID,
+			ClientType:         c.Type,
+			ClientRedirectURIs: c.RedirectURIs,
+			ClientGrantTypes:   c.GrantTypes,
+			ClientScopes:       c.Scopes,
+			ClientTokenTTL:     time.Duration(c.TokenTTL) * time.Second,
+			ClientMaxSession:   time.Duration(c.MaxSession) * time.Second,
+		}
+		if client.ClientType == "" {
+			client.ClientType = ClientTypePublic
+		}
+		if client.ClientGrantTypes == nil {
+			client.ClientGrantTypes = cfg.GrantTypes
+		}
+		if err := w.SaveClient(client, c.Secret); err != nil {
+			return fmt.Errorf("Error registering the client %q: %s", c.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package goauth2
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig says which browser origins may call the server's endpoints,
+// for single-page apps using the token endpoint or a protected API.
+type CORSConfig struct {
+	// Origins allowed to make requests, such as "https://app.example.com",
+	// or "*" for any origin
+	AllowedOrigins []string
+	// Request headers browsers may send. Authorization and Content-Type if
+	// empty.
+	AllowedHeaders []string
+	// How long browsers may cache the answer to a preflight request. It is
+	// not sent if zero.
+	MaxAge time.Duration
+}
+
+// Headers allowed when the configuration doesn't list any
+var defaultCORSHeaders = []string{"Authorization", "Content-Type"}
+
+// Whether requests from an origin are allowed
+func (c *CORSConfig) allows(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether every origin is allowed
+func (c *CORSConfig) wildcard() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Decorate a handler with the Server's CORS configuration, if any.
+// Preflight requests from allowed origins are answered directly, and the
+// other requests from allowed origins get an Access-Control-Allow-Origin
+// header. Requests from other origins are processed without CORS headers.
+func (s *Server) withCORS(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.CORS
+		origin := r.Header.Get("Origin")
+		if c == nil || origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if !c.wildcard() {
+			w.Header().Add("Vary", "Origin")
+		}
+		if !c.allows(origin) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if c.wildcard() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		// Preflight request
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			headers := c.AllowedHeaders
+			if len(headers) == 0 {
+				headers = defaultCORSHeaders
+			}
+			setQueryPairs(w.Header(),
+				"Access-Control-Allow-Methods", "GET, POST, OPTIONS",
+				"Access-Control-Allow-Headers", strings.Join(headers, ", "),
+			)
+			if c.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age",
+					strconv.FormatInt(int64(c.MaxAge/time.Second), 10))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
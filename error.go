@@ -1,11 +1,25 @@
 package goauth2
 
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
 type errorCode string
 
+// ErrorCode names the type of the error codes outside of the package, such
+// as in the function given to Server.SetDefaultErrorURIFunc
+type ErrorCode = errorCode
+
 const (
 	// Error codes returned by the server, following the OAuth specification.
 	ErrorCodeAccessDenied            errorCode = "access_denied"
 	ErrorCodeInvalidRequest          errorCode = "invalid_request"
+	ErrorCodeInvalidClient           errorCode = "invalid_client"
+	ErrorCodeInvalidGrant            errorCode = "invalid_grant"
 	ErrorCodeInvalidScope            errorCode = "invalid_scope"
 	ErrorCodeServerError             errorCode = "server_error"
 	ErrorCodeTemporarilyUnavailable  errorCode = "temporarily_unavailable"
@@ -14,11 +28,54 @@ const (
 	ErrorCodeUnsupportedGrantType    errorCode = "unsupported_grant_type"
 	ErrorCodeInvalidToken            errorCode = "invalid_token"
 	ErrorCodeBadRedirectURI          errorCode = "bad_redirect_uri" //FIXME
+	// Error code of OpenID Connect when prompt=none can't be honored
+	ErrorCodeInteractionRequired errorCode = "interaction_required"
+	// Error code of resource indicators for an unacceptable resource
+	ErrorCodeInvalidTarget errorCode = "invalid_target"
 )
 
+// Sentinel errors for each error code. A ServerError matches the one of its
+// code with errors.Is, whatever its description.
+var (
+	ErrAccessDenied            error = ServerError{code: ErrorCodeAccessDenied}
+	ErrInvalidRequest          error = ServerError{code: ErrorCodeInvalidRequest}
+	ErrInvalidClient           error = ServerError{code: ErrorCodeInvalidClient}
+	ErrInvalidGrant            error = ServerError{code: ErrorCodeInvalidGrant}
+	ErrInvalidScope            error = ServerError{code: ErrorCodeInvalidScope}
+	ErrServerError             error = ServerError{code: ErrorCodeServerError}
+	ErrTemporarilyUnavailable  error = ServerError{code: ErrorCodeTemporarilyUnavailable}
+	ErrUnauthorizedClient      error = ServerError{code: ErrorCodeUnauthorizedClient}
+	ErrUnsupportedResponseType error = ServerError{code: ErrorCodeUnsupportedResponseType}
+	ErrUnsupportedGrantType    error = ServerError{code: ErrorCodeUnsupportedGrantType}
+	ErrInvalidToken            error = ServerError{code: ErrorCodeInvalidToken}
+	ErrBadRedirectURI          error = ServerError{code: ErrorCodeBadRedirectURI}
+	ErrInteractionRequired     error = ServerError{code: ErrorCodeInteractionRequired}
+	ErrInvalidTarget           error = ServerError{code: ErrorCodeInvalidTarget}
+)
+
+// ErrBackendUnavailable is returned (possibly wrapped) by an AuthCache when
+// its backend cannot be reached. The server reports it as
+// temporarily_unavailable instead of treating tokens as invalid.
+var ErrBackendUnavailable = errors.New("Token backend unavailable")
+
+// ErrCodeNotFound and ErrCodeExpired are returned (possibly wrapped) by an
+// AuthCache looking up an authorization code that was never issued, or that
+// expired. Caches that can't tell them apart return ErrCodeNotFound.
+var (
+	ErrCodeNotFound = errors.New("AuthCode not found in Cache!")
+	ErrCodeExpired  = errors.New("AuthCode expired")
+)
+
+// ErrNotSupported is returned by a Store when its backend does not support
+// an optional operation
+var ErrNotSupported = errors.New("Operation not supported by the backend")
+
+// Longest error description sent to clients, in bytes
+const maxErrorDescription = 256
+
 // NewServerError [...]
 func NewServerError(code errorCode, description, uri string) ServerError {
-	return ServerError{code, description, uri}
+	return ServerError{code: code, description: description, uri: uri}
 }
 
 // ServerError [...]
@@ -26,6 +83,10 @@ type ServerError struct {
 	code        errorCode
 	description string
 	uri         string
+	// The error that caused this one, if any
+	cause error
+	// How long the client should wait before retrying, if known
+	retryAfter time.Duration
 }
 
 // Error [...]
@@ -47,3 +108,73 @@ func (e ServerError) Description() string {
 func (e ServerError) URI() string {
 	return e.uri
 }
+
+// WithCause returns a copy of the error wrapping the error that caused it
+func (e ServerError) WithCause(cause error) ServerError {
+	e.cause = cause
+	return e
+}
+
+// WithRetryAfter returns a copy of the error advising the client to wait
+// before retrying, for temporarily_unavailable errors. The hint is sent in a
+// Retry-After header.
+func (e ServerError) WithRetryAfter(d time.Duration) ServerError {
+	e.retryAfter = d
+	return e
+}
+
+// RetryAfter returns how long the client should wait before retrying, or
+// zero if there is no hint
+func (e ServerError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// Unwrap returns the error that caused this one, if any
+func (e ServerError) Unwrap() error {
+	return e.cause
+}
+
+// Is reports whether target is a ServerError with the same code, such as
+// the sentinel errors
+func (e ServerError) Is(target error) bool {
+	t, ok := target.(ServerError)
+	return ok && t.code == e.code
+}
+
+// ----------------------------------------------------------------------------
+
+// The parameters of an error response, for both redirects and JSON bodies.
+// Descriptions may carry request input, such as a malformed redirection URI,
+// so they are sanitized, and the error URI is the one the server registered
+// for the code rather than any URI carried by the error. s may be nil.
+func (s *Server) errorResponse(e ServerError) map[string]string {
+	res := make(map[string]string)
+	res["error"] = string(e.Code())
+	res["error_description"] = sanitizeDescription(e.Description())
+	res["error_uri"] = ""
+	if s != nil {
+		res["error_uri"] = s.errorURI(e.Code())
+	}
+	return res
+}
+
+// Replace the control characters of a description, including newlines,
+// with spaces, and cut it to maxErrorDescription bytes
+func sanitizeDescription(description string) string {
+	description = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return ' '
+		}
+		return r
+	}, description)
+	description = strings.TrimSpace(description)
+
+	if len(description) > maxErrorDescription {
+		cut := maxErrorDescription - len("...")
+		for cut > 0 && !utf8.RuneStart(description[cut]) {
+			cut--
+		}
+		description = description[:cut] + "..."
+	}
+	return description
+}
@@ -0,0 +1,87 @@
+package goauth2
+
+import (
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The page of DefaultErrorPageRenderer
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Authorization Error</title></head>
+<body>
+<h1>The authorization request can't be completed</h1>
+<p>{{if .Description}}{{.Description}}{{else}}The request is invalid.{{end}}</p>
+<p>Error: <code>{{.Code}}</code>{{if .URI}} (<a href="{{.URI}}">more information</a>){{end}}</p>
+</body>
+</html>
+`))
+
+// DefaultErrorPageRenderer writes a minimal HTML page of an authorization
+// error, with its sanitized description and the registered error URI
+func (s *Server) DefaultErrorPageRenderer(w http.ResponseWriter, r *http.Request, e ServerError) {
+	setQueryPairs(w.Header(),
+		"Content-Type", "text/html; charset=utf-8",
+		"Cache-Control", "no-store",
+		"Pragma", "no-cache",
+	)
+	w.WriteHeader(errorStatus(e))
+	res := s.errorResponse(e)
+	err := errorPageTemplate.Execute(w, struct {
+		Code, Description, URI string
+	}{res["error"], res["error_description"], res["error_uri"]})
+	if err != nil {
+		s.logger().Println("OAuth Handler: Error writing error page!", err)
+	}
+}
+
+// Write an authorization error that wasn't redirected, as a page for
+// browsers and as JSON for other clients
+func (s *Server) writeAuthorizeError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == nil {
+		return
+	} else if !prefersHTML(r) {
+		s.writeError(w, err)
+		return
+	}
+
+	render := s.ErrorPageRenderer
+	if render == nil {
+		render = s.DefaultErrorPageRenderer
+	}
+	render(w, r, s.InterpretError(err))
+}
+
+// Whether the Accept header of a request prefers text/html to JSON. Ties,
+// such as */*, go to JSON.
+func prefersHTML(r *http.Request) bool {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		qualities[mediaType] = q
+	}
+
+	// The quality of a media type is the one of its most specific range
+	quality := func(mediaType string) float64 {
+		ranges := []string{mediaType, strings.SplitN(mediaType, "/", 2)[0] + "/*", "*/*"}
+		for _, m := range ranges {
+			if q, ok := qualities[m]; ok {
+				return q
+			}
+		}
+		return 0
+	}
+	return quality("text/html") > quality("application/json")
+}
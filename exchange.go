@@ -0,0 +1,169 @@
+package goauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// The token type of access tokens in token exchange
+// http://tools.ietf.org/html/rfc8693#section-3
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// TokenExchangePolicy decides whether a client may act for the subject of
+// a token. scope is the requested scope, or the scope of the subject token
+// if none was requested. Return the scope of the new token, which may not
+// exceed the scope of the subject token, or an error to deny the exchange.
+type TokenExchangePolicy func(client Client, subject *TokenInfo, scope string) (string, error)
+
+// TokenIssuer is implemented by a Store that can issue an access token
+// without a grant, such as for token exchange
+type TokenIssuer interface {
+	IssueAccessToken(info TokenInfo) (token, token_type string, expiry int64, err error)
+}
+
+// The token exchange grant, exchanging the subject token of a request for
+// a token of the requesting client after the TokenExchangePolicy allowed it
+// http://tools.ietf.org/html/rfc8693#section-2
+func (s *Server) exchangeToken(ctx context.Context, req *AccessTokenRequest, info ClientInfo) (*AccessTokenResponse, error) {
+	issuer, ok := s.Store.(TokenIssuer)
+	if s.TokenExchangePolicy == nil || !ok {
+		return nil, s.NewError(ErrorCodeUnsupportedGrantType,
+			"Token exchange is not supported.")
+	}
+
+	var err error
+	switch {
+	case req.SubjectToken == "":
+		err = s.NewError(ErrorCodeInvalidRequest,
+			"The \"subject_token\" parameter is missing.")
+	case req.SubjectTokenType != TokenTypeAccessToken:
+		err = s.NewError(ErrorCodeInvalidRequest,
+			fmt.Sprintf("The subject token type %q is not supported.", req.SubjectTokenType))
+	case req.RequestedTokenType != "" && req.RequestedTokenType != TokenTypeAccessToken:
+		err = s.NewError(ErrorCodeInvalidRequest,
+			fmt.Sprintf("The requested token type %q is not supported.", req.RequestedTokenType))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.tokenClient(info)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := s.Store.ValidateAccessTokenInfo(req.SubjectToken)
+	if err != nil && !errors.Is(err, ErrInvalidToken) {
+		return nil, s.InterpretError(err)
+	} else if subject == nil {
+		return nil, s.NewError(ErrorCodeInvalidGrant,
+			"The subject token is invalid.")
+	}
+
+	scope := subject.Scope
+	if req.Scope != "" {
+		scope = req.Scope
+	}
+	if err = checkClientGrant(client, GrantTypeTokenExchange, scope); err != nil {
+		return nil, s.InterpretError(err)
+	}
+	if !subsetScope(scope, subject.Scope) {
+		return nil, s.NewError(ErrorCodeInvalidScope,
+			"The requested scope exceeds the scope of the subject token.")
+	}
+	if scope, err = s.TokenExchangePolicy(client, subject, scope); err != nil {
+		var e ServerError
+		if errors.As(err, &e) {
+			return nil, s.InterpretError(err)
+		}
+		return nil, s.NewError(ErrorCodeInvalidGrant, err.Error()).WithCause(err)
+	} else if !subsetScope(scope, subject.Scope) {
+		return nil, s.NewError(ErrorCodeInvalidScope,
+			"The scope exceeds the scope of the subject token.")
+	}
+
+	delegation := subject.Delegation
+	if delegation == "" {
+		delegation = subject.ClientID
+	}
+	audience := subject.Audience
+	if req.Resource != "" {
+		audience = req.Resource
+	}
+	// The new token belongs to the session of the subject token
+	authTime := subject.AuthTime
+	if authTime.IsZero() {
+		authTime = subject.IssuedAt
+	}
+	token, token_type, expiry, err := issuer.IssueAccessToken(TokenInfo{
+		ClientID:   client.ID(),
+		Scope:      uniqueScope(scope),
+		Audience:   audience,
+		UserID:     subject.UserID,
+		AuthTime:   authTime,
+		Delegation: delegation + " " + client.ID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &AccessTokenResponse{
+		Token:     token,
+		TokenType: token_type,
+		Expiry:    expiry,
+		Scope:     uniqueScope(scope),
+		Extra:     map[string]string{"issued_token_type": TokenTypeAccessToken},
+	}, nil
+}
+
+// The client making a token request, once its credentials are checked
+// Returns an invalid_client error if the Store can't check them.
+func (s *Server) tokenClient(info ClientInfo) (Client, error) {
+	if info.ID == "" {
+		return nil, s.NewError(ErrorCodeInvalidClient,
+			"The client is not authenticated.")
+	}
+
+	var client Client
+	var err error
+	if info.Authenticated {
+		client, err = s.Store.GetClient(info.ID)
+	} else if a, ok := s.Store.(ClientAuthenticator); ok {
+		client, err = a.AuthenticateClient(info.ID, info.Secret)
+	} else {
+		return nil, s.NewError(ErrorCodeInvalidClient,
+			"The client can't be authenticated.")
+	}
+	if err != nil {
+		return nil, s.InterpretError(err)
+	}
+	return client, nil
+}
+
+// Issue an access token with the given information
+func (s *StoreImpl) IssueAccessToken(info TokenInfo) (token, token_type string, expiry int64, err error) {
+	client, err := s.GetClient(info.ClientID)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	// The token continues the session of info.AuthTime, or starts one
+	info.IssuedAt = s.now()
+	if info.AuthTime.IsZero() {
+		info.AuthTime = info.IssuedAt
+	}
+	lifetime, err := s.tokenLifetime(client, info.AuthTime)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	if err = s.enforceTokenLimit(client); err != nil {
+		return "", "", 0, err
+	}
+
+	token = s.randomString()
+	ttype, exp, err := s.registerAccessToken(token, info, lifetime)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return s.issuedToken(token), ttype, exp, nil
+}
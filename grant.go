@@ -0,0 +1,81 @@
+package goauth2
+
+import (
+	"context"
+	"net/http"
+	"sort"
+)
+
+// GrantHandler issues an access token for a token request of one grant
+// type. Return a ServerError to refuse the request.
+type GrantHandler func(ctx context.Context, req *AccessTokenRequest, client ClientInfo) (*AccessTokenResponse, error)
+
+// ClientInfo holds the credentials a client gave in a token request, from
+// its Basic authentication or the client_id and client_secret parameters.
+// They are not checked: grant handlers authenticate the client if they need
+// to.
+type ClientInfo struct {
+	ID, Secret string
+	// The client was already authenticated by a client assertion
+	Authenticated bool
+}
+
+// AccessTokenResponse is a successful response of the token endpoint
+// http://tools.ietf.org/html/rfc6749#section-5.1
+type AccessTokenResponse struct {
+	Token, TokenType string
+	// In seconds, or 0 if the token doesn't expire
+	Expiry int64
+	// The scope of the token, if it differs from the requested one
+	Scope string
+	// Other parameters of the response, such as "issued_token_type"
+	Extra map[string]string
+}
+
+// RegisterGrantType adds or replaces the handler of a grant type of the
+// token endpoint. The authorization_code and token exchange grants are
+// registered by NewServer.
+func (s *Server) RegisterGrantType(name string, handler GrantHandler) {
+	if s.grants == nil {
+		s.grants = make(map[string]GrantHandler)
+	}
+	s.grants[name] = handler
+}
+
+// The grant types with a handler, other than the built-in ones, in order
+func (s *Server) extensionGrantTypes() []string {
+	var names []string
+	for name := range s.grants {
+		if name != GrantTypeAuthorizationCode && name != GrantTypeTokenExchange {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The credentials of the client of a token request
+func requestClientInfo(r *http.Request) ClientInfo {
+	if id, secret, ok := r.BasicAuth(); ok {
+		return ClientInfo{ID: id, Secret: secret}
+	}
+	return ClientInfo{ID: r.FormValue("client_id"), Secret: r.FormValue("client_secret")}
+}
+
+// The authorization_code grant, exchanging authorization codes
+// http://tools.ietf.org/html/rfc6749#section-4.1.3
+func (s *Server) authorizationCodeGrant(ctx context.Context, req *AccessTokenRequest, client ClientInfo) (*AccessTokenResponse, error) {
+	if req.Code == "" {
+		return nil, s.NewError(ErrorCodeInvalidRequest,
+			"The \"code\" parameter is missing.")
+	}
+	if client.Authenticated {
+		req.ClientID = client.ID
+	}
+	token, token_type, expiry, err := s.Store.CreateAccessToken(req)
+	if err != nil {
+		return nil, err
+	}
+	// The scope is only sent when it was narrowed
+	return &AccessTokenResponse{Token: token, TokenType: token_type, Expiry: expiry, Scope: req.Scope}, nil
+}
@@ -3,58 +3,187 @@ package goauth2
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
 )
 
 // ----------------------------------------------------------------------------
 
 // MasterHandler
 // Differentiate between an OAuth request (implicit, auth codes) and an
-// Access Token request
+// Access Token request, for servers with a single endpoint. AuthorizeHandler
+// and TokenHandler serve them on separate paths.
 func (s *Server) MasterHandler() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return s.withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		s.masterHandlerImpl(w, r)
-	})
+	}))
+}
+
+// Handler
+// Mount the standard endpoints on a ServeMux under prefix, such as "/oauth2":
+// the authorization endpoint at /authorize, the token endpoint at /token,
+// the pushed authorization request endpoint at /par and the metadata at
+// /.well-known/oauth-authorization-server. Unless the Server's Endpoints
+// are set, the metadata advertises these paths.
+func (s *Server) Handler(prefix string) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	mounted := Endpoints{
+		Authorization:       prefix + "/authorize",
+		Token:               prefix + "/token",
+		PushedAuthorization: prefix + "/par",
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(mounted.Authorization, s.AuthorizeHandler())
+	mux.Handle(mounted.Token, s.TokenHandler())
+	mux.Handle(mounted.PushedAuthorization, s.PARHandler())
+	mux.Handle(prefix+"/.well-known/oauth-authorization-server", s.metadataHandler(mounted))
+	return mux
+}
+
+// AuthorizeHandler
+// The authorization endpoint, serving the Authorization Code and Implicit
+// Grant flows
+func (s *Server) AuthorizeHandler() http.Handler {
+	return s.withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.writeAuthorizeError(w, r, s.HandleOAuthRequest(w, r))
+	}))
+}
+
+// TokenHandler
+// The token endpoint, exchanging authorization codes for access tokens
+func (s *Server) TokenHandler() http.Handler {
+	return s.withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.writeError(w, s.HandleAccessTokenRequest(w, r))
+	}))
 }
 
 // Implementation of MasterHandler
 func (s *Server) masterHandlerImpl(w http.ResponseWriter, r *http.Request) {
-	v := r.URL.Query()
+	v := requestParams(r)
 	response_type := v.Get("response_type")
-	var err error
-	if response_type != "" {
-		err = s.HandleOAuthRequest(w, r)
+	if response_type != "" || v.Get("request_uri") != "" {
+		s.writeAuthorizeError(w, r, s.HandleOAuthRequest(w, r))
 	} else {
-		err = s.HandleAccessTokenRequest(w, r)
+		s.writeError(w, s.HandleAccessTokenRequest(w, r))
 	}
+}
 
-	// Return something if there was an error
-	if err != nil {
-		// Encode error as json
-		e := s.InterpretError(err)
-		res := make(map[string]string)
-
-		res["error"] = string(e.Code())
-		res["error_description"] = e.Description()
-		res["error_uri"] = e.URI()
+// Check that a request uses one of the methods of an endpoint. Otherwise,
+// a 405 response with an Allow header is written and false is returned.
+// OPTIONS requests only get this far if no CORS configuration answered them.
+func (s *Server) allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, s.errorResponse(s.NewError(ErrorCodeInvalidRequest,
+		fmt.Sprintf("The %s method is not allowed.", r.Method))))
+	return false
+}
 
-		setQueryPairs(w.Header(),
-			"Content-Type", "application/json",
-			"Cache-Control", "no-store",
-			"Pragma", "no-cache",
-		)
-		encoder := json.NewEncoder(w)
-		encoder.Encode(res)
+// Write an error that wasn't redirected as JSON, if there is one
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	if err == nil {
+		return
 	}
+
+	// Encode error as json
+	res := s.errorResponse(s.InterpretError(err))
+
+	setQueryPairs(w.Header(),
+		"Content-Type", "application/json",
+		"Cache-Control", "no-store",
+		"Pragma", "no-cache",
+	)
+	encoder := json.NewEncoder(w)
+	encoder.Encode(res)
 }
 
 // HandleOAuthRequest [...]
 func (s *Server) HandleOAuthRequest(w http.ResponseWriter, r *http.Request) error {
-	// 1. Get all request values.
+	if t, err := s.tenantServer(r); err != nil {
+		return err
+	} else if t != s {
+		return t.HandleOAuthRequest(w, r)
+	}
+
+	// 1. Get all request values, from a pushed request if there is a
+	// request URI.
+	if !s.allowMethod(w, r, "GET", "POST") {
+		return nil
+	}
 	req := s.NewOAuthRequest(r)
+	if uri := requestParams(r).Get("request_uri"); uri != "" {
+		var err error
+		if req, err = s.pushedOAuthRequest(r, uri); err != nil {
+			// The redirection URI can't be trusted: don't redirect.
+			s.logNoRedirect(requestParams(r).Get("client_id"), "", err)
+			return err
+		}
+	}
+
+	// 2-3. Validate required parameters, load client and validate the
+	// redirection URI.
+	client, err := s.validateOAuthRequest(req)
 
-	// 2. Validate required parameters.
+	// 4. If no valid redirection URI was set, abort.
+	if req.RedirectURI == nil {
+		// An error occurred because client_id or redirect_uri are invalid:
+		// the caller must display an error page and don't redirect.
+		s.logNoRedirect(req.ClientID, req.redirectURI_raw, err)
+		return err
+	}
+
+	// 5. Check the state, if it is required, the response mode, the scope,
+	// and that the client may use the response type and scope.
+	if s.RequireState && req.State == "" {
+		err = s.NewError(ErrorCodeInvalidRequest,
+			"The \"state\" parameter is missing.")
+	} else if e := req.checkResponseMode(); e != nil {
+		err = s.InterpretError(e)
+	} else if e := req.checkScope(); e != nil {
+		err = s.InterpretError(e)
+	} else if e := req.checkClientGrant(client); e != nil {
+		err = s.InterpretError(e)
+	}
+
+	// 5.1 If there was an error, redirect now with an error
+	if err != nil {
+		req.ErrorRedirect(w, r, err)
+		return nil
+	}
+
+	// 5.2 No error: Now we allow the handlers to finish the job.
+	if req.IssuesToken() {
+		// Pass off the request to the Implicit Handler for
+		// Authentication. ImplicitRedirect also issues the code of
+		// the hybrid flow.
+		s.Auth.AuthorizeImplicit(w, r, req)
+	} else {
+		// Pass off the request to the AuthCode Handler for
+		// Authentication
+		s.Auth.Authorize(w, r, req)
+	}
+
+	return nil
+}
+
+// Log why an authorization request is refused without a redirect, so that
+// misconfigured clients can be diagnosed. The redirection URI is the one
+// sent, since none was accepted.
+func (s *Server) logNoRedirect(clientID, redirectURI string, err error) {
+	e := s.InterpretError(err)
+	s.logger().Printf("OAuth Handler: Authorization request not redirected: client_id=%q redirect_uri=%q error=%q description=%q",
+		clientID, redirectURI, e.Code(), e.Description())
+}
+
+// Validate the parameters, client and redirection URI of an OAuth request
+// req.RedirectURI is only set if the redirection URI is valid.
+func (s *Server) validateOAuthRequest(req *OAuthRequest) (Client, error) {
+	// Validate required parameters.
 	var err error
 	if req.ClientID == "" {
 		// Missing ClientID: no redirect.
@@ -63,104 +192,137 @@ func (s *Server) HandleOAuthRequest(w http.ResponseWriter, r *http.Request) erro
 	} else if req.ResponseType == "" {
 		err = s.NewError(ErrorCodeInvalidRequest,
 			"The \"response_type\" parameter is missing.")
-	} else if !(req.ResponseType == "code" || req.ResponseType == "token") {
+	} else if !req.supportedResponseType() {
 		err = s.NewError(ErrorCodeUnsupportedResponseType,
 			fmt.Sprintf("The response type %q is not supported.",
 				req.ResponseType))
 	}
 
-	// 3. Load client and validate the redirection URI.
+	// Load client and validate the redirection URI.
+	var client Client
 	if err == nil {
-		if u, uErr := validateRedirectURI(req.redirectURI_raw); uErr == nil {
-			req.RedirectURI = u
-		} else {
+		client, err = s.Store.GetClient(req.ClientID)
+	}
+	if err == nil {
+		// The redirection URI may be omitted if the client registered
+		// only one
+		uri := req.redirectURI_raw
+		if uri == "" && len(client.RedirectURIs()) == 1 {
+			uri = client.RedirectURIs()[0]
+		}
+
+		if u, uErr := validateRedirectURI(uri); uErr != nil {
 			// Missing, mismatching or invalid URI: no redirect.
-			if req.redirectURI_raw == "" {
+			if uri == "" {
 				err = s.NewError(ErrorCodeInvalidRequest,
 					"Missing redirection URI.")
 			} else {
 				err = s.NewError(ErrorCodeInvalidRequest, uErr.Error())
 			}
+		} else if pErr := s.RedirectURIPolicy.check(uri, u); pErr != nil {
+			err = s.NewError(ErrorCodeInvalidRequest, pErr.Error())
+		} else if !client.ValidateRedirectURI(uri) && !s.relaxedRedirectMatch(client, uri) {
+			err = s.NewError(ErrorCodeInvalidRequest,
+				"The redirection URI is not registered for the client.")
+		} else {
+			req.RedirectURI = u
 		}
 	}
+	return client, err
+}
 
-	// 4. If no valid redirection URI was set, abort.
-	if req.RedirectURI == nil {
-		// An error occurred because client_id or redirect_uri are invalid:
-		// the caller must display an error page and don't redirect.
+// HandleAccessTokenRequest [...]
+func (s *Server) HandleAccessTokenRequest(w http.ResponseWriter, r *http.Request) error {
+	if t, err := s.tenantServer(r); err != nil {
 		return err
+	} else if t != s {
+		return t.HandleAccessTokenRequest(w, r)
 	}
 
-	// 5.1 If there was an error, redirect now with an error
-	if err != nil {
-		if req.ResponseType == "code" {
-			req.AuthCodeRedirect(w, r, err)
-		} else {
-			req.ImplicitRedirect(w, r, err)
+	// 0. Enforce the methods of the endpoint, and the rate limit if any.
+	if s.LegacyGETTokenRequests {
+		if !s.allowMethod(w, r, "GET", "POST") {
+			return nil
 		}
+	} else if !s.allowMethod(w, r, "POST") {
+		return nil
 	}
-
-	// 5.2 No error: Now we allow the handlers to finish the job.
-	if req.ResponseType == "code" {
-		// Pass off the request to the AuthCode Handler for
-		// Authentication
-		s.Auth.Authorize(w, r, req)
-	} else {
-		// Pass off the request to the Implicit Handler for
-		// Authentication
-		s.Auth.AuthorizeImplicit(w, r, req)
+	if !s.allowTokenRequest(w, r) {
+		return nil
 	}
 
-	return nil
-}
-
-// HandleAccessTokenRequest [...]
-func (s *Server) HandleAccessTokenRequest(w http.ResponseWriter, r *http.Request) error {
 	// 1. Get all request values.
 	req := s.NewAccessTokenRequest(r)
 
-	// 2. Validate required parameters.
+	// 2. Find the handler of the grant type.
 	var err error
-	// Check for missing or wrong parameters
+	handler, ok := s.grants[req.GrantType]
 	if req.GrantType == "" {
 		// Missing GrantType: error.
 		err = s.NewError(ErrorCodeInvalidRequest,
 			"The \"grant_type\" parameter is missing.")
-	} else if req.Code == "" {
-		// Missing Code: error.
-		err = s.NewError(ErrorCodeInvalidRequest,
-			"The \"code\" parameter is missing.")
-	} else if req.RedirectURI == "" {
-		// Missing RedirectURI: error.
-		err = s.NewError(ErrorCodeInvalidRequest,
-			"The \"redirect_uri\" parameter is missing.")
-	} else if req.GrantType != "authorization_code" {
-		// GrantType must be authorization_code
+	} else if !ok {
 		err = s.NewError(ErrorCodeUnsupportedGrantType,
 			fmt.Sprintf("The grant type %q is not supported.",
 				req.GrantType))
+	} else if req.Scopes, err = ParseScope(req.Scope); err == nil {
+		req.Scope = strings.Join(req.Scopes, " ")
 	}
 
 	// 3. Get the response data to the URL.
-	// Authorization code response
-	var token, token_type string
-	var expiry int64
+	var token *AccessTokenResponse
+	var client ClientInfo
+	status := http.StatusOK
 	res := make(map[string]string)
 	if err == nil {
-		token, token_type, expiry, err = s.Store.CreateAccessToken(req)
+		client, err = s.tokenClientInfo(r, req)
+	}
+	if err == nil {
+		token, err = handler(r.Context(), req, client)
 	}
 	if err == nil {
 		// Success.
-		res["token"] = token
-		res["token_type"] = token_type
-		if expiry > 0 { // Don't add it if expiry = 0
-			res["expires_in"] = fmt.Sprintf("%d", expiry)
+		s.auditToken(r.Context(), AuditTokenIssued, token.Token, map[string]interface{}{
+			"grant_type": req.GrantType,
+			"ip":         remoteIP(r.RemoteAddr),
+		})
+		for k, v := range token.Extra {
+			res[k] = v
+		}
+		res["token"] = token.Token
+		res["token_type"] = token.TokenType
+		if token.Expiry > 0 { // Don't add it if expiry = 0
+			res["expires_in"] = fmt.Sprintf("%d", token.Expiry)
+			if s.IncludeExpiresAt {
+				res["expires_at"] = s.expiresAt(token.Expiry)
+			}
+		}
+		if token.Scope != "" {
+			res["scope"] = token.Scope
+		}
+		for k, v := range req.Extra {
+			if _, ok := res[k]; v != "" && !ok && !reservedResponseParams[k] {
+				res[k] = v
+			}
 		}
 	} else {
 		e := s.InterpretError(err)
-		res["error"] = string(e.Code())
-		res["error_description"] = e.Description()
-		res["error_uri"] = e.URI()
+		s.audit(r.Context(), AuditTokenDenied, map[string]interface{}{
+			"client_id":  client.ID,
+			"grant_type": req.GrantType,
+			"ip":         remoteIP(r.RemoteAddr),
+			"error":      string(e.Code()),
+		})
+		for k, v := range s.errorResponse(e) {
+			res[k] = v
+		}
+		if e.Code() == ErrorCodeTemporarilyUnavailable {
+			// The client should try again later
+			status = http.StatusServiceUnavailable
+			if e.RetryAfter() > 0 {
+				setRetryAfter(w.Header(), e.RetryAfter())
+			}
+		}
 	}
 
 	// 4. Write the response
@@ -169,6 +331,7 @@ func (s *Server) HandleAccessTokenRequest(w http.ResponseWriter, r *http.Request
 		"Cache-Control", "no-store",
 		"Pragma", "no-cache",
 	)
+	w.WriteHeader(status)
 	encoder := json.NewEncoder(w)
 	encoder.Encode(res)
 
@@ -180,36 +343,133 @@ func (s *Server) HandleAccessTokenRequest(w http.ResponseWriter, r *http.Request
 // If the request is invalid, return an error
 // If the token is valid, return nil
 func (s *Server) VerifyToken(r *http.Request) (err error) {
-	if authField := r.Header.Get("Authorization"); authField == "" {
-		err = s.NewError(ErrorCodeInvalidRequest,
-			"The \"Authorization\" header field is missing.")
+	if t, err := s.tenantServer(r); err != nil {
 		return err
-	} else if b, e2 := s.Store.ValidateAccessToken(authField); err != nil {
+	} else if t != s {
+		return t.VerifyToken(r)
+	}
+
+	authField, err := s.requestToken(r)
+	if err != nil {
+		return err
+	}
+	// Junk tokens aren't worth a lookup
+	if len(authField) > s.maxTokenLength() {
+		return s.NewError(ErrorCodeInvalidRequest,
+			"The Access Token is too long.")
+	}
+
+	// Without an Audience or AuditLogger, nothing needs the token's
+	// information, and the check stays free of allocations
+	if s.Audience == "" && s.AuditLogger == nil {
+		if b, e2 := s.Store.ValidateAccessToken(authField); e2 != nil {
+			return s.InterpretError(e2)
+		} else if !b {
+			return s.NewError(ErrorCodeInvalidToken,
+				"The Access Token is invalid.")
+		}
+		return nil
+	}
+
+	// Otherwise a single lookup serves the audience check and the audit
+	info, e2 := s.Store.ValidateAccessTokenInfo(authField)
+	if e2 != nil {
 		return s.InterpretError(e2)
-	} else if !b {
+	} else if info == nil {
 		err = s.NewError(ErrorCodeInvalidToken,
 			"The Access Token is invalid.")
-		return err
+	} else if s.Audience != "" && info.Audience != s.Audience {
+		err = s.NewError(ErrorCodeInvalidToken,
+			"The Access Token is not meant for this resource server.")
 	}
 
-	// Success
-	return nil
+	if s.AuditLogger != nil {
+		s.auditTokenInfo(r.Context(), AuditTokenValidated, authField, info, map[string]interface{}{
+			"valid": err == nil,
+			"ip":    remoteIP(r.RemoteAddr),
+		})
+	}
+	return err
+}
+
+// The access token of a request, from the Authorization header or, if
+// AllowBodyToken is set, the access_token parameter of the body or query
+// http://tools.ietf.org/html/rfc6750#section-2
+func (s *Server) requestToken(r *http.Request) (string, error) {
+	// Count the tokens rather than collect them, so that the common case
+	// of a single header doesn't allocate
+	var found string
+	n := 0
+	if authField := r.Header.Get("Authorization"); authField != "" {
+		found, n = authField, n+1
+	}
+	if s.AllowBodyToken {
+		r.ParseForm()
+		if token := r.PostForm.Get("access_token"); token != "" {
+			found, n = token, n+1
+		}
+		if token := r.URL.Query().Get("access_token"); token != "" {
+			found, n = token, n+1
+		}
+	}
+
+	switch n {
+	case 0:
+		return "", s.NewError(ErrorCodeInvalidRequest,
+			"The \"Authorization\" header field is missing.")
+	case 1:
+		return found, nil
+	default:
+		return "", s.NewError(ErrorCodeInvalidRequest,
+			"The Access Token must be sent in a single way.")
+	}
+}
+
+// The MaxTokenLength of the Server, or the default
+func (s *Server) maxTokenLength() int {
+	if s.MaxTokenLength <= 0 {
+		return DefaultMaxTokenLength
+	}
+	return s.MaxTokenLength
 }
 
 // Decorate a http.Handler with an OAuth Access Token Verification
 func (server *Server) TokenVerifier(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+	return server.withCORS(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
 		if err := server.VerifyToken(request); err != nil {
 			// Write the error
-			response.WriteHeader(http.StatusUnauthorized)
-			log.Println("OAuth Handler: Unauthorized access!", err)
+			if e, ok := err.(ServerError); ok && e.Code() == ErrorCodeTemporarilyUnavailable {
+				// The token could not be checked, which doesn't make it invalid
+				response.WriteHeader(http.StatusServiceUnavailable)
+			} else {
+				if server.Realm != "" {
+					response.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", server.Realm))
+				}
+				response.WriteHeader(http.StatusUnauthorized)
+			}
+			server.logger().Println("OAuth Handler: Unauthorized access!", err)
 
 			_, err = response.Write([]byte(err.Error()))
 			if err != nil {
-				log.Println("OAuth Handler: Error writing response!", err)
+				server.logger().Println("OAuth Handler: Error writing response!", err)
 			}
 		} else {
 			handler.ServeHTTP(response, request)
 		}
+	}))
+}
+
+// HealthHandler responds 200 if the token backend is reachable and 503
+// otherwise. Stores that can't be pinged are always considered healthy.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := s.Store.(Pinger); ok {
+			if err := p.Ping(r.Context()); err != nil {
+				s.logger().Println("OAuth Handler: Health check failed!", err)
+				http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("OK"))
 	})
 }
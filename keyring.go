@@ -0,0 +1,108 @@
+package goauth2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sync"
+)
+
+// KeyRing holds the HMAC keys of a TokenCodec or a StatelessCodeStore: an
+// active key signing new tokens and codes, and the older keys that still
+// verify the ones signed before, so that keys can be rotated without
+// invalidating them. To rotate, add the new key, make it active, and remove
+// the old one once what it signed has expired.
+//
+// Signatures don't name their key, so the tokens signed with a single key
+// before a KeyRing was used keep verifying. KeyRing is safe for concurrent
+// use.
+type KeyRing struct {
+	mu     sync.RWMutex
+	keys   map[string][]byte
+	active string
+}
+
+// Create a KeyRing whose active key is key, identified by id
+func NewKeyRing(id string, key []byte) *KeyRing {
+	return &KeyRing{keys: map[string][]byte{id: key}, active: id}
+}
+
+// AddKey adds a verification key, or replaces the key of id
+func (k *KeyRing) AddKey(id string, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = key
+}
+
+// SetActive makes the key of id sign from now on. The previous active key
+// still verifies.
+func (k *KeyRing) SetActive(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("Unknown key %q", id)
+	}
+	k.active = id
+	return nil
+}
+
+// RemoveKey retires a key, so that it no longer verifies. The active key
+// can't be removed.
+func (k *KeyRing) RemoveKey(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.active {
+		return fmt.Errorf("Key %q is active", id)
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// Active returns the identifier of the active key
+func (k *KeyRing) Active() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// Sign returns the HMAC-SHA256 of data with the active key, base64url
+// encoded
+func (k *KeyRing) Sign(data string) string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return hmacSign(k.keys[k.active], data)
+}
+
+// Verify checks a signature of data against all the keys
+func (k *KeyRing) Verify(data, signature string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if hmac.Equal([]byte(signature), []byte(hmacSign(key, data))) {
+			return true
+		}
+	}
+	return false
+}
+
+// The active key and its identifier
+func (k *KeyRing) activeKey() (string, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active, k.keys[k.active]
+}
+
+// The key of an identifier, if it is in the ring
+func (k *KeyRing) key(id string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+func hmacSign(key []byte, data string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,69 @@
+package goauth2
+
+import (
+	"time"
+)
+
+// TokenLifetime is the lifetime a Store gives an access token it registers
+// in its AuthCache
+type TokenLifetime struct {
+	// The lifetime of the token, or 0 for the AuthCache's own
+	TTL time.Duration
+	// The time the token must expire by whatever its lifetime, such as the
+	// end of its session, or the zero time
+	Deadline time.Time
+}
+
+// Seconds gives the lifetime in seconds of a token registered at now by an
+// AuthCache whose own lifetime is defaultSecs, 0 meaning that the token
+// doesn't expire. Lifetimes are rounded down to whole seconds, but are at
+// least a second long.
+func (l TokenLifetime) Seconds(now time.Time, defaultSecs int64) int64 {
+	secs := defaultSecs
+	if l.TTL > 0 {
+		secs = atLeastASecond(l.TTL)
+	}
+	if !l.Deadline.IsZero() {
+		if left := atLeastASecond(l.Deadline.Sub(now)); secs <= 0 || left < secs {
+			secs = left
+		}
+	}
+	return secs
+}
+
+func atLeastASecond(d time.Duration) int64 {
+	if secs := int64(d / time.Second); secs >= 1 {
+		return secs
+	}
+	return 1
+}
+
+// SessionLimitedClient is implemented by a Client whose sessions have a
+// maximum length, measured from the time the resource owner authorized
+// them. The tokens of a session, including those issued late by exchanging
+// its code or by token exchange, expire by its end. ClientImpl implements
+// it.
+type SessionLimitedClient interface {
+	Client
+	// The maximum length of the client's sessions, or 0 for no limit
+	MaxSession() time.Duration
+}
+
+// The lifetime of a new token of a client, for a session the resource
+// owner authorized at authTime: the client's TokenTTL, or the AuthCache's
+// if it has none, up to the end of the session
+// Returns an invalid_grant error if the session has ended.
+func (s *StoreImpl) tokenLifetime(client Client, authTime time.Time) (TokenLifetime, error) {
+	lifetime := TokenLifetime{TTL: client.TokenTTL()}
+	c, ok := client.(SessionLimitedClient)
+	if !ok || c.MaxSession() <= 0 {
+		return lifetime, nil
+	}
+
+	lifetime.Deadline = authTime.Add(c.MaxSession())
+	if lifetime.Deadline.Sub(s.now()) < time.Second {
+		return lifetime, NewServerError(ErrorCodeInvalidGrant,
+			"The session has reached its maximum length.", "")
+	}
+	return lifetime, nil
+}
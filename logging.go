@@ -0,0 +1,106 @@
+package goauth2
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The query parameters hidden by a RequestLogger by default, which carry
+// codes, tokens and client credentials
+var DefaultRedactedParams = []string{
+	"code",
+	"code_verifier",
+	"client_secret",
+	"client_assertion",
+	"access_token",
+	"refresh_token",
+	"subject_token",
+}
+
+// The value logged in place of a redacted parameter
+const redactedValue = "REDACTED"
+
+// RequestLogger writes an access log line for each request: the method, the
+// URL with its secret query parameters redacted, the status and the latency.
+type RequestLogger struct {
+	// The logger of the lines, log.Default() if nil
+	Logger *log.Logger
+	// The query parameters whose values are redacted, DefaultRedactedParams
+	// if nil
+	RedactedParams []string
+}
+
+// LoggingMiddleware logs the requests to h with a default RequestLogger
+func LoggingMiddleware(h http.Handler) http.Handler {
+	return (&RequestLogger{}).Middleware(h)
+}
+
+// Middleware logs the requests to h once they are served
+func (l *RequestLogger) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		logger := l.Logger
+		if logger == nil {
+			logger = log.Default()
+		}
+		logger.Printf("%s %s %d %s", r.Method, l.redactURL(r.URL), rec.status, time.Since(start))
+	})
+}
+
+// The path and query of a URL, with the values of the redacted parameters
+// replaced, and the order of the parameters kept
+func (l *RequestLogger) redactURL(u *url.URL) string {
+	redacted := l.RedactedParams
+	if redacted == nil {
+		redacted = DefaultRedactedParams
+	}
+	path := u.EscapedPath()
+	if u.RawQuery == "" {
+		return path
+	}
+
+	pairs := strings.Split(u.RawQuery, "&")
+	for i, pair := range pairs {
+		key := strings.SplitN(pair, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		for _, param := range redacted {
+			if key == param {
+				pairs[i] = url.QueryEscape(key) + "=" + redactedValue
+				break
+			}
+		}
+	}
+	return path + "?" + strings.Join(pairs, "&")
+}
+
+// A ResponseWriter remembering the status of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the wrapped writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,118 @@
+package goauth2
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultLoginExpiry is how long a user has to log in when the Server's
+// LoginExpiry is not set
+const DefaultLoginExpiry = 10 * time.Minute
+
+// The query parameter of the login URL holding the identifier of the
+// pending request
+const LoginReturnParam = "return_to"
+
+// Prefix of the identifiers of requests waiting for a login, which keeps
+// them apart from pushed requests in the cache
+const pendingLoginPrefix = "login:"
+
+// PendingRequestStore is implemented by a Store that can keep the requests
+// waiting for the user to log in
+type PendingRequestStore interface {
+	// Keep a serialized request and return its identifier
+	SavePendingRequest(data []byte, expiry time.Duration) (id string, err error)
+	// Remove and return the request of an identifier
+	// Return nil if it is unknown, expired or already taken.
+	TakePendingRequest(id string) ([]byte, error)
+}
+
+// RequireLogin keeps the request while the user logs in, and redirects the
+// user to loginURL with the identifier of the request in its "return_to"
+// parameter. Once the user logged in, the login page passes the identifier
+// to Server.ResumeAuthorize to complete the request.
+// Requests with prompt=none get interaction_required instead.
+func (req *OAuthRequest) RequireLogin(w http.ResponseWriter, r *http.Request, loginURL string) {
+	if req.HasPrompt("none") {
+		req.InteractionRequired(w, r)
+		return
+	}
+
+	login, err := url.Parse(loginURL)
+	store, ok := req.Store.(PendingRequestStore)
+	if err == nil && ok && req.server != nil {
+		var data []byte
+		var id string
+		if data, err = req.MarshalBinary(); err == nil {
+			id, err = store.SavePendingRequest(data, req.server.loginExpiry())
+		}
+		if err == nil {
+			query := login.Query()
+			query.Set(LoginReturnParam, id)
+			login.RawQuery = query.Encode()
+			http.Redirect(w, r, login.String(), http.StatusFound)
+			return
+		}
+	}
+
+	e := NewServerError(ErrorCodeServerError,
+		"The request can't be kept while logging in.", "").WithCause(err)
+	req.ErrorRedirect(w, r, e)
+}
+
+// ResumeAuthorize takes back a request kept by RequireLogin, from the
+// identifier given to the login page. The caller completes it once the user
+// logged in, by setting its UserID and redirecting with AuthCodeRedirect or
+// ImplicitRedirect. The request is validated again, as its client may have
+// changed since. Unknown or expired requests are access_denied.
+func (s *Server) ResumeAuthorize(state string) (*OAuthRequest, error) {
+	store, ok := s.Store.(PendingRequestStore)
+	if !ok {
+		return nil, s.NewError(ErrorCodeServerError,
+			"Pending requests are not supported.")
+	}
+	data, err := store.TakePendingRequest(state)
+	if err != nil {
+		return nil, s.InterpretError(err)
+	} else if data == nil {
+		return nil, s.NewError(ErrorCodeAccessDenied,
+			"The request is unknown or expired.")
+	}
+	return s.UnmarshalOAuthRequest(data)
+}
+
+// How long a user has to log in
+func (s *Server) loginExpiry() time.Duration {
+	if s.LoginExpiry > 0 {
+		return s.LoginExpiry
+	}
+	return DefaultLoginExpiry
+}
+
+// Keep a request waiting for a login in the backend
+// Returns ErrNotSupported if the backend can't keep pushed requests
+func (s *StoreImpl) SavePendingRequest(data []byte, expiry time.Duration) (string, error) {
+	c, ok := s.Backend.(PushedRequestCache)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	id := s.randomString()
+	if err := c.RegisterPushedRequest(pendingLoginPrefix+id, data, expiry); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Remove and return a request waiting for a login from the backend
+// Returns ErrNotSupported if the backend can't keep pushed requests
+func (s *StoreImpl) TakePendingRequest(id string) ([]byte, error) {
+	c, ok := s.Backend.(PushedRequestCache)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if id == "" {
+		return nil, nil
+	}
+	return c.TakePushedRequest(pendingLoginPrefix + id)
+}
@@ -0,0 +1,112 @@
+package goauth2
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Endpoints gives the paths the Server's handlers are mounted at, such as
+// "/oauth2", for MetadataHandler. Endpoints with an empty path are left out
+// of the metadata.
+type Endpoints struct {
+	// The MasterHandler serves both the authorization and token endpoints,
+	// so they usually have the same path
+	Authorization string
+	Token         string
+	Revocation    string
+	Introspection string
+	// The PARHandler
+	PushedAuthorization string
+}
+
+// MetadataHandler serves the authorization server metadata, usually at
+// /.well-known/oauth-authorization-server, so that clients can configure
+// themselves. The endpoint URLs are made of the Server's Issuer and
+// Endpoints.
+// http://tools.ietf.org/html/rfc8414
+func (s *Server) MetadataHandler() http.Handler {
+	return s.metadataHandler(Endpoints{})
+}
+
+// The metadata handler of a Server whose handlers are mounted at the paths
+// of mounted, unless its Endpoints are set
+func (s *Server) metadataHandler(mounted Endpoints) http.Handler {
+	return s.withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.writeMetadata(w, r, mounted)
+	}))
+}
+
+// Write the metadata of the Server, or of the tenant of a request
+func (s *Server) writeMetadata(w http.ResponseWriter, r *http.Request, mounted Endpoints) {
+	if t, err := s.tenantServer(r); err != nil {
+		e := s.InterpretError(err)
+		writeJSON(w, errorStatus(e), s.errorResponse(e))
+		return
+	} else if t != s {
+		t.writeMetadata(w, r, mounted)
+		return
+	}
+	endpoints := s.Endpoints
+	if endpoints == (Endpoints{}) {
+		endpoints = mounted
+	}
+
+	issuer := s.issuer(r)
+
+	res := map[string]interface{}{
+		"issuer": issuer,
+		// Clients don't authenticate at the token endpoint, unless
+		// they sign an assertion
+		"token_endpoint_auth_methods_supported": []string{"none"},
+	}
+	if _, ok := s.Store.(AssertionAuthenticator); ok && s.Issuer != "" {
+		res["token_endpoint_auth_methods_supported"] = []string{"none", "private_key_jwt"}
+		res["token_endpoint_auth_signing_alg_values_supported"] = clientAssertionAlgs
+	}
+	// Codes are only advertised if they can be exchanged, such as when a
+	// Config left their grant type out
+	grants := []string{GrantTypeImplicit}
+	responseTypes := []string{"token"}
+	if s.grants[GrantTypeAuthorizationCode] != nil {
+		grants = []string{GrantTypeAuthorizationCode, GrantTypeImplicit}
+		responseTypes = []string{"code", "token", "code token"}
+	}
+	if s.TokenExchangePolicy != nil && s.grants[GrantTypeTokenExchange] != nil {
+		grants = append(grants, GrantTypeTokenExchange)
+	}
+	res["grant_types_supported"] = append(grants, s.extensionGrantTypes()...)
+	res["response_types_supported"] = responseTypes
+	endpoint := func(name, path string) {
+		if path != "" {
+			res[name] = issuer + path
+		}
+	}
+	endpoint("authorization_endpoint", endpoints.Authorization)
+	endpoint("token_endpoint", endpoints.Token)
+	endpoint("revocation_endpoint", endpoints.Revocation)
+	endpoint("introspection_endpoint", endpoints.Introspection)
+	endpoint("pushed_authorization_request_endpoint", endpoints.PushedAuthorization)
+	if len(s.ScopesSupported) > 0 {
+		res["scopes_supported"] = s.ScopesSupported
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// The Issuer, or the base URL of the server a request was sent to, without
+// a trailing slash
+func (s *Server) issuer(r *http.Request) string {
+	issuer := s.Issuer
+	if issuer == "" {
+		issuer = requestBaseURL(r)
+	}
+	return strings.TrimSuffix(issuer, "/")
+}
+
+// The base URL of the server a request was sent to
+func requestBaseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
@@ -0,0 +1,176 @@
+// Package goauth2/oauthclient builds the requests of OAuth 2.0 clients to
+// the endpoints of a server, such as a goauth2 Server.
+//
+// The parameters are encoded with url.Values, and the empty ones are left
+// out:
+//
+//	uri, err := oauthclient.BuildAuthorizeURL("https://auth.example.com/oauth2",
+//		oauthclient.AuthorizeParams{
+//			ClientID:     "client1",
+//			ResponseType: "code",
+//			RedirectURI:  "https://client.example.com/cb",
+//			State:        state,
+//		})
+//
+//	req, err := oauthclient.BuildTokenRequest("https://auth.example.com/oauth2",
+//		oauthclient.TokenParams{
+//			GrantType:   "authorization_code",
+//			Code:        code,
+//			RedirectURI: "https://client.example.com/cb",
+//			ClientID:    "client1",
+//		})
+//	res, err := http.DefaultClient.Do(req)
+package oauthclient
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The code_challenge_method of PKCE challenges made with CodeChallengeS256
+// http://tools.ietf.org/html/rfc7636#section-4.2
+const CodeChallengeMethodS256 = "S256"
+
+// AuthorizeParams are the parameters of an authorization request
+// http://tools.ietf.org/html/rfc6749#section-4.1.1
+type AuthorizeParams struct {
+	ClientID     string
+	ResponseType string
+	RedirectURI  string
+	Scope        string
+	State        string
+	ResponseMode string
+	Prompt       string
+	Resource     string
+	// The request_uri of a pushed authorization request
+	// http://tools.ietf.org/html/rfc9126#section-4
+	RequestURI string
+
+	// The PKCE challenge of the code verifier sent to the token endpoint
+	// http://tools.ietf.org/html/rfc7636#section-4.3
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	// Other parameters, which don't replace the ones above
+	Extra url.Values
+}
+
+// TokenParams are the parameters of a token request. The client is
+// authenticated by its secret or an assertion, if set.
+// http://tools.ietf.org/html/rfc6749#section-4.1.3
+type TokenParams struct {
+	GrantType   string
+	Code        string
+	RedirectURI string
+	Scope       string
+	Resource    string
+
+	// The PKCE code verifier of the challenge of the authorization request
+	CodeVerifier string
+
+	ClientID     string
+	ClientSecret string
+	// A client assertion, and its type
+	// http://tools.ietf.org/html/rfc7521#section-4.2
+	ClientAssertion     string
+	ClientAssertionType string
+
+	// The parameters of token exchange
+	// http://tools.ietf.org/html/rfc8693#section-2.1
+	SubjectToken       string
+	SubjectTokenType   string
+	RequestedTokenType string
+
+	// Other parameters, which don't replace the ones above
+	Extra url.Values
+}
+
+// BuildAuthorizeURL
+// Add the parameters of an authorization request to the query of the
+// authorization endpoint base, which may be relative. The query of base is
+// kept, but it may not have a fragment.
+func BuildAuthorizeURL(base string, p AuthorizeParams) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	} else if u.Fragment != "" {
+		return "", fmt.Errorf("The authorization endpoint must not contain a fragment: %q", base)
+	}
+
+	params := url.Values{}
+	for k, v := range p.Extra {
+		params[k] = v
+	}
+	setParams(params,
+		"client_id", p.ClientID,
+		"response_type", p.ResponseType,
+		"redirect_uri", p.RedirectURI,
+		"scope", p.Scope,
+		"state", p.State,
+		"response_mode", p.ResponseMode,
+		"prompt", p.Prompt,
+		"resource", p.Resource,
+		"request_uri", p.RequestURI,
+		"code_challenge", p.CodeChallenge,
+		"code_challenge_method", p.CodeChallengeMethod,
+	)
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// BuildTokenRequest
+// Make a POST request of the parameters to the token endpoint at base,
+// which may be relative, in a form body
+func BuildTokenRequest(base string, p TokenParams) (*http.Request, error) {
+	params := url.Values{}
+	for k, v := range p.Extra {
+		params[k] = v
+	}
+	setParams(params,
+		"grant_type", p.GrantType,
+		"code", p.Code,
+		"redirect_uri", p.RedirectURI,
+		"scope", p.Scope,
+		"resource", p.Resource,
+		"code_verifier", p.CodeVerifier,
+		"client_id", p.ClientID,
+		"client_secret", p.ClientSecret,
+		"client_assertion", p.ClientAssertion,
+		"client_assertion_type", p.ClientAssertionType,
+		"subject_token", p.SubjectToken,
+		"subject_token_type", p.SubjectTokenType,
+		"requested_token_type", p.RequestedTokenType,
+	)
+
+	req, err := http.NewRequest("POST", base, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// CodeChallengeS256 returns the S256 PKCE challenge of a code verifier
+// http://tools.ietf.org/html/rfc7636#section-4.2
+func CodeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Set the non-empty values of key/value pairs
+func setParams(v url.Values, pairs ...string) {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			v.Set(pairs[i], pairs[i+1])
+		}
+	}
+}
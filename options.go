@@ -0,0 +1,208 @@
+package goauth2
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Option configures a Server built by NewServerOptions
+type Option func(o *serverOptions) error
+
+// The configuration gathered from the options, checked once they are all
+// applied
+type serverOptions struct {
+	store     Store
+	cache     AuthCache
+	clients   ClientStore
+	auth      AuthHandler
+	logger    *log.Logger
+	realm     string
+	errorURIs map[errorCode]string
+	tokenTTL  time.Duration
+	audit     AuditLogger
+	clock     Clock
+	policy    *BackendPolicy
+	redirect  int
+}
+
+// ClockSetter is implemented by an AuthCache whose clock can be set, which
+// WithClock sets
+type ClockSetter interface {
+	SetClock(clock Clock)
+}
+
+// TokenExpirySetter is implemented by an AuthCache whose lifetime of access
+// tokens can be set, which WithTokenTTL needs
+type TokenExpirySetter interface {
+	// Set the lifetime of the tokens registered from now on, in seconds
+	SetTokenExpiry(secs int64)
+}
+
+// NewServerOptions
+// Create a new OAuth 2.0 Server from options. An AuthHandler is required,
+// along with either a Store or an AuthCache to build the default Store
+// from. Incoherent options, such as a ClientStore for a custom Store, give
+// an error.
+func NewServerOptions(opts ...Option) (*Server, error) {
+	o := &serverOptions{errorURIs: make(map[errorCode]string)}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case o.auth == nil:
+		return nil, errors.New("An AuthHandler is required")
+	case o.store == nil && o.cache == nil:
+		return nil, errors.New("A Store or an AuthCache is required")
+	case o.store != nil && o.cache != nil:
+		return nil, errors.New("A Store can't be used with an AuthCache")
+	case o.store != nil && o.clients != nil:
+		return nil, errors.New("A ClientStore can only be used with an AuthCache")
+	case o.store != nil && o.tokenTTL > 0:
+		return nil, errors.New("A token lifetime can only be set with an AuthCache")
+	case o.store != nil && o.policy != nil:
+		return nil, errors.New("A BackendPolicy can only be used with an AuthCache")
+	}
+
+	store := o.store
+	if store == nil {
+		if o.tokenTTL > 0 {
+			setter, ok := o.cache.(TokenExpirySetter)
+			if !ok {
+				return nil, errors.New("The AuthCache can't set the token lifetime")
+			}
+			setter.SetTokenExpiry(int64(o.tokenTTL / time.Second))
+		}
+		impl := NewStore(o.cache)
+		impl.Clients = o.clients
+		impl.AuditLogger = o.audit
+		impl.Clock = o.clock
+		impl.BackendPolicy = o.policy
+		if setter, ok := o.cache.(ClockSetter); ok && o.clock != nil {
+			setter.SetClock(o.clock)
+		}
+		store = impl
+	}
+
+	s := newServer(store, o.auth)
+	s.Logger = o.logger
+	s.Realm = o.realm
+	s.AuditLogger = o.audit
+	s.Clock = o.clock
+	s.RedirectStatusCode = o.redirect
+	for code, uri := range o.errorURIs {
+		s.RegisterErrorURI(code, uri)
+	}
+	return s, nil
+}
+
+// WithStore serves the codes, tokens and clients of a custom Store
+func WithStore(store Store) Option {
+	return func(o *serverOptions) error {
+		o.store = store
+		return nil
+	}
+}
+
+// WithAuthCache keeps the codes and tokens of the default Store in cache
+func WithAuthCache(cache AuthCache) Option {
+	return func(o *serverOptions) error {
+		o.cache = cache
+		return nil
+	}
+}
+
+// WithClientStore only serves the clients registered in clients
+func WithClientStore(clients ClientStore) Option {
+	return func(o *serverOptions) error {
+		o.clients = clients
+		return nil
+	}
+}
+
+// WithAuthHandler authenticates the resource owners with auth
+func WithAuthHandler(auth AuthHandler) Option {
+	return func(o *serverOptions) error {
+		o.auth = auth
+		return nil
+	}
+}
+
+// WithLogger sends the log messages of the Server to logger
+func WithLogger(logger *log.Logger) Option {
+	return func(o *serverOptions) error {
+		o.logger = logger
+		return nil
+	}
+}
+
+// WithRealm sets the realm of the challenges sent by TokenVerifier
+func WithRealm(realm string) Option {
+	return func(o *serverOptions) error {
+		o.realm = realm
+		return nil
+	}
+}
+
+// WithErrorURI registers the URI of an error code, as RegisterErrorURI
+func WithErrorURI(code errorCode, uri string) Option {
+	return func(o *serverOptions) error {
+		o.errorURIs[code] = uri
+		return nil
+	}
+}
+
+// WithTokenTTL sets the lifetime of access tokens in the AuthCache, in
+// whole seconds
+func WithTokenTTL(ttl time.Duration) Option {
+	return func(o *serverOptions) error {
+		if ttl < time.Second {
+			return fmt.Errorf("The token lifetime is too short: %s", ttl)
+		}
+		o.tokenTTL = ttl
+		return nil
+	}
+}
+
+// WithAuditLogger sends the audit events of the Server, and of the default
+// Store, to logger
+func WithAuditLogger(logger AuditLogger) Option {
+	return func(o *serverOptions) error {
+		o.audit = logger
+		return nil
+	}
+}
+
+// WithClock makes the Server, the default Store and the AuthCache, if it is
+// a ClockSetter, tell the time with clock, such as a fake clock in tests
+func WithClock(clock Clock) Option {
+	return func(o *serverOptions) error {
+		o.clock = clock
+		return nil
+	}
+}
+
+// WithBackendPolicy bounds the calls of the default Store to the AuthCache
+// with policy, which must not be shared with another Store
+func WithBackendPolicy(policy *BackendPolicy) Option {
+	return func(o *serverOptions) error {
+		o.policy = policy
+		return nil
+	}
+}
+
+// WithRedirectStatusCode sets the status of the redirects to clients,
+// which must be 302, 303 or 307
+func WithRedirectStatusCode(code int) Option {
+	return func(o *serverOptions) error {
+		if !validRedirectStatus(code) {
+			return fmt.Errorf("Invalid redirect status code %d: it must be 302, 303 or 307", code)
+		}
+		o.redirect = code
+		return nil
+	}
+}
@@ -0,0 +1,241 @@
+package goauth2
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Prefix of the request URIs of pushed authorization requests
+// http://tools.ietf.org/html/rfc9126#section-2.2
+const pushedRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+// DefaultPushedRequestExpiry is how long a pushed authorization request
+// may be used when the Server's PushedRequestExpiry is not set
+const DefaultPushedRequestExpiry = 60 * time.Second
+
+// PushedRequestCache is implemented by an AuthCache that can keep pushed
+// authorization requests for a short time
+type PushedRequestCache interface {
+	// Register the serialized request of an identifier, expiring after
+	// expiry
+	RegisterPushedRequest(id string, data []byte, expiry time.Duration) error
+	// Remove and return the request of an identifier
+	// Return nil if it is unknown, expired or already taken.
+	TakePushedRequest(id string) ([]byte, error)
+}
+
+// PushedRequestStore is implemented by a Store that can keep pushed
+// authorization requests until they are used
+type PushedRequestStore interface {
+	// Keep a serialized request and return its request URI
+	PushRequest(data []byte, expiry time.Duration) (requestURI string, err error)
+	// Remove and return the request of a request URI
+	// Return nil if it is unknown, expired or already used.
+	TakePushedRequest(requestURI string) ([]byte, error)
+}
+
+// ClientAuthenticator is implemented by a Store that can check the
+// credentials of a client
+type ClientAuthenticator interface {
+	// Return the client if the credentials are valid, or an invalid_client
+	// ServerError
+	AuthenticateClient(clientID, secret string) (Client, error)
+}
+
+// PARHandler is the pushed authorization request endpoint. Clients post the
+// parameters of an authorization request to it, and get a request_uri to
+// send to the authorization endpoint in their place.
+// http://tools.ietf.org/html/rfc9126
+func (s *Server) PARHandler() http.Handler {
+	return s.withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		res, err := s.pushRequest(r)
+		if err != nil {
+			e := s.InterpretError(err)
+			writeJSON(w, errorStatus(e), s.errorResponse(e))
+			return
+		}
+		writeJSON(w, http.StatusCreated, res)
+	}))
+}
+
+// Validate and keep a pushed authorization request
+func (s *Server) pushRequest(r *http.Request) (map[string]interface{}, error) {
+	if t, err := s.tenantServer(r); err != nil {
+		return nil, err
+	} else if t != s {
+		return t.pushRequest(r)
+	}
+	store, ok := s.Store.(PushedRequestStore)
+	if !ok {
+		return nil, s.NewError(ErrorCodeServerError,
+			"Pushed authorization requests are not supported.")
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, s.NewError(ErrorCodeInvalidRequest, "The request body is malformed.")
+	}
+
+	// Authenticate the client
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID == "" {
+		return nil, s.NewError(ErrorCodeInvalidClient, "The client is not authenticated.")
+	}
+	a, ok := s.Store.(ClientAuthenticator)
+	if !ok {
+		return nil, s.NewError(ErrorCodeInvalidClient, "The client can't be authenticated.")
+	}
+	if _, err := a.AuthenticateClient(clientID, secret); err != nil {
+		return nil, err
+	}
+
+	v := r.PostForm
+	if v.Get("request_uri") != "" {
+		return nil, s.NewError(ErrorCodeInvalidRequest,
+			"The \"request_uri\" parameter can't be pushed.")
+	}
+	req := &OAuthRequest{
+		ClientID:        clientID,
+		ResponseType:    v.Get("response_type"),
+		redirectURI_raw: v.Get("redirect_uri"),
+		Scope:           v.Get("scope"),
+		State:           v.Get("state"),
+		Prompt:          v.Get("prompt"),
+		Resource:        v.Get("resource"),
+		ResponseMode:    v.Get("response_mode"),
+		RemoteAddr:      r.RemoteAddr,
+		Store:           s.Store,
+		server:          s,
+	}
+	if err := s.checkOAuthRequest(req); err != nil {
+		return nil, err
+	}
+
+	data, err := req.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	expiry := s.PushedRequestExpiry
+	if expiry <= 0 {
+		expiry = DefaultPushedRequestExpiry
+	}
+	requestURI, err := store.PushRequest(data, expiry)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"request_uri": requestURI,
+		"expires_in":  int64(expiry / time.Second),
+	}, nil
+}
+
+// Load the pushed request of a request URI, on behalf of the client of the
+// authorization request. The request is not validated.
+func (s *Server) pushedOAuthRequest(r *http.Request, requestURI string) (*OAuthRequest, error) {
+	store, ok := s.Store.(PushedRequestStore)
+	if !ok || !strings.HasPrefix(requestURI, pushedRequestURIPrefix) {
+		return nil, s.NewError(ErrorCodeInvalidRequest,
+			"The request URI is not supported.")
+	}
+
+	data, err := store.TakePushedRequest(requestURI)
+	if err != nil {
+		return nil, s.InterpretError(err)
+	} else if data == nil {
+		return nil, s.NewError(ErrorCodeInvalidRequest,
+			"The request URI is unknown, expired or already used.")
+	}
+
+	req, err := s.decodeOAuthRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	if req.ClientID != requestParams(r).Get("client_id") {
+		return nil, s.NewError(ErrorCodeInvalidRequest,
+			"The request URI was pushed by another client.")
+	}
+	req.RemoteAddr = r.RemoteAddr
+	return req, nil
+}
+
+// The status of an error response that isn't redirected, such as those of
+// the PAR endpoint
+func errorStatus(e ServerError) int {
+	switch e.Code() {
+	case ErrorCodeInvalidClient:
+		return http.StatusUnauthorized
+	case ErrorCodeServerError:
+		return http.StatusInternalServerError
+	case ErrorCodeTemporarilyUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// ----------------------------------------------------------------------------
+
+// Keep a pushed authorization request in the backend
+// Returns ErrNotSupported if the backend can't keep pushed requests
+func (s *StoreImpl) PushRequest(data []byte, expiry time.Duration) (string, error) {
+	c, ok := s.Backend.(PushedRequestCache)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	id := s.randomString()
+	if err := c.RegisterPushedRequest(id, data, expiry); err != nil {
+		return "", err
+	}
+	return pushedRequestURIPrefix + id, nil
+}
+
+// Remove and return a pushed authorization request from the backend
+// Returns ErrNotSupported if the backend can't keep pushed requests
+func (s *StoreImpl) TakePushedRequest(requestURI string) ([]byte, error) {
+	c, ok := s.Backend.(PushedRequestCache)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if !strings.HasPrefix(requestURI, pushedRequestURIPrefix) {
+		return nil, nil
+	}
+	return c.TakePushedRequest(strings.TrimPrefix(requestURI, pushedRequestURIPrefix))
+}
+
+// Check the credentials of a client. Confidential clients must give their
+// secret, which is checked if the ClientStore can verify secrets.
+func (s *StoreImpl) AuthenticateClient(clientID, secret string) (Client, error) {
+	client, err := s.GetClient(clientID)
+	if err != nil {
+		return nil, NewServerError(ErrorCodeInvalidClient,
+			"The client is unknown.", "").WithCause(err)
+	}
+	if client.Type() != ClientTypeConfidential {
+		return client, nil
+	}
+
+	v, ok := s.Clients.(secretVerifier)
+	if !ok {
+		return nil, NewServerError(ErrorCodeInvalidClient,
+			"The client secret can't be checked.", "")
+	}
+	if valid, err := v.VerifySecret(clientID, secret); err != nil {
+		return nil, err
+	} else if !valid {
+		return nil, NewServerError(ErrorCodeInvalidClient,
+			"The client secret is invalid.", "")
+	}
+	return client, nil
+}
+
+// secretVerifier is a ClientStore that can check client secrets
+type secretVerifier interface {
+	VerifySecret(clientID, secret string) (bool, error)
+}
@@ -1,8 +1,15 @@
 package goauth2
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"math"
+	"math/big"
+	"strings"
 	"time"
 )
 
@@ -13,14 +20,85 @@ func init() {
 }
 
 func RandomStrings() <-chan string {
+	return RandomStringsUntil(nil)
+}
+
+// RandomStringsContext is RandomStrings with a generator that stops when
+// ctx is done
+func RandomStringsContext(ctx context.Context) <-chan string {
+	return RandomStringsUntil(ctx.Done())
+}
+
+// RandomStringsUntil is RandomStrings with a generator that stops when
+// stop is closed. The channel is not closed then, so that no empty string
+// is ever received from it.
+func RandomStringsUntil(stop <-chan struct{}) <-chan string {
 	randstr := make(chan string, 0)
 	go func() {
 		hash := sha1.New()
 		base := []byte(time.Now().String())
 		for {
 			hash.Write(base)
-			randstr <- fmt.Sprintf("%x", hash.Sum(nil))
+			select {
+			case randstr <- fmt.Sprintf("%x", hash.Sum(nil)):
+			case <-stop:
+				return
+			}
 		}
 	}()
 	return randstr
 }
+
+// ----------------------------------------------------------------------------
+
+// The alphabet of generated tokens
+type TokenEncoding int
+
+const (
+	// Lowercase hexadecimal digits
+	EncodingHex TokenEncoding = iota
+	// Base64 with the URL-safe alphabet and no padding
+	EncodingBase64URL
+	// Digits and ASCII letters only
+	EncodingBase62
+)
+
+// TokenGenerator generates codes and tokens of Length random bytes from
+// crypto/rand, in an Encoding. It is an alternative to the default
+// generator for systems limiting the length or alphabet of tokens.
+type TokenGenerator struct {
+	Length   int
+	Encoding TokenEncoding
+}
+
+// Generate a new random string
+func (g TokenGenerator) Generate() (string, error) {
+	b := make([]byte, g.Length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	switch g.Encoding {
+	case EncodingBase64URL:
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	case EncodingBase62:
+		str := new(big.Int).SetBytes(b).Text(62)
+		// Pad to a fixed length, since leading zero bytes are dropped
+		return strings.Repeat("0", g.EncodedLen()-len(str)) + str, nil
+	default:
+		return hex.EncodeToString(b), nil
+	}
+}
+
+// EncodedLen is the length of the generated strings
+func (g TokenGenerator) EncodedLen() int {
+	switch g.Encoding {
+	case EncodingBase64URL:
+		return base64.RawURLEncoding.EncodedLen(g.Length)
+	case EncodingBase62:
+		// Enough digits for 8 bits per byte at log2(62) bits per digit
+		return int(math.Ceil(float64(8*g.Length) / math.Log2(62)))
+	default:
+		return hex.EncodedLen(g.Length)
+	}
+}
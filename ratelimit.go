@@ -0,0 +1,177 @@
+package goauth2
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter decides whether a request identified by key may proceed.
+// If it may not, it returns how long the caller should wait before retrying.
+// Implementations must be safe for concurrent use, and may be shared
+// between servers to enforce a distributed limit.
+type RateLimiter interface {
+	Allow(key string) (ok bool, retryAfter time.Duration)
+}
+
+// Number of buckets kept before idle ones are dropped
+const maxIdleBuckets = 10000
+
+// TokenBucketLimiter is an in-memory RateLimiter giving every key a bucket
+// of Burst tokens refilled at Rate tokens per second.
+type TokenBucketLimiter struct {
+	Rate  float64
+	Burst int
+	// The current time, time.Now if nil
+	Now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Create a limiter allowing rate requests per second per key, with bursts
+// of up to burst requests
+func NewTokenBucketLimiter(rate float64, burst int) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *TokenBucketLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.Now != nil {
+		now = l.Now()
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.dropIdle(now)
+		}
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = l.refill(b, now)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.Rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	wait := (1 - b.tokens) / l.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// Number of tokens in a bucket at time now
+func (l *TokenBucketLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.Rate
+	return math.Min(tokens, float64(l.Burst))
+}
+
+// Drop the buckets that are full again, since they are as good as new
+func (l *TokenBucketLimiter) dropIdle(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// The keys a token request is rate limited by: its remote IP, then the
+// client_id of its Basic credentials if it has some. The credentials are
+// not checked yet, so the IP comes first: claiming to be a client never
+// escapes the limit of the address.
+func rateLimitKeys(r *http.Request) []string {
+	keys := []string{"ip:" + remoteIP(r.RemoteAddr)}
+	if clientID, _, ok := r.BasicAuth(); ok && clientID != "" {
+		keys = append(keys, "client:"+clientID)
+	}
+	return keys
+}
+
+// Check a token request against the Server's TokenRateLimiter.
+// If it is refused, a 429 response is written and false is returned.
+func (s *Server) allowTokenRequest(w http.ResponseWriter, r *http.Request) bool {
+	if s.TokenRateLimiter == nil {
+		return true
+	}
+	for _, key := range rateLimitKeys(r) {
+		if ok, retryAfter := s.TokenRateLimiter.Allow(key); !ok {
+			s.tooManyRequests(w, retryAfter, "Too many token requests.")
+			return false
+		}
+	}
+	return true
+}
+
+// Write a 429 response with a Retry-After header
+func (s *Server) tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, description string) {
+	setRetryAfter(w.Header(), retryAfter)
+	writeJSON(w, http.StatusTooManyRequests, s.errorResponse(s.NewError(
+		ErrorCodeTemporarilyUnavailable, description)))
+}
+
+// Set the Retry-After header to a delay in whole seconds, rounded up
+func setRetryAfter(h http.Header, retryAfter time.Duration) {
+	secs := int64(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	h.Set("Retry-After", strconv.FormatInt(secs, 10))
+}
+
+// RateLimitPolicy says how RateLimited limits requests. Either limiter may
+// be nil, and a single limiter may be used for both.
+type RateLimitPolicy struct {
+	// Limits the requests of each client, by the client_id of their Basic
+	// authentication or parameters
+	PerClient RateLimiter
+	// Limits the requests from each remote IP
+	PerIP RateLimiter
+}
+
+// RateLimited decorates a handler, such as the authorization or token
+// endpoint, with rate limits per client and per remote IP. Requests over
+// either limit get a 429 response with a Retry-After header.
+func (s *Server) RateLimited(handler http.Handler, policy RateLimitPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The IP is checked first, so that a single address guessing codes
+		// of a client doesn't use up the client's own limit
+		if policy.PerIP != nil {
+			if ok, retryAfter := policy.PerIP.Allow("ip:" + remoteIP(r.RemoteAddr)); !ok {
+				s.tooManyRequests(w, retryAfter, "Too many requests from this address.")
+				return
+			}
+		}
+		if policy.PerClient != nil {
+			clientID, _, ok := r.BasicAuth()
+			if !ok || clientID == "" {
+				clientID = r.FormValue("client_id")
+			}
+			if clientID != "" {
+				if ok, retryAfter := policy.PerClient.Allow("client:" + clientID); !ok {
+					s.tooManyRequests(w, retryAfter, "Too many requests for this client.")
+					return
+				}
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,96 @@
+package goauth2
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// RedirectURIPolicy restricts the redirection URIs of every client, on top
+// of the checks of their registration. The zero policy allows any absolute
+// URI without a fragment.
+type RedirectURIPolicy struct {
+	// Refuse plain http URIs, except loopback ones of native apps.
+	// Private-use schemes are not affected.
+	RequireHTTPS bool
+	// Refuse URIs with a user and password, as in http://user@host/
+	ForbidUserInfo bool
+	// Refuse hosts with a wildcard, such as *.example.com
+	ForbidWildcardHosts bool
+	// Refuse URIs longer than MaxLength bytes, if it is not zero
+	MaxLength int
+	// If not empty, the only hosts URIs may point to
+	AllowedHosts []string
+}
+
+// Check a redirection URI against the policy
+// Return a description of the violation, or nil if the URI is allowed.
+func (p RedirectURIPolicy) check(raw string, u *url.URL) error {
+	host := u.Hostname()
+	switch {
+	case p.MaxLength > 0 && len(raw) > p.MaxLength:
+		return fmt.Errorf("The redirection URI is longer than %d bytes.", p.MaxLength)
+	case p.RequireHTTPS && u.Scheme == "http" && !isLoopback(host):
+		return fmt.Errorf("The redirection URI must use https: %q.", raw)
+	case p.ForbidUserInfo && u.User != nil:
+		return fmt.Errorf("The redirection URI must not contain user information: %q.", raw)
+	case p.ForbidWildcardHosts && strings.Contains(u.Host, "*"):
+		return fmt.Errorf("The redirection URI must not contain a wildcard host: %q.", raw)
+	case len(p.AllowedHosts) > 0 && u.Host != "" && !allowed(p.AllowedHosts, host):
+		return fmt.Errorf("The redirection URI host is not allowed: %q.", host)
+	}
+	return nil
+}
+
+// RedirectMatch loosens the comparison of redirection URIs with the
+// registered ones, for clients whose URIs differ only in form. The query
+// and the user information are always compared exactly, and redirection
+// URIs have no fragment. The zero value compares URIs as strings, as the
+// specification requires.
+type RedirectMatch struct {
+	// Compare the scheme and host regardless of case
+	IgnoreCase bool
+	// Ignore a trailing slash of the path, so that https://app/cb/ matches
+	// https://app/cb
+	IgnoreTrailingSlash bool
+}
+
+// The registered URI of a client matching a redirection URI, or "" if
+// there is none
+func (m RedirectMatch) match(client Client, uri string) string {
+	if m == (RedirectMatch{}) {
+		return ""
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	for _, registered := range client.RedirectURIs() {
+		r, err := url.Parse(registered)
+		if err == nil && m.normalize(r) == m.normalize(u) {
+			return registered
+		}
+	}
+	return ""
+}
+
+// Whether a redirection URI matches a registered URI of a client under the
+// RelaxedRedirectMatch of the server, which is valid for the client
+func (s *Server) relaxedRedirectMatch(client Client, uri string) bool {
+	registered := s.RelaxedRedirectMatch.match(client, uri)
+	return registered != "" && client.ValidateRedirectURI(registered)
+}
+
+// The form of a URI that is compared
+func (m RedirectMatch) normalize(u *url.URL) string {
+	n := *u
+	if m.IgnoreCase {
+		n.Scheme = strings.ToLower(n.Scheme)
+		n.Host = strings.ToLower(n.Host)
+	}
+	if m.IgnoreTrailingSlash {
+		n.Path = strings.TrimSuffix(n.Path, "/")
+		n.RawPath = ""
+	}
+	return n.String()
+}
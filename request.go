@@ -1,9 +1,14 @@
 package goauth2
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"log"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 // Redirect an OAuth Authorization Code Flow Request
@@ -11,7 +16,7 @@ import (
 // If err is not nil, then the error will be included in the redirect
 func (req *OAuthRequest) AuthCodeRedirect(w http.ResponseWriter, r *http.Request, err error) {
 
-	query := req.RedirectURI.Query()
+	query := url.Values{}
 
 	setQueryPairs(query, "state", req.State)
 
@@ -20,69 +25,460 @@ func (req *OAuthRequest) AuthCodeRedirect(w http.ResponseWriter, r *http.Request
 		code, err = req.Store.CreateAuthCode(req)
 	}
 	if err == nil {
+		if req.server != nil && req.server.OnCodeIssued != nil {
+			req.server.OnCodeIssued(req, code)
+		}
+		req.server.audit(r.Context(), AuditCodeIssued, req.auditFields())
 		query.Set("code", code)
+		addExtraParams(query, req.Extra)
 	} else {
-		if e, ok := err.(ServerError); ok {
-			setQueryPairs(query,
-				"error", string(e.Code()),
-				"error_description", e.Description(),
-				"error_uri", e.URI(),
-			)
-		} else {
-			setQueryPairs(query,
-				"error", string(ErrorCodeAccessDenied),
-				"error_description", err.Error(),
-				"error_uri", "",
-			)
-		}
+		req.setError(w, r, query, err)
 	}
-	req.RedirectURI.RawQuery = query.Encode()
-	http.Redirect(w, r, req.RedirectURI.String(), 302)
+	req.respond(w, r, query, false)
 }
 
-// Redirect an OAuth Implicit Grant Flow Request
+// Redirect an OAuth Implicit Grant Flow Request, or a hybrid flow
+// request, which also gets an authorization code
 // If err is nil, the request is successful
 // If err is not nil, then the error will be included in the redirect
 func (req *OAuthRequest) ImplicitRedirect(w http.ResponseWriter, r *http.Request, err error) {
 
-	query, err2 := url.ParseQuery(req.RedirectURI.Fragment)
-	if err2 != nil {
-		err = NewServerError(ErrorCodeBadRedirectURI, "Can't parse redirect fragment.", "")
-	}
-
+	query := url.Values{}
 	setQueryPairs(query, "state", req.State)
 
+	if err == nil && req.hasResponseType("code") {
+		var code string
+		if code, err = req.Store.CreateAuthCode(req); err == nil {
+			if req.server != nil && req.server.OnCodeIssued != nil {
+				req.server.OnCodeIssued(req, code)
+			}
+			req.server.audit(r.Context(), AuditCodeIssued, req.auditFields())
+			query.Set("code", code)
+		}
+	}
 	if err == nil {
-		token, token_type, expiry, err :=
+		var token, token_type string
+		var expiry int64
+		token, token_type, expiry, err =
 			req.Store.CreateImplicitAccessToken(req)
 		if err == nil {
+			if req.server != nil && req.server.OnTokenIssued != nil {
+				req.server.OnTokenIssued(req, token)
+			}
+			fields := req.auditFields()
+			fields["grant_type"] = GrantTypeImplicit
+			fields["token_hash"] = AuditTokenHash(token)
+			req.server.audit(r.Context(), AuditTokenIssued, fields)
+			// http://tools.ietf.org/html/rfc6749#section-4.2.2
 			setQueryPairs(query,
-				"token", token,
+				"access_token", token,
 				"token_type", token_type,
+				"scope", req.Scope,
 			)
+			if req.server != nil && req.server.LegacyTokenKey {
+				setQueryPairs(query, "token", token)
+			}
 			if expiry > 0 {
 				setQueryPairs(query, "expires_in", fmt.Sprintf("%d", expiry))
+				if req.server != nil && req.server.IncludeExpiresAt {
+					setQueryPairs(query, "expires_at", req.server.expiresAt(expiry))
+				}
 			}
 		}
 	}
 	if err != nil {
-		e, ok := err.(ServerError)
-		if ok {
-			setQueryPairs(query,
-				"error", string(e.Code()),
-				"error_description", e.Description(),
-				"error_uri", e.URI(),
-			)
-		} else {
-			setQueryPairs(query,
-				"error", string(ErrorCodeAccessDenied),
-				"error_description", err.Error(),
-				"error_uri", "",
-			)
+		query.Del("code")
+		req.setError(w, r, query, err)
+	} else {
+		addExtraParams(query, req.Extra)
+	}
+
+	req.respond(w, r, query, true)
+}
+
+// ErrorRedirect sends an error to the client of a request of any response
+// type, in the response mode of the request like a successful response.
+// Errors that don't wrap a ServerError deny access.
+func (req *OAuthRequest) ErrorRedirect(w http.ResponseWriter, r *http.Request, err error) {
+	if req.IssuesToken() {
+		req.ImplicitRedirect(w, r, err)
+	} else {
+		req.AuthCodeRedirect(w, r, err)
+	}
+}
+
+// Set the parameters of an error in a redirect. Errors that don't wrap a
+// ServerError deny access. The error URI is the one the server registered
+// for the code, if any.
+func (req *OAuthRequest) setError(w http.ResponseWriter, r *http.Request, query url.Values, err error) {
+	var e ServerError
+	if !errors.As(err, &e) {
+		e = NewServerError(ErrorCodeAccessDenied, err.Error(), "")
+	}
+	fields := req.auditFields()
+	fields["error"] = string(e.Code())
+	req.server.audit(r.Context(), AuditAuthDenied, fields)
+	if e.RetryAfter() > 0 {
+		setRetryAfter(w.Header(), e.RetryAfter())
+	}
+	for k, v := range req.server.errorResponse(e) {
+		setQueryPairs(query, k, v)
+	}
+}
+
+// The parameters of the responses that extra parameters can't replace
+var reservedResponseParams = map[string]bool{
+	"code": true, "state": true, "iss": true,
+	"access_token": true, "token": true, "token_type": true,
+	"expires_in": true, "expires_at": true, "scope": true,
+	"refresh_token": true, "id_token": true, "issued_token_type": true,
+	"error": true, "error_description": true, "error_uri": true,
+}
+
+// Add the extra parameters of a response, except the empty, reserved or
+// already set ones
+func addExtraParams(query url.Values, extra map[string]string) {
+	for k, v := range extra {
+		if v != "" && !reservedResponseParams[k] && !query.Has(k) {
+			query.Set(k, v)
+		}
+	}
+}
+
+// The fields of the audit events of a request
+func (req *OAuthRequest) auditFields() map[string]interface{} {
+	return map[string]interface{}{
+		"client_id": req.ClientID,
+		"user_id":   req.UserID,
+		"scope":     req.Scope,
+		"ip":        remoteIP(req.RemoteAddr),
+	}
+}
+
+// The response mode of a request: how the response parameters are sent
+// to the client. Unsupported modes give the default mode of the flow.
+// http://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#ResponseModes
+func (req *OAuthRequest) responseMode(implicit bool) string {
+	switch {
+	case req.ResponseMode == "form_post", req.ResponseMode == "fragment":
+		return req.ResponseMode
+	case req.ResponseMode == "query" && !implicit:
+		return req.ResponseMode
+	case implicit:
+		return "fragment"
+	}
+	return "query"
+}
+
+// Check the format of the scope of a request, and normalize it
+func (req *OAuthRequest) checkScope() error {
+	scopes, err := ParseScope(req.Scope)
+	if err != nil {
+		return err
+	}
+	req.Scopes = scopes
+	req.Scope = strings.Join(scopes, " ")
+	return nil
+}
+
+// Check that the response mode of a request is supported. Tokens may not
+// be sent in the query.
+func (req *OAuthRequest) checkResponseMode() error {
+	switch req.ResponseMode {
+	case "", "fragment", "form_post":
+		return nil
+	case "query":
+		if !req.IssuesToken() {
+			return nil
+		}
+	}
+	return NewServerError(ErrorCodeInvalidRequest,
+		fmt.Sprintf("The response mode %q is not supported.", req.ResponseMode), "")
+}
+
+// Send the response parameters to the client, in the query or fragment of
+// a redirect or in an auto-submitted form
+func (req *OAuthRequest) respond(w http.ResponseWriter, r *http.Request, params url.Values, implicit bool) {
+	if req.responseMode(implicit) == "form_post" {
+		writeFormPost(w, req.RedirectURI.String(), params)
+		return
+	}
+	http.Redirect(w, r, req.RedirectLocation(params, implicit).String(), req.redirectStatus(r))
+}
+
+// RedirectLocation returns the URL a response with params is redirected
+// to: the request's RedirectURI with the parameters in its query or
+// fragment, as in AuthCodeRedirect, or ImplicitRedirect if implicit is true.
+// The form_post response mode posts the parameters instead, and gets the
+// redirection URI as it is. params and the RedirectURI aren't changed.
+func (req *OAuthRequest) RedirectLocation(params url.Values, implicit bool) *url.URL {
+	switch req.responseMode(implicit) {
+	case "form_post":
+		return buildRedirectURL(req.RedirectURI, nil, nil)
+	case "fragment":
+		if code := params.Get("code"); code != "" && implicit && req.ResponseMode == "" {
+			// The code of the hybrid flow goes in the query, with the state
+			fragment := url.Values{}
+			for k, v := range params {
+				fragment[k] = v
+			}
+			fragment.Del("code")
+			query := url.Values{}
+			setQueryPairs(query, "code", code, "state", req.State)
+			return buildRedirectURL(req.RedirectURI, query, fragment)
+		}
+		return buildRedirectURL(req.RedirectURI, nil, params)
+	}
+	return buildRedirectURL(req.RedirectURI, params, nil)
+}
+
+// Add parameters to the query of a redirection URI, and set its fragment
+// to others. The query of the URI is kept as it is otherwise. Redirection
+// URIs have no fragment of their own.
+func buildRedirectURL(uri *url.URL, query, fragment url.Values) *url.URL {
+	u := *uri
+	if len(query) > 0 {
+		q := u.Query()
+		for k, v := range query {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	if len(fragment) > 0 {
+		u.Fragment = fragment.Encode()
+		u.RawFragment = ""
+	}
+	return &u
+}
+
+// The page of the form_post response mode, submitting the response
+// parameters to the client as soon as it loads
+// http://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html
+var formPostTemplate = template.Must(template.New("form_post").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Submit This Form</title></head>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{.Action}}">
+{{range $name, $values := .Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+// Write the page of the form_post response mode
+func writeFormPost(w http.ResponseWriter, action string, params url.Values) {
+	setQueryPairs(w.Header(),
+		"Content-Type", "text/html; charset=utf-8",
+		"Cache-Control", "no-store",
+		"Pragma", "no-cache",
+	)
+	err := formPostTemplate.Execute(w, struct {
+		// The redirection URI was validated, and may have a private-use
+		// scheme the template would otherwise refuse
+		Action template.URL
+		Params url.Values
+	}{template.URL(action), params})
+	if err != nil {
+		log.Println("OAuth Handler: Error writing form_post response!", err)
+	}
+}
+
+// The status of a redirect to the client. A form submission, such as a
+// consent page, gets 303 See Other so that the browser doesn't post the form
+// again to the redirection URI. Other requests get the server's
+// RedirectStatusCode, or 302 Found.
+func (req *OAuthRequest) redirectStatus(r *http.Request) int {
+	if r.Method == "POST" {
+		return http.StatusSeeOther
+	}
+	if req.server != nil && validRedirectStatus(req.server.RedirectStatusCode) {
+		return req.server.RedirectStatusCode
+	}
+	return http.StatusFound
+}
+
+// Whether a status can be used for the redirects to clients
+func validRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+		return true
+	}
+	return false
+}
+
+// Whether the space-delimited response type of a request includes value
+func (req *OAuthRequest) hasResponseType(value string) bool {
+	for _, t := range strings.Fields(req.ResponseType) {
+		if t == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the response type is "code", "token", or the "code token" of the
+// hybrid flow, in any order
+// http://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#Combinations
+func (req *OAuthRequest) supportedResponseType() bool {
+	types := strings.Fields(req.ResponseType)
+	for _, t := range types {
+		if t != "code" && t != "token" {
+			return false
+		}
+	}
+	switch len(types) {
+	case 1:
+		return true
+	case 2:
+		return types[0] != types[1]
+	}
+	return false
+}
+
+// IssuesToken reports whether the response type sends an access token to
+// the user agent, as in the implicit grant and the hybrid flow. Those
+// requests are completed with ImplicitRedirect.
+func (req *OAuthRequest) IssuesToken() bool {
+	return req.hasResponseType("token")
+}
+
+// Check that the client may use the grant types of the response type and
+// the requested scope
+func (req *OAuthRequest) checkClientGrant(client Client) error {
+	if req.hasResponseType("code") {
+		if err := checkClientGrant(client, GrantTypeAuthorizationCode, req.Scope); err != nil {
+			return err
+		}
+	}
+	if req.IssuesToken() {
+		return checkClientGrant(client, GrantTypeImplicit, req.Scope)
+	}
+	return nil
+}
+
+// Check whether the request asks for a prompt value, such as "none"
+func (req *OAuthRequest) HasPrompt(value string) bool {
+	for _, p := range strings.Fields(req.Prompt) {
+		if p == value {
+			return true
 		}
 	}
+	return false
+}
+
+// Redirect with an interaction_required error, for AuthHandlers that can't
+// authorize a prompt=none request without interacting with the user
+func (req *OAuthRequest) InteractionRequired(w http.ResponseWriter, r *http.Request) {
+	err := NewServerError(ErrorCodeInteractionRequired,
+		"The request can't be authorized without user interaction.", "")
+	if req.server != nil {
+		err = req.server.NewError(err.code, err.description)
+	}
+	req.ErrorRedirect(w, r, err)
+}
+
+// Deny redirects with an access_denied error and reason as its description,
+// for AuthHandlers refusing a request of any response type
+func (req *OAuthRequest) Deny(w http.ResponseWriter, r *http.Request, reason string) {
+	err := NewServerError(ErrorCodeAccessDenied, reason, "")
+	if req.server != nil {
+		err = req.server.NewError(err.code, err.description)
+	}
+	req.ErrorRedirect(w, r, err)
+}
+
+// The fields of an OAuthRequest kept by MarshalBinary
+type oauthRequestData struct {
+	ClientID     string `json:"client_id"`
+	ResponseType string `json:"response_type"`
+	RedirectURI  string `json:"redirect_uri"`
+	Scope        string `json:"scope"`
+	State        string `json:"state"`
+	Prompt       string `json:"prompt"`
+	Resource     string `json:"resource"`
+	ResponseMode string `json:"response_mode,omitempty"`
+	RemoteAddr   string `json:"remote_addr"`
+	UserID       string `json:"user_id"`
+}
+
+// MarshalBinary serializes the request, without its Store, so that an
+// AuthHandler can keep it while the user logs in and resume it with
+// Server.UnmarshalOAuthRequest.
+func (req *OAuthRequest) MarshalBinary() ([]byte, error) {
+	return json.Marshal(oauthRequestData{
+		ClientID:     req.ClientID,
+		ResponseType: req.ResponseType,
+		RedirectURI:  req.redirectURI_raw,
+		Scope:        req.Scope,
+		State:        req.State,
+		Prompt:       req.Prompt,
+		Resource:     req.Resource,
+		ResponseMode: req.ResponseMode,
+		RemoteAddr:   req.RemoteAddr,
+		UserID:       req.UserID,
+	})
+}
+
+// UnmarshalOAuthRequest restores a request serialized with MarshalBinary.
+// The request is validated again, as its client may have changed since.
+// Return a ServerError if it is no longer valid.
+func (s *Server) UnmarshalOAuthRequest(data []byte) (*OAuthRequest, error) {
+	req, err := s.decodeOAuthRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkOAuthRequest(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Restore a request serialized with MarshalBinary, without validating it
+func (s *Server) decodeOAuthRequest(data []byte) (*OAuthRequest, error) {
+	var d oauthRequestData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, s.NewError(ErrorCodeInvalidRequest,
+			"The saved request can't be read.")
+	}
+
+	req := &OAuthRequest{
+		ClientID:        d.ClientID,
+		ResponseType:    d.ResponseType,
+		redirectURI_raw: d.RedirectURI,
+		Scope:           d.Scope,
+		State:           d.State,
+		Prompt:          d.Prompt,
+		Resource:        d.Resource,
+		ResponseMode:    d.ResponseMode,
+		RemoteAddr:      d.RemoteAddr,
+		UserID:          d.UserID,
+		Store:           s.Store,
+		server:          s,
+	}
+	return req, nil
+}
 
-	// Encode as a fragment
-	req.RedirectURI.Fragment = query.Encode()
-	http.Redirect(w, r, req.RedirectURI.String(), 302)
+// Validate a request that isn't redirected with its errors, such as a
+// saved or pushed one
+func (s *Server) checkOAuthRequest(req *OAuthRequest) error {
+	client, err := s.validateOAuthRequest(req)
+	if err != nil {
+		return err
+	}
+
+	if s.RequireState && req.State == "" {
+		return s.NewError(ErrorCodeInvalidRequest,
+			"The \"state\" parameter is missing.")
+	}
+	if err := req.checkResponseMode(); err != nil {
+		return s.InterpretError(err)
+	}
+	if err := req.checkScope(); err != nil {
+		return s.InterpretError(err)
+	}
+	if err := req.checkClientGrant(client); err != nil {
+		return s.InterpretError(err)
+	}
+	return nil
 }
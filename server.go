@@ -1,9 +1,14 @@
 package goauth2
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
@@ -29,6 +34,16 @@ type Store interface {
 	// Validate an access token is valid
 	// Return true if valid, false otherwise.
 	ValidateAccessToken(authorization_field string) (bool, error)
+	// Validate an access token and return its information, with a single
+	// lookup in the backend
+	// Return nil if it is not valid.
+	ValidateAccessTokenInfo(authorization_field string) (*TokenInfo, error)
+	// Validate several access tokens at once
+	// Return whether each one is valid, keyed by authorization field.
+	ValidateAccessTokens(authorization_fields []string) (map[string]bool, error)
+	// Load a registered client
+	// Return a ServerError if the client is unknown or can't be loaded
+	GetClient(clientID string) (Client, error)
 }
 
 // AuthHandler performs authentication with the resource owner
@@ -54,61 +69,296 @@ type OAuthRequest struct {
 	redirectURI_raw string
 	RedirectURI     *url.URL
 	Scope           string
-	State           string
+	// The values of the scope, once it was checked
+	Scopes []string
+	State  string
+	// Space-delimited list of prompt values (none, login, consent,
+	// select_account) of OpenID Connect, asking for or against interaction
+	// with the user
+	Prompt string
+	// The resource server the token is meant for, if any
+	// http://tools.ietf.org/html/rfc8707
+	Resource string
+	// How the response is sent to the client: "query", "fragment" or
+	// "form_post". The default is the query for codes and the fragment for
+	// tokens.
+	ResponseMode string
+	// Network address of the user agent, as in http.Request
+	RemoteAddr string
+	// The resource owner who authorized the request, if the AuthHandler
+	// knows it
+	UserID string
+	// Extra parameters the AuthHandler adds to the successful response,
+	// such as "tenant_id". They are also sent in the token response of the
+	// code, if the Store keeps them. They can't replace the standard
+	// parameters.
+	Extra map[string]string
 
 	// For accessing store functions, such as creating auth codes
 	Store Store
+
+	// The server that received the request, nil if it was built by hand
+	server *Server
 }
 
 // AccessTokenRequest [...]
 type AccessTokenRequest struct {
+	// All the parameters, for the grant types needing others
+	Values url.Values
+
 	GrantType   string
 	Code        string
 	RedirectURI string
+	// The resource server the token is meant for, if any
+	Resource string
+	// A scope narrower than the one granted, if any
+	// http://tools.ietf.org/html/rfc6749#section-3.3
+	Scope string
+	// The values of the scope, once it was checked
+	Scopes []string
+	// The token to exchange and the token types, for token exchange
+	// http://tools.ietf.org/html/rfc8693#section-2.1
+	SubjectToken, SubjectTokenType, RequestedTokenType string
+	// The assertion a client authenticates with instead of a secret, and
+	// its type
+	// http://tools.ietf.org/html/rfc7521#section-4.2
+	ClientAssertion, ClientAssertionType string
+	// The client authenticated by a client assertion, if any. Codes issued
+	// to other clients are refused.
+	ClientID string
+	// Extra parameters of the token response, which the Store or the grant
+	// handler may set, such as those the AuthHandler added to the code.
+	// They can't replace the standard parameters.
+	Extra map[string]string
 }
 
 // NewOAuthRequest [...]
 func (s *Server) NewOAuthRequest(r *http.Request) *OAuthRequest {
-	v := r.URL.Query()
+	v := requestParams(r)
 	return &OAuthRequest{
 		ClientID:        v.Get("client_id"),
 		ResponseType:    v.Get("response_type"),
 		redirectURI_raw: v.Get("redirect_uri"),
 		Scope:           v.Get("scope"),
 		State:           v.Get("state"),
+		Prompt:          v.Get("prompt"),
+		Resource:        v.Get("resource"),
+		ResponseMode:    v.Get("response_mode"),
+		RemoteAddr:      r.RemoteAddr,
 		Store:           s.Store,
+		server:          s,
 	}
 }
 
 // NewAccessTokenRequest [...]
 func (s *Server) NewAccessTokenRequest(r *http.Request) *AccessTokenRequest {
-	v := r.URL.Query()
+	v := requestParams(r)
 	return &AccessTokenRequest{
+		Values:      v,
 		GrantType:   v.Get("grant_type"),
 		Code:        v.Get("code"),
 		RedirectURI: v.Get("redirect_uri"),
+		Resource:    v.Get("resource"),
+		Scope:       v.Get("scope"),
+
+		SubjectToken:       v.Get("subject_token"),
+		SubjectTokenType:   v.Get("subject_token_type"),
+		RequestedTokenType: v.Get("requested_token_type"),
+
+		ClientAssertion:     v.Get("client_assertion"),
+		ClientAssertionType: v.Get("client_assertion_type"),
 	}
 }
 
 // ----------------------------------------------------------------------------
 
+// The MaxTokenLength of a Server that doesn't set one
+const DefaultMaxTokenLength = 4096
+
 // Server [...]
 type Server struct {
 	Store     Store
 	Auth      AuthHandler
 	errorURIs map[errorCode]string
+	// The handlers of the grant types of the token endpoint
+	grants map[string]GrantHandler
+	// Computes the error URIs that aren't registered, if set
+	errorURIFunc func(code errorCode) string
+
+	// Logger receives the log messages of the Server, which go to the
+	// standard logger if it is nil
+	Logger *log.Logger
+
+	// AuditLogger receives the security-relevant events of the Server, such
+	// as the codes and tokens issued, the validations and the denials. The
+	// default Store has its own AuditLogger for the events it sees.
+	AuditLogger AuditLogger
+
+	// Realm is sent in the challenges of TokenVerifier, in a
+	// WWW-Authenticate header. There is no header if it is empty.
+	Realm string
+
+	// AdminAuthorizer decides whether a request may use the AdminHandler by
+	// returning nil. If it is not set, every admin request is forbidden.
+	AdminAuthorizer func(r *http.Request) error
+
+	// TokenRateLimiter limits the requests to the token endpoint per remote
+	// IP, and per client for requests with Basic credentials. Requests over
+	// either limit get a 429 response. It is not set by default.
+	TokenRateLimiter RateLimiter
+
+	// OnCodeIssued and OnTokenIssued are called with each authorization
+	// code or implicit grant token right after it is generated, before the
+	// user agent is redirected. Either may be nil.
+	OnCodeIssued  func(oar *OAuthRequest, code string)
+	OnTokenIssued func(oar *OAuthRequest, token string)
+
+	// Audience is the identifier of the resource server protected by
+	// TokenVerifier. If set, tokens must have been issued for it.
+	Audience string
+
+	// AllowBodyToken lets TokenVerifier accept an access_token in the form
+	// body or query of a request instead of the Authorization header. Query
+	// tokens leak into logs and histories, so it is off by default.
+	AllowBodyToken bool
+
+	// MaxTokenLength is the length in bytes of the longest access token,
+	// with its Authorization header scheme, that VerifyToken looks up.
+	// Longer ones are refused with invalid_request without reaching the
+	// Store. DefaultMaxTokenLength is used if it is 0.
+	MaxTokenLength int
+
+	// LegacyGETTokenRequests lets clients send token requests with GET and
+	// the parameters in the query, as older versions required. The
+	// parameters, such as codes, then leak into logs, so only POST is
+	// accepted by default.
+	LegacyGETTokenRequests bool
+
+	// RedirectStatusCode is the status of the redirects to clients: 302,
+	// the default, 303 or 307. Redirects after a form is posted, such as a
+	// consent page, always use 303. WithRedirectStatusCode and
+	// NewServerFromConfig refuse other values; set here, they give 302.
+	RedirectStatusCode int
+
+	// ErrorPageRenderer writes the page of the authorization errors that
+	// can't be redirected, such as an invalid redirection URI, to browsers
+	// preferring text/html. If it is nil, DefaultErrorPageRenderer is used.
+	// Other clients get the error as JSON.
+	ErrorPageRenderer func(w http.ResponseWriter, r *http.Request, e ServerError)
+
+	// LegacyTokenKey also sends implicit grant tokens under the "token" key
+	// of older versions, next to the "access_token" key of the
+	// specification, for clients that weren't updated
+	LegacyTokenKey bool
+
+	// RedirectURIPolicy restricts the redirection URIs of every client.
+	// Requests with other URIs are refused without a redirect.
+	RedirectURIPolicy RedirectURIPolicy
+
+	// RelaxedRedirectMatch accepts redirection URIs differing from a
+	// registered one only in host case or a trailing slash, as configured.
+	// It is off by default.
+	RelaxedRedirectMatch RedirectMatch
+
+	// RequireState rejects the authorization requests without a state
+	// parameter, which clients use against cross-site request forgery
+	RequireState bool
+
+	// CORS lets browser-based clients from other origins call the
+	// MasterHandler and the handlers decorated by TokenVerifier. There are
+	// no CORS headers if it is nil.
+	CORS *CORSConfig
+
+	// Issuer is the base URL of the server, such as
+	// "https://auth.example.com", and Endpoints are the paths of its
+	// handlers. They are published by MetadataHandler, which uses the
+	// URL a request was sent to if Issuer is empty. Client assertions are
+	// only accepted when Issuer is set.
+	Issuer    string
+	Endpoints Endpoints
+
+	// ScopesSupported lists the scopes clients may request, for the
+	// metadata. It is left out of the metadata if empty.
+	ScopesSupported []string
+
+	// IncludeExpiresAt adds a non-standard "expires_at" field with the
+	// RFC 3339 expiry time next to "expires_in" in token responses, to
+	// help correlate tokens in logs
+	IncludeExpiresAt bool
+
+	// TokenExchangePolicy decides which clients may exchange the tokens of
+	// others, and for which scope. Token exchange is not supported if it is
+	// nil.
+	TokenExchangePolicy TokenExchangePolicy
+
+	// LoginExpiry is how long a request kept by RequireLogin waits for the
+	// user to log in, DefaultLoginExpiry if zero
+	LoginExpiry time.Duration
+
+	// PushedRequestExpiry is how long a request pushed to the PARHandler
+	// may be used, DefaultPushedRequestExpiry if zero
+	PushedRequestExpiry time.Duration
+
+	// TenantResolver gives the name of the tenant of a request, such as
+	// from its host or path, to serve it with the tenant's Server. The
+	// tenants are added by RegisterTenant, and the requests of unknown
+	// tenants are refused. Every request is served by the Server itself if
+	// it is nil.
+	TenantResolver func(r *http.Request) (string, error)
+	// The Servers of the tenants, by name
+	tenants map[string]*Server
+
+	// Clock tells the time of the expires_at fields of the responses,
+	// RealClock if nil. The Store and the AuthCache have clocks of their
+	// own, which WithClock sets along with it.
+	Clock Clock
 }
 
-// NewServer 
+// NewServer
 // Create a new OAuth 2.0 Server
 // cache is an AuthCache interface to hold the code and token
 func NewServer(cache AuthCache, auth AuthHandler) *Server {
-	store := NewStore(cache)
-	return &Server{
+	return newServer(NewStore(cache), auth)
+}
+
+// A Server with the built-in grant types
+func newServer(store Store, auth AuthHandler) *Server {
+	s := &Server{
 		Store:     store,
 		Auth:      auth,
 		errorURIs: make(map[errorCode]string),
 	}
+	s.RegisterGrantType(GrantTypeAuthorizationCode, s.authorizationCodeGrant)
+	s.RegisterGrantType(GrantTypeTokenExchange, s.exchangeToken)
+	return s
+}
+
+// NewServerWithClients
+// Create a new OAuth 2.0 Server that only serves the clients registered
+// in a ClientStore
+func NewServerWithClients(cache AuthCache, clients ClientStore, auth AuthHandler) *Server {
+	s := NewServer(cache, auth)
+	s.Store.(*StoreImpl).Clients = clients
+	return s
+}
+
+// Close
+// Stop the background work of the Store, such as its token generator, and
+// close its backend if it is an io.Closer, which stops the janitors of the
+// BasicAuthCache and closes the connections of the Redis cache
+func (s *Server) Close() error {
+	if c, ok := s.Store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// The logger of the Server's messages. s may be nil.
+func (s *Server) logger() *log.Logger {
+	if s == nil || s.Logger == nil {
+		return log.Default()
+	}
+	return s.Logger
 }
 
 // RegisterErrorURI [...]
@@ -116,19 +366,46 @@ func (s *Server) RegisterErrorURI(code errorCode, uri string) {
 	s.errorURIs[code] = uri
 }
 
+// SetDefaultErrorURIFunc sets a function computing the URI of the error
+// codes without a registered one, such as a section of a documentation page
+// for each code
+func (s *Server) SetDefaultErrorURIFunc(f func(code errorCode) string) {
+	s.errorURIFunc = f
+}
+
+// The URI of an error code: the registered one, or else the default one
+func (s *Server) errorURI(code errorCode) string {
+	if uri := s.errorURIs[code]; uri != "" || s.errorURIFunc == nil {
+		return uri
+	}
+	return s.errorURIFunc(code)
+}
+
 // NewError [...]
 func (s *Server) NewError(code errorCode, description string) ServerError {
-	return NewServerError(code, description, s.errorURIs[code])
+	return NewServerError(code, description, s.errorURI(code))
 }
 
+// InterpretError converts an error into a ServerError with its registered
+// error URI. ServerErrors are found even when wrapped, and other errors
+// become server errors.
 func (s *Server) InterpretError(err error) ServerError {
-	e, ok := err.(ServerError)
-	if !ok {
-		e = s.NewError(ErrorCodeServerError, e.Error())
-	} else if e.uri == "" {
-		e = s.NewError(e.code, e.description)
+	var e ServerError
+	switch {
+	case err == nil:
+		return s.NewError(ErrorCodeServerError, "An unknown error occurred.")
+	case errors.As(err, &e):
+		if e.uri == "" {
+			e.uri = s.errorURI(e.code)
+		}
+		return e
+	case errors.Is(err, ErrBackendUnavailable):
+		s.logger().Println("OAuth Server: Token backend unavailable!", err)
+		return s.NewError(ErrorCodeTemporarilyUnavailable,
+			"The authorization server is temporarily unavailable.")
+	default:
+		return s.NewError(ErrorCodeServerError, err.Error()).WithCause(err)
 	}
-	return e
 }
 
 // ----------------------------------------------------------------------------
@@ -148,6 +425,39 @@ func setQueryPairs(v Setter, pairs ...string) {
 	}
 }
 
+// The parameters of a request: the form body and the query of POST
+// requests, or the query of the others
+func requestParams(r *http.Request) url.Values {
+	if r.Method == "POST" {
+		r.ParseForm()
+		return r.Form
+	}
+	return r.URL.Query()
+}
+
+// The time of the Server's Clock. s may be nil.
+func (s *Server) now() time.Time {
+	if s == nil || s.Clock == nil {
+		return RealClock.Now()
+	}
+	return s.Clock.Now()
+}
+
+// The RFC 3339 time a token expiring in expiry seconds from now expires at
+func (s *Server) expiresAt(expiry int64) string {
+	return s.now().Add(time.Duration(expiry) * time.Second).UTC().Format(time.RFC3339)
+}
+
+// remoteIP strips the port from a network address such as
+// http.Request.RemoteAddr
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
 // validateRedirectURI checks if a redirection URL is valid.
 func validateRedirectURI(uri string) (u *url.URL, err error) {
 	u, err = url.Parse(uri)
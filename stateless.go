@@ -0,0 +1,233 @@
+package goauth2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Default lifetime of the codes of a StatelessCodeStore
+const DefaultStatelessCodeExpiry = time.Minute
+
+// StatelessCodeStore is a Store whose authorization codes carry their own
+// information, signed with an HMAC key, so that servers sharing the key can
+// exchange them without looking them up. The AuthCache only keeps a marker
+// for each code that was used, as long as the code is valid, so that codes
+// can't be used twice. It must implement CodeAdder.
+//
+// The information of the codes is readable by anyone holding them, unless
+// the store was created by NewEncryptedCodeStore.
+type StatelessCodeStore struct {
+	*StoreImpl
+	// Lifetime of the codes, DefaultStatelessCodeExpiry by default
+	CodeExpiry time.Duration
+
+	keys *KeyRing
+	// The keys encrypting the codes, if they are encrypted
+	encKeys *KeyRing
+}
+
+// The signed content of a stateless code
+type statelessCode struct {
+	ClientID    string `json:"cid"`
+	Scope       string `json:"scp,omitempty"`
+	RedirectURI string `json:"uri,omitempty"`
+	Resource    string `json:"res,omitempty"`
+	UserID      string `json:"sub,omitempty"`
+	RequestIP   string `json:"ip,omitempty"`
+	// The extra token response parameters
+	Extra map[string]string `json:"ext,omitempty"`
+	// Random value, so that codes are unique
+	Nonce     string `json:"n"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Create a StatelessCodeStore signing codes with key, and keeping tokens
+// and used codes in cache
+func NewStatelessCodeStore(cache AuthCache, key []byte) *StatelessCodeStore {
+	return NewStatelessCodeStoreWithKeyRing(cache, NewKeyRing("default", key))
+}
+
+// Create a StatelessCodeStore signing codes with the active key of keys,
+// and accepting the codes signed by any of them
+func NewStatelessCodeStoreWithKeyRing(cache AuthCache, keys *KeyRing) *StatelessCodeStore {
+	return &StatelessCodeStore{
+		StoreImpl:  NewStore(cache),
+		CodeExpiry: DefaultStatelessCodeExpiry,
+		keys:       keys,
+	}
+}
+
+// Create a StatelessCodeStore whose codes are also encrypted with AES-GCM,
+// with a key derived from the active key of encKeys. The identifier of the
+// key is part of the code, so the codes encrypted with any key of encKeys
+// are accepted, and keys can be rotated as those of a KeyRing signing.
+// Codes that aren't encrypted are refused.
+func NewEncryptedCodeStore(cache AuthCache, keys, encKeys *KeyRing) *StatelessCodeStore {
+	s := NewStatelessCodeStoreWithKeyRing(cache, keys)
+	s.encKeys = encKeys
+	return s
+}
+
+// KeyRing returns the keys of the codes, to rotate them
+func (s *StatelessCodeStore) KeyRing() *KeyRing {
+	return s.keys
+}
+
+// Create a signed authorization code holding the request's information
+func (s *StatelessCodeStore) CreateAuthCode(r *OAuthRequest) (string, error) {
+	now := s.now()
+	payload, err := json.Marshal(statelessCode{
+		ClientID:    r.ClientID,
+		Scope:       r.Scope,
+		RedirectURI: r.redirectURI_raw,
+		Resource:    r.Resource,
+		UserID:      r.UserID,
+		RequestIP:   remoteIP(r.RemoteAddr),
+		Extra:       r.Extra,
+		Nonce:       s.randomString(),
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   now.Add(s.CodeExpiry).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	if s.encKeys != nil {
+		if body, err = s.encrypt(payload); err != nil {
+			return "", err
+		}
+	}
+	return body + "." + s.keys.Sign(body), nil
+}
+
+// Verify a signed authorization code and issue an access token for it
+func (s *StatelessCodeStore) CreateAccessToken(r *AccessTokenRequest) (token, token_type string, expiry int64, err error) {
+	info, err := s.decodeCode(r.Code)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	// Mark the code as used, keyed by its signature. Only the request that
+	// adds the marker may exchange the code.
+	marker := "used:" + r.Code[strings.LastIndex(r.Code, ".")+1:]
+	added, err := s.addAuthCode(marker, AuthCodeInfo{ClientID: info.ClientID}, s.CodeExpiry+s.Leeway)
+	if err != nil {
+		return "", "", 0, err
+	} else if !added {
+		return "", "", 0, NewServerError(ErrorCodeInvalidGrant,
+			"The authorization code was already used.", "")
+	}
+
+	return s.exchangeCode(r, info)
+}
+
+// Check the signature and expiry of a code and return its information
+func (s *StatelessCodeStore) decodeCode(code string) (*AuthCodeInfo, error) {
+	unknown := NewServerError(ErrorCodeInvalidGrant, "The authorization code is unknown.", "")
+	i := strings.LastIndex(code, ".")
+	if i < 0 || !s.keys.Verify(code[:i], code[i+1:]) {
+		return nil, unknown
+	}
+	var payload []byte
+	var err error
+	if s.encKeys != nil {
+		payload, err = s.decrypt(code[:i])
+	} else {
+		payload, err = base64.RawURLEncoding.DecodeString(code[:i])
+	}
+	if err != nil {
+		return nil, unknown
+	}
+	var c statelessCode
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, unknown
+	}
+	if !s.now().Before(time.Unix(c.ExpiresAt, 0).Add(s.Leeway)) {
+		return nil, NewServerError(ErrorCodeInvalidGrant,
+			"The authorization code has expired.", "").WithCause(ErrCodeExpired)
+	}
+
+	return &AuthCodeInfo{
+		ClientID:    c.ClientID,
+		Scope:       c.Scope,
+		RedirectURI: c.RedirectURI,
+		IssuedAt:    time.Unix(c.IssuedAt, 0),
+		RequestIP:   c.RequestIP,
+		Resource:    c.Resource,
+		UserID:      c.UserID,
+		Extra:       c.Extra,
+	}, nil
+}
+
+// EncryptionKeyRing returns the keys encrypting the codes, to rotate them,
+// or nil if the codes aren't encrypted
+func (s *StatelessCodeStore) EncryptionKeyRing() *KeyRing {
+	return s.encKeys
+}
+
+// Encrypt the payload of a code with the active encryption key. The body
+// is the base64url identifier of the key, a dot, and the base64url nonce
+// and ciphertext, which authenticates the key identifier.
+func (s *StatelessCodeStore) encrypt(payload []byte) (string, error) {
+	id, key := s.encKeys.activeKey()
+	gcm, err := codeCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, payload, []byte(id))
+	return base64.RawURLEncoding.EncodeToString([]byte(id)) + "." +
+		base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt the payload of a code with the key it names
+func (s *StatelessCodeStore) decrypt(body string) ([]byte, error) {
+	i := strings.Index(body, ".")
+	if i < 0 {
+		return nil, errors.New("The code is not encrypted")
+	}
+	id, err := base64.RawURLEncoding.DecodeString(body[:i])
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(body[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := s.encKeys.key(string(id))
+	if !ok {
+		return nil, errors.New("Unknown encryption key")
+	}
+	gcm, err := codeCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("The code is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, id)
+}
+
+// The AES-256-GCM cipher of an encryption key. The AES key is derived from
+// the key, so that keys of any length can be used, and so that a key used
+// to sign as well doesn't encrypt with the same bytes.
+func codeCipher(key []byte) (cipher.AEAD, error) {
+	derived := sha256.Sum256(append([]byte("goauth2 code encryption:"), key...))
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
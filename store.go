@@ -1,61 +1,341 @@
 package goauth2
 
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
 // Authorization Cache
 // This is an interface that registers and looks up authorization codes
 // and access tokens with corresponding information.
 type AuthCache interface {
 	// Register an authorization code into the cache
-	// ClientID is the client requesting
-	// Scope is the requested access scope
-	// Redirect_uri is the redirect URI to save for checking on lookup
 	// Code is a generated random string to register with the request
-	RegisterAuthCode(clientID, scope, redirect_uri, code string) error
+	// Info is the information on the request to save for checking on lookup
+	RegisterAuthCode(code string, info AuthCodeInfo) error
 
 	// Register an access token into the cache
-	// ClientID is the client requesting
-	// Scope is the requested access scope
 	// Token is a generated random string to register with the request
+	// Info is the client, scope and audience of the token
+	// Lifetime is the lifetime of the token, the cache's own by default
 	// Returns the token type, expiration time (in seconds), and possibly an error
-	RegisterAccessToken(clientID, scope, token string) (ttype string, expiry int64, err error)
+	RegisterAccessToken(token string, info TokenInfo, lifetime TokenLifetime) (ttype string, expiry int64, err error)
 
-	// Lookup access token
+	// Lookup an authorization code
 	// Code is the code passed from the user
-	// Returns the clientID, scope, and redirect URI registered with that code
-	LookupAuthCode(code string) (clientID, scope, redirect_uri string, err error)
+	// Returns the information registered with that code
+	LookupAuthCode(code string) (*AuthCodeInfo, error)
 
 	// Lookup an Access Token
 	// Token is the token passed from the client
-	// Return whether the token is valid
-	LookupAccessToken(token string) (bool, error)
+	// Return the information registered with the token, or nil if the
+	// token is not valid
+	LookupAccessToken(token string) (*TokenInfo, error)
+
+	// Lookup several Access Tokens at once
+	// Tokens are the tokens passed from the clients
+	// Return whether each token is valid. Unknown tokens map to false.
+	LookupAccessTokens(tokens []string) (map[string]bool, error)
+}
+
+// Pinger is implemented by an AuthCache that can check whether its backend
+// is reachable. Backends that don't implement it are considered healthy.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// AccessTokenChecker is implemented by an AuthCache that can tell whether
+// an access token is valid without looking up its information, which saves
+// the allocation of a TokenInfo on every verified request
+type AccessTokenChecker interface {
+	// Return whether the token is valid, like LookupAccessToken does
+	CheckAccessToken(token string) (bool, error)
+}
+
+// CodeConsumer is implemented by an AuthCache that can look up and remove
+// an authorization code in one atomic step. StoreImpl requires it to
+// exchange codes, which may be used only once, even by concurrent requests.
+// http://tools.ietf.org/html/rfc6749#section-4.1.2
+type CodeConsumer interface {
+	// Remove a code and return the information registered with it, like
+	// LookupAuthCode does. Returns ErrCodeNotFound if the code is unknown
+	// or was already taken.
+	TakeAuthCode(code string) (*AuthCodeInfo, error)
+}
+
+// CodeAdder is implemented by an AuthCache that can register an
+// authorization code only if it isn't registered yet, in one atomic step.
+// StatelessCodeStore requires it to mark the codes that were used, and
+// StoreImpl to mark the client assertions that were used.
+type CodeAdder interface {
+	// Register a code like RegisterAuthCode does, unless it is registered
+	// already, for lifetime rounded up to whole seconds, or the cache's own
+	// lifetime of codes if it is 0. Return whether it was registered.
+	AddAuthCode(code string, info AuthCodeInfo, lifetime time.Duration) (bool, error)
+}
+
+// TokenEnumerator is implemented by an AuthCache that can list the tokens
+// issued to a client
+type TokenEnumerator interface {
+	ListTokensByClient(clientID string) ([]TokenInfo, error)
+}
+
+// ClientTokenLister is implemented by a Store that can list the tokens
+// issued to a client without giving them away, such as for the admin API.
+// StoreImpl and CachingStore implement it.
+type ClientTokenLister interface {
+	ListTokensByClient(clientID string) ([]TokenSummary, error)
+}
+
+// BulkRevoker is implemented by an AuthCache that can revoke all the tokens
+// issued to a client at once
+type BulkRevoker interface {
+	// Revoke the tokens and return how many there were
+	RevokeByClient(clientID string) (int, error)
+}
+
+// UserTokenLister is implemented by an AuthCache that can list the tokens
+// authorized by a user, such as for a page of the user's active sessions
+type UserTokenLister interface {
+	ListUserTokens(userID string) ([]TokenSummary, error)
+}
+
+// UserCutoffSetter is implemented by an AuthCache that can invalidate every
+// token a user authorized before a time, such as to log the user out
+// everywhere, without enumerating the tokens
+type UserCutoffSetter interface {
+	// Tokens of the user issued before t are no longer valid
+	SetUserCutoff(userID string, t time.Time) error
+}
+
+// AuthCodeInfo is the information registered with an authorization code
+type AuthCodeInfo struct {
+	ClientID, Scope string
+	// The redirect URI of the authorization request, empty if it had none
+	RedirectURI string
+	// Time at which the code was issued
+	IssuedAt time.Time
+	// IP address of the user agent that requested the code, if known
+	RequestIP string
+	// The resource server the code's token is meant for, if any
+	Resource string
+	// The resource owner who authorized the code, if known
+	UserID string
+	// The extra parameters of the token response, set by the AuthHandler
+	Extra map[string]string
+}
+
+// TokenInfo is the information registered with an access token
+type TokenInfo struct {
+	Token           string
+	ClientID, Scope string
+	// The resource server the token may be used at, if it is restricted
+	Audience string
+	// Time at which the token expires, or the zero time if it does not
+	ExpiresAt time.Time
+	// The resource owner who authorized the token, if known
+	UserID string
+	// Time at which the token was issued, if known
+	IssuedAt time.Time
+	// Time at which the resource owner authorized the session of the
+	// token, if known. Tokens issued by token exchange keep the one of
+	// their subject token.
+	AuthTime time.Time
+	// For tokens issued by token exchange, the client of the original
+	// token followed by each client that exchanged it, space-delimited
+	Delegation string
+}
+
+// TokenSummary describes an access token without giving it away
+type TokenSummary struct {
+	// A non-secret identifier of the token, made by TokenID
+	ID              string
+	ClientID, Scope string
+	// The resource owner who authorized the token, if known
+	UserID string
+	// Times at which the token was issued and expires, or zero times if
+	// unknown or if it does not expire
+	IssuedAt, ExpiresAt time.Time
+}
+
+// Maximum length of the token identifiers made by TokenID
+const tokenIDLength = 8
+
+// TokenID returns the identifier of a token used in TokenSummary, which is
+// a prefix short enough to be shown without revealing the token: at most
+// 8 characters, and never more than half of the token. The identifier
+// doesn't change when a tag or a tenant is appended to a long token.
+func TokenID(token string) string {
+	n := len(token) / 2
+	if n > tokenIDLength {
+		n = tokenIDLength
+	}
+	return token[:n]
+}
+
+// Summarize the information of a token
+func (info TokenInfo) Summary() TokenSummary {
+	return TokenSummary{
+		ID:        TokenID(info.Token),
+		ClientID:  info.ClientID,
+		Scope:     info.Scope,
+		UserID:    info.UserID,
+		IssuedAt:  info.IssuedAt,
+		ExpiresAt: info.ExpiresAt,
+	}
 }
 
 // ----------------------------------------------------------------------------
 
 // An implementation of the goauth2 store that abstracts away the
 // work into 3 parts:
+//
 //	1: Token/Code generation and error handling is done for the user
 //	2: Caching active tokens and codes into an AuthCache interface
 //	3: Looking up clients into the ClientStore interface
+//
 // Note: Currently only supports public clients with bearer tokens
 type StoreImpl struct {
 	Backend AuthCache
+	// The registered clients. If nil, any client is accepted.
+	Clients ClientStore
+	// Tags the issued access tokens if set, and then rejects the tokens
+	// without a valid tag
+	Codec *TokenCodec
+	// Keep accepting the untagged tokens issued before the Codec was set
+	AcceptUntagged bool
+	// Generates the codes and tokens if set, instead of the default
+	// generator of 40 hexadecimal digits
+	Generator *TokenGenerator
+	// Receives the events of the codes exchanged and tokens revoked through
+	// the Store. The Server has its own AuditLogger.
+	AuditLogger AuditLogger
+	// Tells the time of the codes and tokens issued, and of the expiries
+	// checked by the Store. RealClock if nil.
+	Clock Clock
+	// Leeway is the clock skew tolerated when checking the expiration and
+	// not-before times set by other parties, such as those of client
+	// assertions and of the codes of other StatelessCodeStores
+	Leeway time.Duration
+	// Bounds the time of the calls to the Backend, and retries the failed
+	// lookups, if set
+	BackendPolicy *BackendPolicy
+	// The cap of the active access tokens of the clients that don't have
+	// their own. Capping tokens requires a backend that can list them by
+	// client, and revoke them to evict the oldest.
+	DefaultTokenLimit TokenLimit
+
+	// The generator of codes and tokens, stopped by Close. The shared
+	// RandStr is used without it, or once it is stopped.
+	randStr   <-chan string
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // ----------------------------------------------------------------------------
 
 func NewStore(backend AuthCache) *StoreImpl {
+	stop := make(chan struct{})
 	return &StoreImpl{
-		backend,
+		Backend: backend,
+		randStr: RandomStringsUntil(stop),
+		stop:    stop,
+	}
+}
+
+// The time of the Store's Clock
+func (s *StoreImpl) now() time.Time {
+	if s.Clock == nil {
+		return RealClock.Now()
+	}
+	return s.Clock.Now()
+}
+
+// A new random string for a code or token
+func (s *StoreImpl) randomString() string {
+	if s.Generator != nil {
+		str, err := s.Generator.Generate()
+		if err == nil {
+			return str
+		}
+		log.Println("OAuth Store: Token generator failed!", err)
+	}
+	if s.randStr == nil {
+		return <-RandStr
+	}
+	select {
+	case str := <-s.randStr:
+		return str
+	case <-s.stop:
+		return <-RandStr
+	}
+}
+
+// Close stops the generator of codes and tokens, and closes the backend if
+// it is an io.Closer
+func (s *StoreImpl) Close() (err error) {
+	s.closeOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+		}
+		if c, ok := s.Backend.(io.Closer); ok {
+			err = c.Close()
+		}
+	})
+	return err
+}
+
+// Load a registered client
+// Return a ServerError if the client is unknown or can't be loaded
+func (s *StoreImpl) GetClient(clientID string) (Client, error) {
+	if s.Clients == nil {
+		return NewClient(clientID), nil
+	}
+
+	var client Client
+	var err error
+	if loader, ok := s.Clients.(ClientLoader); ok {
+		client, err = loader.LoadClient(clientID)
+	} else {
+		var valid bool
+		if valid, err = s.Clients.ValidClient(clientID); valid {
+			client = NewClient(clientID)
+		}
+	}
+
+	if err != nil {
+		log.Println("OAuth Store: Error loading client!", clientID, err)
+		if errors.Is(err, ErrBackendUnavailable) {
+			return nil, err
+		}
+		return nil, NewServerError(ErrorCodeServerError,
+			"The client could not be loaded.", "").WithCause(err)
+	} else if client == nil {
+		return nil, NewServerError(ErrorCodeUnauthorizedClient,
+			"The client is not registered.", "")
 	}
+	return client, nil
 }
 
 // Create the authorization code for the Authorization Code Grant flow
 // Return a ServerError if the authorization code cannot be requested
 // http://tools.ietf.org/html/draft-ietf-oauth-v2-28#section-4.1.1
 func (s *StoreImpl) CreateAuthCode(r *OAuthRequest) (string, error) {
-	code := <-RandStr
-	if err := s.Backend.RegisterAuthCode(r.ClientID,
-		r.Scope, r.redirectURI_raw, code); err != nil {
+	code := s.randomString()
+	if err := s.registerAuthCode(code, AuthCodeInfo{
+		ClientID:    r.ClientID,
+		Scope:       r.Scope,
+		RedirectURI: r.redirectURI_raw,
+		IssuedAt:    s.now(),
+		RequestIP:   remoteIP(r.RemoteAddr),
+		Resource:    r.Resource,
+		UserID:      r.UserID,
+		Extra:       r.Extra,
+	}); err != nil {
 		return "", err
 	}
 
@@ -66,50 +346,309 @@ func (s *StoreImpl) CreateAuthCode(r *OAuthRequest) (string, error) {
 // The token type, token and expiry should conform to the response guidelines
 // http://tools.ietf.org/html/draft-ietf-oauth-v2-28#section-4.2.2
 func (s *StoreImpl) CreateImplicitAccessToken(r *OAuthRequest) (token, token_type string, expiry int64, err error) {
-	token = <-RandStr
-	ttype, exp, err := s.Backend.RegisterAccessToken(r.ClientID, r.Scope, token)
+	client, err := s.GetClient(r.ClientID)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	if err = s.enforceTokenLimit(client); err != nil {
+		return "", "", 0, err
+	}
+
+	// The token starts the session
+	now := s.now()
+	lifetime, err := s.tokenLifetime(client, now)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	token = s.randomString()
+	ttype, exp, err := s.registerAccessToken(token, TokenInfo{
+		ClientID: r.ClientID,
+		Scope:    r.Scope,
+		Audience: r.Resource,
+		UserID:   r.UserID,
+		IssuedAt: now,
+		AuthTime: now,
+	}, lifetime)
 
 	if err != nil {
 		return "", "", 0, err
 	}
-	return token, ttype, exp, nil
+	return s.issuedToken(token), ttype, exp, nil
 }
 
 // Validate an authorization code is valid and generate access token
 // Return true if valid, false otherwise.
 func (s *StoreImpl) CreateAccessToken(r *AccessTokenRequest) (token, token_type string, expiry int64, err error) {
 
-	cid, scope, uri, err := s.Backend.LookupAuthCode(r.Code)
-	if err != nil {
+	// The code is consumed before the request is checked, so that it can't
+	// be exchanged twice, and a request that failed must get a new code
+	info, err := s.takeAuthCode(r.Code)
+	if errors.Is(err, ErrCodeExpired) {
+		return "", "", 0, NewServerError(ErrorCodeInvalidGrant,
+			"The authorization code has expired.", "").WithCause(err)
+	} else if errors.Is(err, ErrCodeNotFound) {
+		return "", "", 0, NewServerError(ErrorCodeInvalidGrant,
+			"The authorization code is unknown or was already used.", "").WithCause(err)
+	} else if err != nil {
 		return
 	}
+	return s.exchangeCode(r, info)
+}
+
+// Issue an access token for a valid authorization code, once the request
+// matches the information registered with the code
+func (s *StoreImpl) exchangeCode(r *AccessTokenRequest, info *AuthCodeInfo) (token, token_type string, expiry int64, err error) {
+	if r.ClientID != "" && r.ClientID != info.ClientID {
+		return "", "", 0, NewServerError(ErrorCodeInvalidGrant,
+			"The authorization code was issued to another client.", "")
+	}
+	uri := info.RedirectURI
 
-	// Check Valid Redirect URI
-	if uri != r.RedirectURI {
+	// Check the redirect URI. It is required, and must be identical, only
+	// if it was included in the authorization request.
+	// http://tools.ietf.org/html/draft-ietf-oauth-v2-28#section-4.1.3
+	if uri != "" && r.RedirectURI == "" {
+		err = NewServerError(ErrorCodeInvalidRequest,
+			"The \"redirect_uri\" parameter is missing.", "")
+	} else if uri != r.RedirectURI {
 		err = NewServerError(ErrorCodeBadRedirectURI, "Redirect URI Incorrect.", "")
+	}
+	if err != nil {
+		// Keep track of where the rejected code came from, for the
+		// server logs only
+		log.Printf("OAuth Store: Rejected auth code issued at %s to client %q from %q: %s",
+			info.IssuedAt.Format(time.RFC3339), info.ClientID, info.RequestIP,
+			err.(ServerError).Description())
 		return
 	}
 
+	// Check the client may still use this grant
+	client, err := s.GetClient(info.ClientID)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if err = checkClientGrant(client, GrantTypeAuthorizationCode, info.Scope); err != nil {
+		return "", "", 0, err
+	}
+
+	// The token may be restricted to the resource of the authorization
+	// request, but not to another one
+	// http://tools.ietf.org/html/rfc8707#section-2.2
+	audience := info.Resource
+	if r.Resource != "" {
+		if audience != "" && r.Resource != audience {
+			return "", "", 0, NewServerError(ErrorCodeInvalidTarget,
+				"The resource was not part of the authorization request.", "")
+		}
+		audience = r.Resource
+	}
+
+	// The token may have a narrower scope than the one granted, but not a
+	// broader one
+	scope := info.Scope
+	if r.Scope != "" {
+		if !subsetScope(r.Scope, info.Scope) {
+			return "", "", 0, NewServerError(ErrorCodeInvalidScope,
+				"The requested scope exceeds the scope granted.", "")
+		}
+		scope = uniqueScope(r.Scope)
+		// The token response reports the scope that was issued
+		r.Scope = scope
+	}
+
+	// The session started when the code was issued, and exchanging the
+	// code late doesn't extend it
+	now := s.now()
+	authTime := info.IssuedAt
+	if authTime.IsZero() {
+		authTime = now
+	}
+	lifetime, err := s.tokenLifetime(client, authTime)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	if err = s.enforceTokenLimit(client); err != nil {
+		return "", "", 0, err
+	}
+
 	// All good
-	token = <-RandStr
-	ttype, exp, err := s.Backend.RegisterAccessToken(cid, scope, token)
+	token = s.randomString()
+	ttype, exp, err := s.registerAccessToken(token, TokenInfo{
+		ClientID: info.ClientID,
+		Scope:    scope,
+		Audience: audience,
+		UserID:   info.UserID,
+		IssuedAt: now,
+		AuthTime: authTime,
+	}, lifetime)
 	if err != nil {
 		return "", "", 0, err
 	}
 
-	return token, ttype, exp, nil
+	for k, v := range info.Extra {
+		if r.Extra == nil {
+			r.Extra = make(map[string]string)
+		}
+		if _, ok := r.Extra[k]; !ok {
+			r.Extra[k] = v
+		}
+	}
+
+	audit(s.AuditLogger, context.Background(), AuditCodeExchanged, map[string]interface{}{
+		"client_id": info.ClientID,
+		"user_id":   info.UserID,
+		"scope":     scope,
+	})
+	return s.issuedToken(token), ttype, exp, nil
 }
 
 // Validate an access token is valid
 // Return true if valid, false otherwise.
 // Note: Supports only bearer tokens
 func (s *StoreImpl) ValidateAccessToken(authorization_field string) (bool, error) {
-	token := authorization_field // TODO
-
-	valid, err := s.Backend.LookupAccessToken(token)
+	if _, ok := s.Backend.(AccessTokenChecker); !ok {
+		info, err := s.ValidateAccessTokenInfo(authorization_field)
+		return info != nil, err
+	}
+	// The backend can check a token without building its information
+	token, err := s.tokenValue(authorization_field)
 	if err != nil {
 		return false, err
 	}
+	return s.checkAccessToken(token)
+}
+
+// Validate an access token and return its information, with a single
+// lookup in the backend
+// Return nil if it is not valid.
+// Note: Supports only bearer tokens
+func (s *StoreImpl) ValidateAccessTokenInfo(authorization_field string) (*TokenInfo, error) {
+	token, err := s.tokenValue(authorization_field)
+	if err != nil {
+		return nil, err
+	}
 
+	info, err := s.lookupAccessToken(token)
+	if info != nil {
+		info.Token = authorization_field
+	}
+	return info, err
+}
+
+// Validate several access tokens with a single lookup in the backend
+// Return whether each one is valid, keyed by authorization field.
+// Note: Supports only bearer tokens
+func (s *StoreImpl) ValidateAccessTokens(authorization_fields []string) (map[string]bool, error) {
+	// Tampered tokens are invalid without a lookup
+	valid := make(map[string]bool, len(authorization_fields))
+	var tokens []string
+	values := make(map[string]string, len(authorization_fields))
+	for _, field := range authorization_fields {
+		token, err := s.tokenValue(field)
+		if err != nil {
+			valid[field] = false
+			continue
+		}
+		tokens = append(tokens, token)
+		values[field] = token
+	}
+	if len(tokens) == 0 {
+		return valid, nil
+	}
+
+	found, err := s.lookupAccessTokens(tokens)
+	if err != nil {
+		return nil, err
+	}
+	for field, token := range values {
+		valid[field] = found[token]
+	}
 	return valid, nil
 }
+
+// Revoke an access token
+// Returns ErrNotSupported if the backend can't revoke tokens
+func (s *StoreImpl) RevokeToken(token string) error {
+	if r, ok := s.Backend.(TokenRevoker); ok {
+		value, err := s.tokenValue(token)
+		if err != nil {
+			return err
+		}
+		fields := map[string]interface{}{"token_hash": AuditTokenHash(token)}
+		if s.AuditLogger != nil {
+			if info, _ := s.lookupAccessToken(value); info != nil {
+				fields["client_id"] = info.ClientID
+				fields["user_id"] = info.UserID
+			}
+		}
+		if err := r.RevokeToken(value); err != nil {
+			return err
+		}
+		audit(s.AuditLogger, context.Background(), AuditTokenRevoked, fields)
+		return nil
+	}
+	return ErrNotSupported
+}
+
+// Check that the backend is reachable, if it supports checking
+func (s *StoreImpl) Ping(ctx context.Context) error {
+	if p, ok := s.Backend.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// List the tokens issued to a client, without the tokens themselves
+// Returns ErrNotSupported if the backend can't enumerate tokens
+func (s *StoreImpl) ListTokensByClient(clientID string) ([]TokenSummary, error) {
+	e, ok := s.Backend.(TokenEnumerator)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	tokens, err := e.ListTokensByClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]TokenSummary, len(tokens))
+	for i, info := range tokens {
+		summaries[i] = info.Summary()
+	}
+	return summaries, nil
+}
+
+// List the tokens authorized by a user, without the tokens themselves
+// Returns ErrNotSupported if the backend can't list a user's tokens
+func (s *StoreImpl) ListUserTokens(userID string) ([]TokenSummary, error) {
+	if l, ok := s.Backend.(UserTokenLister); ok {
+		return l.ListUserTokens(userID)
+	}
+	return nil, ErrNotSupported
+}
+
+// Invalidate the tokens a user authorized before t
+// Returns ErrNotSupported if the backend doesn't keep user cutoffs
+func (s *StoreImpl) SetUserCutoff(userID string, t time.Time) error {
+	if c, ok := s.Backend.(UserCutoffSetter); ok {
+		return c.SetUserCutoff(userID, t)
+	}
+	return ErrNotSupported
+}
+
+// Revoke every token issued to a client
+// Returns ErrNotSupported if the backend can't revoke tokens in bulk
+func (s *StoreImpl) RevokeByClient(clientID string) (int, error) {
+	if r, ok := s.Backend.(BulkRevoker); ok {
+		n, err := r.RevokeByClient(clientID)
+		if err == nil {
+			audit(s.AuditLogger, context.Background(), AuditTokenRevoked, map[string]interface{}{
+				"client_id": clientID,
+				"count":     n,
+			})
+		}
+		return n, err
+	}
+	return 0, ErrNotSupported
+}
@@ -0,0 +1,303 @@
+package goauth2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The separator of the tenant in the keys of a TenantCache. Tenant names
+// can't contain it.
+const tenantSeparator = "@"
+
+// TenantConfig is the configuration of a tenant registered by
+// RegisterTenant
+type TenantConfig struct {
+	// The backend of the codes and tokens of the tenant. It may be shared
+	// with other tenants. Required.
+	Cache AuthCache
+	// The clients of the tenant. Any client is accepted if it is nil.
+	Clients ClientStore
+	// The AuthHandler of the tenant, the Server's if nil
+	Auth AuthHandler
+	// The error URIs of the tenant, in addition to the Server's
+	ErrorURIs map[ErrorCode]string
+	// The Issuer of the tenant, the Server's if empty
+	Issuer string
+}
+
+// RegisterTenant
+// Add a tenant to a Server whose TenantResolver is set. The requests
+// resolved to the tenant are served by a Server of its own, with its
+// clients, AuthHandler and error URIs, and a Store whose backend is the
+// tenant's view of the cache made by NewTenantCache, so that tenants may
+// share a cache without seeing each other's codes and tokens.
+//
+// The tenant's Server starts with a copy of the settings of s, and is
+// returned to be configured further, such as to register grant types. Like
+// RegisterGrantType, RegisterTenant must not be called while requests are
+// served.
+func (s *Server) RegisterTenant(name string, config TenantConfig) (*Server, error) {
+	switch {
+	case name == "" || strings.Contains(name, tenantSeparator):
+		return nil, fmt.Errorf("Invalid tenant name %q", name)
+	case config.Cache == nil:
+		return nil, errors.New("The AuthCache of a tenant is required")
+	case s.tenants[name] != nil:
+		return nil, fmt.Errorf("The tenant %q is already registered", name)
+	}
+
+	store := NewStore(NewTenantCache(config.Cache, name))
+	store.Clients = config.Clients
+	store.AuditLogger = s.AuditLogger
+
+	t := *s
+	t.Store = store
+	t.TenantResolver = nil
+	t.tenants = nil
+	if config.Auth != nil {
+		t.Auth = config.Auth
+	}
+	if config.Issuer != "" {
+		t.Issuer = config.Issuer
+	}
+	t.errorURIs = make(map[errorCode]string)
+	for code, uri := range s.errorURIs {
+		t.errorURIs[code] = uri
+	}
+	for code, uri := range config.ErrorURIs {
+		t.errorURIs[code] = uri
+	}
+	// The built-in grants use the Store of their Server
+	t.grants = nil
+	for grantType, handler := range s.grants {
+		t.RegisterGrantType(grantType, handler)
+	}
+	t.RegisterGrantType(GrantTypeAuthorizationCode, t.authorizationCodeGrant)
+	t.RegisterGrantType(GrantTypeTokenExchange, t.exchangeToken)
+
+	if s.tenants == nil {
+		s.tenants = make(map[string]*Server)
+	}
+	s.tenants[name] = &t
+	return &t, nil
+}
+
+// Tenant returns the Server of a registered tenant, or nil
+func (s *Server) Tenant(name string) *Server {
+	return s.tenants[name]
+}
+
+// The Server serving a request: the Server of its tenant if there is a
+// TenantResolver, and s otherwise
+func (s *Server) tenantServer(r *http.Request) (*Server, error) {
+	if s.TenantResolver == nil {
+		return s, nil
+	}
+	name, err := s.TenantResolver(r)
+	if err != nil {
+		return nil, err
+	}
+	if t := s.tenants[name]; t != nil {
+		return t, nil
+	}
+	return nil, s.NewError(ErrorCodeInvalidRequest,
+		fmt.Sprintf("The tenant %q is unknown.", name))
+}
+
+// ----------------------------------------------------------------------------
+
+// TenantCache is the view of a tenant of a shared AuthCache. The codes,
+// tokens, pushed requests, client IDs and user IDs of the tenant are kept
+// in the cache with the tenant's name appended, so that the keys of
+// tenants never collide and the listings and revocations by client or user
+// stay within the tenant. The name is appended rather than prepended so
+// that the TokenID of a long token is the same in the cache.
+type TenantCache struct {
+	cache  AuthCache
+	tenant string
+}
+
+// Create the view of a tenant of cache
+func NewTenantCache(cache AuthCache, tenant string) *TenantCache {
+	return &TenantCache{cache: cache, tenant: tenant}
+}
+
+// The key of a value of the tenant in the cache. Empty values stay empty.
+func (c *TenantCache) key(value string) string {
+	if value == "" {
+		return ""
+	}
+	return value + tenantSeparator + c.tenant
+}
+
+// The value of a key of the tenant
+func (c *TenantCache) strip(key string) string {
+	return strings.TrimSuffix(key, tenantSeparator+c.tenant)
+}
+
+func (c *TenantCache) RegisterAuthCode(code string, info AuthCodeInfo) error {
+	info.ClientID, info.UserID = c.key(info.ClientID), c.key(info.UserID)
+	return c.cache.RegisterAuthCode(c.key(code), info)
+}
+
+func (c *TenantCache) RegisterAccessToken(token string, info TokenInfo, lifetime TokenLifetime) (string, int64, error) {
+	info.ClientID, info.UserID = c.key(info.ClientID), c.key(info.UserID)
+	return c.cache.RegisterAccessToken(c.key(token), info, lifetime)
+}
+
+func (c *TenantCache) LookupAuthCode(code string) (*AuthCodeInfo, error) {
+	info, err := c.cache.LookupAuthCode(c.key(code))
+	if info != nil {
+		info.ClientID, info.UserID = c.strip(info.ClientID), c.strip(info.UserID)
+	}
+	return info, err
+}
+
+// Add a code of the tenant unless it is registered already
+// Returns ErrNotSupported if the cache can't add codes
+func (c *TenantCache) AddAuthCode(code string, info AuthCodeInfo, lifetime time.Duration) (bool, error) {
+	adder, ok := c.cache.(CodeAdder)
+	if !ok {
+		return false, ErrNotSupported
+	}
+	info.ClientID, info.UserID = c.key(info.ClientID), c.key(info.UserID)
+	return adder.AddAuthCode(c.key(code), info, lifetime)
+}
+
+// Take a code of the tenant
+// Returns ErrNotSupported if the cache can't take codes
+func (c *TenantCache) TakeAuthCode(code string) (*AuthCodeInfo, error) {
+	consumer, ok := c.cache.(CodeConsumer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	info, err := consumer.TakeAuthCode(c.key(code))
+	if info != nil {
+		info.ClientID, info.UserID = c.strip(info.ClientID), c.strip(info.UserID)
+	}
+	return info, err
+}
+
+func (c *TenantCache) LookupAccessToken(token string) (*TokenInfo, error) {
+	info, err := c.cache.LookupAccessToken(c.key(token))
+	if info != nil {
+		c.stripTokenInfo(info)
+	}
+	return info, err
+}
+
+// Check a token of the tenant, with the cache's AccessTokenChecker if it
+// has one
+func (c *TenantCache) CheckAccessToken(token string) (bool, error) {
+	if checker, ok := c.cache.(AccessTokenChecker); ok {
+		return checker.CheckAccessToken(c.key(token))
+	}
+	info, err := c.cache.LookupAccessToken(c.key(token))
+	return info != nil, err
+}
+
+func (c *TenantCache) LookupAccessTokens(tokens []string) (map[string]bool, error) {
+	keys := make([]string, len(tokens))
+	for i, token := range tokens {
+		keys[i] = c.key(token)
+	}
+	found, err := c.cache.LookupAccessTokens(keys)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]bool, len(found))
+	for key, valid := range found {
+		res[c.strip(key)] = valid
+	}
+	return res, nil
+}
+
+func (c *TenantCache) stripTokenInfo(info *TokenInfo) {
+	info.Token = c.strip(info.Token)
+	info.ClientID, info.UserID = c.strip(info.ClientID), c.strip(info.UserID)
+}
+
+// Revoke a token of the tenant
+// Returns ErrNotSupported if the cache can't revoke tokens
+func (c *TenantCache) RevokeToken(token string) error {
+	if r, ok := c.cache.(TokenRevoker); ok {
+		return r.RevokeToken(c.key(token))
+	}
+	return ErrNotSupported
+}
+
+// List the tokens of a client of the tenant
+// Returns ErrNotSupported if the cache can't enumerate tokens
+func (c *TenantCache) ListTokensByClient(clientID string) ([]TokenInfo, error) {
+	e, ok := c.cache.(TokenEnumerator)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	tokens, err := e.ListTokensByClient(c.key(clientID))
+	for i := range tokens {
+		c.stripTokenInfo(&tokens[i])
+	}
+	return tokens, err
+}
+
+// Revoke the tokens of a client of the tenant
+// Returns ErrNotSupported if the cache can't revoke them
+func (c *TenantCache) RevokeByClient(clientID string) (int, error) {
+	if r, ok := c.cache.(BulkRevoker); ok {
+		return r.RevokeByClient(c.key(clientID))
+	}
+	return 0, ErrNotSupported
+}
+
+// List the tokens of a user of the tenant
+// Returns ErrNotSupported if the cache can't list a user's tokens
+func (c *TenantCache) ListUserTokens(userID string) ([]TokenSummary, error) {
+	l, ok := c.cache.(UserTokenLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	tokens, err := l.ListUserTokens(c.key(userID))
+	for i := range tokens {
+		tokens[i].ClientID = c.strip(tokens[i].ClientID)
+	}
+	return tokens, err
+}
+
+// Invalidate the tokens of a user of the tenant issued before t
+// Returns ErrNotSupported if the cache can't set cutoffs
+func (c *TenantCache) SetUserCutoff(userID string, t time.Time) error {
+	if s, ok := c.cache.(UserCutoffSetter); ok {
+		return s.SetUserCutoff(c.key(userID), t)
+	}
+	return ErrNotSupported
+}
+
+// Keep a pushed request of the tenant
+// Returns ErrNotSupported if the cache can't keep pushed requests
+func (c *TenantCache) RegisterPushedRequest(id string, data []byte, expiry time.Duration) error {
+	if p, ok := c.cache.(PushedRequestCache); ok {
+		return p.RegisterPushedRequest(c.key(id), data, expiry)
+	}
+	return ErrNotSupported
+}
+
+// Take a pushed request of the tenant
+// Returns ErrNotSupported if the cache can't keep pushed requests
+func (c *TenantCache) TakePushedRequest(id string) ([]byte, error) {
+	if p, ok := c.cache.(PushedRequestCache); ok {
+		return p.TakePushedRequest(c.key(id))
+	}
+	return nil, ErrNotSupported
+}
+
+// Check that the shared cache is reachable
+func (c *TenantCache) Ping(ctx context.Context) error {
+	if p, ok := c.cache.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
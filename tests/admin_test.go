@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Create a server with tokens for two clients
+func newAdminTestServer(t *testing.T) (*goauth2.Server, *authcache.BasicAuthCache) {
+	ac := authcache.NewBasicAuthCache()
+	for i := 0; i < 3; i++ {
+		for _, client := range []string{"client1", "client2"} {
+			if _, _, err := ac.RegisterAccessToken(fmt.Sprintf("token%d-%s", i, client), goauth2.TokenInfo{ClientID: client}, goauth2.TokenLifetime{}); err != nil {
+				t.Fatal("Error registering access token", err)
+			}
+		}
+	}
+
+	server := goauth2.NewServer(ac, authhandler.NewWhiteList("client1"))
+	server.AdminAuthorizer = func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "admin-secret" {
+			return fmt.Errorf("bad admin credentials")
+		}
+		return nil
+	}
+	return server, ac
+}
+
+func adminRequest(server *goauth2.Server, method, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "admin-secret")
+	w := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(w, req)
+	return w
+}
+
+// Revoking one client's tokens leaves the other client's tokens intact
+func TestRevokeByClient(t *testing.T) {
+	server, ac := newAdminTestServer(t)
+
+	if tokens, err := ac.ListTokensByClient("client1"); err != nil || len(tokens) != 3 {
+		t.Fatal("Bad listing of client1 tokens", tokens, err)
+	}
+
+	w := adminRequest(server, "DELETE", "/clients/client1/tokens")
+	if w.Code != http.StatusOK {
+		t.Fatal("Revocation response status is bad", w.Code, w.Body.String())
+	}
+	res := make(map[string]int)
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal("Could not unmarshal response body.", err)
+	}
+	if res["revoked"] != 3 {
+		t.Error("Wrong number of revoked tokens", res["revoked"])
+	}
+
+	if info, _ := ac.LookupAccessToken("token0-client1"); info != nil {
+		t.Error("Revoked token is still valid")
+	}
+	if tokens, err := ac.ListTokensByClient("client2"); err != nil || len(tokens) != 3 {
+		t.Error("client2 tokens were affected by the revocation", tokens, err)
+	}
+}
+
+// A page of the admin listing
+type adminPage struct {
+	Tokens     []map[string]interface{} `json:"tokens"`
+	Total      int                      `json:"total"`
+	NextOffset *int                     `json:"next_offset"`
+}
+
+func adminList(t *testing.T, server *goauth2.Server, path string) adminPage {
+	t.Helper()
+	w := adminRequest(server, "GET", path)
+	if w.Code != http.StatusOK {
+		t.Fatal("Listing response status is bad", w.Code, w.Body.String())
+	}
+	var page adminPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal("Could not unmarshal response body.", err)
+	}
+	return page
+}
+
+// Listing returns the client's tokens and only them, without their values
+func TestAdminListTokens(t *testing.T) {
+	server, _ := newAdminTestServer(t)
+
+	page := adminList(t, server, "/admin/clients/client2/tokens")
+	if len(page.Tokens) != 3 || page.Total != 3 || page.NextOffset != nil {
+		t.Fatal("Wrong tokens listed", page)
+	}
+	for _, token := range page.Tokens {
+		if token["client_id"] != "client2" || token["token"] != nil ||
+			!strings.HasPrefix(token["token_id"].(string), "token") || len(token["token_id"].(string)) != 7 {
+			t.Error("Bad listed token", token)
+		}
+	}
+}
+
+// Listings are paginated in a stable order
+func TestAdminListPages(t *testing.T) {
+	server, _ := newAdminTestServer(t)
+
+	first := adminList(t, server, "/clients/client1/tokens?limit=2")
+	if len(first.Tokens) != 2 || first.Total != 3 || first.NextOffset == nil || *first.NextOffset != 2 {
+		t.Fatal("Bad first page", first)
+	}
+	second := adminList(t, server, fmt.Sprintf("/clients/client1/tokens?limit=2&offset=%d", *first.NextOffset))
+	if len(second.Tokens) != 1 || second.NextOffset != nil {
+		t.Fatal("Bad last page", second)
+	}
+	seen := map[interface{}]bool{}
+	for _, token := range append(first.Tokens, second.Tokens...) {
+		seen[token["token_id"]] = true
+	}
+	if len(seen) != 3 {
+		t.Error("Pages overlap", first, second)
+	}
+
+	for _, bad := range []string{"?limit=0", "?limit=abc", "?offset=-1"} {
+		if w := adminRequest(server, "GET", "/clients/client1/tokens"+bad); w.Code != http.StatusBadRequest {
+			t.Error("Bad page was accepted", bad, w.Code)
+		}
+	}
+}
+
+// A single token is revoked by its value
+func TestAdminRevokeToken(t *testing.T) {
+	server, ac := newAdminTestServer(t)
+
+	w := adminRequest(server, "DELETE", "/admin/tokens/token1-client1")
+	if w.Code != http.StatusOK {
+		t.Fatal("Revocation response status is bad", w.Code, w.Body.String())
+	}
+	if info, _ := ac.LookupAccessToken("token1-client1"); info != nil {
+		t.Error("Revoked token is still valid")
+	}
+	if tokens, _ := ac.ListTokensByClient("client1"); len(tokens) != 2 {
+		t.Error("Other tokens were revoked", tokens)
+	}
+
+	for path, status := range map[string]int{
+		"/admin/unknown":               http.StatusNotFound,
+		"/admin/tokens/token0-client1": http.StatusMethodNotAllowed,
+	} {
+		if w := adminRequest(server, "GET", path); w.Code != status {
+			t.Error("Bad status", path, w.Code, status)
+		}
+	}
+}
+
+// A Store without enumeration nor revocation gives 501
+func TestAdminNotImplemented(t *testing.T) {
+	server, _ := newAdminTestServer(t)
+	server.Store = plainStore{server.Store}
+
+	for _, r := range []struct{ method, path string }{
+		{"GET", "/clients/client1/tokens"},
+		{"DELETE", "/clients/client1/tokens"},
+		{"DELETE", "/tokens/token0-client1"},
+	} {
+		if w := adminRequest(server, r.method, r.path); w.Code != http.StatusNotImplemented {
+			t.Error("Unsupported route was not 501", r, w.Code)
+		}
+	}
+}
+
+// A Store with only the methods of the interface
+type plainStore struct {
+	goauth2.Store
+}
+
+// Admin requests must be authorized
+func TestAdminForbidden(t *testing.T) {
+	server, _ := newAdminTestServer(t)
+
+	req, _ := http.NewRequest("DELETE", "/clients/client1/tokens", nil)
+	w := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Error("Unauthorized admin request was not forbidden", w.Code)
+	}
+}
+
+// Without an AdminAuthorizer, every admin request is forbidden
+func TestAdminDenyAllByDefault(t *testing.T) {
+	server, _ := newAdminTestServer(t)
+	server.AdminAuthorizer = nil
+
+	if w := adminRequest(server, "GET", "/clients/client1/tokens"); w.Code != http.StatusForbidden {
+		t.Error("Admin request was allowed without an AdminAuthorizer", w.Code)
+	}
+}
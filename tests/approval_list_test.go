@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Exact entries win over patterns, and longer patterns over shorter ones
+func TestApprovalListPatterns(t *testing.T) {
+	al := authhandler.NewWhiteList("internal-*", "client1")
+	al.Deny("internal-test-*")
+	al.Allow("internal-test-ok")
+
+	cases := map[string]bool{
+		"client1":          true,
+		"client2":          false,
+		"internal-api":     true,
+		"internal-test-db": false,
+		"internal-test-ok": true,
+	}
+	for clientID, want := range cases {
+		if got := al.Approves(clientID); got != want {
+			t.Error("Bad policy for", clientID, got)
+		}
+	}
+
+	// Removing an entry falls back to the patterns, then the default
+	al.Remove("internal-test-ok")
+	if al.Approves("internal-test-ok") {
+		t.Error("Removed client is still allowed")
+	}
+	al.Remove("client1")
+	if al.Approves("client1") {
+		t.Error("Removed client does not follow the default policy")
+	}
+}
+
+func TestApprovalListJSON(t *testing.T) {
+	al := new(authhandler.ApprovalList)
+	err := json.Unmarshal([]byte(`{"default": true, "deny": ["bad-*"], "allow": ["bad-but-ok"]}`), al)
+	if err != nil {
+		t.Fatal("Error loading the list", err)
+	}
+	if !al.Approves("client1") || al.Approves("bad-client") || !al.Approves("bad-but-ok") {
+		t.Error("Bad policy of the loaded list", al.List)
+	}
+
+	b, err := json.Marshal(al)
+	if err != nil {
+		t.Fatal("Error saving the list", err)
+	}
+	if string(b) != `{"default":true,"allow":["bad-but-ok"],"deny":["bad-*"]}` {
+		t.Error("Bad JSON of the list", string(b))
+	}
+}
+
+// The list may change while requests are authorized
+func TestApprovalListConcurrent(t *testing.T) {
+	al := authhandler.NewWhiteList("client1")
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), al)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id := "client" + strconv.Itoa(i*100+j+2)
+				al.Allow(id)
+				al.Deny(id)
+				al.Remove(id)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := clientAuthorizeRequest(server, "client1", "code")
+				loc, _ := url.Parse(w.Header().Get("Location"))
+				if loc.Query().Get("code") == "" {
+					t.Error("Allowed client was denied", loc)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Send an authorization request for client1 with a scope
+func scopedAuthorizeRequest(server *goauth2.Server, responseType, scope string) *url.URL {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: responseType,
+		RedirectURI:  "http://localhost/redirect",
+		Scope:        scope,
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	return loc
+}
+
+// Clients limited to some scopes are granted only those
+func TestApprovalListScopes(t *testing.T) {
+	al := authhandler.NewWhiteList("client1")
+	al.SetScopes("client1", "read", "profile")
+	cache := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(cache, al)
+
+	loc := scopedAuthorizeRequest(server, "code", "read write")
+	code := loc.Query().Get("code")
+	if code == "" {
+		t.Fatal("Code request was refused", loc)
+	}
+	token, _, _, err := server.Store.CreateAccessToken(&goauth2.AccessTokenRequest{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	})
+	if err != nil {
+		t.Fatal("Error exchanging the code", err)
+	}
+	if scope := cache.AccessTokens[token].Scope; scope != "read" {
+		t.Error("Token was not downgraded to the allowed scope", scope)
+	}
+
+	loc = scopedAuthorizeRequest(server, "token", "read write profile")
+	frag, _ := url.ParseQuery(loc.Fragment)
+	if entry, ok := cache.AccessTokens[frag.Get("access_token")]; !ok || entry.Scope != "read profile" {
+		t.Error("Implicit token was not downgraded to the allowed scope", loc)
+	}
+
+	// No allowed scope left
+	loc = scopedAuthorizeRequest(server, "code", "write")
+	if loc.Query().Get("error") != "invalid_scope" || loc.Query().Get("code") != "" {
+		t.Error("Request for a forbidden scope was not refused", loc)
+	}
+
+	// Lifting the limit grants the whole request
+	al.SetScopes("client1")
+	loc = scopedAuthorizeRequest(server, "token", "read write")
+	frag, _ = url.ParseQuery(loc.Fragment)
+	if entry, ok := cache.AccessTokens[frag.Get("access_token")]; !ok || entry.Scope != "read write" {
+		t.Error("Scope was limited after lifting the limit", loc)
+	}
+}
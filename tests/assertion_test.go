@@ -0,0 +1,181 @@
+package tests
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The audience of the assertions sent to the token endpoint
+const assertionAudience = "http://auth.example.com/oauth2"
+
+// Sign a client assertion with an RSA or ECDSA key
+func signAssertion(t *testing.T, key crypto.Signer, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(input))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		r, s, e := ecdsa.Sign(rand.Reader, k, hash[:])
+		sig, err = make([]byte, 64), e
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	if err != nil {
+		t.Fatal("Error signing assertion", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// The claims of a valid assertion of a client, with a new identifier
+func assertionClaims(clientID string) map[string]interface{} {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return map[string]interface{}{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": assertionAudience,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"jti": base64.RawURLEncoding.EncodeToString(id),
+	}
+}
+
+// Post a token request for a code of client1, authenticated by an assertion
+func assertionTokenRequest(t *testing.T, server *goauth2.Server, assertionType, assertion string) map[string]string {
+	loc := authorizeRequest(t, server, "code")
+	body := url.Values{
+		"grant_type":            {"authorization_code"},
+		"code":                  {loc.Query().Get("code")},
+		"redirect_uri":          {"http://localhost/redirect"},
+		"client_assertion_type": {assertionType},
+		"client_assertion":      {assertion},
+	}
+	req, _ := http.NewRequest("POST", assertionAudience, strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	return ret
+}
+
+func TestClientAssertion(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(goauth2.NewClient("client1"))
+	clients.AddClient(goauth2.NewClient("client2"))
+	clients.SetPublicKey("client1", &rsaKey.PublicKey)
+	clients.SetPublicKey("client2", &ecKey.PublicKey)
+	server := goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients,
+		authhandler.NewWhiteList("client1", "client2"))
+	server.Issuer = "http://auth.example.com"
+
+	valid := signAssertion(t, rsaKey, assertionClaims("client1"))
+	ret := assertionTokenRequest(t, server, goauth2.ClientAssertionTypeJWTBearer, valid)
+	if ret["token"] == "" {
+		t.Error("Valid RS256 assertion was refused", ret)
+	}
+
+	// Other claims, keys and types are refused
+	expired := assertionClaims("client1")
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	audience := assertionClaims("client1")
+	audience["aud"] = []string{"https://other.example.com/token"}
+	subject := assertionClaims("client1")
+	subject["sub"] = "client2"
+	noID := assertionClaims("client1")
+	delete(noID, "jti")
+	tests := []struct {
+		name, assertionType, assertion, err string
+	}{
+		{"expired", goauth2.ClientAssertionTypeJWTBearer, signAssertion(t, rsaKey, expired), "invalid_client"},
+		{"wrong audience", goauth2.ClientAssertionTypeJWTBearer, signAssertion(t, rsaKey, audience), "invalid_client"},
+		{"subject not issuer", goauth2.ClientAssertionTypeJWTBearer, signAssertion(t, rsaKey, subject), "invalid_client"},
+		{"wrong key", goauth2.ClientAssertionTypeJWTBearer, signAssertion(t, otherKey, assertionClaims("client2")), "invalid_client"},
+		{"algorithm of another key", goauth2.ClientAssertionTypeJWTBearer, signAssertion(t, ecKey, assertionClaims("client1")), "invalid_client"},
+		{"no identifier", goauth2.ClientAssertionTypeJWTBearer, signAssertion(t, rsaKey, noID), "invalid_client"},
+		{"replay", goauth2.ClientAssertionTypeJWTBearer, valid, "invalid_client"},
+		{"not a JWT", goauth2.ClientAssertionTypeJWTBearer, "assertion", "invalid_client"},
+		{"unknown type", "urn:example:assertion", signAssertion(t, rsaKey, assertionClaims("client1")), "invalid_client"},
+		// The code was issued to client1
+		{"another client", goauth2.ClientAssertionTypeJWTBearer, signAssertion(t, ecKey, assertionClaims("client2")), "invalid_grant"},
+	}
+	for _, test := range tests {
+		if ret := assertionTokenRequest(t, server, test.assertionType, test.assertion); ret["error"] != test.err || ret["token"] != "" {
+			t.Errorf("Bad response to an assertion of %s: %v", test.name, ret)
+		}
+	}
+
+	md := getMetadata(t, server)
+	if methods, _ := md["token_endpoint_auth_methods_supported"].([]interface{}); len(methods) != 2 || methods[1] != "private_key_jwt" {
+		t.Error("Bad authentication methods", md["token_endpoint_auth_methods_supported"])
+	}
+
+	// Without an Issuer, the audience would come from the Host of the request
+	server.Issuer = ""
+	if ret := assertionTokenRequest(t, server, goauth2.ClientAssertionTypeJWTBearer,
+		signAssertion(t, rsaKey, assertionClaims("client1"))); ret["error"] != "invalid_client" {
+		t.Error("Assertion was accepted without an Issuer", ret)
+	}
+	md = getMetadata(t, server)
+	if methods, _ := md["token_endpoint_auth_methods_supported"].([]interface{}); len(methods) != 1 {
+		t.Error("Assertions were advertised without an Issuer", methods)
+	}
+}
+
+// ES256 assertions authenticate a client for token exchange
+func TestClientAssertionTokenExchange(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(goauth2.NewClient("client1"))
+	clients.SaveClient(&goauth2.ClientImpl{ClientID: "gateway", ClientType: goauth2.ClientTypeConfidential}, "secret")
+	clients.SetPublicKey("gateway", &key.PublicKey)
+	server := goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients, authhandler.NewWhiteList("client1"))
+	server.TokenExchangePolicy = gatewayPolicy
+	server.Issuer = "http://auth.example.com"
+
+	body := url.Values{
+		"grant_type":            {goauth2.GrantTypeTokenExchange},
+		"subject_token":         {implicitToken(t, server)},
+		"subject_token_type":    {goauth2.TokenTypeAccessToken},
+		"client_assertion_type": {goauth2.ClientAssertionTypeJWTBearer},
+		"client_assertion":      {signAssertion(t, key, assertionClaims("gateway"))},
+	}
+	req, _ := http.NewRequest("POST", assertionAudience, strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if ret["token"] == "" {
+		t.Error("Confidential client with a valid assertion was refused", w.Code, ret)
+	}
+}
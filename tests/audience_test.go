@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Get a token through the authorization code flow, requesting resources
+// at both steps
+func audienceToken(t *testing.T, server *goauth2.Server, authResource, tokenResource string) (string, error) {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+		Resource:     authResource,
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+
+	req, _ = oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        loc.Query().Get("code"),
+		RedirectURI: "http://localhost/redirect",
+		Resource:    tokenResource,
+	})
+	token, _, _, err := server.Store.CreateAccessToken(server.NewAccessTokenRequest(req))
+	return token, err
+}
+
+func apiStatus(resourceServer *goauth2.Server, token string) int {
+	api := resourceServer.TokenVerifier(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	req, _ := http.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	return w.Code
+}
+
+// Tokens are only accepted by the resource server they were issued for
+func TestTokenAudience(t *testing.T) {
+	cache := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(cache, authhandler.NewWhiteList("client1"))
+
+	// Two resource servers sharing the token cache
+	billing := goauth2.NewServer(cache, nil)
+	billing.Audience = "https://billing.example.com"
+	mail := goauth2.NewServer(cache, nil)
+	mail.Audience = "https://mail.example.com"
+
+	token, err := audienceToken(t, server, "https://billing.example.com", "")
+	if err != nil {
+		t.Fatal("Error getting token", err)
+	}
+	if code := apiStatus(billing, token); code != http.StatusOK {
+		t.Error("Token was refused by its audience", code)
+	}
+	if code := apiStatus(mail, token); code != http.StatusUnauthorized {
+		t.Error("Token was accepted by another resource server", code)
+	}
+
+	// The resource can be given at the token endpoint only
+	token, err = audienceToken(t, server, "", "https://mail.example.com")
+	if err != nil {
+		t.Fatal("Error getting token", err)
+	}
+	if code := apiStatus(mail, token); code != http.StatusOK {
+		t.Error("Token was refused by its audience", code)
+	}
+
+	// Tokens without audience are only accepted without audience checks
+	token, _ = audienceToken(t, server, "", "")
+	if code := apiStatus(mail, token); code != http.StatusUnauthorized {
+		t.Error("Token without audience was accepted", code)
+	}
+	if code := apiStatus(server, token); code != http.StatusOK {
+		t.Error("Token was refused without audience checks", code)
+	}
+}
+
+// The token endpoint can't switch to another resource than the authorized one
+func TestTokenAudienceMismatch(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	_, err := audienceToken(t, server, "https://billing.example.com", "https://mail.example.com")
+	if e, ok := err.(goauth2.ServerError); !ok || e.Code() != goauth2.ErrorCodeInvalidTarget {
+		t.Error("Resource mismatch was not an invalid target", err)
+	}
+}
+
+// Checking the audience and auditing a verification take a single lookup
+// of the token
+func TestVerifyTokenSingleLookup(t *testing.T) {
+	cache := newFlakyCache()
+	server := goauth2.NewServer(cache, authhandler.NewWhiteList("client1"))
+	token, err := audienceToken(t, server, "https://billing.example.com", "")
+	if err != nil {
+		t.Fatal("Error getting token", err)
+	}
+
+	billing := goauth2.NewServer(cache, nil)
+	billing.Audience = "https://billing.example.com"
+	logger := &recordingAuditLogger{}
+	billing.AuditLogger = logger
+
+	calls := cache.callCount()
+	if code := apiStatus(billing, token); code != http.StatusOK {
+		t.Error("Token was refused by its audience", code)
+	}
+	if n := cache.callCount() - calls; n != 1 {
+		t.Error("Bad number of lookups", n)
+	}
+	if events := logger.take(); len(events) != 1 || events[0].fields["client_id"] != "client1" {
+		t.Error("Verification was not audited with the token's client", events)
+	}
+}
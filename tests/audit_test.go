@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type auditEvent struct {
+	eventType string
+	fields    map[string]interface{}
+}
+
+// An AuditLogger keeping the events
+type recordingAuditLogger struct {
+	mu     sync.Mutex
+	events []auditEvent
+}
+
+func (l *recordingAuditLogger) Event(ctx context.Context, eventType string, fields map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, auditEvent{eventType, fields})
+}
+
+// Take the events recorded so far
+func (l *recordingAuditLogger) take() []auditEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := l.events
+	l.events = nil
+	return events
+}
+
+// Denies the requests of client2, and approves the others
+var denyClient2 = authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+	var err error
+	if oar.ClientID == "client2" {
+		err = errors.New("The user denied access.")
+	}
+	oar.UserID = "user1"
+	if implicit {
+		oar.ImplicitRedirect(w, r, err)
+	} else {
+		oar.AuthCodeRedirect(w, r, err)
+	}
+})
+
+// Every security-relevant event is logged with its client and user, and
+// without codes or tokens
+func TestAuditEvents(t *testing.T) {
+	logger := &recordingAuditLogger{}
+	server, err := goauth2.NewServerOptions(
+		goauth2.WithAuthCache(authcache.NewBasicAuthCache()),
+		goauth2.WithAuthHandler(denyClient2),
+		goauth2.WithAuditLogger(logger),
+	)
+	if err != nil {
+		t.Fatal("Error creating server", err)
+	}
+	var secrets []string
+	expect := func(step string, types ...string) {
+		events := logger.take()
+		if len(events) != len(types) {
+			t.Fatal("Bad events after", step, events)
+		}
+		for i, e := range events {
+			if e.eventType != types[i] || e.fields["client_id"] != "client1" && types[i] != goauth2.AuditAuthDenied {
+				t.Error("Bad event after", step, e)
+			}
+			for _, v := range e.fields {
+				for _, secret := range secrets {
+					if fmt.Sprint(v) == secret {
+						t.Error("Event has a code or token", e)
+					}
+				}
+			}
+		}
+	}
+
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	secrets = append(secrets, code)
+	expect("authorization", goauth2.AuditCodeIssued)
+
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	})
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	secrets = append(secrets, ret["token"])
+	expect("token request", goauth2.AuditCodeExchanged, goauth2.AuditTokenIssued)
+
+	loc := authorizeRequest(t, server, "token")
+	frag, _ := url.ParseQuery(loc.Fragment)
+	token := frag.Get("access_token")
+	secrets = append(secrets, token)
+	events := logger.take()
+	if len(events) != 1 || events[0].eventType != goauth2.AuditTokenIssued ||
+		events[0].fields["grant_type"] != "implicit" || events[0].fields["user_id"] != "user1" {
+		t.Error("Bad implicit grant event", events)
+	}
+
+	apiStatus(server, token)
+	expect("validation", goauth2.AuditTokenValidated)
+	apiStatus(server, "unknown")
+	if events := logger.take(); len(events) != 1 || events[0].fields["valid"] != false {
+		t.Error("Bad event of an invalid token", events)
+	}
+
+	server.Store.(*goauth2.StoreImpl).RevokeToken(token)
+	expect("revocation", goauth2.AuditTokenRevoked)
+
+	req, _ = oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        "unknown",
+		RedirectURI: "http://localhost/redirect",
+	})
+	server.MasterHandler().ServeHTTP(httptest.NewRecorder(), req)
+	if events := logger.take(); len(events) != 1 || events[0].eventType != goauth2.AuditTokenDenied ||
+		events[0].fields["grant_type"] != "authorization_code" || events[0].fields["error"] != "invalid_grant" {
+		t.Error("Bad token denial event", events)
+	}
+
+	clientAuthorizeRequest(server, "client2", "code")
+	if events := logger.take(); len(events) != 1 || events[0].eventType != goauth2.AuditAuthDenied ||
+		events[0].fields["client_id"] != "client2" || events[0].fields["error"] != "access_denied" {
+		t.Error("Bad denial event", events)
+	}
+}
+
+func TestJSONAuditLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := goauth2.NewJSONAuditLogger(&buf)
+	logger.Event(context.Background(), goauth2.AuditTokenRevoked, map[string]interface{}{"client_id": "client1"})
+	logger.Event(context.Background(), goauth2.AuditAuthDenied, map[string]interface{}{"client_id": "client2"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Events were not written on separate lines", buf.String())
+	}
+	event := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal("Event is not JSON", lines[0])
+	}
+	if event["event"] != "token_revoked" || event["client_id"] != "client1" || event["time"] == nil {
+		t.Error("Bad JSON event", event)
+	}
+}
@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/audit"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Read the events of a file of JSON lines
+func readAuditLog(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("Error opening the audit log", err)
+	}
+	defer f.Close()
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Audit line %q is not JSON: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// Both grant flows write their events in order to the file, with the hashes
+// of the tokens and never the tokens
+func TestFileAuditLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := audit.NewFileLogger(path, audit.FileOptions{})
+	if err != nil {
+		t.Fatal("Error creating the logger", err)
+	}
+	server, err := goauth2.NewServerOptions(
+		goauth2.WithAuthCache(authcache.NewBasicAuthCache()),
+		goauth2.WithAuthHandler(denyClient2),
+		goauth2.WithAuditLogger(logger),
+	)
+	if err != nil {
+		t.Fatal("Error creating the server", err)
+	}
+
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	})
+	req.RemoteAddr = "192.0.2.1:4321"
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	codeToken := ret["token"]
+
+	frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	implicitToken := frag.Get("access_token")
+	if code == "" || codeToken == "" || implicitToken == "" {
+		t.Fatal("The grants failed", code, codeToken, implicitToken)
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatal("Error closing the logger", err)
+	}
+
+	expected := []struct {
+		event, grantType, tokenHash string
+	}{
+		{goauth2.AuditCodeIssued, "", ""},
+		{goauth2.AuditCodeExchanged, "", ""},
+		{goauth2.AuditTokenIssued, "authorization_code", goauth2.AuditTokenHash(codeToken)},
+		{goauth2.AuditTokenIssued, "implicit", goauth2.AuditTokenHash(implicitToken)},
+	}
+	events := readAuditLog(t, path)
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %v", len(expected), events)
+	}
+	if events[2]["ip"] != "192.0.2.1" {
+		t.Error("Token request event has no IP", events[2])
+	}
+	for i, e := range events {
+		x := expected[i]
+		if e["event"] != x.event || e["client_id"] != "client1" || e["time"] == nil ||
+			x.grantType != "" && e["grant_type"] != x.grantType ||
+			x.tokenHash != "" && e["token_hash"] != x.tokenHash {
+			t.Errorf("Event %d is not %v: %v", i, x, e)
+		}
+		if e["event"] == goauth2.AuditTokenIssued && e["user_id"] != "user1" {
+			t.Errorf("Event %d has no user: %v", i, e)
+		}
+	}
+
+	raw, _ := os.ReadFile(path)
+	for _, secret := range []string{code, codeToken, implicitToken} {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("Secret %q was written to the audit log", secret)
+		}
+	}
+}
+
+// The file is rotated past its size, and the oldest backups are removed
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := audit.OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal("Error opening the file", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal("Error writing", err)
+		}
+	}
+	f.Close()
+
+	for name, expected := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		if b, err := os.ReadFile(name); err != nil || string(b) != expected {
+			t.Errorf("%s is %q, not %q: %v", name, b, expected, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Backup past MaxBackups was kept", err)
+	}
+}
+
+// An AuditLogger blocking until released
+type blockingAuditLogger struct {
+	release chan struct{}
+	events  int
+}
+
+func (l *blockingAuditLogger) Event(ctx context.Context, eventType string, fields map[string]interface{}) {
+	<-l.release
+	l.events++
+}
+
+// Events are dropped and counted when the queue is full
+func TestAsyncLoggerDrops(t *testing.T) {
+	next := &blockingAuditLogger{release: make(chan struct{})}
+	logger := audit.NewAsyncLogger(next, 1)
+	for i := 0; i < 10; i++ {
+		logger.Event(context.Background(), goauth2.AuditTokenValidated, nil)
+	}
+	// One event is being written, and one is queued
+	if dropped := logger.Dropped(); dropped < 8 {
+		t.Error("Events were not dropped", dropped)
+	}
+	close(next.release)
+	logger.Close()
+
+	if uint64(next.events)+logger.Dropped() != 10 {
+		t.Error("Events were lost without being counted", next.events, logger.Dropped())
+	}
+	logger.Event(context.Background(), goauth2.AuditTokenValidated, nil)
+	if logger.Dropped() != 10-uint64(next.events)+1 {
+		t.Error("Event after Close was not dropped", logger.Dropped())
+	}
+}
@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An AuthCache whose calls can be slowed down, or made to fail as an
+// unreachable backend does
+type flakyCache struct {
+	goauth2.AuthCache
+
+	mu       sync.Mutex
+	delay    time.Duration
+	failures int
+	calls    int
+}
+
+func newFlakyCache() *flakyCache {
+	return &flakyCache{AuthCache: authcache.NewBasicAuthCache()}
+}
+
+// Count a call, and return an error if it should fail
+func (c *flakyCache) call() error {
+	c.mu.Lock()
+	c.calls++
+	delay, fail := c.delay, c.failures > 0
+	if fail {
+		c.failures--
+	}
+	c.mu.Unlock()
+
+	time.Sleep(delay)
+	if fail {
+		return fmt.Errorf("%w: injected failure", goauth2.ErrBackendUnavailable)
+	}
+	return nil
+}
+
+// Make the next n calls fail, and return the number of calls so far
+func (c *flakyCache) fail(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = n
+	return c.calls
+}
+
+func (c *flakyCache) callCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+func (c *flakyCache) RegisterAccessToken(token string, info goauth2.TokenInfo, lifetime goauth2.TokenLifetime) (string, int64, error) {
+	if err := c.call(); err != nil {
+		return "", 0, err
+	}
+	return c.AuthCache.RegisterAccessToken(token, info, lifetime)
+}
+
+func (c *flakyCache) LookupAccessToken(token string) (*goauth2.TokenInfo, error) {
+	if err := c.call(); err != nil {
+		return nil, err
+	}
+	return c.AuthCache.LookupAccessToken(token)
+}
+
+func (c *flakyCache) TakeAuthCode(code string) (*goauth2.AuthCodeInfo, error) {
+	if err := c.call(); err != nil {
+		return nil, err
+	}
+	return c.AuthCache.(goauth2.CodeConsumer).TakeAuthCode(code)
+}
+
+// A server whose Store calls a flakyCache under a policy
+func newPolicyServer(t *testing.T, policy *goauth2.BackendPolicy) (*goauth2.Server, *flakyCache) {
+	cache := newFlakyCache()
+	server, err := goauth2.NewServerOptions(
+		goauth2.WithAuthCache(cache),
+		goauth2.WithAuthHandler(authhandler.NewWhiteList("client1")),
+		goauth2.WithBackendPolicy(policy),
+	)
+	if err != nil {
+		t.Fatal("Error creating the server", err)
+	}
+	return server, cache
+}
+
+// Slow lookups time out as an unavailable backend
+func TestBackendPolicyTimeout(t *testing.T) {
+	server, cache := newPolicyServer(t, &goauth2.BackendPolicy{Timeout: 20 * time.Millisecond})
+	frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	token := frag.Get("access_token")
+
+	cache.mu.Lock()
+	cache.delay = 500 * time.Millisecond
+	cache.mu.Unlock()
+	start := time.Now()
+	if status := apiStatus(server, token); status != http.StatusServiceUnavailable {
+		t.Error("Slow lookup was not reported as unavailable", status)
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Error("Lookup was waited for", d)
+	}
+}
+
+// Failed lookups are retried, but registrations aren't
+func TestBackendPolicyRetries(t *testing.T) {
+	server, cache := newPolicyServer(t, &goauth2.BackendPolicy{
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+	})
+	frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	token := frag.Get("access_token")
+
+	calls := cache.fail(2)
+	if status := apiStatus(server, token); status != http.StatusOK {
+		t.Error("Lookup was not retried", status)
+	}
+	if n := cache.callCount() - calls; n != 3 {
+		t.Error("Bad number of lookups", n)
+	}
+
+	cache.fail(3)
+	if status := apiStatus(server, token); status != http.StatusServiceUnavailable {
+		t.Error("Lookup was retried too many times", status)
+	}
+
+	calls = cache.fail(1)
+	frag, _ = url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	if frag.Get("error") == "" || frag.Has("access_token") {
+		t.Error("Failed registration was retried", frag)
+	}
+	if n := cache.callCount() - calls; n != 1 {
+		t.Error("Registration was made several times", n)
+	}
+}
+
+// The breaker fails fast after consecutive failures, and closes after its
+// cooldown
+func TestBackendPolicyBreaker(t *testing.T) {
+	clock := newFakeClock()
+	server, cache := newPolicyServer(t, &goauth2.BackendPolicy{
+		BreakerThreshold: 3,
+		BreakerCooldown:  time.Minute,
+		Clock:            clock,
+	})
+	frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	token := frag.Get("access_token")
+
+	cache.fail(3)
+	for i := 0; i < 3; i++ {
+		if status := apiStatus(server, token); status != http.StatusServiceUnavailable {
+			t.Error("Failed lookup was not reported as unavailable", status)
+		}
+	}
+	calls := cache.callCount()
+	if status := apiStatus(server, token); status != http.StatusServiceUnavailable {
+		t.Error("Open breaker let the lookup fail otherwise", status)
+	}
+	if cache.callCount() != calls {
+		t.Error("Open breaker called the backend")
+	}
+
+	clock.Advance(time.Minute)
+	if status := apiStatus(server, token); status != http.StatusOK {
+		t.Error("Breaker did not recover", status)
+	}
+
+	// Failures after a recovery need the full threshold again
+	cache.fail(1)
+	apiStatus(server, token)
+	if status := apiStatus(server, token); status != http.StatusOK {
+		t.Error("Breaker opened after a single failure", status)
+	}
+}
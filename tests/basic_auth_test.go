@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Send an authorization request with optional Basic credentials
+func basicAuthRequest(server *goauth2.Server, responseType, user, pass string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: responseType,
+		RedirectURI:  "http://localhost/redirect",
+	}), nil)
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	return w
+}
+
+func newBasicAuthServer() *goauth2.Server {
+	auth := authhandler.NewBasicAuth("goauth2 test",
+		authhandler.StaticCredentials(map[string]string{"user1": "secret"}))
+	return goauth2.NewServer(authcache.NewBasicAuthCache(), auth)
+}
+
+func TestBasicAuthChallenge(t *testing.T) {
+	server := newBasicAuthServer()
+
+	for _, rt := range []string{"code", "token"} {
+		w := basicAuthRequest(server, rt, "", "")
+		if w.Code != http.StatusUnauthorized {
+			t.Error("Request without credentials was not challenged", rt, w.Code)
+		}
+		if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), `Basic realm="goauth2 test"`) {
+			t.Error("Bad challenge", w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestBasicAuthWrongPassword(t *testing.T) {
+	server := newBasicAuthServer()
+
+	for _, creds := range [][2]string{{"user1", "wrong"}, {"user2", "secret"}} {
+		w := basicAuthRequest(server, "code", creds[0], creds[1])
+		if w.Code != http.StatusUnauthorized || w.Header().Get("Location") != "" {
+			t.Error("Invalid credentials were accepted", creds, w.Code)
+		}
+	}
+}
+
+func TestBasicAuthGrant(t *testing.T) {
+	server := newBasicAuthServer()
+	var user string
+	server.OnCodeIssued = func(oar *goauth2.OAuthRequest, code string) {
+		user = oar.UserID
+	}
+
+	w := basicAuthRequest(server, "code", "user1", "secret")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || loc.Query().Get("code") == "" {
+		t.Fatal("Valid credentials were not granted a code", w.Code, loc)
+	}
+	if user != "user1" {
+		t.Error("The user was not set on the request", user)
+	}
+
+	w = basicAuthRequest(server, "token", "user1", "secret")
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	if frag, _ := url.ParseQuery(loc.Fragment); frag.Get("access_token") == "" {
+		t.Error("Valid credentials were not granted a token", w.Code, loc)
+	}
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyToken(t *testing.T) {
+	cache := authcache.NewBasicAuthCache()
+	cache.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	server := goauth2.NewServer(cache, nil)
+	api := server.TokenVerifier(http.HandlerFunc(TestApiHandler))
+
+	status := func(method, query, body, header string) int {
+		req, _ := http.NewRequest(method, "/api"+query, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Parameters are ignored by default
+	if code := status("GET", "?access_token=token1", "", ""); code != http.StatusUnauthorized {
+		t.Error("Query token was accepted by default", code)
+	}
+	if code := status("GET", "?access_token=token1", "", "token1"); code != http.StatusOK {
+		t.Error("Query parameter interfered with the header", code)
+	}
+
+	server.AllowBodyToken = true
+	cases := []struct {
+		method, query, body, header string
+		want                        int
+	}{
+		{"GET", "", "", "token1", http.StatusOK},
+		{"GET", "?access_token=token1", "", "", http.StatusOK},
+		{"POST", "", "access_token=token1", "", http.StatusOK},
+		{"GET", "?access_token=bad", "", "", http.StatusUnauthorized},
+		{"POST", "", "access_token=bad", "", http.StatusUnauthorized},
+		{"GET", "", "", "", http.StatusUnauthorized},
+		// Only one method may be used
+		{"GET", "?access_token=token1", "", "token1", http.StatusUnauthorized},
+		{"POST", "", "access_token=token1", "token1", http.StatusUnauthorized},
+		{"POST", "?access_token=token1", "access_token=token1", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		if code := status(c.method, c.query, c.body, c.header); code != c.want {
+			t.Error("Bad status", c, code)
+		}
+	}
+
+	// Sending the token twice is an invalid request
+	req, _ := http.NewRequest("GET", "/api?access_token=token1", nil)
+	req.Header.Set("Authorization", "token1")
+	err := server.VerifyToken(req)
+	if e, ok := err.(goauth2.ServerError); !ok || e.Code() != goauth2.ErrorCodeInvalidRequest {
+		t.Error("Token sent twice was not an invalid request", err)
+	}
+}
+
+// Over-long tokens are refused as invalid requests, without a lookup
+func TestOversizedToken(t *testing.T) {
+	cache := newFlakyCache()
+	server := goauth2.NewServer(cache, nil)
+	verify := func(token string) error {
+		req, _ := http.NewRequest("GET", "/api", nil)
+		req.Header.Set("Authorization", token)
+		return server.VerifyToken(req)
+	}
+
+	calls := cache.callCount()
+	err := verify(strings.Repeat("a", goauth2.DefaultMaxTokenLength+1))
+	if e, ok := err.(goauth2.ServerError); !ok || e.Code() != goauth2.ErrorCodeInvalidRequest {
+		t.Error("Over-long token was not an invalid request", err)
+	}
+	if n := cache.callCount() - calls; n != 0 {
+		t.Error("Over-long token was looked up", n)
+	}
+	if err := verify(strings.Repeat("a", goauth2.DefaultMaxTokenLength)); err == nil || cache.callCount() == calls {
+		t.Error("Token of the maximum length was not looked up", err)
+	}
+
+	server.MaxTokenLength = 10
+	if e, ok := verify("0123456789a").(goauth2.ServerError); !ok || e.Code() != goauth2.ErrorCodeInvalidRequest {
+		t.Error("The MaxTokenLength of the server was not applied", e)
+	}
+}
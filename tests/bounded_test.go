@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"testing"
+	"time"
+)
+
+// Filling a bounded cache past its cap evicts the least recently used
+// codes and tokens, each kind within its own cap
+func TestBoundedAuthCache(t *testing.T) {
+	ac := authcache.NewBoundedAuthCacheWithLimits(authcache.BoundedLimits{
+		Codes: 2, Tokens: 2, PushedRequests: 1, UserCutoffs: 1,
+	})
+	for i := 0; i < 2; i++ {
+		ac.RegisterAccessToken(fmt.Sprint("token", i), goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	}
+	// A flood of codes only evicts codes
+	for i := 0; i < 10; i++ {
+		ac.RegisterAuthCode(fmt.Sprint("code", i), goauth2.AuthCodeInfo{ClientID: "client1"})
+	}
+	for _, token := range []string{"token0", "token1"} {
+		if info, _ := ac.LookupAccessToken(token); info == nil {
+			t.Error("Token was evicted by codes", token)
+		}
+	}
+	if _, err := ac.LookupAuthCode("code0"); err != goauth2.ErrCodeNotFound {
+		t.Error("Least recently used code was not evicted", err)
+	}
+	if len(ac.AuthCodes) != 2 {
+		t.Error("Bad number of codes", len(ac.AuthCodes))
+	}
+
+	// token0 becomes the most recently used
+	if info, _ := ac.LookupAccessToken("token0"); info == nil {
+		t.Fatal("Token is not valid before the cap is reached")
+	}
+	ac.RegisterAccessToken("token2", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	if info, _ := ac.LookupAccessToken("token1"); info != nil {
+		t.Error("Least recently used token was not evicted")
+	}
+	if info, _ := ac.LookupAccessToken("token0"); info == nil {
+		t.Error("Recently used token was evicted")
+	}
+
+	// Revoked tokens free their place
+	ac.RevokeToken("token0")
+	ac.RegisterAccessToken("token3", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	if info, _ := ac.LookupAccessToken("token2"); info == nil {
+		t.Error("Token was evicted although a token was revoked")
+	}
+}
+
+// A bounded cache keeps a bounded number of pushed requests and user
+// cutoffs, and the cutoffs past its cap still apply
+func TestBoundedAuthCacheOtherEntries(t *testing.T) {
+	ac := authcache.NewBoundedAuthCache(1)
+	ac.RegisterPushedRequest("req1", []byte("1"), time.Minute)
+	ac.RegisterPushedRequest("req2", []byte("2"), 2*time.Minute)
+	if len(ac.PushedRequests) != 1 {
+		t.Error("Bad number of pushed requests", len(ac.PushedRequests))
+	}
+	if data, _ := ac.TakePushedRequest("req2"); string(data) != "2" {
+		t.Error("Newest pushed request was evicted", data)
+	}
+
+	now := time.Now()
+	ac.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1", UserID: "user1", IssuedAt: now.Add(-time.Hour)}, goauth2.TokenLifetime{})
+	ac.SetUserCutoff("user2", now)
+	ac.SetUserCutoff("user1", now)
+	if len(ac.UserCutoffs) != 1 {
+		t.Error("Bad number of user cutoffs", len(ac.UserCutoffs))
+	}
+	if info, _ := ac.LookupAccessToken("token1"); info != nil {
+		t.Error("Token issued before a cutoff past the cap is valid")
+	}
+}
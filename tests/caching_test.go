@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"testing"
+	"time"
+)
+
+// A Store counting the validations that reach it
+type countingStore struct {
+	*goauth2.StoreImpl
+	validations int
+	batches     int
+	infos       int
+}
+
+func (s *countingStore) ValidateAccessToken(authorization_field string) (bool, error) {
+	s.validations++
+	return s.StoreImpl.ValidateAccessToken(authorization_field)
+}
+
+func (s *countingStore) ValidateAccessTokenInfo(authorization_field string) (*goauth2.TokenInfo, error) {
+	s.infos++
+	return s.StoreImpl.ValidateAccessTokenInfo(authorization_field)
+}
+
+func (s *countingStore) ValidateAccessTokens(authorization_fields []string) (map[string]bool, error) {
+	s.batches++
+	return s.StoreImpl.ValidateAccessTokens(authorization_fields)
+}
+
+func TestCachingStore(t *testing.T) {
+	ac := authcache.NewBasicAuthCache()
+	ac.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	inner := &countingStore{StoreImpl: goauth2.NewStore(ac)}
+	store := goauth2.NewCachingStore(inner, 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if valid, err := store.ValidateAccessToken("token1"); err != nil || !valid {
+			t.Fatal("Valid token was refused", err)
+		}
+	}
+	if inner.validations != 1 {
+		t.Error("Validations were not cached", inner.validations)
+	}
+
+	// Entries expire
+	time.Sleep(60 * time.Millisecond)
+	store.ValidateAccessToken("token1")
+	if inner.validations != 2 {
+		t.Error("Expired validation was used", inner.validations)
+	}
+
+	// Revocation through the cache takes effect at once
+	if err := store.RevokeToken("token1"); err != nil {
+		t.Fatal("Error revoking token", err)
+	}
+	if valid, _ := store.ValidateAccessToken("token1"); valid {
+		t.Error("Revoked token is still valid")
+	}
+}
+
+// Batches only send the tokens that aren't cached to the inner Store
+func TestCachingStoreBatch(t *testing.T) {
+	ac := authcache.NewBasicAuthCache()
+	ac.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	ac.RegisterAccessToken("token2", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	inner := &countingStore{StoreImpl: goauth2.NewStore(ac)}
+	store := goauth2.NewCachingStore(inner, time.Minute)
+
+	store.ValidateAccessToken("token1")
+	valid, err := store.ValidateAccessTokens([]string{"token1", "token2", "unknown"})
+	if err != nil {
+		t.Fatal("Error validating tokens", err)
+	}
+	if !valid["token1"] || !valid["token2"] || valid["unknown"] || len(valid) != 3 {
+		t.Error("Bad batch validation", valid)
+	}
+	if inner.batches != 1 {
+		t.Error("Missing tokens were not validated in one batch", inner.batches)
+	}
+
+	// Everything is cached now
+	store.ValidateAccessTokens([]string{"token2", "unknown"})
+	if inner.batches != 1 || inner.validations != 1 {
+		t.Error("Cached validations were not used", inner.batches, inner.validations)
+	}
+}
+
+// The information of tokens is cached as well, and copied so that callers
+// can't change the cache
+func TestCachingStoreInfo(t *testing.T) {
+	ac := authcache.NewBasicAuthCache()
+	ac.TokenExpiry = 60
+	ac.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1", Scope: "read", UserID: "user1"}, goauth2.TokenLifetime{})
+	inner := &countingStore{StoreImpl: goauth2.NewStore(ac)}
+	store := goauth2.NewCachingStore(inner, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		info, err := store.ValidateAccessTokenInfo("token1")
+		if err != nil || info == nil {
+			t.Fatal("Valid token was refused", err)
+		}
+		if info.ClientID != "client1" || info.Scope != "read" || info.UserID != "user1" || info.ExpiresAt.IsZero() {
+			t.Error("Bad token information", info)
+		}
+		info.ClientID = "changed"
+	}
+	if inner.infos != 1 {
+		t.Error("Token information was not cached", inner.infos)
+	}
+
+	// Invalid tokens are cached, whichever way they were validated
+	store.ValidateAccessToken("unknown")
+	if info, err := store.ValidateAccessTokenInfo("unknown"); info != nil || err != nil {
+		t.Error("Unknown token was valid", info, err)
+	}
+	if inner.infos != 1 {
+		t.Error("Invalid token was looked up again", inner.infos)
+	}
+}
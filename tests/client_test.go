@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Only registered clients are served, and unknown ones are not redirected
+func TestRegisteredClients(t *testing.T) {
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(goauth2.NewClient("client1"))
+	server := goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients,
+		authhandler.NewBlackList())
+
+	if loc := authorizeRequest(t, server, "code"); loc.Query().Get("code") == "" {
+		t.Error("Registered client got no code")
+	}
+
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "unknown",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	if w.Code == http.StatusFound {
+		t.Error("Unknown client was redirected to", w.Header().Get("Location"))
+	}
+}
+
+// Client settings restrict the grants, scopes and redirect URIs it may use
+func TestClientSettings(t *testing.T) {
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(&goauth2.ClientImpl{
+		ClientID:           "client1",
+		ClientRedirectURIs: []string{"http://localhost/redirect"},
+		ClientGrantTypes:   []string{goauth2.GrantTypeAuthorizationCode},
+		ClientScopes:       []string{"read"},
+		ClientTokenTTL:     time.Minute,
+	})
+	server := goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients,
+		authhandler.NewBlackList())
+
+	authorize := func(p oauthclient.AuthorizeParams) *httptest.ResponseRecorder {
+		p.ClientID = "client1"
+		req, _ := http.NewRequest("GET", authorizeURL("/oauth2", p), nil)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		return w
+	}
+	location := func(w *httptest.ResponseRecorder) *url.URL {
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || w.Code != http.StatusFound {
+			t.Fatal("Authorization request was not redirected", w.Code, err)
+		}
+		return loc
+	}
+
+	// The implicit grant is not allowed
+	loc := location(authorize(oauthclient.AuthorizeParams{ResponseType: "token"}))
+	if frag, _ := url.ParseQuery(loc.Fragment); frag.Get("error") != "unauthorized_client" {
+		t.Error("Implicit grant was not refused", loc)
+	}
+
+	// Unregistered redirect URIs are refused without a redirect
+	w := authorize(oauthclient.AuthorizeParams{
+		ResponseType: "code",
+		RedirectURI:  "http://evil.example.com/redirect",
+	})
+	if w.Code == http.StatusFound {
+		t.Error("Unregistered redirect URI was used", w.Header().Get("Location"))
+	}
+
+	// Only allowed scopes can be requested
+	loc = location(authorize(oauthclient.AuthorizeParams{ResponseType: "code", Scope: "read write"}))
+	if loc.Query().Get("error") != "invalid_scope" {
+		t.Error("Disallowed scope was not refused", loc)
+	}
+
+	// The registered redirect URI is used when it is omitted
+	loc = location(authorize(oauthclient.AuthorizeParams{ResponseType: "code", Scope: "read"}))
+	code := loc.Query().Get("code")
+	if code == "" || loc.Host != "localhost" {
+		t.Fatal("Authorization failed", loc)
+	}
+
+	// The client's token lifetime is reported
+	token, ttype, expiry, err := server.Store.CreateAccessToken(&goauth2.AccessTokenRequest{
+		GrantType: "authorization_code",
+		Code:      code,
+	})
+	if err != nil || token == "" || ttype != "bearer" {
+		t.Fatal("Error exchanging the code", err)
+	}
+	if expiry != 60 {
+		t.Error("Client token lifetime was not used", expiry)
+	}
+}
+
+// Native clients may use loopback URIs on any port and private-use schemes
+func TestNativeClientRedirectURIs(t *testing.T) {
+	native := &goauth2.ClientImpl{
+		ClientID:           "native",
+		ClientRedirectURIs: []string{"http://127.0.0.1/cb", "http://[::1]/cb", "com.example.app:/cb"},
+		ClientNative:       true,
+	}
+	web := &goauth2.ClientImpl{
+		ClientID:           "web",
+		ClientRedirectURIs: []string{"http://127.0.0.1/cb", "com.example.app:/cb", "http://example.com/cb"},
+	}
+
+	cases := []struct {
+		client *goauth2.ClientImpl
+		uri    string
+		valid  bool
+	}{
+		{native, "http://127.0.0.1/cb", true},
+		{native, "http://127.0.0.1:54321/cb", true},
+		{native, "http://[::1]:8080/cb", true},
+		{native, "http://127.0.0.1:54321/other", false},
+		{native, "http://127.0.0.1:54321/cb?x=1", false},
+		{native, "https://127.0.0.1:54321/cb", false},
+		{native, "http://localhost:54321/cb", false},
+		{native, "com.example.app:/cb", true},
+		{native, "com.other.app:/cb", false},
+		{web, "http://127.0.0.1/cb", true},
+		{web, "http://127.0.0.1:54321/cb", false},
+		{web, "com.example.app:/cb", false},
+		{web, "http://example.com/cb", true},
+		{web, "http://example.com:8080/cb", false},
+	}
+	for _, c := range cases {
+		if valid := c.client.ValidateRedirectURI(c.uri); valid != c.valid {
+			t.Error("Bad validation of", c.client.ClientID, c.uri, valid)
+		}
+	}
+}
+
+// A native app is redirected to the port it listens on
+func TestNativeClientLoopback(t *testing.T) {
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(&goauth2.ClientImpl{
+		ClientID:           "client1",
+		ClientRedirectURIs: []string{"http://127.0.0.1/cb", "http://[::1]/cb", "http://example.com:8080/cb"},
+		ClientNative:       true,
+	})
+	server := goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients,
+		authhandler.NewBlackList())
+	authorize := func(uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+			ClientID:     "client1",
+			ResponseType: "code",
+			RedirectURI:  uri,
+		}), nil)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		return w
+	}
+
+	for _, host := range []string{"127.0.0.1:49152", "[::1]:49152"} {
+		w := authorize("http://" + host + "/cb")
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusFound || loc.Host != host || loc.Query().Get("code") == "" {
+			t.Error("Native client was not redirected to its port", w.Code, loc)
+		}
+	}
+
+	// Other hosts must match the registered port
+	if w := authorize("http://example.com:49152/cb"); w.Code == http.StatusFound {
+		t.Error("Non-loopback port mismatch was redirected to", w.Header().Get("Location"))
+	}
+}
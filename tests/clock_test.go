@@ -0,0 +1,216 @@
+package tests
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := fakeWaiter{c.now.Add(d), make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+	} else {
+		c.waiters = append(c.waiters, w)
+	}
+	return w.c
+}
+
+// Move the clock forward, firing the timers that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+// Codes and tokens expire when the clock says so, without sleeping
+func TestClockExpiry(t *testing.T) {
+	clock := newFakeClock()
+	cache := authcache.NewBasicAuthCache()
+	cache.Clock = clock
+	cache.TokenExpiry = 60
+
+	if _, expiry, _ := cache.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{}); expiry != 60 {
+		t.Error("Bad token expiry", expiry)
+	}
+	cache.RegisterAuthCode("code1", goauth2.AuthCodeInfo{ClientID: "client1"})
+
+	info, err := cache.LookupAccessToken("token1")
+	if err != nil || info == nil || !info.ExpiresAt.Equal(clock.Now().Add(time.Minute)) {
+		t.Fatal("Bad lookup of a fresh token", info, err)
+	}
+
+	clock.Advance(59 * time.Second)
+	if info, _ := cache.LookupAccessToken("token1"); info == nil {
+		t.Error("Token expired early")
+	}
+	clock.Advance(time.Second)
+	if info, _ := cache.LookupAccessToken("token1"); info != nil {
+		t.Error("Token did not expire")
+	}
+	if valid, _ := cache.LookupAccessTokens([]string{"token1"}); valid["token1"] {
+		t.Error("Expired token is valid in a batch")
+	}
+
+	clock.Advance(time.Duration(authcache.CodeExpiry) * time.Second)
+	if _, err := cache.LookupAuthCode("code1"); err != goauth2.ErrCodeExpired {
+		t.Error("Code did not expire", err)
+	}
+}
+
+// WithClock sets the clock of the Server, the Store and the cache, so that
+// expires_at and the expiry of tokens follow it
+func TestWithClock(t *testing.T) {
+	clock := newFakeClock()
+	cache := authcache.NewBasicAuthCache()
+	cache.TokenExpiry = 60
+	server, err := goauth2.NewServerOptions(
+		goauth2.WithAuthCache(cache),
+		goauth2.WithAuthHandler(authhandler.NewWhiteList("client1")),
+		goauth2.WithClock(clock),
+	)
+	if err != nil {
+		t.Fatal("Error creating the server", err)
+	}
+	server.IncludeExpiresAt = true
+
+	frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	expected := clock.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	if frag.Get("expires_at") != expected {
+		t.Error("expires_at doesn't follow the clock", frag.Get("expires_at"), expected)
+	}
+	token := frag.Get("access_token")
+	info, _ := cache.LookupAccessToken(token)
+	if info == nil || !info.IssuedAt.Equal(clock.Now()) {
+		t.Error("IssuedAt doesn't follow the clock", info)
+	}
+
+	clock.Advance(time.Minute)
+	if status := apiStatus(server, token); status != http.StatusUnauthorized {
+		t.Error("Token did not expire with the clock", status)
+	}
+}
+
+// Stateless codes expire with the clock, after the leeway
+func TestClockStatelessCodes(t *testing.T) {
+	clock := newFakeClock()
+	server, _ := newStatelessServer("key1")
+	store := server.Store.(*goauth2.StatelessCodeStore)
+	store.Clock = clock
+	store.Leeway = 5 * time.Second
+
+	expired := authorizeRequest(t, server, "code").Query().Get("code")
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	clock.Advance(goauth2.DefaultStatelessCodeExpiry + 4*time.Second)
+	if err := statelessExchange(server, code, "http://localhost/redirect"); err != nil {
+		t.Error("Code was refused within the leeway", err)
+	}
+	clock.Advance(time.Second)
+	if err := statelessExchange(server, expired, "http://localhost/redirect"); err == nil {
+		t.Error("Code was accepted past the leeway")
+	}
+}
+
+// Client assertions expire with the clock of the Store, after the leeway
+func TestClockAssertionLeeway(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(goauth2.NewClient("client1"))
+	clients.SetPublicKey("client1", &key.PublicKey)
+	server := goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients, authhandler.NewWhiteList("client1"))
+	server.Issuer = "http://auth.example.com"
+	clock := newFakeClock()
+	store := server.Store.(*goauth2.StoreImpl)
+	store.Clock = clock
+
+	claims := assertionClaims("client1")
+	claims["exp"] = clock.Now().Add(time.Minute).Unix()
+	claims["nbf"] = clock.Now().Unix()
+	assertion := signAssertion(t, key, claims)
+	ret := assertionTokenRequest(t, server, goauth2.ClientAssertionTypeJWTBearer, assertion)
+	if ret["token"] == "" {
+		t.Error("Valid assertion was refused", ret)
+	}
+
+	// An assertion is used once, so the late one has another identifier
+	clock.Advance(time.Minute)
+	claims["jti"] = "late"
+	assertion = signAssertion(t, key, claims)
+	if ret := assertionTokenRequest(t, server, goauth2.ClientAssertionTypeJWTBearer, assertion); ret["error"] != "invalid_client" {
+		t.Error("Expired assertion was accepted", ret)
+	}
+	store.Leeway = 10 * time.Second
+	if ret := assertionTokenRequest(t, server, goauth2.ClientAssertionTypeJWTBearer, assertion); ret["token"] == "" {
+		t.Error("Assertion was refused within the leeway", ret)
+	}
+
+	claims["jti"] = "early"
+	claims["nbf"] = clock.Now().Add(5 * time.Second).Unix()
+	claims["exp"] = clock.Now().Add(time.Minute).Unix()
+	if ret := assertionTokenRequest(t, server, goauth2.ClientAssertionTypeJWTBearer, signAssertion(t, key, claims)); ret["token"] == "" {
+		t.Error("Assertion not valid yet was refused within the leeway", ret)
+	}
+}
+
+// Cached validations expire with the clock of the CachingStore
+func TestClockCachingStore(t *testing.T) {
+	clock := newFakeClock()
+	cache := authcache.NewBasicAuthCache()
+	cache.RegisterAccessToken("token1", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	store := goauth2.NewCachingStore(goauth2.NewStore(cache), time.Minute)
+	store.Clock = clock
+
+	if valid, err := store.ValidateAccessToken("token1"); !valid || err != nil {
+		t.Fatal("Token was refused", err)
+	}
+	cache.RevokeToken("token1")
+	clock.Advance(59 * time.Second)
+	if valid, _ := store.ValidateAccessToken("token1"); !valid {
+		t.Error("Cached validation expired early")
+	}
+	clock.Advance(time.Second)
+	if valid, _ := store.ValidateAccessToken("token1"); valid {
+		t.Error("Cached validation did not expire")
+	}
+}
@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// An AuthCache recording whether it was closed
+type closingCache struct {
+	*authcache.BasicAuthCache
+	closed bool
+}
+
+func (c *closingCache) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestServerClose(t *testing.T) {
+	cache := &closingCache{BasicAuthCache: authcache.NewBasicAuthCache()}
+	server := goauth2.NewServer(cache, authhandler.NewWhiteList("client1"))
+	if err := server.Close(); err != nil {
+		t.Fatal("Error closing the server", err)
+	}
+	if !cache.closed {
+		t.Error("The AuthCache was not closed")
+	}
+	if err := server.Close(); err != nil {
+		t.Error("Error closing the server twice", err)
+	}
+
+	// Codes can still be issued from the shared generator
+	if loc := authorizeRequest(t, server, "code"); loc.Query().Get("code") == "" {
+		t.Error("No code was issued after closing", loc)
+	}
+}
+
+// Closing servers stops their token generators
+func TestServerCloseGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+		server.Close()
+	}
+
+	// The generators return once they see the stop channel
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Error("Generators were left running", before, n)
+	}
+}
+
+// Closing a BasicAuthCache stops its delayed deletions
+func TestBasicAuthCacheClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	cache := authcache.NewBasicAuthCache()
+	cache.TokenExpiry = 60
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint("key", i)
+		cache.RegisterAuthCode(key, goauth2.AuthCodeInfo{ClientID: "client1"})
+		cache.RegisterAccessToken(key, goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	}
+	if n := runtime.NumGoroutine(); n < before+40 {
+		t.Fatal("Delayed deletions are not running", before, n)
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatal("Error closing the cache", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Error("Delayed deletions were left running", before, n)
+	}
+	if err := cache.Close(); err != nil {
+		t.Error("Error closing the cache twice", err)
+	}
+
+	// The entries are still there
+	if info, _ := cache.LookupAccessToken("key1"); info == nil {
+		t.Error("Token was lost when closing the cache")
+	}
+}
+
+// Generators started with a context stop when it is done
+func TestRandomStringsContext(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	randstr := goauth2.RandomStringsContext(ctx)
+	if <-randstr == "" {
+		t.Error("Empty random string")
+	}
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Error("Generator was left running", before, n)
+	}
+}
+
+func TestRandomStringsUntil(t *testing.T) {
+	stop := make(chan struct{})
+	randstr := goauth2.RandomStringsUntil(stop)
+	if a, b := <-randstr, <-randstr; a == "" || a == b {
+		t.Error("Bad random strings", a, b)
+	}
+	close(stop)
+	select {
+	case s := <-randstr:
+		// The generator may have been sending already
+		if s == "" {
+			t.Error("Empty string after stopping")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
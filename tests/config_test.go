@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// A memory-backed server built from a Config serves its registered clients
+// with the configured lifetimes, grants and error URIs
+func TestNewServerFromConfig(t *testing.T) {
+	server, err := goauth2.NewServerFromConfig(goauth2.Config{
+		Cache:   goauth2.BackendConfig{Backend: "memory"},
+		Clients: goauth2.BackendConfig{Backend: "memory"},
+		RegisteredClients: []goauth2.ClientConfig{
+			{ID: "client1", RedirectURIs: []string{"http://localhost/redirect"}},
+			{ID: "client2", Type: goauth2.ClientTypeConfidential, Secret: "s3cret"},
+		},
+		GrantTypes:  []string{"authorization_code", "implicit"},
+		TokenExpiry: 60,
+		ErrorURIs:   map[string]string{"invalid_grant": "http://localhost/errors"},
+		Issuer:      "http://auth.example.com",
+		Auth:        authhandler.NewWhiteList("client1", "client2"),
+	})
+	if err != nil {
+		t.Fatal("Error creating the server", err)
+	}
+	if server.Issuer != "http://auth.example.com" {
+		t.Error("Issuer was not set", server.Issuer)
+	}
+
+	frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	if frag.Get("access_token") == "" || frag.Get("expires_in") != "60" {
+		t.Error("Bad implicit grant of the registered client", frag)
+	}
+
+	token := func(params oauthclient.TokenParams) map[string]string {
+		req, _ := oauthclient.BuildTokenRequest("/oauth2", params)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		ret := make(map[string]string)
+		json.NewDecoder(w.Body).Decode(&ret)
+		return ret
+	}
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	params := oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	}
+	if ret := token(params); ret["token"] == "" || ret["expires_in"] != "60" {
+		t.Error("Bad token of the registered client", ret)
+	}
+	params.Code = "unknown"
+	if ret := token(params); ret["error"] != "invalid_grant" || ret["error_uri"] != "http://localhost/errors" {
+		t.Error("Bad error of an unknown code", ret)
+	}
+
+	// Token exchange was left out of the grant types
+	if ret := token(oauthclient.TokenParams{GrantType: goauth2.GrantTypeTokenExchange}); ret["error"] != "unsupported_grant_type" {
+		t.Error("Grant type left out of the config was served", ret)
+	}
+
+	// Only registered clients are served
+	req := httptest.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client3",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	if w.Header().Get("Location") != "" {
+		t.Error("Unregistered client was served", w.Header())
+	}
+}
+
+// Invalid configurations are refused with an error saying why
+func TestNewServerFromConfigErrors(t *testing.T) {
+	auth := authhandler.NewWhiteList("client1")
+	memory := goauth2.BackendConfig{Backend: "memory"}
+	for name, c := range map[string]struct {
+		cfg    goauth2.Config
+		reason string
+	}{
+		"no auth":     {goauth2.Config{Cache: memory}, "AuthHandler"},
+		"no cache":    {goauth2.Config{Auth: auth}, "cache backend is required"},
+		"bad cache":   {goauth2.Config{Cache: goauth2.BackendConfig{Backend: "nosuch"}, Auth: auth}, "nosuch"},
+		"bad clients": {goauth2.Config{Cache: memory, Clients: goauth2.BackendConfig{Backend: "nosuch"}, Auth: auth}, "nosuch"},
+		"bad option": {goauth2.Config{Cache: goauth2.BackendConfig{Backend: "memory",
+			Options: map[string]string{"max_entries": "none"}}, Auth: auth}, "max_entries"},
+		"clients without store": {goauth2.Config{Cache: memory, Auth: auth,
+			RegisteredClients: []goauth2.ClientConfig{{ID: "client1"}}}, "client store"},
+		"bad grant": {goauth2.Config{Cache: memory, Auth: auth, GrantTypes: []string{"password"}}, "password"},
+		"bad error uri": {goauth2.Config{Cache: memory, Auth: auth,
+			ErrorURIs: map[string]string{"invalid_grant": "/errors"}}, "invalid_grant"},
+		"duplicate client": {goauth2.Config{Cache: memory, Clients: memory, Auth: auth,
+			RegisteredClients: []goauth2.ClientConfig{{ID: "client1"}, {ID: "client1"}}}, "twice"},
+		"confidential without secret": {goauth2.Config{Cache: memory, Clients: memory, Auth: auth,
+			RegisteredClients: []goauth2.ClientConfig{{ID: "client1", Type: goauth2.ClientTypeConfidential}}}, "no secret"},
+		"negative expiry":     {goauth2.Config{Cache: memory, Auth: auth, TokenExpiry: -1}, "negative"},
+		"bad redirect status": {goauth2.Config{Cache: memory, Auth: auth, RedirectStatusCode: 308}, "redirect status"},
+		"negative session": {goauth2.Config{Cache: memory, Clients: memory, Auth: auth,
+			RegisteredClients: []goauth2.ClientConfig{{ID: "client1", MaxSession: -1}}}, "session length"},
+	} {
+		if _, err := goauth2.NewServerFromConfig(c.cfg); err == nil || !strings.Contains(err.Error(), c.reason) {
+			t.Errorf("%s: bad error %v", name, err)
+		}
+	}
+}
+
+// A Config can be read from JSON, and misspelled settings are refused
+func TestLoadConfig(t *testing.T) {
+	cfg, err := goauth2.LoadConfig(strings.NewReader(`{
+		"cache": {"backend": "memory", "options": {"max_entries": "100"}},
+		"clients": {"backend": "memory"},
+		"registered_clients": [{"id": "client1", "redirect_uris": ["http://localhost/redirect"]}],
+		"code_expiry": 30,
+		"error_uris": {"invalid_grant": "http://localhost/errors"}
+	}`))
+	if err != nil {
+		t.Fatal("Error loading the config", err)
+	}
+	cfg.Auth = authhandler.NewWhiteList("client1")
+	server, err := goauth2.NewServerFromConfig(*cfg)
+	if err != nil {
+		t.Fatal("Error creating the server", err)
+	}
+	if code := authorizeRequest(t, server, "code").Query().Get("code"); code == "" {
+		t.Error("No code issued")
+	}
+
+	if _, err := goauth2.LoadConfig(strings.NewReader(`{"cache": {"backend": "memory"}, "token_expiri": 60}`)); err == nil {
+		t.Error("Misspelled setting was accepted")
+	}
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+var formValue = regexp.MustCompile(`name="(nonce|csrf_token)" value="([^"]*)"`)
+
+// Start a server with a consent page, and a client that keeps cookies and
+// doesn't follow redirects
+func newConsentServer(t *testing.T) (*httptest.Server, *http.Client) {
+	consent := authhandler.NewConsentHandler("/consent")
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), consent)
+
+	mux := http.NewServeMux()
+	mux.Handle("/oauth2", server.MasterHandler())
+	mux.Handle("/consent", consent.CallbackHandler())
+	ts := httptest.NewServer(mux)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return ts, client
+}
+
+// Load the consent page and return its form fields
+func loadConsentPage(t *testing.T, ts *httptest.Server, client *http.Client) url.Values {
+	res, err := client.Get(authorizeURL(ts.URL+"/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+		Scope:        "read write",
+		State:        "consent_test",
+	}))
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Consent page was not served", res.Status, string(body))
+	}
+
+	form := make(url.Values)
+	for _, m := range formValue.FindAllStringSubmatch(string(body), -1) {
+		form.Set(m[1], m[2])
+	}
+	if form.Get("nonce") == "" || form.Get("csrf_token") == "" {
+		t.Fatal("Consent page has no form", string(body))
+	}
+	return form
+}
+
+// Submit the consent form and return the redirect location
+func submitConsent(t *testing.T, ts *httptest.Server, client *http.Client, form url.Values) *http.Response {
+	res, err := client.PostForm(ts.URL+"/consent", form)
+	if err != nil {
+		t.Fatal("Error posting consent form", err)
+	}
+	res.Body.Close()
+	return res
+}
+
+// Approving the consent page completes the authorization code grant
+func TestConsentApprove(t *testing.T) {
+	ts, client := newConsentServer(t)
+	defer ts.Close()
+
+	form := loadConsentPage(t, ts, client)
+	form.Set("action", "approve")
+	res := submitConsent(t, ts, client, form)
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatal("Approval was not redirected with 303 See Other", res.Status)
+	}
+	loc, _ := url.Parse(res.Header.Get("Location"))
+	code := loc.Query().Get("code")
+	if code == "" || loc.Query().Get("state") != "consent_test" {
+		t.Fatal("Approval redirect has no code", loc)
+	}
+
+	// Exchange the code for a token
+	req, _ := oauthclient.BuildTokenRequest(ts.URL+"/oauth2", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	})
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal("Error on the token request", err)
+	}
+	defer res.Body.Close()
+	ret := make(map[string]string)
+	json.NewDecoder(res.Body).Decode(&ret)
+	if ret["token"] == "" {
+		t.Error("Code exchange failed", ret)
+	}
+
+	// The consent request can't be answered twice
+	if res := submitConsent(t, ts, client, form); res.StatusCode != http.StatusBadRequest {
+		t.Error("Consent request was answered twice", res.Status)
+	}
+}
+
+func TestConsentDeny(t *testing.T) {
+	ts, client := newConsentServer(t)
+	defer ts.Close()
+
+	form := loadConsentPage(t, ts, client)
+	form.Set("action", "deny")
+	res := submitConsent(t, ts, client, form)
+	loc, _ := url.Parse(res.Header.Get("Location"))
+	if loc.Query().Get("error") != "access_denied" || loc.Query().Get("code") != "" {
+		t.Error("Denial was not redirected with access_denied", loc)
+	}
+}
+
+// The form must come with the CSRF cookie of the page
+func TestConsentCSRF(t *testing.T) {
+	ts, client := newConsentServer(t)
+	defer ts.Close()
+
+	form := loadConsentPage(t, ts, client)
+	form.Set("action", "approve")
+
+	// A forged submission from another browser has no cookie
+	res, err := http.PostForm(ts.URL+"/consent", form)
+	if err != nil {
+		t.Fatal("Error posting consent form", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Submission without the CSRF cookie was accepted", res.Status)
+	}
+}
@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCORSServer() *goauth2.Server {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.CORS = &goauth2.CORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+		MaxAge:         10 * time.Minute,
+	}
+	return server
+}
+
+func preflight(handler http.Handler, origin string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("OPTIONS", "/oauth2", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "authorization")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORSPreflight(t *testing.T) {
+	server := newCORSServer()
+	for _, handler := range []http.Handler{
+		server.MasterHandler(),
+		server.TokenVerifier(http.HandlerFunc(TestApiHandler)),
+	} {
+		w := preflight(handler, "https://app.example.com")
+		h := w.Header()
+		if w.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+			t.Error("Preflight of an allowed origin was not answered", w.Code, h)
+		}
+		if !strings.Contains(h.Get("Access-Control-Allow-Headers"), "Authorization") {
+			t.Error("Authorization header is not allowed", h)
+		}
+		if h.Get("Access-Control-Max-Age") != "600" {
+			t.Error("Bad max age", h)
+		}
+
+		w = preflight(handler, "https://evil.example.com")
+		if w.Code == http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Error("Preflight of another origin was answered", w.Code, w.Header())
+		}
+	}
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	server := newCORSServer()
+	request := func(origin string) *httptest.ResponseRecorder {
+		req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+			GrantType: "authorization_code",
+			Code:      "badcode",
+		})
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("https://app.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || w.Header().Get("Vary") != "Origin" {
+		t.Error("Response to an allowed origin has no CORS headers", w.Header())
+	}
+
+	// Other origins are processed normally
+	w = request("https://evil.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || !strings.Contains(w.Body.String(), "error") {
+		t.Error("Response to another origin has CORS headers", w.Header(), w.Body)
+	}
+
+	// Any origin is allowed with a wildcard
+	server.CORS.AllowedOrigins = []string{"*"}
+	w = request("https://other.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("Wildcard did not allow another origin", w.Header())
+	}
+}
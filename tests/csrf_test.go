@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2/authhandler"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+// A form page embedding the token, and a protected handler it posts to
+func newCSRFServer() *httptest.Server {
+	csrf := authhandler.NewCSRF(authhandler.CookieCSRFSource("csrf", "/"))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/form", func(w http.ResponseWriter, r *http.Request) {
+		field, err := csrf.FormField(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`<form method="POST" action="/submit">` + string(field) + `</form>`))
+	})
+	mux.Handle("/submit", csrf.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})))
+	return httptest.NewServer(mux)
+}
+
+func TestCSRF(t *testing.T) {
+	ts := newCSRFServer()
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/form")
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	m := csrfField.FindStringSubmatch(string(body))
+	if m == nil {
+		t.Fatal("Form has no token", string(body))
+	}
+	cookies := res.Cookies()
+
+	post := func(token string, cookies []*http.Cookie) int {
+		req, _ := http.NewRequest("POST", ts.URL+"/submit",
+			strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Error posting form", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := post(m[1], cookies); status != http.StatusOK {
+		t.Error("Form with the session token was refused", status)
+	}
+	if status := post("forged", cookies); status != http.StatusForbidden {
+		t.Error("Form with another token was accepted", status)
+	}
+	if status := post(m[1], nil); status != http.StatusForbidden {
+		t.Error("Form without a session was accepted", status)
+	}
+	if status := post("", nil); status != http.StatusForbidden {
+		t.Error("Form without a token was accepted", status)
+	}
+}
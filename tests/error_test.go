@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestInterpretError(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), nil)
+	server.RegisterErrorURI(goauth2.ErrorCodeAccessDenied, "http://example.com/denied")
+
+	// A wrapped ServerError keeps its code and gets the registered URI
+	wrapped := fmt.Errorf("authorizing: %w",
+		goauth2.NewServerError(goauth2.ErrorCodeAccessDenied, "access denied", ""))
+	e := server.InterpretError(wrapped)
+	if e.Code() != goauth2.ErrorCodeAccessDenied || e.Description() != "access denied" ||
+		e.URI() != "http://example.com/denied" {
+		t.Error("Bad interpretation of a wrapped ServerError", e.Code(), e.Description(), e.URI())
+	}
+
+	// Other errors are server errors with their message
+	e = server.InterpretError(errors.New("disk on fire"))
+	if e.Code() != goauth2.ErrorCodeServerError || e.Description() != "disk on fire" {
+		t.Error("Bad interpretation of a plain error", e.Code(), e.Description())
+	}
+
+	e = server.InterpretError(nil)
+	if e.Code() != goauth2.ErrorCodeServerError {
+		t.Error("Bad interpretation of a nil error", e.Code())
+	}
+}
+
+// ServerErrors match the sentinel of their code and unwrap to their cause
+func TestServerErrorIs(t *testing.T) {
+	err := fmt.Errorf("authorizing: %w",
+		goauth2.NewServerError(goauth2.ErrorCodeAccessDenied, "access denied", ""))
+	if !errors.Is(err, goauth2.ErrAccessDenied) {
+		t.Error("Access denied error does not match ErrAccessDenied")
+	}
+	if errors.Is(err, goauth2.ErrInvalidRequest) {
+		t.Error("Access denied error matches ErrInvalidRequest")
+	}
+
+	cause := errors.New("connection reset")
+	err = goauth2.NewServerError(goauth2.ErrorCodeServerError, "lookup failed", "").WithCause(cause)
+	if !errors.Is(err, cause) || !errors.Is(err, goauth2.ErrServerError) {
+		t.Error("Server error does not match its cause and code")
+	}
+
+	var e goauth2.ServerError
+	if !errors.As(fmt.Errorf("wrapped: %w", err), &e) || e.Description() != "lookup failed" {
+		t.Error("Wrapped ServerError was not found")
+	}
+}
+
+// Codes without a registered URI get the default one
+func TestDefaultErrorURIFunc(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), nil)
+	server.RegisterErrorURI(goauth2.ErrorCodeAccessDenied, "http://example.com/denied")
+	server.SetDefaultErrorURIFunc(func(code goauth2.ErrorCode) string {
+		return "https://docs.example.com/oauth-errors#" + string(code)
+	})
+
+	if e := server.NewError(goauth2.ErrorCodeInvalidScope, "bad scope"); e.URI() != "https://docs.example.com/oauth-errors#invalid_scope" {
+		t.Error("Bad default error URI", e.URI())
+	}
+	if e := server.NewError(goauth2.ErrorCodeAccessDenied, "denied"); e.URI() != "http://example.com/denied" {
+		t.Error("Registered error URI was not used", e.URI())
+	}
+	e := server.InterpretError(goauth2.NewServerError(goauth2.ErrorCodeInvalidRequest, "bad request", ""))
+	if e.URI() != "https://docs.example.com/oauth-errors#invalid_request" {
+		t.Error("Interpreted error has no default URI", e.URI())
+	}
+	if e := server.InterpretError(errors.New("disk on fire")); e.URI() != "https://docs.example.com/oauth-errors#server_error" {
+		t.Error("Server error has no default URI", e.URI())
+	}
+}
+
+// Whether a description is safe to reflect to the user agent
+func saneDescription(description string) bool {
+	return len(description) <= 256 && strings.IndexFunc(description, unicode.IsControl) < 0
+}
+
+// Hostile descriptions are sanitized and only registered error URIs are sent
+func TestSanitizedErrors(t *testing.T) {
+	hostile := goauth2.NewServerError(goauth2.ErrorCodeAccessDenied,
+		"denied\r\nSet-Cookie: session=evil\x00"+strings.Repeat("é", 1000),
+		"javascript:alert(1)")
+	deny := authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		if implicit {
+			oar.ImplicitRedirect(w, r, hostile)
+		} else {
+			oar.AuthCodeRedirect(w, r, hostile)
+		}
+	})
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), deny)
+	server.RegisterErrorURI(goauth2.ErrorCodeAccessDenied, "http://example.com/denied")
+
+	for _, rt := range []string{"code", "token"} {
+		w := clientAuthorizeRequest(server, "client1", rt)
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		params := loc.Query()
+		if rt == "token" {
+			params, _ = url.ParseQuery(loc.Fragment)
+		}
+		if d := params.Get("error_description"); !saneDescription(d) || !strings.HasPrefix(d, "denied") {
+			t.Error("Redirected description was not sanitized", rt, len(d), d)
+		}
+		if !utf8.ValidString(params.Get("error_description")) {
+			t.Error("Description was cut inside a character", rt)
+		}
+		if u := params.Get("error_uri"); u != "http://example.com/denied" {
+			t.Error("Error URI of the error was redirected", rt, u)
+		}
+	}
+
+	// Descriptions holding request input, here a huge redirection URI
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect#" + strings.Repeat("\n<script>", 500),
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if ret["error"] != "invalid_request" || !saneDescription(ret["error_description"]) {
+		t.Error("JSON description was not sanitized", ret)
+	}
+}
+
+// Redirected errors get the error URI of their code, whatever their type
+func TestRedirectErrorURI(t *testing.T) {
+	var denial error
+	deny := authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		oar.ErrorRedirect(w, r, denial)
+	})
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), deny)
+	server.RegisterErrorURI(goauth2.ErrorCodeAccessDenied, "http://example.com/denied")
+	server.SetDefaultErrorURIFunc(func(code goauth2.ErrorCode) string {
+		return "https://docs.example.com/oauth-errors#" + string(code)
+	})
+
+	tests := []struct {
+		err       error
+		code, uri string
+	}{
+		{errors.New("user said no"), "access_denied", "http://example.com/denied"},
+		{goauth2.NewServerError(goauth2.ErrorCodeInvalidScope, "bad scope", ""),
+			"invalid_scope", "https://docs.example.com/oauth-errors#invalid_scope"},
+		{fmt.Errorf("checking: %w", goauth2.NewServerError(goauth2.ErrorCodeTemporarilyUnavailable, "busy", "")),
+			"temporarily_unavailable", "https://docs.example.com/oauth-errors#temporarily_unavailable"},
+	}
+	for _, test := range tests {
+		denial = test.err
+		for _, rt := range []string{"code", "token"} {
+			loc, _ := url.Parse(clientAuthorizeRequest(server, "client1", rt).Header().Get("Location"))
+			params := loc.Query()
+			if rt == "token" {
+				params, _ = url.ParseQuery(loc.Fragment)
+			}
+			if params.Get("error") != test.code || params.Get("error_uri") != test.uri {
+				t.Error("Bad error redirect", test.err, rt, loc)
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// An authorization request with an unregistered redirection URI, which
+// can't be redirected
+func badRedirectRequest(server *goauth2.Server, accept string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "relative/<script>",
+	}), nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	return w
+}
+
+// Browsers get an error page, and API clients JSON
+func TestErrorPage(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.RegisterErrorURI(goauth2.ErrorCodeInvalidRequest, "http://example.com/invalid")
+
+	browser := "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	w := badRedirectRequest(server, browser)
+	body := w.Body.String()
+	if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatal("Browser did not get an error page", w.Code, w.Header())
+	}
+	if !strings.Contains(body, "invalid_request") || !strings.Contains(body, `href="http://example.com/invalid"`) {
+		t.Error("Error page lacks the error", body)
+	}
+	if strings.Contains(body, "<script>") {
+		t.Error("Error page is not escaped", body)
+	}
+
+	for _, accept := range []string{"", "application/json", "*/*", "application/json, text/html;q=0.5", "text/html;q=0.1, */*"} {
+		w := badRedirectRequest(server, accept)
+		ret := make(map[string]string)
+		if err := json.NewDecoder(w.Body).Decode(&ret); err != nil || ret["error"] != "invalid_request" {
+			t.Error("API client did not get a JSON error", accept, err, ret)
+		}
+	}
+
+	// The page can be replaced
+	var rendered goauth2.ServerError
+	server.ErrorPageRenderer = func(w http.ResponseWriter, r *http.Request, e goauth2.ServerError) {
+		rendered = e
+		w.WriteHeader(http.StatusTeapot)
+	}
+	if w := badRedirectRequest(server, browser); w.Code != http.StatusTeapot || rendered.Code() != goauth2.ErrorCodeInvalidRequest {
+		t.Error("Error page renderer was not used", w.Code, rendered)
+	}
+}
+
+// Deny redirects with access_denied in the flow of the request
+func TestDeny(t *testing.T) {
+	deny := authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		oar.Deny(w, r, "The user said no.")
+	})
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), deny)
+	server.RegisterErrorURI(goauth2.ErrorCodeAccessDenied, "http://example.com/denied")
+
+	loc, _ := url.Parse(clientAuthorizeRequest(server, "client1", "code").Header().Get("Location"))
+	if q := loc.Query(); q.Get("error") != "access_denied" || q.Get("error_description") != "The user said no." ||
+		q.Get("error_uri") != "http://example.com/denied" {
+		t.Error("Bad denial of a code request", loc)
+	}
+	loc, _ = url.Parse(clientAuthorizeRequest(server, "client1", "token").Header().Get("Location"))
+	if frag, _ := url.ParseQuery(loc.Fragment); frag.Get("error") != "access_denied" || frag.Get("access_token") != "" {
+		t.Error("Bad denial of an implicit request", loc)
+	}
+}
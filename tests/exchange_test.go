@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Get an implicit grant token of client1 for the "read write" scope
+func implicitToken(t *testing.T, server *goauth2.Server) string {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "token",
+		RedirectURI:  "http://localhost/redirect",
+		Scope:        "read write",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	frag, _ := url.ParseQuery(loc.Fragment)
+	token := frag.Get("access_token")
+	if token == "" {
+		t.Fatal("No implicit grant token", w.Code, loc)
+	}
+	return token
+}
+
+// Exchange a token as the gateway client
+func exchangeToken(server *goauth2.Server, p oauthclient.TokenParams) map[string]string {
+	p.GrantType = goauth2.GrantTypeTokenExchange
+	if p.ClientID == "" {
+		p.ClientID = "gateway"
+	}
+	if p.SubjectTokenType == "" {
+		p.SubjectTokenType = goauth2.TokenTypeAccessToken
+	}
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", p)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	return ret
+}
+
+var errNotGateway = errors.New("Only the gateway may exchange tokens.")
+
+// Only the gateway may exchange tokens, for their scope or less
+func gatewayPolicy(client goauth2.Client, subject *goauth2.TokenInfo, scope string) (string, error) {
+	if client.ID() != "gateway" {
+		return "", errNotGateway
+	}
+	return scope, nil
+}
+
+// An implicit grant token is exchanged for a token with a narrower scope,
+// which records the delegation
+func TestTokenExchange(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.TokenExchangePolicy = gatewayPolicy
+	subject := implicitToken(t, server)
+
+	ret := exchangeToken(server, oauthclient.TokenParams{
+		SubjectToken:       subject,
+		RequestedTokenType: goauth2.TokenTypeAccessToken,
+		Scope:              "read",
+	})
+	if ret["token"] == "" || ret["token"] == subject || ret["scope"] != "read" ||
+		ret["issued_token_type"] != goauth2.TokenTypeAccessToken {
+		t.Fatal("Bad token exchange response", ret)
+	}
+
+	info, err := server.Store.ValidateAccessTokenInfo(ret["token"])
+	if err != nil || info == nil {
+		t.Fatal("Exchanged token is not valid", err)
+	}
+	if info.ClientID != "gateway" || info.Scope != "read" || info.Delegation != "client1 gateway" {
+		t.Error("Bad exchanged token information", info)
+	}
+
+	// The exchanged token can be exchanged again, extending the chain
+	ret = exchangeToken(server, oauthclient.TokenParams{SubjectToken: ret["token"]})
+	info, _ = server.Store.ValidateAccessTokenInfo(ret["token"])
+	if info == nil || info.Scope != "read" || info.Delegation != "client1 gateway gateway" {
+		t.Error("Bad information of a token exchanged twice", ret, info)
+	}
+}
+
+func TestTokenExchangeErrors(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	subject := implicitToken(t, server)
+
+	tests := []struct {
+		name   string
+		params oauthclient.TokenParams
+		code   string
+	}{
+		{"no policy", oauthclient.TokenParams{SubjectToken: subject}, "unsupported_grant_type"},
+		{"policy denial", oauthclient.TokenParams{SubjectToken: subject, ClientID: "other"}, "invalid_grant"},
+		{"missing subject token", oauthclient.TokenParams{}, "invalid_request"},
+		{"unknown subject token", oauthclient.TokenParams{SubjectToken: "unknown"}, "invalid_grant"},
+		{"subject token type", oauthclient.TokenParams{SubjectToken: subject,
+			SubjectTokenType: "urn:ietf:params:oauth:token-type:id_token"}, "invalid_request"},
+		{"requested token type", oauthclient.TokenParams{SubjectToken: subject,
+			RequestedTokenType: "urn:ietf:params:oauth:token-type:refresh_token"}, "invalid_request"},
+		{"broader scope", oauthclient.TokenParams{SubjectToken: subject, Scope: "read admin"}, "invalid_scope"},
+	}
+	for i, test := range tests {
+		if i == 1 {
+			server.TokenExchangePolicy = gatewayPolicy
+		}
+		ret := exchangeToken(server, test.params)
+		if ret["error"] != test.code || ret["token"] != "" || ret["issued_token_type"] != "" {
+			t.Error("Bad error for", test.name, ret)
+		}
+	}
+}
+
+// A Store that issues tokens but can't check the credentials of clients
+type issuingStore struct {
+	goauth2.Store
+	goauth2.TokenIssuer
+}
+
+// Clients are refused when the Store can't authenticate them
+func TestTokenExchangeUnauthenticated(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.TokenExchangePolicy = gatewayPolicy
+	subject := implicitToken(t, server)
+	server.Store = issuingStore{server.Store, server.Store.(goauth2.TokenIssuer)}
+
+	if ret := exchangeToken(server, oauthclient.TokenParams{SubjectToken: subject}); ret["error"] != "invalid_client" || ret["token"] != "" {
+		t.Error("Client was not authenticated by the Store", ret)
+	}
+}
@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// An AuthHandler approving every request with extra parameters, some of
+// which try to replace standard ones
+var extraAuth = authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+	oar.Extra = map[string]string{
+		"tenant_id":  "t1",
+		"token_type": "fake",
+		"state":      "fake",
+		"error":      "fake",
+	}
+	if implicit {
+		oar.ImplicitRedirect(w, r, nil)
+	} else {
+		oar.AuthCodeRedirect(w, r, nil)
+	}
+})
+
+// The extra parameters of the AuthHandler are sent in the implicit
+// fragment, and in the token response of the code
+func TestExtraParams(t *testing.T) {
+	for name, server := range map[string]*goauth2.Server{
+		"store":     goauth2.NewServer(authcache.NewBasicAuthCache(), extraAuth),
+		"stateless": newExtraStatelessServer(),
+	} {
+		frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+		if frag.Get("tenant_id") != "t1" || frag.Get("access_token") == "" {
+			t.Errorf("%s: extra parameter is not in the fragment: %v", name, frag)
+		}
+		if frag.Get("token_type") != "bearer" || frag.Has("error") {
+			t.Errorf("%s: extra parameter replaced a standard one: %v", name, frag)
+		}
+
+		query := authorizeRequest(t, server, "code").Query()
+		if query.Get("tenant_id") != "t1" {
+			t.Errorf("%s: extra parameter is not in the code redirect: %v", name, query)
+		}
+
+		req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+			GrantType:   "authorization_code",
+			Code:        query.Get("code"),
+			RedirectURI: "http://localhost/redirect",
+		})
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		ret := make(map[string]string)
+		json.NewDecoder(w.Body).Decode(&ret)
+		if ret["tenant_id"] != "t1" || ret["token"] == "" {
+			t.Errorf("%s: extra parameter is not in the token response: %v", name, ret)
+		}
+		if ret["token_type"] != "bearer" || ret["error"] != "" {
+			t.Errorf("%s: extra parameter replaced a standard one: %v", name, ret)
+		}
+	}
+}
+
+func newExtraStatelessServer() *goauth2.Server {
+	cache := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(cache, extraAuth)
+	server.Store = goauth2.NewStatelessCodeStore(cache, []byte("key1"))
+	return server
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler/federated"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// An upstream provider logging in user1, or failing with loginError
+func newUpstream(t *testing.T, loginError string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		u, _ := url.Parse(q.Get("redirect_uri"))
+		back := url.Values{"state": {q.Get("state")}}
+		if loginError != "" {
+			back.Set("error", loginError)
+		} else {
+			back.Set("code", "upstreamcode")
+		}
+		u.RawQuery = back.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if user != "goauth2" || pass != "secret" || r.PostFormValue("code") != "upstreamcode" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		enc := base64.RawURLEncoding
+		idToken := enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			enc.EncodeToString([]byte(`{"sub":"user1"}`)) + "."
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "upstreamtoken",
+			"id_token":     idToken,
+		})
+	})
+	return httptest.NewServer(mux)
+}
+
+// Run an authorization request through the upstream provider and return
+// the final redirect to the client
+func federatedLogin(t *testing.T, loginError string) (*url.URL, string) {
+	upstream := newUpstream(t, loginError)
+	defer upstream.Close()
+
+	handler := federated.NewFederatedHandler(upstream.URL+"/authorize", upstream.URL+"/token",
+		"goauth2", "secret", "/federated/callback")
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), handler)
+	var user string
+	server.OnCodeIssued = func(oar *goauth2.OAuthRequest, code string) {
+		user = oar.UserID
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/oauth2", server.MasterHandler())
+	mux.Handle("/federated/callback", handler.CallbackHandler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == "localhost" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	res, err := client.Get(authorizeURL(ts.URL+"/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+		State:        "federated_test",
+	}))
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	res.Body.Close()
+	loc, _ := url.Parse(res.Header.Get("Location"))
+	if res.StatusCode != http.StatusFound || loc.Host != "localhost" {
+		t.Fatal("Login did not end with a redirect to the client", res.Status, loc)
+	}
+	return loc, user
+}
+
+func TestFederatedLogin(t *testing.T) {
+	loc, user := federatedLogin(t, "")
+	if loc.Query().Get("code") == "" || loc.Query().Get("state") != "federated_test" {
+		t.Error("Login was not redirected with a code", loc)
+	}
+	if user != "user1" {
+		t.Error("The upstream user was not set on the request", user)
+	}
+}
+
+func TestFederatedLoginFailure(t *testing.T) {
+	loc, _ := federatedLogin(t, "access_denied")
+	if loc.Query().Get("error") != "access_denied" || loc.Query().Get("code") != "" {
+		t.Error("Failed login was not denied", loc)
+	}
+}
+
+func TestFederatedUnknownState(t *testing.T) {
+	handler := federated.NewFederatedHandler("http://idp/authorize", "http://idp/token",
+		"goauth2", "secret", "/federated/callback")
+	req, _ := http.NewRequest("GET", "/federated/callback?state=unknown&code=x", nil)
+	w := httptest.NewRecorder()
+	handler.CallbackHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Error("Callback with an unknown state was accepted", w.Code)
+	}
+}
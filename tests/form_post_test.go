@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+var (
+	formAction = regexp.MustCompile(`<form method="post" action="([^"]*)">`)
+	formField  = regexp.MustCompile(`<input type="hidden" name="([^"]*)" value="([^"]*)">`)
+)
+
+// Send an authorization request with a response mode
+func responseModeRequest(server *goauth2.Server, responseType, mode, state string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: responseType,
+		RedirectURI:  "http://localhost/redirect?foo=bar",
+		ResponseMode: mode,
+		State:        state,
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	return w
+}
+
+// Parse the action and fields of a form_post page
+func parseFormPost(t *testing.T, w *httptest.ResponseRecorder) (string, url.Values) {
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/html; charset=utf-8" ||
+		w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatal("Bad form_post response", w.Code, w.Header())
+	}
+	body := w.Body.String()
+	m := formAction.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("Page has no form", body)
+	}
+	fields := url.Values{}
+	for _, f := range formField.FindAllStringSubmatch(body, -1) {
+		fields.Add(html.UnescapeString(f[1]), html.UnescapeString(f[2]))
+	}
+	return html.UnescapeString(m[1]), fields
+}
+
+func TestFormPost(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+
+	action, fields := parseFormPost(t, responseModeRequest(server, "code", "form_post", `"><script>`))
+	if action != "http://localhost/redirect?foo=bar" {
+		t.Error("Bad form action", action)
+	}
+	if fields.Get("code") == "" || fields.Get("state") != `"><script>` || fields.Get("foo") != "" {
+		t.Error("Bad form fields", fields)
+	}
+
+	action, fields = parseFormPost(t, responseModeRequest(server, "token", "form_post", "form_post_test"))
+	if action != "http://localhost/redirect?foo=bar" || fields.Get("access_token") == "" ||
+		fields.Get("token_type") != "bearer" || fields.Get("state") != "form_post_test" {
+		t.Error("Bad implicit form", action, fields)
+	}
+
+	// Errors are posted too
+	server.Auth = authhandler.NewBlackList("client1")
+	_, fields = parseFormPost(t, responseModeRequest(server, "code", "form_post", ""))
+	if fields.Get("error") != "access_denied" || fields.Get("code") != "" {
+		t.Error("Bad error form", fields)
+	}
+}
+
+func TestResponseModes(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+
+	// Codes may be sent in the fragment
+	w := responseModeRequest(server, "code", "fragment", "")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if frag, _ := url.ParseQuery(loc.Fragment); frag.Get("code") == "" || loc.RawQuery != "foo=bar" {
+		t.Error("Code was not sent in the fragment", loc)
+	}
+
+	// Unsupported modes and tokens in the query are refused
+	for _, c := range []struct{ responseType, mode string }{
+		{"code", "web_message"},
+		{"token", "query"},
+	} {
+		w := responseModeRequest(server, c.responseType, c.mode, "")
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		params := loc.Query()
+		if c.responseType == "token" {
+			params, _ = url.ParseQuery(loc.Fragment)
+		}
+		if params.Get("error") != "invalid_request" || params.Get("code") != "" || params.Get("access_token") != "" {
+			t.Error("Unsupported response mode was used", c.responseType, c.mode, loc)
+		}
+	}
+}
+
+// Errors are posted with their description, URI and state, for every
+// response type and wherever they occur
+func TestFormPostErrors(t *testing.T) {
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(&goauth2.ClientImpl{
+		ClientID:         "client1",
+		ClientGrantTypes: []string{goauth2.GrantTypeAuthorizationCode, goauth2.GrantTypeImplicit},
+	})
+	clients.AddClient(&goauth2.ClientImpl{
+		ClientID:         "client2",
+		ClientGrantTypes: []string{goauth2.GrantTypeAuthorizationCode},
+	})
+	deny := authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		oar.ErrorRedirect(w, r, errors.New("The user denied access."))
+	})
+	server := goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients, deny)
+	server.RegisterErrorURI(goauth2.ErrorCodeAccessDenied, "http://example.com/denied")
+
+	for _, responseType := range []string{"code", "token", "code token"} {
+		action, fields := parseFormPost(t, responseModeRequest(server, responseType, "form_post", "form_post_error"))
+		if action != "http://localhost/redirect?foo=bar" || fields.Get("error") != "access_denied" ||
+			fields.Get("error_description") != "The user denied access." ||
+			fields.Get("error_uri") != "http://example.com/denied" || fields.Get("state") != "form_post_error" {
+			t.Error("Bad error form for", responseType, action, fields)
+		}
+		if fields.Get("code") != "" || fields.Get("access_token") != "" {
+			t.Error("Error form has a code or token", responseType, fields)
+		}
+	}
+
+	// Errors of the validation are posted too
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client2",
+		ResponseType: "token",
+		RedirectURI:  "http://localhost/redirect",
+		ResponseMode: "form_post",
+		State:        "form_post_error",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	if _, fields := parseFormPost(t, w); fields.Get("error") != "unauthorized_client" ||
+		fields.Get("state") != "form_post_error" {
+		t.Error("Bad form of a validation error", fields)
+	}
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Send an authorization request for a client and return the response
+func clientAuthorizeRequest(server *goauth2.Server, clientID, responseType string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     clientID,
+		ResponseType: responseType,
+		RedirectURI:  "http://localhost/redirect",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	return w
+}
+
+// A handler that only approves client1 and defers the other requests
+var approveClient1 = authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+	if oar.ClientID != "client1" {
+		return
+	}
+	if implicit {
+		oar.ImplicitRedirect(w, r, nil)
+	} else {
+		oar.AuthCodeRedirect(w, r, nil)
+	}
+})
+
+func TestFunc(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), approveClient1)
+
+	w := clientAuthorizeRequest(server, "client1", "code")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if loc.Query().Get("code") == "" {
+		t.Error("Func did not authorize the code request", w.Code, loc)
+	}
+
+	w = clientAuthorizeRequest(server, "client1", "token")
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	if frag, _ := url.ParseQuery(loc.Fragment); frag.Get("access_token") == "" {
+		t.Error("Func did not authorize the implicit request", w.Code, loc)
+	}
+}
+
+// The first handler defers the requests it doesn't handle to the second
+func TestChain(t *testing.T) {
+	chain := authhandler.Chain(approveClient1, authhandler.NewWhiteList("client2"))
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), chain)
+
+	for _, clientID := range []string{"client1", "client2"} {
+		w := clientAuthorizeRequest(server, clientID, "code")
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		if loc.Query().Get("code") == "" {
+			t.Error("Chain did not authorize", clientID, loc)
+		}
+	}
+
+	w := clientAuthorizeRequest(server, "client3", "code")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if loc.Query().Get("error") != "access_denied" {
+		t.Error("Chain did not deny client3", loc)
+	}
+
+	// When no handler writes a response, the request is denied
+	server = goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.Chain(approveClient1))
+	w = clientAuthorizeRequest(server, "client2", "token")
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	if frag, _ := url.ParseQuery(loc.Fragment); frag.Get("error") != "access_denied" {
+		t.Error("Request no handler wrote for was not denied", loc)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	isClient2 := func(oar *goauth2.OAuthRequest) bool { return oar.ClientID == "client2" }
+	cond := authhandler.Conditional(isClient2, authhandler.NewBlackList(), authhandler.NewWhiteList())
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), cond)
+
+	w := clientAuthorizeRequest(server, "client2", "code")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if loc.Query().Get("code") == "" {
+		t.Error("Conditional did not route client2 to the first handler", loc)
+	}
+
+	w = clientAuthorizeRequest(server, "client1", "code")
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	if loc.Query().Get("error") != "access_denied" {
+		t.Error("Conditional did not route client1 to the second handler", loc)
+	}
+}
@@ -0,0 +1,229 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The error codes the server may send
+var registeredErrorCodes = map[string]bool{}
+
+func init() {
+	for _, code := range []goauth2.ErrorCode{
+		goauth2.ErrorCodeAccessDenied,
+		goauth2.ErrorCodeInvalidRequest,
+		goauth2.ErrorCodeInvalidClient,
+		goauth2.ErrorCodeInvalidGrant,
+		goauth2.ErrorCodeInvalidScope,
+		goauth2.ErrorCodeServerError,
+		goauth2.ErrorCodeTemporarilyUnavailable,
+		goauth2.ErrorCodeUnauthorizedClient,
+		goauth2.ErrorCodeUnsupportedResponseType,
+		goauth2.ErrorCodeUnsupportedGrantType,
+		goauth2.ErrorCodeInvalidToken,
+		goauth2.ErrorCodeBadRedirectURI,
+		goauth2.ErrorCodeInteractionRequired,
+		goauth2.ErrorCodeInvalidTarget,
+	} {
+		registeredErrorCodes[string(code)] = true
+	}
+}
+
+// The redirection URIs, states and response modes of the seed corpora,
+// from the cases of the other tests
+var (
+	seedRedirectURIs = []string{
+		"http://localhost/redirect",
+		"http://localhost/redirect?keep=1&state=theirs",
+		"http://localhost/redirect#fragment",
+		"https://client.example.com/cb?a=%zz;b",
+		"com.example.app:/callback",
+		"hafda;rea",
+		"/relative",
+		"://",
+		"",
+	}
+	seedStates        = []string{"", "authcode_grant_test", "état ✓ 日本語", "a&b=c#d %25", "\x00\xff\n"}
+	seedResponseModes = []string{"", "query", "fragment", "form_post", "web_message"}
+	seedResponseTypes = []string{"code", "token", "code token", "token code", "blah", ""}
+	seedTokenRequests = []string{
+		"grant_type=authorization_code&code=abc&redirect_uri=http%3A%2F%2Flocalhost%2Fredirect",
+		"grant_type=authorization_code&code=&redirect_uri=hafda;rea",
+		"grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Atoken-exchange&subject_token=x",
+		"grant_type=client_credentials&scope=read%20write",
+		"client_assertion_type=urn%3Aietf%3Aparams%3Aoauth%3Aclient-assertion-type%3Ajwt-bearer&client_assertion=a.b.c",
+		"grant_type=%zz&&==",
+		"",
+	}
+)
+
+// The response parameters of a redirect, from its query and fragment
+func redirectParams(t *testing.T, location string) (query, fragment url.Values) {
+	loc, err := url.Parse(location)
+	if err != nil {
+		t.Fatalf("Redirect location %q doesn't parse: %v", location, err)
+	}
+	fragment, err = url.ParseQuery(loc.Fragment)
+	if err != nil {
+		t.Fatalf("Redirect fragment %q doesn't parse: %v", loc.Fragment, err)
+	}
+	return loc.Query(), fragment
+}
+
+// Authorization requests never panic, redirect to URLs that parse, with
+// the state of the request and registered error codes
+func FuzzAuthorizationRequest(f *testing.F) {
+	for _, uri := range seedRedirectURIs {
+		for _, state := range seedStates {
+			f.Add("client1", "code", uri, state, "")
+		}
+	}
+	for _, responseType := range seedResponseTypes {
+		for _, mode := range seedResponseModes {
+			f.Add("client1", responseType, "http://localhost/redirect", "état ✓", mode)
+			f.Add("client2", responseType, "http://localhost/redirect", "", mode)
+		}
+	}
+
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	f.Fuzz(func(t *testing.T, clientID, responseType, redirectURI, state, responseMode string) {
+		req := httptest.NewRequest("GET", "/oauth2?"+url.Values{
+			"client_id":     {clientID},
+			"response_type": {responseType},
+			"redirect_uri":  {redirectURI},
+			"state":         {state},
+			"response_mode": {responseMode},
+		}.Encode(), nil)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+
+		location := w.Header().Get("Location")
+		switch {
+		case location != "":
+			query, fragment := redirectParams(t, location)
+			for _, params := range []url.Values{query, fragment} {
+				if params.Get("code") == "" && params.Get("access_token") == "" && params.Get("error") == "" {
+					continue
+				}
+				if errstr := params.Get("error"); errstr != "" && !registeredErrorCodes[errstr] {
+					t.Errorf("Unregistered error code %q in %q", errstr, location)
+				}
+				if got := params.Get("state"); state != "" && got != state {
+					t.Errorf("State %q came back as %q in %q", state, got, location)
+				}
+			}
+		case strings.HasPrefix(w.Header().Get("Content-Type"), "application/json"):
+			ret := make(map[string]interface{})
+			if err := json.NewDecoder(w.Body).Decode(&ret); err != nil {
+				t.Fatal("Error response is not JSON", w.Code, err)
+			}
+			if errstr, _ := ret["error"].(string); !registeredErrorCodes[errstr] {
+				t.Errorf("Unregistered error code %q", errstr)
+			}
+		case w.Code != http.StatusOK:
+			t.Errorf("Unexpected response %d %q", w.Code, w.Body)
+		}
+	})
+}
+
+// Token requests never panic, and get a token or a JSON error with a
+// registered code
+func FuzzAccessTokenRequest(f *testing.F) {
+	for _, body := range seedTokenRequests {
+		f.Add(body)
+	}
+
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	f.Fuzz(func(t *testing.T, body string) {
+		req := httptest.NewRequest("POST", "/oauth2", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+
+		ret := make(map[string]interface{})
+		if err := json.NewDecoder(w.Body).Decode(&ret); err != nil {
+			t.Fatal("Token response is not JSON", w.Code, err)
+		}
+		if errstr, ok := ret["error"].(string); ok {
+			if !registeredErrorCodes[errstr] {
+				t.Errorf("Unregistered error code %q", errstr)
+			}
+		} else if ret["token"] == nil {
+			t.Error("Token response has no token nor error", ret)
+		}
+	})
+}
+
+// Redirect locations parse again, carry the parameters byte for byte in
+// the query or fragment of the response mode, and leave their inputs as
+// they were
+func FuzzRedirectLocation(f *testing.F) {
+	for _, uri := range seedRedirectURIs {
+		for _, state := range seedStates {
+			f.Add(uri, state, "", false)
+			f.Add(uri, state, "", true)
+		}
+	}
+	for _, mode := range seedResponseModes {
+		f.Add("http://localhost/redirect?state=theirs", "état ✓", mode, false)
+		f.Add("http://localhost/redirect?state=theirs", "état ✓", mode, true)
+	}
+
+	f.Fuzz(func(t *testing.T, redirectURI, state, responseMode string, implicit bool) {
+		uri, err := url.Parse(redirectURI)
+		if err != nil || !uri.IsAbs() || uri.Fragment != "" {
+			t.Skip("Not a valid redirection URI")
+		}
+		req := &goauth2.OAuthRequest{RedirectURI: uri, State: state, ResponseMode: responseMode}
+
+		// The parameters of the redirects of the server, which have no
+		// empty state
+		params := url.Values{"code": {"the code"}}
+		if state != "" {
+			params.Set("state", state)
+		}
+		if implicit {
+			params.Set("access_token", "the token")
+		}
+		saved := url.Values{}
+		for k, v := range params {
+			saved[k] = append([]string(nil), v...)
+		}
+		before := uri.String()
+
+		loc := req.RedirectLocation(params, implicit)
+		if !reflect.DeepEqual(params, saved) || uri.String() != before {
+			t.Fatal("RedirectLocation changed its inputs", params, uri)
+		}
+		query, fragment := redirectParams(t, loc.String())
+
+		switch {
+		case responseMode == "form_post":
+			if loc.String() != before {
+				t.Error("Form post location is not the redirection URI", loc)
+			}
+		case implicit && responseMode == "":
+			// The hybrid flow sends the code in the query
+			if query.Get("code") != "the code" || (state != "" && query.Get("state") != state) ||
+				fragment.Get("access_token") != "the token" || fragment.Get("state") != state || fragment.Get("code") != "" {
+				t.Errorf("Bad hybrid redirect %q for state %q", loc, state)
+			}
+		case implicit || responseMode == "fragment":
+			if !reflect.DeepEqual(fragment, saved) {
+				t.Errorf("Fragment %v of %q is not %v", fragment, loc, saved)
+			}
+		default:
+			if query.Get("code") != "the code" || (state != "" && query.Get("state") != state) {
+				t.Errorf("Bad query redirect %q for state %q", loc, state)
+			}
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+// Generated strings have the requested length and alphabet, and don't repeat
+func TestTokenGenerator(t *testing.T) {
+	tests := []struct {
+		gen      goauth2.TokenGenerator
+		length   int
+		alphabet *regexp.Regexp
+	}{
+		{goauth2.TokenGenerator{Length: 16, Encoding: goauth2.EncodingHex}, 32, regexp.MustCompile(`^[0-9a-f]+$`)},
+		{goauth2.TokenGenerator{Length: 16, Encoding: goauth2.EncodingBase64URL}, 22, regexp.MustCompile(`^[0-9A-Za-z_-]+$`)},
+		{goauth2.TokenGenerator{Length: 16, Encoding: goauth2.EncodingBase62}, 22, regexp.MustCompile(`^[0-9A-Za-z]+$`)},
+		{goauth2.TokenGenerator{Length: 5, Encoding: goauth2.EncodingBase62}, 7, regexp.MustCompile(`^[0-9A-Za-z]+$`)},
+	}
+	for _, test := range tests {
+		if n := test.gen.EncodedLen(); n != test.length {
+			t.Error("Bad encoded length", test.gen, n)
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			str, err := test.gen.Generate()
+			if err != nil {
+				t.Fatal("Error generating a token", err)
+			}
+			if len(str) != test.length || !test.alphabet.MatchString(str) {
+				t.Fatal("Bad generated token", test.gen, str)
+			}
+			if seen[str] {
+				t.Fatal("Generated token repeated", test.gen, str)
+			}
+			seen[str] = true
+		}
+	}
+}
+
+// The Store issues codes and tokens with its Generator, and 40 hexadecimal
+// digits without one
+func TestStoreGenerator(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	loc := authorizeRequest(t, server, "code")
+	if code := loc.Query().Get("code"); !regexp.MustCompile(`^[0-9a-f]{40}$`).MatchString(code) {
+		t.Error("Default code changed", code)
+	}
+
+	server.Store.(*goauth2.StoreImpl).Generator = &goauth2.TokenGenerator{
+		Length:   12,
+		Encoding: goauth2.EncodingBase64URL,
+	}
+	loc = authorizeRequest(t, server, "code")
+	if code := loc.Query().Get("code"); !regexp.MustCompile(`^[0-9A-Za-z_-]{16}$`).MatchString(code) {
+		t.Error("Code was not generated by the Generator", code)
+	}
+	loc = authorizeRequest(t, server, "token")
+	frag, _ := url.ParseQuery(loc.Fragment)
+	if token := frag.Get("access_token"); !regexp.MustCompile(`^[0-9A-Za-z_-]{16}$`).MatchString(token) {
+		t.Error("Token was not generated by the Generator", token)
+	}
+}
@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const apiKeyGrant = "urn:example:params:oauth:grant-type:api-key"
+
+// An extension grant trading an API key of a user for an access token
+func apiKeyGrantHandler(server *goauth2.Server) goauth2.GrantHandler {
+	keys := map[string]string{"key1": "user1"}
+	return func(ctx context.Context, req *goauth2.AccessTokenRequest, client goauth2.ClientInfo) (*goauth2.AccessTokenResponse, error) {
+		user, ok := keys[req.Values.Get("api_key")]
+		if !ok {
+			return nil, server.NewError(goauth2.ErrorCodeInvalidGrant, "The API key is invalid.")
+		}
+		token, ttype, expiry, err := server.Store.(goauth2.TokenIssuer).IssueAccessToken(goauth2.TokenInfo{
+			ClientID: client.ID,
+			Scope:    req.Scope,
+			UserID:   user,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &goauth2.AccessTokenResponse{
+			Token:     token,
+			TokenType: ttype,
+			Expiry:    expiry,
+			Extra:     map[string]string{"user": user},
+		}, nil
+	}
+}
+
+func grantRequest(server *goauth2.Server, params url.Values) map[string]string {
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{Extra: params})
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	return ret
+}
+
+func TestExtensionGrant(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), nil)
+	params := url.Values{
+		"grant_type": {apiKeyGrant},
+		"client_id":  {"client1"},
+		"api_key":    {"key1"},
+	}
+
+	// Unknown until registered
+	if ret := grantRequest(server, params); ret["error"] != "unsupported_grant_type" {
+		t.Error("Unregistered grant type was accepted", ret)
+	}
+
+	server.RegisterGrantType(apiKeyGrant, apiKeyGrantHandler(server))
+	ret := grantRequest(server, params)
+	if ret["token"] == "" || ret["token_type"] != "bearer" || ret["user"] != "user1" {
+		t.Fatal("Bad extension grant response", ret)
+	}
+	info, _ := server.Store.ValidateAccessTokenInfo(ret["token"])
+	if info == nil || info.ClientID != "client1" || info.UserID != "user1" {
+		t.Error("Bad token of the extension grant", info)
+	}
+
+	if gt, _ := getMetadata(t, server)["grant_types_supported"].([]interface{}); len(gt) != 3 || gt[2] != apiKeyGrant {
+		t.Error("Extension grant is not in the metadata", gt)
+	}
+
+	params.Set("api_key", "unknown")
+	if ret := grantRequest(server, params); ret["error"] != "invalid_grant" || ret["token"] != "" {
+		t.Error("Extension grant error was not sent", ret)
+	}
+
+	// The built-in grant is still there
+	if ret := grantRequest(server, url.Values{"grant_type": {"authorization_code"}}); ret["error"] != "invalid_request" {
+		t.Error("Bad authorization_code error", ret)
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func hybridRequest(server *goauth2.Server, responseType, responseMode string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: responseType,
+		ResponseMode: responseMode,
+		RedirectURI:  "http://localhost/redirect",
+		State:        "hybrid_test",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	return w
+}
+
+// The "code token" hybrid flow sends the code in the query and the token in
+// the fragment, and both can be used
+func TestHybridCodeToken(t *testing.T) {
+	cache := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(cache, authhandler.NewWhiteList("client1"))
+
+	for _, responseType := range []string{"code token", "token code"} {
+		w := hybridRequest(server, responseType, "")
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || w.Code != http.StatusFound {
+			t.Fatal("Hybrid request was not redirected", w.Code, w.Body)
+		}
+		frag, _ := url.ParseQuery(loc.Fragment)
+		code, token := loc.Query().Get("code"), frag.Get("access_token")
+		if code == "" || token == "" || frag.Get("code") != "" ||
+			loc.Query().Get("state") != "hybrid_test" || frag.Get("state") != "hybrid_test" {
+			t.Fatal("Bad hybrid redirect", loc)
+		}
+
+		if _, ok := cache.AccessTokens[token]; !ok {
+			t.Error("Hybrid token was not registered", token)
+		}
+		if _, _, _, err := server.Store.CreateAccessToken(&goauth2.AccessTokenRequest{
+			GrantType:   "authorization_code",
+			Code:        code,
+			RedirectURI: "http://localhost/redirect",
+		}); err != nil {
+			t.Error("Hybrid code can't be exchanged", err)
+		}
+	}
+
+	// All the parameters go in the requested response mode
+	w := hybridRequest(server, "code token", "fragment")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	frag, _ := url.ParseQuery(loc.Fragment)
+	if loc.RawQuery != "" || frag.Get("code") == "" || frag.Get("access_token") == "" {
+		t.Error("Bad hybrid redirect in the fragment", loc)
+	}
+	if w := hybridRequest(server, "code token", "query"); w.Code != http.StatusFound ||
+		!hasFragmentError(w, "invalid_request") {
+		t.Error("Hybrid tokens were allowed in the query", w.Header().Get("Location"))
+	}
+}
+
+func hasFragmentError(w *httptest.ResponseRecorder, code string) bool {
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	frag, _ := url.ParseQuery(loc.Fragment)
+	return frag.Get("error") == code && frag.Get("access_token") == "" && loc.Query().Get("code") == ""
+}
+
+func TestHybridErrors(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client2"))
+
+	// Denied requests get the error in the fragment, without a code
+	if w := hybridRequest(server, "code token", ""); !hasFragmentError(w, "access_denied") {
+		t.Error("Bad hybrid denial", w.Header().Get("Location"))
+	}
+
+	// Unknown combinations are not supported
+	for _, responseType := range []string{"code id_token", "token token", "code token code", "code  id_token token"} {
+		w := hybridRequest(server, responseType, "")
+		if w.Code == http.StatusFound || !strings.Contains(w.Body.String(), "unsupported_response_type") {
+			t.Error("Unknown response type was accepted", responseType, w.Code, w.Body)
+		}
+	}
+
+	// The client must be allowed both grant types
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(&goauth2.ClientImpl{
+		ClientID:           "client1",
+		ClientRedirectURIs: []string{"http://localhost/redirect"},
+		ClientGrantTypes:   []string{goauth2.GrantTypeAuthorizationCode},
+	})
+	server = goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients, authhandler.NewBlackList())
+	if w := hybridRequest(server, "code token", ""); !hasFragmentError(w, "unauthorized_client") {
+		t.Error("Hybrid flow was allowed without the implicit grant", w.Header().Get("Location"))
+	}
+}
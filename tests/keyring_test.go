@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Tokens tagged with an old key still validate after a rotation, until
+// the key is removed
+func TestKeyRingRotation(t *testing.T) {
+	keys := goauth2.NewKeyRing("k1", []byte("first key"))
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.Store.(*goauth2.StoreImpl).Codec = goauth2.NewTokenCodecWithKeyRing(keys)
+
+	issue := func() string {
+		frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+		return frag.Get("access_token")
+	}
+	old := issue()
+
+	keys.AddKey("k2", []byte("second key"))
+	if err := keys.SetActive("k2"); err != nil {
+		t.Fatal("Error activating the key", err)
+	}
+	if err := keys.SetActive("k3"); err == nil {
+		t.Error("Unknown key was activated")
+	}
+	if err := keys.RemoveKey("k2"); err == nil {
+		t.Error("Active key was removed")
+	}
+
+	current := issue()
+	value := current[:strings.LastIndex(current, ".")]
+	if goauth2.NewTokenCodec([]byte("second key")).Encode(value) != current {
+		t.Error("New token was not tagged with the active key", current)
+	}
+	for _, token := range []string{old, current} {
+		if status := apiStatus(server, token); status != http.StatusOK {
+			t.Error("Token was refused after the rotation", token, status)
+		}
+	}
+
+	if err := keys.RemoveKey("k1"); err != nil {
+		t.Fatal("Error removing the key", err)
+	}
+	if status := apiStatus(server, old); status != http.StatusUnauthorized {
+		t.Error("Token of a removed key was accepted", status)
+	}
+	if status := apiStatus(server, current); status != http.StatusOK {
+		t.Error("Token of the active key was refused", status)
+	}
+}
+
+// Stateless codes signed with an old key are exchanged after a rotation
+func TestKeyRingStatelessCodes(t *testing.T) {
+	cache := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(cache, authhandler.NewWhiteList("client1"))
+	store := goauth2.NewStatelessCodeStoreWithKeyRing(cache, goauth2.NewKeyRing("k1", []byte("first key")))
+	server.Store = store
+
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	store.KeyRing().AddKey("k2", []byte("second key"))
+	store.KeyRing().SetActive("k2")
+	if err := statelessExchange(server, code, "http://localhost/redirect"); err != nil {
+		t.Error("Code of the old key was refused", err)
+	}
+
+	// Codes of the new key aren't accepted by servers with the old one only
+	code = authorizeRequest(t, server, "code").Query().Get("code")
+	other := goauth2.NewServer(cache, nil)
+	other.Store = goauth2.NewStatelessCodeStore(cache, []byte("first key"))
+	if err := statelessExchange(other, code, "http://localhost/redirect"); err == nil {
+		t.Error("Code of the new key was accepted with the old key")
+	}
+}
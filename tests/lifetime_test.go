@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// A server of the given clients whose cache gives tokens a minute and
+// keeps codes for a day, on a fake clock
+func newLifetimeServer(t *testing.T, clients ...*goauth2.ClientImpl) (*goauth2.Server, *fakeClock) {
+	store := clientstore.NewBasicClientStore()
+	var ids []string
+	for _, client := range clients {
+		store.AddClient(client)
+		ids = append(ids, client.ClientID)
+	}
+	cache := authcache.NewBasicAuthCache()
+	cache.CodeExpiry = 24 * 3600
+	clock := newFakeClock()
+	server, err := goauth2.NewServerOptions(
+		goauth2.WithAuthCache(cache),
+		goauth2.WithClientStore(store),
+		goauth2.WithAuthHandler(authhandler.NewWhiteList(ids...)),
+		goauth2.WithTokenTTL(time.Minute),
+		goauth2.WithClock(clock),
+	)
+	if err != nil {
+		t.Fatal("Error creating the server", err)
+	}
+	return server, clock
+}
+
+// Get the implicit token of a client
+func clientImplicitToken(t *testing.T, server *goauth2.Server, clientID string) url.Values {
+	req := httptest.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     clientID,
+		ResponseType: "token",
+		RedirectURI:  "http://localhost/redirect",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	frag, _ := url.ParseQuery(loc.Fragment)
+	if frag.Get("access_token") == "" {
+		t.Fatal("No token issued to", clientID, frag)
+	}
+	return frag
+}
+
+// Exchange a code at the token endpoint
+func exchangeLifetimeCode(server *goauth2.Server, code string) map[string]string {
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	})
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	return ret
+}
+
+// Tokens live for the lifetime of their client, or the cache's, and
+// expires_in tells the lifetime they were given
+func TestClientTokenTTL(t *testing.T) {
+	server, clock := newLifetimeServer(t,
+		&goauth2.ClientImpl{ClientID: "cli", ClientTokenTTL: 8 * time.Hour},
+		&goauth2.ClientImpl{ClientID: "web", ClientTokenTTL: 15 * time.Minute},
+		&goauth2.ClientImpl{ClientID: "other"},
+	)
+
+	tokens := make(map[string]string)
+	for client, expiresIn := range map[string]string{"cli": "28800", "web": "900", "other": "60"} {
+		frag := clientImplicitToken(t, server, client)
+		if frag.Get("expires_in") != expiresIn {
+			t.Errorf("Bad expiry of the token of %s: %s", client, frag.Get("expires_in"))
+		}
+		tokens[client] = frag.Get("access_token")
+	}
+
+	clock.Advance(2 * time.Minute)
+	if apiStatus(server, tokens["other"]) != http.StatusUnauthorized {
+		t.Error("Token outlived the cache's lifetime")
+	}
+	if apiStatus(server, tokens["web"]) != http.StatusOK {
+		t.Error("Token expired before its client's lifetime")
+	}
+	clock.Advance(15 * time.Minute)
+	if apiStatus(server, tokens["web"]) != http.StatusUnauthorized {
+		t.Error("Token outlived its client's lifetime")
+	}
+	if apiStatus(server, tokens["cli"]) != http.StatusOK {
+		t.Error("Token expired before its client's lifetime")
+	}
+}
+
+// Tokens of a session expire by its end, however late they are issued
+func TestMaxSession(t *testing.T) {
+	server, clock := newLifetimeServer(t, &goauth2.ClientImpl{
+		ClientID:         "client1",
+		ClientTokenTTL:   time.Hour,
+		ClientMaxSession: 2 * time.Hour,
+	})
+
+	if ret := exchangeLifetimeCode(server, authorizeRequest(t, server, "code").Query().Get("code")); ret["expires_in"] != "3600" {
+		t.Error("Bad expiry of a token early in the session", ret)
+	}
+
+	// A code exchanged late in its session gives a shorter token
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	clock.Advance(90 * time.Minute)
+	ret := exchangeLifetimeCode(server, code)
+	if ret["expires_in"] != "1800" {
+		t.Error("Token of the session outlives it", ret)
+	}
+	clock.Advance(30 * time.Minute)
+	if apiStatus(server, ret["token"]) != http.StatusUnauthorized {
+		t.Error("Token is valid after the end of its session")
+	}
+
+	code = authorizeRequest(t, server, "code").Query().Get("code")
+	clock.Advance(2 * time.Hour)
+	if ret := exchangeLifetimeCode(server, code); ret["error"] != "invalid_grant" {
+		t.Error("Token was issued after the end of the session", ret)
+	}
+
+	// Tokens issued for a session, such as by token exchange, are capped
+	// from its authorization
+	issuer := server.Store.(goauth2.TokenIssuer)
+	authTime := clock.Now().Add(-100 * time.Minute)
+	if _, _, expiry, err := issuer.IssueAccessToken(goauth2.TokenInfo{ClientID: "client1", AuthTime: authTime}); err != nil || expiry != 1200 {
+		t.Error("Bad expiry of a token of the session", expiry, err)
+	}
+	clock.Advance(20 * time.Minute)
+	if _, _, _, err := issuer.IssueAccessToken(goauth2.TokenInfo{ClientID: "client1", AuthTime: authTime}); err == nil {
+		t.Error("Token was issued after the end of the session")
+	}
+}
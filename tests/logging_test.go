@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Codes and secrets in the query never reach the access log
+func TestLoggingMiddleware(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.LegacyGETTokenRequests = true
+	var buf bytes.Buffer
+	logged := (&goauth2.RequestLogger{Logger: log.New(&buf, "", 0)}).Middleware(server.MasterHandler())
+
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	query := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"http://localhost/redirect"},
+		"client_secret": {"s3cret"},
+	}
+	req, _ := http.NewRequest("GET", "/oauth2?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	logged.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatal("Token request failed", w.Code, w.Body)
+	}
+
+	line := buf.String()
+	if code == "" || strings.Contains(line, code) || strings.Contains(line, "s3cret") {
+		t.Error("A secret was logged", line)
+	}
+	if !strings.HasPrefix(line, "GET /oauth2?") || !strings.Contains(line, "code=REDACTED") ||
+		!strings.Contains(line, "grant_type=authorization_code") || !strings.Contains(line, " 200 ") {
+		t.Error("Bad access log line", line)
+	}
+}
+
+// The redacted parameters can be configured, and the status is logged
+func TestLoggingMiddlewareParams(t *testing.T) {
+	var buf bytes.Buffer
+	logged := (&goauth2.RequestLogger{
+		Logger:         log.New(&buf, "", 0),
+		RedactedParams: []string{"session"},
+	}).Middleware(http.NotFoundHandler())
+
+	req, _ := http.NewRequest("GET", "/page?session=abc&code=xyz", nil)
+	logged.ServeHTTP(httptest.NewRecorder(), req)
+	if line := buf.String(); !strings.HasPrefix(line, "GET /page?session=REDACTED&code=xyz 404 ") {
+		t.Error("Bad access log line", line)
+	}
+}
+
+// Authorization requests refused without a redirect are logged with the
+// client, the redirection URI sent and the reason
+func TestLogNoRedirect(t *testing.T) {
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(&goauth2.ClientImpl{
+		ClientID:           "client1",
+		ClientRedirectURIs: []string{"http://localhost/redirect"},
+	})
+	server := goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients,
+		authhandler.NewWhiteList("client1"))
+	var buf bytes.Buffer
+	server.Logger = log.New(&buf, "", 0)
+
+	for _, c := range []struct {
+		clientID, redirectURI, logged string
+	}{
+		{"client1", "http://evil.example.com/redirect",
+			`client_id="client1" redirect_uri="http://evil.example.com/redirect" error="invalid_request" description="The redirection URI is not registered for the client."`},
+		{"client1", "not a uri\x7f", `redirect_uri="not a uri\x7f"`},
+		{"client2", "http://localhost/redirect", `client_id="client2" redirect_uri="http://localhost/redirect" error="unauthorized_client"`},
+	} {
+		buf.Reset()
+		req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+			ClientID:     c.clientID,
+			ResponseType: "code",
+			RedirectURI:  c.redirectURI,
+		}), nil)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		if w.Header().Get("Location") != "" {
+			t.Error("Request was redirected", c.redirectURI)
+		}
+		if line := buf.String(); !strings.Contains(line, "not redirected") || !strings.Contains(line, c.logged) {
+			t.Errorf("Bad log of the refused request %q, not containing %s", line, c.logged)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// An AuthHandler approving the requests of logged in users, and sending the
+// others to the login page
+func newLoginServer() *goauth2.Server {
+	auth := authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		c, err := r.Cookie("session")
+		if err != nil {
+			oar.RequireLogin(w, r, "/login?lang=en")
+			return
+		}
+		oar.UserID = c.Value
+		oar.AuthCodeRedirect(w, r, nil)
+	})
+	return goauth2.NewServer(authcache.NewBasicAuthCache(), auth)
+}
+
+func TestRequireLogin(t *testing.T) {
+	server := newLoginServer()
+
+	// The user is sent to log in
+	login := authorizeRequest(t, server, "code")
+	id := login.Query().Get(goauth2.LoginReturnParam)
+	if login.Path != "/login" || login.Query().Get("lang") != "en" || id == "" {
+		t.Fatal("User was not sent to the login page", login)
+	}
+
+	// After logging in, the request is completed for the user
+	oar, err := server.ResumeAuthorize(id)
+	if err != nil || oar.ClientID != "client1" || oar.RedirectURI.String() != "http://localhost/redirect" {
+		t.Fatal("Pending request was not resumed", oar, err)
+	}
+	oar.UserID = "user1"
+	req, _ := http.NewRequest("POST", "/login", nil)
+	w := httptest.NewRecorder()
+	oar.AuthCodeRedirect(w, req, nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") == "" {
+		t.Error("Resumed request was not redirected", w.Code)
+	}
+
+	// Requests are resumed only once
+	if _, err := server.ResumeAuthorize(id); !errors.Is(err, goauth2.ErrAccessDenied) {
+		t.Error("Pending request was resumed twice", err)
+	}
+	if _, err := server.ResumeAuthorize("unknown"); !errors.Is(err, goauth2.ErrAccessDenied) {
+		t.Error("Unknown request was resumed", err)
+	}
+	if _, err := server.ResumeAuthorize(""); !errors.Is(err, goauth2.ErrAccessDenied) {
+		t.Error("Empty identifier was resumed", err)
+	}
+}
+
+// Requests that forbid prompting the user are not sent to log in
+func TestRequireLoginPromptNone(t *testing.T) {
+	server := newLoginServer()
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+		Prompt:       "none",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if loc.Path != "/redirect" || loc.Query().Get("error") != "interaction_required" {
+		t.Error("Login was required with prompt=none", loc)
+	}
+}
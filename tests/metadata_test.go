@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Fetch the metadata of a server
+func getMetadata(t *testing.T, server *goauth2.Server) map[string]interface{} {
+	return getMetadataAt(t, server.MetadataHandler(), "/.well-known/oauth-authorization-server")
+}
+
+// Fetch the metadata served by a handler at a path
+func getMetadataAt(t *testing.T, handler http.Handler, path string) map[string]interface{} {
+	req, _ := http.NewRequest("GET", "http://auth.example.com"+path, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatal("Bad metadata response", w.Code, w.Header())
+	}
+	res := make(map[string]interface{})
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal("Error decoding metadata", err)
+	}
+	return res
+}
+
+func TestMetadataMinimal(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	md := getMetadata(t, server)
+
+	if md["issuer"] != "http://auth.example.com" {
+		t.Error("Issuer was not derived from the request", md["issuer"])
+	}
+	for _, key := range []string{"authorization_endpoint", "token_endpoint",
+		"revocation_endpoint", "introspection_endpoint", "scopes_supported"} {
+		if _, ok := md[key]; ok {
+			t.Error("Unconfigured metadata is published", key, md[key])
+		}
+	}
+	if rt, _ := md["response_types_supported"].([]interface{}); len(rt) != 3 || rt[0] != "code" || rt[1] != "token" || rt[2] != "code token" {
+		t.Error("Bad response types", md["response_types_supported"])
+	}
+	if gt, _ := md["grant_types_supported"].([]interface{}); len(gt) != 2 || gt[0] != "authorization_code" || gt[1] != "implicit" {
+		t.Error("Bad grant types", md["grant_types_supported"])
+	}
+}
+
+func TestMetadataConfigured(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.Issuer = "https://issuer.example.com/"
+	server.Endpoints = goauth2.Endpoints{
+		Authorization: "/oauth2",
+		Token:         "/oauth2",
+		Revocation:    "/revoke",
+	}
+	server.ScopesSupported = []string{"read", "write"}
+	md := getMetadata(t, server)
+
+	expected := map[string]string{
+		"issuer":                 "https://issuer.example.com",
+		"authorization_endpoint": "https://issuer.example.com/oauth2",
+		"token_endpoint":         "https://issuer.example.com/oauth2",
+		"revocation_endpoint":    "https://issuer.example.com/revoke",
+	}
+	for key, value := range expected {
+		if md[key] != value {
+			t.Error("Bad metadata", key, md[key])
+		}
+	}
+	if _, ok := md["introspection_endpoint"]; ok {
+		t.Error("Unconfigured introspection endpoint is published")
+	}
+	if scopes, _ := md["scopes_supported"].([]interface{}); len(scopes) != 2 || scopes[0] != "read" {
+		t.Error("Bad scopes", md["scopes_supported"])
+	}
+}
+
+// The endpoints mounted by Server.Handler are advertised by its metadata,
+// without changing the Server
+func TestMetadataMounted(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	md := getMetadataAt(t, server.Handler("/oauth2"), "/oauth2/.well-known/oauth-authorization-server")
+	if md["pushed_authorization_request_endpoint"] != "http://auth.example.com/oauth2/par" ||
+		md["token_endpoint"] != "http://auth.example.com/oauth2/token" {
+		t.Error("Mounted endpoints are not advertised", md)
+	}
+	if server.Endpoints != (goauth2.Endpoints{}) {
+		t.Error("Handler set the Endpoints of the Server", server.Endpoints)
+	}
+
+	// Configured endpoints take precedence
+	server.Endpoints = goauth2.Endpoints{Token: "/token"}
+	md = getMetadataAt(t, server.Handler("/oauth2"), "/oauth2/.well-known/oauth-authorization-server")
+	if md["token_endpoint"] != "http://auth.example.com/token" || md["authorization_endpoint"] != nil {
+		t.Error("Configured endpoints are not advertised", md)
+	}
+}
+
+// The grant and response types follow the grant types of the token
+// endpoint
+func TestMetadataGrantTypes(t *testing.T) {
+	server, err := goauth2.NewServerFromConfig(goauth2.Config{
+		Cache:      goauth2.BackendConfig{Backend: "memory"},
+		GrantTypes: []string{"implicit"},
+		Auth:       authhandler.NewWhiteList("client1"),
+	})
+	if err != nil {
+		t.Fatal("Error creating the server", err)
+	}
+	md := getMetadata(t, server)
+	if rt, _ := md["response_types_supported"].([]interface{}); len(rt) != 1 || rt[0] != "token" {
+		t.Error("Bad response types", md["response_types_supported"])
+	}
+	if gt, _ := md["grant_types_supported"].([]interface{}); len(gt) != 1 || gt[0] != "implicit" {
+		t.Error("Bad grant types", md["grant_types_supported"])
+	}
+
+	server = goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.TokenExchangePolicy = func(client goauth2.Client, subject *goauth2.TokenInfo, scope string) (string, error) {
+		return scope, nil
+	}
+	md = getMetadata(t, server)
+	if gt, _ := md["grant_types_supported"].([]interface{}); len(gt) != 3 || gt[2] != goauth2.GrantTypeTokenExchange {
+		t.Error("Token exchange is not advertised", md["grant_types_supported"])
+	}
+}
@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Requests with other methods are refused with 405 and the allowed methods
+func TestMethodNotAllowed(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	tests := []struct {
+		handler http.Handler
+		method  string
+		allow   string
+	}{
+		{server.AuthorizeHandler(), "PUT", "GET, POST"},
+		{server.AuthorizeHandler(), "OPTIONS", "GET, POST"},
+		{server.TokenHandler(), "GET", "POST"},
+		{server.TokenHandler(), "DELETE", "POST"},
+		{server.TokenHandler(), "OPTIONS", "POST"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+			ClientID:     "client1",
+			ResponseType: "code",
+			RedirectURI:  "http://localhost/redirect",
+		}), nil)
+		w := httptest.NewRecorder()
+		test.handler.ServeHTTP(w, req)
+		ret := make(map[string]string)
+		json.NewDecoder(w.Body).Decode(&ret)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != test.allow || ret["error"] != "invalid_request" {
+			t.Error("Bad response to", test.method, w.Code, w.Header().Get("Allow"), ret)
+		}
+	}
+
+	// Preflights are answered by the CORS configuration
+	server.CORS = &goauth2.CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}
+	req, _ := http.NewRequest("OPTIONS", "/oauth2", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	server.TokenHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Error("Preflight was not answered", w.Code)
+	}
+}
+
+// Token requests are posted as a form, and GET is only accepted with the
+// legacy flag
+func TestPostTokenRequest(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	params := func() url.Values {
+		loc := authorizeRequest(t, server, "code")
+		return url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {loc.Query().Get("code")},
+			"redirect_uri": {"http://localhost/redirect"},
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "/oauth2", strings.NewReader(params().Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if w.Code != http.StatusOK || ret["token"] == "" {
+		t.Error("Posted token request failed", w.Code, ret)
+	}
+
+	server.LegacyGETTokenRequests = true
+	req, _ = http.NewRequest("GET", "/oauth2?"+params().Encode(), nil)
+	w = httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret = make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if w.Code != http.StatusOK || ret["token"] == "" {
+		t.Error("Legacy GET token request failed", w.Code, ret)
+	}
+}
@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// The standard endpoints are mounted under the prefix
+func TestServerHandler(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	ts := httptest.NewServer(server.Handler("/oauth2/"))
+	defer ts.Close()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	loc := getRedirect(t, client, authorizeURL(ts.URL+"/oauth2/authorize", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+	}))
+	code := loc.Query().Get("code")
+	if code == "" {
+		t.Fatal("Authorization endpoint did not issue a code", loc)
+	}
+
+	req, _ := oauthclient.BuildTokenRequest(ts.URL+"/oauth2/token", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	})
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal("Error on the token request", err)
+	}
+	ret := make(map[string]string)
+	json.NewDecoder(res.Body).Decode(&ret)
+	res.Body.Close()
+	if ret["token"] == "" {
+		t.Error("Token endpoint did not issue a token", ret)
+	}
+
+	res, err = client.Get(ts.URL + "/oauth2/.well-known/oauth-authorization-server")
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	md := make(map[string]interface{})
+	json.NewDecoder(res.Body).Decode(&md)
+	res.Body.Close()
+	if md["token_endpoint"] != ts.URL+"/oauth2/token" || md["authorization_endpoint"] != ts.URL+"/oauth2/authorize" {
+		t.Error("Metadata does not list the mounted endpoints", md)
+	}
+
+	if res, err := client.Get(ts.URL + "/oauth2"); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Error("Unknown path was served", res, err)
+	} else {
+		res.Body.Close()
+	}
+}
+
+// The standalone handlers don't look at response_type to pick the endpoint
+func TestStandaloneHandlers(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+
+	// A request without response_type is an invalid authorization request
+	req, _ := http.NewRequest("GET", authorizeURL("/authorize", oauthclient.AuthorizeParams{
+		ClientID:    "client1",
+		RedirectURI: "http://localhost/redirect",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.AuthorizeHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if w.Code == http.StatusFound || ret["error"] != "invalid_request" {
+		t.Error("Authorization request without response_type was not refused", w.Code, ret)
+	}
+
+	// A token request with a stray response_type is still a token request
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	req, _ = oauthclient.BuildTokenRequest("/token", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+		Extra:       url.Values{"response_type": {"code"}},
+	})
+	w = httptest.NewRecorder()
+	server.TokenHandler().ServeHTTP(w, req)
+	ret = make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if ret["token"] == "" {
+		t.Error("Token request with a response_type was not served", ret)
+	}
+
+	// Errors of the token endpoint are written as JSON
+	req, _ = http.NewRequest("GET", "/token", nil)
+	w = httptest.NewRecorder()
+	server.TokenHandler().ServeHTTP(w, req)
+	ret = make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if ret["error"] != "invalid_request" {
+		t.Error("Bad token error", ret)
+	}
+}
@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2/oauthclient"
+	"io/ioutil"
+	"net/url"
+	"testing"
+)
+
+// Parameters are encoded, the empty ones are left out, and the query of the
+// endpoint is kept
+func TestBuildAuthorizeURL(t *testing.T) {
+	uri, err := oauthclient.BuildAuthorizeURL("https://auth.example.com/oauth2?tenant=a%26b", oauthclient.AuthorizeParams{
+		ClientID:            "client 1",
+		ResponseType:        "code",
+		RedirectURI:         "https://client.example.com/cb?x=1&y=2",
+		State:               "état&=#",
+		CodeChallenge:       oauthclient.CodeChallengeS256("verifier"),
+		CodeChallengeMethod: oauthclient.CodeChallengeMethodS256,
+		Extra:               url.Values{"nonce": {"n-0S6"}, "client_id": {"ignored"}},
+	})
+	if err != nil {
+		t.Fatal("Error building the URL", err)
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Host != "auth.example.com" || u.Path != "/oauth2" {
+		t.Fatal("Bad authorization URL", uri, err)
+	}
+	q := u.Query()
+	expected := url.Values{
+		"tenant":                {"a&b"},
+		"client_id":             {"client 1"},
+		"response_type":         {"code"},
+		"redirect_uri":          {"https://client.example.com/cb?x=1&y=2"},
+		"state":                 {"état&=#"},
+		"code_challenge":        {oauthclient.CodeChallengeS256("verifier")},
+		"code_challenge_method": {"S256"},
+		"nonce":                 {"n-0S6"},
+	}
+	if q.Encode() != expected.Encode() {
+		t.Error("Bad authorization query", q)
+	}
+
+	if _, err := oauthclient.BuildAuthorizeURL("https://auth.example.com/oauth2#frag", oauthclient.AuthorizeParams{}); err == nil {
+		t.Error("Endpoint with a fragment was accepted")
+	}
+	if _, err := oauthclient.BuildAuthorizeURL("://", oauthclient.AuthorizeParams{}); err == nil {
+		t.Error("Malformed endpoint was accepted")
+	}
+}
+
+// Token requests are posted in a form body
+func TestBuildTokenRequest(t *testing.T) {
+	req, err := oauthclient.BuildTokenRequest("https://auth.example.com/oauth2", oauthclient.TokenParams{
+		GrantType:    "authorization_code",
+		Code:         "a+b/c=",
+		RedirectURI:  "https://client.example.com/cb",
+		CodeVerifier: "verifier",
+		ClientID:     "client1",
+		ClientSecret: "s3cr&t",
+	})
+	if err != nil {
+		t.Fatal("Error building the request", err)
+	}
+	if req.Method != "POST" || req.URL.RawQuery != "" ||
+		req.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		t.Error("Bad token request", req.Method, req.URL, req.Header)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	v, err := url.ParseQuery(string(body))
+	if err != nil || v.Get("code") != "a+b/c=" || v.Get("client_secret") != "s3cr&t" ||
+		v.Get("code_verifier") != "verifier" || v.Has("scope") {
+		t.Error("Bad token request body", string(body), err)
+	}
+}
+
+// The S256 challenge of the example of RFC 7636
+func TestCodeChallengeS256(t *testing.T) {
+	if c := oauthclient.CodeChallengeS256("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); c != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Error("Bad S256 challenge", c)
+	}
+}
@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerOptionsErrors(t *testing.T) {
+	cache := authcache.NewBasicAuthCache()
+	auth := authhandler.NewWhiteList("client1")
+	store := goauth2.NewStore(cache)
+
+	tests := map[string][]goauth2.Option{
+		"no AuthHandler":        {goauth2.WithAuthCache(cache)},
+		"no Store":              {goauth2.WithAuthHandler(auth)},
+		"Store and AuthCache":   {goauth2.WithAuthHandler(auth), goauth2.WithStore(store), goauth2.WithAuthCache(cache)},
+		"Store and ClientStore": {goauth2.WithAuthHandler(auth), goauth2.WithStore(store), goauth2.WithClientStore(clientstore.NewBasicClientStore())},
+		"Store and token TTL":   {goauth2.WithAuthHandler(auth), goauth2.WithStore(store), goauth2.WithTokenTTL(time.Hour)},
+		"short token TTL":       {goauth2.WithAuthHandler(auth), goauth2.WithAuthCache(cache), goauth2.WithTokenTTL(time.Millisecond)},
+		"308 redirect status":   {goauth2.WithAuthHandler(auth), goauth2.WithAuthCache(cache), goauth2.WithRedirectStatusCode(http.StatusPermanentRedirect)},
+	}
+	for name, opts := range tests {
+		if server, err := goauth2.NewServerOptions(opts...); err == nil || server != nil {
+			t.Error("Incoherent options were accepted:", name)
+		}
+	}
+}
+
+// The redirects to clients use the status of the options
+func TestServerOptionsRedirectStatus(t *testing.T) {
+	server, err := goauth2.NewServerOptions(
+		goauth2.WithAuthCache(authcache.NewBasicAuthCache()),
+		goauth2.WithAuthHandler(authhandler.NewWhiteList("client1")),
+		goauth2.WithRedirectStatusCode(http.StatusTemporaryRedirect),
+	)
+	if err != nil {
+		t.Fatal("Error creating server", err)
+	}
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") == "" {
+		t.Error("Bad redirect status", w.Code)
+	}
+}
+
+// Challenges carry the realm, and failures are logged to the logger
+func TestServerOptionsRealm(t *testing.T) {
+	var logs bytes.Buffer
+	server, err := goauth2.NewServerOptions(
+		goauth2.WithAuthCache(authcache.NewBasicAuthCache()),
+		goauth2.WithAuthHandler(authhandler.NewWhiteList("client1")),
+		goauth2.WithRealm("example"),
+		goauth2.WithLogger(log.New(&logs, "", 0)),
+	)
+	if err != nil {
+		t.Fatal("Error creating server", err)
+	}
+	plain := goauth2.NewServer(authcache.NewBasicAuthCache(), nil)
+
+	req, _ := http.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", "unknown")
+	for _, s := range []*goauth2.Server{server, plain} {
+		w := httptest.NewRecorder()
+		s.TokenVerifier(http.NotFoundHandler()).ServeHTTP(w, req)
+		challenge := w.Header().Get("WWW-Authenticate")
+		if w.Code != http.StatusUnauthorized {
+			t.Error("Invalid token was accepted", w.Code)
+		} else if s == server && challenge != `Bearer realm="example"` {
+			t.Error("Bad challenge", challenge)
+		} else if s == plain && challenge != "" {
+			t.Error("Challenge without a realm", challenge)
+		}
+	}
+	if !strings.Contains(logs.String(), "Unauthorized access!") {
+		t.Error("Failure was not logged to the logger", logs.String())
+	}
+}
+
+// The clients, token lifetime and error URIs of the options are used
+func TestServerOptionsStore(t *testing.T) {
+	cache := authcache.NewBasicAuthCache()
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(goauth2.NewClient("client1"))
+	server, err := goauth2.NewServerOptions(
+		goauth2.WithAuthCache(cache),
+		goauth2.WithClientStore(clients),
+		goauth2.WithAuthHandler(authhandler.NewWhiteList("client1", "client2")),
+		goauth2.WithTokenTTL(time.Hour),
+		goauth2.WithErrorURI(goauth2.ErrorCodeUnauthorizedClient, "http://example.com/unauthorized"),
+	)
+	if err != nil {
+		t.Fatal("Error creating server", err)
+	}
+
+	loc := authorizeRequest(t, server, "token")
+	frag, _ := url.ParseQuery(loc.Fragment)
+	if frag.Get("access_token") == "" || frag.Get("expires_in") != "3600" {
+		t.Error("Token lifetime was not set", loc)
+	}
+
+	// client2 is not registered
+	w := clientAuthorizeRequest(server, "client2", "code")
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if ret["error"] != "unauthorized_client" || ret["error_uri"] != "http://example.com/unauthorized" {
+		t.Error("Unregistered client was not refused with the error URI", w.Code, ret)
+	}
+}
@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPARServer() *goauth2.Server {
+	clients := clientstore.NewBasicClientStore()
+	clients.SaveClient(&goauth2.ClientImpl{
+		ClientID:   "client1",
+		ClientType: goauth2.ClientTypeConfidential,
+	}, "secret1")
+	return goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients,
+		authhandler.NewWhiteList("client1"))
+}
+
+// Push an authorization request and return the response
+func pushRequest(server *goauth2.Server, secret string, params map[string]string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	form := url.Values{}
+	for k, v := range params {
+		form.Set(k, v)
+	}
+	req, _ := http.NewRequest("POST", "/par", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("client1", secret)
+	w := httptest.NewRecorder()
+	server.PARHandler().ServeHTTP(w, req)
+	ret := make(map[string]interface{})
+	json.NewDecoder(w.Body).Decode(&ret)
+	return w, ret
+}
+
+// Send an authorization request with a request URI
+func authorizePushed(server *goauth2.Server, requestURI string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:   "client1",
+		RequestURI: requestURI,
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	return w
+}
+
+var pushedParams = map[string]string{
+	"response_type": "code",
+	"redirect_uri":  "http://localhost/redirect",
+	"state":         "par_test",
+}
+
+func TestPushedRequest(t *testing.T) {
+	server := newPARServer()
+
+	w, ret := pushRequest(server, "secret1", pushedParams)
+	requestURI, _ := ret["request_uri"].(string)
+	if w.Code != http.StatusCreated || !strings.HasPrefix(requestURI, "urn:ietf:params:oauth:request_uri:") {
+		t.Fatal("Request was not pushed", w.Code, ret)
+	}
+	if ret["expires_in"] != float64(60) {
+		t.Error("Bad expiry", ret["expires_in"])
+	}
+
+	w = authorizePushed(server, requestURI)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || loc.Query().Get("code") == "" || loc.Query().Get("state") != "par_test" {
+		t.Fatal("Pushed request was not authorized", w.Code, loc)
+	}
+
+	// The request URI can only be used once
+	w = authorizePushed(server, requestURI)
+	if w.Code == http.StatusFound || !strings.Contains(w.Body.String(), "invalid_request") {
+		t.Error("Request URI was used twice", w.Code, w.Body)
+	}
+}
+
+func TestPushedRequestExpired(t *testing.T) {
+	server := newPARServer()
+	server.PushedRequestExpiry = time.Millisecond
+
+	_, ret := pushRequest(server, "secret1", pushedParams)
+	requestURI, _ := ret["request_uri"].(string)
+	time.Sleep(10 * time.Millisecond)
+	if w := authorizePushed(server, requestURI); w.Code == http.StatusFound {
+		t.Error("Expired request URI was used", w.Header().Get("Location"))
+	}
+}
+
+func TestPushedRequestRefused(t *testing.T) {
+	server := newPARServer()
+
+	if w, ret := pushRequest(server, "wrong", pushedParams); w.Code != http.StatusUnauthorized || ret["error"] != "invalid_client" {
+		t.Error("Bad client secret was accepted", w.Code, ret)
+	}
+	if w, ret := pushRequest(server, "secret1", map[string]string{
+		"response_type": "code",
+		"redirect_uri":  "not a URI",
+	}); w.Code != http.StatusBadRequest || ret["error"] != "invalid_request" {
+		t.Error("Invalid request was pushed", w.Code, ret)
+	}
+
+	// Another client can't use the request URI
+	_, ret := pushRequest(server, "secret1", pushedParams)
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:   "client2",
+		RequestURI: ret["request_uri"].(string),
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	if w.Code == http.StatusFound {
+		t.Error("Request URI of another client was used", w.Header().Get("Location"))
+	}
+}
+
+// A Store that keeps pushed requests but can't check the credentials of
+// clients
+type pushingStore struct {
+	goauth2.Store
+	goauth2.PushedRequestStore
+}
+
+// Requests are refused when the Store can't authenticate their client,
+// even behind a CachingStore
+func TestPushedRequestUnauthenticated(t *testing.T) {
+	server := newPARServer()
+	inner := pushingStore{server.Store, server.Store.(goauth2.PushedRequestStore)}
+	for _, store := range []goauth2.Store{inner, goauth2.NewCachingStore(inner, time.Minute)} {
+		server.Store = store
+		if w, ret := pushRequest(server, "wrong", pushedParams); w.Code != http.StatusUnauthorized || ret["error"] != "invalid_client" {
+			t.Errorf("Request of %T was pushed without authenticating its client: %d %v", store, w.Code, ret)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// An AuthHandler without sessions, which always needs to ask the user
+type interactiveHandler struct{}
+
+func (interactiveHandler) Authorize(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	if oar.HasPrompt("none") {
+		oar.InteractionRequired(w, r)
+		return
+	}
+	oar.AuthCodeRedirect(w, r, nil)
+}
+
+func (interactiveHandler) AuthorizeImplicit(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest) {
+	if oar.HasPrompt("none") {
+		oar.InteractionRequired(w, r)
+		return
+	}
+	oar.ImplicitRedirect(w, r, nil)
+}
+
+func promptRequest(t *testing.T, server *goauth2.Server, responseType, prompt string) *url.URL {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: responseType,
+		RedirectURI:  "http://localhost/redirect",
+		State:        "prompt_test",
+		Prompt:       prompt,
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusFound {
+		t.Fatal("Authorization request was not redirected", w.Code, err)
+	}
+	return loc
+}
+
+// prompt=none gets interaction_required in the redirect of its response type
+func TestPromptNone(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), interactiveHandler{})
+
+	q := promptRequest(t, server, "code", "none").Query()
+	if q.Get("error") != "interaction_required" || q.Get("state") != "prompt_test" {
+		t.Error("Bad code redirect for prompt=none", q)
+	}
+
+	frag, _ := url.ParseQuery(promptRequest(t, server, "token", "none").Fragment)
+	if frag.Get("error") != "interaction_required" || frag.Get("access_token") != "" {
+		t.Error("Bad implicit redirect for prompt=none", frag)
+	}
+
+	if q := promptRequest(t, server, "code", "login consent").Query(); q.Get("code") == "" {
+		t.Error("Interactive request was not authorized", q)
+	}
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func tokenRequest(server *goauth2.Server, clientID, remoteAddr string) *httptest.ResponseRecorder {
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType: "authorization_code",
+		Code:      "badcode",
+	})
+	req.RemoteAddr = remoteAddr
+	if clientID != "" {
+		req.SetBasicAuth(clientID, "secret")
+	}
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	return w
+}
+
+// Token requests over the limit are refused per IP, and per client
+func TestTokenRateLimiter(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.TokenRateLimiter = goauth2.NewTokenBucketLimiter(0.001, 2)
+
+	for i := 0; i < 2; i++ {
+		if w := tokenRequest(server, "client1", "10.0.0.1:1234"); w.Code == http.StatusTooManyRequests {
+			t.Fatal("Request within the burst was limited")
+		}
+	}
+	w := tokenRequest(server, "client1", "10.0.0.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatal("Request over the limit was not limited", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Limited response has no Retry-After header")
+	}
+
+	// Claiming to be another client doesn't escape the limit of the address
+	if w := tokenRequest(server, "client2", "10.0.0.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Error("Request of another client escaped the limit of its address", w.Code)
+	}
+
+	// The limit of a client holds from every address, and other clients
+	// have their own
+	if w := tokenRequest(server, "client1", "10.0.0.4:1234"); w.Code != http.StatusTooManyRequests {
+		t.Error("Request over the limit of its client was not limited", w.Code)
+	}
+	if w := tokenRequest(server, "client2", "10.0.0.5:1234"); w.Code == http.StatusTooManyRequests {
+		t.Error("Another client was limited")
+	}
+
+	// Unauthenticated requests are limited by remote IP
+	for i := 0; i < 2; i++ {
+		tokenRequest(server, "", "10.0.0.2:1234")
+	}
+	if w := tokenRequest(server, "", "10.0.0.2:5678"); w.Code != http.StatusTooManyRequests {
+		t.Error("Unauthenticated request over the limit was not limited", w.Code)
+	}
+	if w := tokenRequest(server, "", "10.0.0.3:1234"); w.Code == http.StatusTooManyRequests {
+		t.Error("Request from another address was limited")
+	}
+}
+
+// The authorization endpoint is not rate limited
+func TestTokenRateLimiterSkipsAuthorize(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.TokenRateLimiter = goauth2.NewTokenBucketLimiter(0.001, 1)
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+			ClientID:     "client1",
+			ResponseType: "code",
+			RedirectURI:  "http://localhost/redirect",
+		}), nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		if w.Code == http.StatusTooManyRequests {
+			t.Fatal("Authorization request was limited")
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	clock := newFakeClock()
+	perClient := goauth2.NewTokenBucketLimiter(1, 3)
+	perClient.Now = clock.Now
+	perIP := goauth2.NewTokenBucketLimiter(1, 5)
+	perIP.Now = clock.Now
+	handler := server.RateLimited(server.MasterHandler(), goauth2.RateLimitPolicy{
+		PerClient: perClient,
+		PerIP:     perIP,
+	})
+
+	request := func(clientID, remoteAddr string) *httptest.ResponseRecorder {
+		req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+			GrantType: "authorization_code",
+			Code:      "badcode",
+		})
+		req.RemoteAddr = remoteAddr
+		req.SetBasicAuth(clientID, "secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Hammer the token endpoint for one client
+	limited := 0
+	for i := 0; i < 10; i++ {
+		w := request("client1", "10.0.0.1:1234")
+		if w.Code == http.StatusTooManyRequests {
+			limited++
+			ret := make(map[string]string)
+			json.NewDecoder(w.Body).Decode(&ret)
+			if ret["error"] != "temporarily_unavailable" || w.Header().Get("Retry-After") != "1" {
+				t.Error("Bad limited response", ret, w.Header())
+			}
+		}
+	}
+	if limited != 7 {
+		t.Error("Requests over the client limit were not limited", limited)
+	}
+
+	// The address is limited too, whatever the client
+	if w := request("client2", "10.0.0.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Error("Request over the address limit was not limited", w.Code)
+	}
+	if w := request("client2", "10.0.0.2:1234"); w.Code == http.StatusTooManyRequests {
+		t.Error("Request of another client from another address was limited")
+	}
+
+	// The buckets fill up again with time
+	clock.Advance(5 * time.Second)
+	if w := request("client1", "10.0.0.1:1234"); w.Code == http.StatusTooManyRequests {
+		t.Error("Limit did not recover", w.Header())
+	}
+}
@@ -1,97 +1,56 @@
 package tests
 
 import (
-	"fmt"
 	"github.com/yanatan16/goauth2"
 	"github.com/yanatan16/goauth2/authcache"
 	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 )
 
-const (
-	auth_port_2     int = 16002
-	redirecter_port int = 16003
-)
-
-var (
-	auth_url_2     string
-	redirecter_url string
-	rreqs          chan *http.Request
-)
-
-func init() {
-	redirecter_url = fmt.Sprintf("http://%s:%d", "127.0.0.1", redirecter_port)
-	auth_url_2 = fmt.Sprintf("http://%s:%d/authorize", "127.0.0.1", auth_port_2)
-	go ExampleRunGoauth2ServerWithRedirecter(auth_port_2, redirecter_url)
-
-	rreqs = make(chan *http.Request, 5)
-	httpd := &http.Server{
-		Addr:           fmt.Sprintf(":%d", redirecter_port),
-		Handler:        http.HandlerFunc(MyRedirecter),
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-	}
-
-	// Start the server
-	go func() {
-		log.Fatal(httpd.ListenAndServe())
-	}()
-}
-
-// Example way to run an goauth2 server
-func ExampleRunGoauth2ServerWithRedirecter(port int, redirectUrl string) {
-	// Create your implementations of AuthCache
-	ac := authcache.NewBasicAuthCache()
+// Start a server whose Redirecter forwards the requests to the redirecter
+// page, and return the URL of its authorization endpoint and the requests
+// received by the page
+func newRedirecterServer(t *testing.T) (string, chan *http.Request) {
+	rreqs := make(chan *http.Request, 5)
+	redirecter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rreqs <- r
+		w.Write([]byte("A-OK"))
+	}))
+	t.Cleanup(redirecter.Close)
 
 	// Create your implementation of AuthHandler
-	auth, err := authhandler.NewRedirecter(redirectUrl, redirectUrl)
+	auth, err := authhandler.NewRedirecter(redirecter.URL, redirecter.URL)
 	if err != nil {
-		log.Fatal("Error intializing Redirecter", err)
+		t.Fatal("Error intializing Redirecter", err)
 	}
 
 	// Create the store and the server
-	server := goauth2.NewServer(ac, auth)
-
-	// Create the Serve Mux for http serving
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), auth)
 	sm := http.NewServeMux()
 	sm.Handle("/authorize", server.MasterHandler())
-
-	// You might have multiple uses, each should be wrapped using TokenVerifier
-	sm.Handle("/api", server.TokenVerifier(http.HandlerFunc(TestApiHandler)))
-
-	// Create the http server
-	httpd := &http.Server{
-		Addr:           fmt.Sprintf(":%d", port),
-		Handler:        sm,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-	}
-
-	// Start the server
-	log.Fatal(httpd.ListenAndServe())
-}
-
-func MyRedirecter(w http.ResponseWriter, r *http.Request) {
-	rreqs <- r
-	w.Write([]byte("A-OK"))
+	ts := httptest.NewServer(sm)
+	t.Cleanup(ts.Close)
+	return ts.URL + "/authorize", rreqs
 }
 
-func TestRedirecterImplicit(t *testing.T) {
-	querymap := map[string]string{
-		"client_id":     "client1",
-		"response_type": "token", // This means use implicit auth grant
-		"redirect_uri":  redirect_url,
-		"scope":         "",                    // Not implemented right now
-		"state":         "implicit_grant_test", // Prevent's cross-site scripting
-	}
-
-	response, err := http.Get(MakeQuery(querymap, auth_url_2))
+// The authorization request reaches the redirecter page with all its
+// parameters
+func testRedirecter(t *testing.T, responseType, state string) {
+	authURL, rreqs := newRedirecterServer(t)
+	uri := authorizeURL(authURL, oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: responseType,
+		RedirectURI:  exampleRedirectURL,
+		State:        state, // Prevent's cross-site scripting
+	})
+
+	response, err := http.Get(uri)
 	if err != nil {
 		t.Fatal("Error on http.Get", err)
 	}
@@ -106,54 +65,131 @@ func TestRedirecterImplicit(t *testing.T) {
 		t.Error("Body of response did not match expected!", body)
 	}
 
+	// The page answered, so it received the request
 	select {
 	case req := <-rreqs:
 		// Check req has all the query parameters
+		sent, _ := url.Parse(uri)
 		q := req.URL.Query()
-		for k, v := range querymap {
-			if q.Get(k) != v {
+		for k := range sent.Query() {
+			if v := sent.Query().Get(k); q.Get(k) != v {
 				t.Error("Request Query did not contain correct", k, q.Get(k))
 			}
 		}
-	case <-time.After(time.Second):
+	default:
 		t.Fatal("Did not receive redirect request!")
 	}
 }
 
+func TestRedirecterImplicit(t *testing.T) {
+	testRedirecter(t, "token", "implicit_grant_test")
+}
+
 func TestRedirecter(t *testing.T) {
-	querymap := map[string]string{
-		"client_id":     "client1",
-		"response_type": "code", // This means use implicit auth grant
-		"redirect_uri":  redirect_url,
-		"scope":         "",                    // Not implemented right now
-		"state":         "authcode_grant_test", // Prevent's cross-site scripting
+	testRedirecter(t, "code", "authcode_grant_test")
+}
+
+// Start a server whose Redirecter forwards to an external UI giving the
+// verdict approved, and a client stopping at the redirect to the client
+func newVerdictServer(t *testing.T, approved bool) (*goauth2.Server, *httptest.Server, *http.Client) {
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+
+	auth, err := authhandler.NewRedirecter(ts.URL+"/approve", ts.URL+"/approve")
+	if err != nil {
+		t.Fatal("Error intializing Redirecter", err)
 	}
+	auth.Key = []byte("shared key")
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), auth)
+
+	mux.Handle("/oauth2", server.MasterHandler())
+	mux.Handle("/callback", auth.CallbackHandler(server))
+	mux.HandleFunc("/approve", func(w http.ResponseWriter, r *http.Request) {
+		// The external UI
+		v, err := auth.SignVerdict(r.URL.Query().Get("request"), approved, "user1")
+		if err != nil {
+			t.Error("Error signing verdict", err)
+		}
+		http.Redirect(w, r, "/callback?verdict="+url.QueryEscape(v), http.StatusFound)
+	})
 
-	response, err := http.Get(MakeQuery(querymap, auth_url_2))
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == "localhost" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	return server, ts, client
+}
+
+// The external UI approves and the client ends up with a working token
+func TestRedirecterCallback(t *testing.T) {
+	server, ts, client := newVerdictServer(t, true)
+	defer ts.Close()
+
+	res, err := client.Get(authorizeURL(ts.URL+"/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+		State:        "verdict_test",
+	}))
 	if err != nil {
 		t.Fatal("Error on http.Get", err)
 	}
-	defer response.Body.Close()
+	res.Body.Close()
+	loc, _ := url.Parse(res.Header.Get("Location"))
+	code := loc.Query().Get("code")
+	if code == "" || loc.Query().Get("state") != "verdict_test" {
+		t.Fatal("Approval did not redirect with a code", res.Status, loc)
+	}
 
-	// Make sure it went to our redirecter
-	body, err := ioutil.ReadAll(response.Body)
+	token, _, _, err := server.Store.CreateAccessToken(&goauth2.AccessTokenRequest{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	})
 	if err != nil {
-		t.Fatal("Error reading http response.", err)
+		t.Fatal("Error exchanging the code", err)
 	}
-	if string(body) != "A-OK" {
-		t.Error("Body of response did not match expected!", body)
+	if status := apiStatus(server, token); status != http.StatusOK {
+		t.Error("The token does not work", status)
 	}
+}
 
-	select {
-	case req := <-rreqs:
-		// Check req has all the query parameters
-		q := req.URL.Query()
-		for k, v := range querymap {
-			if q.Get(k) != v {
-				t.Error("Request Query did not contain correct", k, q.Get(k))
-			}
-		}
-	case <-time.After(time.Second):
-		t.Fatal("Did not receive redirect request!")
+func TestRedirecterCallbackDenied(t *testing.T) {
+	_, ts, client := newVerdictServer(t, false)
+	defer ts.Close()
+
+	res, err := client.Get(authorizeURL(ts.URL+"/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "token",
+		RedirectURI:  "http://localhost/redirect",
+	}))
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	res.Body.Close()
+	loc, _ := url.Parse(res.Header.Get("Location"))
+	if frag, _ := url.ParseQuery(loc.Fragment); frag.Get("error") != "access_denied" || frag.Get("access_token") != "" {
+		t.Error("Denial did not redirect with access_denied", loc)
+	}
+}
+
+// Verdicts that aren't signed with the key are refused
+func TestRedirecterForgedVerdict(t *testing.T) {
+	_, ts, _ := newVerdictServer(t, true)
+	defer ts.Close()
+
+	other := &authhandler.Redirecter{Key: []byte("other key"), Expiry: time.Minute}
+	v, _ := other.SignVerdict("e30", true, "user1")
+	res, err := http.Get(ts.URL + "/callback?verdict=" + url.QueryEscape(v))
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Forged verdict was accepted", res.Status)
 	}
 }
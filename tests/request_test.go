@@ -0,0 +1,305 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Send an authorization request and return the redirect location
+func authorizeRequest(t *testing.T, server *goauth2.Server, responseType string) *url.URL {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: responseType,
+		RedirectURI:  "http://localhost/redirect",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusFound {
+		t.Fatal("Authorization request was not redirected", w.Code, err)
+	}
+	return loc
+}
+
+// The issue callbacks see the code or token that is sent in the redirect
+func TestIssueCallbacks(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+
+	var issuedCode, issuedToken string
+	server.OnCodeIssued = func(oar *goauth2.OAuthRequest, code string) {
+		if oar.ClientID != "client1" {
+			t.Error("Code callback got the wrong request", oar.ClientID)
+		}
+		issuedCode = code
+	}
+	server.OnTokenIssued = func(oar *goauth2.OAuthRequest, token string) {
+		issuedToken = token
+	}
+
+	loc := authorizeRequest(t, server, "code")
+	if code := loc.Query().Get("code"); code == "" || code != issuedCode {
+		t.Error("Code callback got a different code", issuedCode, code)
+	}
+
+	loc = authorizeRequest(t, server, "token")
+	frag, _ := url.ParseQuery(loc.Fragment)
+	if token := frag.Get("access_token"); token == "" || token != issuedToken {
+		t.Error("Token callback got a different token", issuedToken, token)
+	}
+}
+
+// Requests work without callbacks
+func TestNoIssueCallbacks(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	if code := authorizeRequest(t, server, "code").Query().Get("code"); code == "" {
+		t.Error("No code was issued")
+	}
+}
+
+// The query of the redirection URI is kept, while the implicit response goes
+// in the fragment
+func TestImplicitRedirectQuery(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "token",
+		RedirectURI:  "https://app/cb?foo=bar",
+		State:        "query_test",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusFound {
+		t.Fatal("Authorization request was not redirected", w.Code, err)
+	}
+	if loc.Host != "app" || loc.Path != "/cb" || loc.RawQuery != "foo=bar" {
+		t.Error("The redirection URI was not kept", loc)
+	}
+	frag, _ := url.ParseQuery(loc.Fragment)
+	if frag.Get("access_token") == "" || frag.Get("state") != "query_test" {
+		t.Error("The token is not in the fragment", loc)
+	}
+	if frag.Get("foo") != "" {
+		t.Error("The query leaked into the fragment", loc)
+	}
+}
+
+func TestRequireState(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+
+	// Optional by default
+	if loc := authorizeRequest(t, server, "code"); loc.Query().Get("code") == "" {
+		t.Error("Request without state was refused", loc)
+	}
+
+	server.RequireState = true
+	loc := authorizeRequest(t, server, "code")
+	if loc.Query().Get("error") != "invalid_request" || loc.Query().Get("code") != "" {
+		t.Error("Code request without state was not refused", loc)
+	}
+	loc = authorizeRequest(t, server, "token")
+	if frag, _ := url.ParseQuery(loc.Fragment); frag.Get("error") != "invalid_request" || frag.Get("access_token") != "" {
+		t.Error("Implicit request without state was not refused", loc)
+	}
+
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+		State:        "xyz",
+	}), nil)
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	if loc.Query().Get("code") == "" || loc.Query().Get("state") != "xyz" {
+		t.Error("Request with state was refused", loc)
+	}
+}
+
+// The absolute expiry time is only added on demand, in both flows
+func TestIncludeExpiresAt(t *testing.T) {
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(&goauth2.ClientImpl{
+		ClientID:       "client1",
+		ClientTokenTTL: time.Hour,
+	})
+	server := goauth2.NewServerWithClients(authcache.NewBasicAuthCache(), clients,
+		authhandler.NewWhiteList("client1"))
+
+	checkExpiresAt := func(expiresAt string) {
+		at, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			t.Error("Bad expires_at", expiresAt, err)
+		} else if d := time.Until(at); d < 59*time.Minute || d > time.Hour {
+			t.Error("expires_at does not match expires_in", expiresAt)
+		}
+	}
+	exchange := func(code string) map[string]string {
+		req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+			GrantType:   "authorization_code",
+			Code:        code,
+			RedirectURI: "http://localhost/redirect",
+		})
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		ret := make(map[string]string)
+		json.NewDecoder(w.Body).Decode(&ret)
+		return ret
+	}
+
+	// Off by default
+	frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	if frag.Get("expires_in") != "3600" || frag.Has("expires_at") {
+		t.Error("Bad implicit expiry", frag)
+	}
+	ret := exchange(authorizeRequest(t, server, "code").Query().Get("code"))
+	if _, ok := ret["expires_at"]; ok || ret["expires_in"] != "3600" {
+		t.Error("Bad token expiry", ret)
+	}
+
+	server.IncludeExpiresAt = true
+	frag, _ = url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	checkExpiresAt(frag.Get("expires_at"))
+	ret = exchange(authorizeRequest(t, server, "code").Query().Get("code"))
+	checkExpiresAt(ret["expires_at"])
+}
+
+// Redirects use the configured status, and those after a form submission
+// use 303 so that the form isn't posted again to the redirection URI
+func TestRedirectStatus(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), approveClient1)
+	for _, c := range []struct {
+		configured           int
+		method, responseType string
+		status               int
+	}{
+		{0, "GET", "code", http.StatusFound},
+		{0, "GET", "token", http.StatusFound},
+		{0, "POST", "code", http.StatusSeeOther},
+		{0, "POST", "token", http.StatusSeeOther},
+		{http.StatusFound, "GET", "code", http.StatusFound},
+		{http.StatusFound, "POST", "token", http.StatusSeeOther},
+		{http.StatusSeeOther, "GET", "code", http.StatusSeeOther},
+		{http.StatusSeeOther, "GET", "token", http.StatusSeeOther},
+		{http.StatusTemporaryRedirect, "GET", "code", http.StatusTemporaryRedirect},
+		{http.StatusTemporaryRedirect, "GET", "token", http.StatusTemporaryRedirect},
+		{http.StatusTemporaryRedirect, "POST", "code", http.StatusSeeOther},
+		{http.StatusMovedPermanently, "GET", "code", http.StatusFound},
+		{http.StatusOK, "GET", "token", http.StatusFound},
+	} {
+		server.RedirectStatusCode = c.configured
+		req, _ := http.NewRequest(c.method, authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+			ClientID:     "client1",
+			ResponseType: c.responseType,
+			RedirectURI:  "http://localhost/redirect",
+		}), nil)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		if w.Code != c.status || w.Header().Get("Location") == "" {
+			t.Error("Bad redirect status", c.configured, c.method, c.responseType, w.Code)
+		}
+	}
+}
+
+// Implicit grant fragments follow RFC 6749, with the legacy token key kept
+// behind a flag, and errors keep the state
+func TestImplicitFragment(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	implicit := func(clientID string) url.Values {
+		req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+			ClientID:     clientID,
+			ResponseType: "token",
+			RedirectURI:  "http://localhost/redirect",
+			Scope:        "read",
+			State:        "fragment_test",
+		}), nil)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		frag, _ := url.ParseQuery(loc.Fragment)
+		return frag
+	}
+
+	frag := implicit("client1")
+	if frag.Get("access_token") == "" || frag.Get("token_type") != "bearer" ||
+		frag.Get("scope") != "read" || frag.Get("state") != "fragment_test" {
+		t.Error("Bad implicit grant fragment", frag)
+	}
+	if _, ok := frag["token"]; ok {
+		t.Error("Legacy token key was sent", frag)
+	}
+
+	server.LegacyTokenKey = true
+	if frag := implicit("client1"); frag.Get("token") == "" || frag.Get("token") != frag.Get("access_token") {
+		t.Error("Legacy token key is missing", frag)
+	}
+
+	frag = implicit("client2")
+	if frag.Get("error") != "access_denied" || frag.Get("state") != "fragment_test" || frag.Get("access_token") != "" {
+		t.Error("Bad implicit grant error fragment", frag)
+	}
+}
+
+// The redirect helpers keep the query of the redirection URI, never change
+// the request's URI, and give the same redirect when called twice
+func TestRedirectURIWithQuery(t *testing.T) {
+	var first, second *httptest.ResponseRecorder
+	var uri string
+	twice := authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		first, second = httptest.NewRecorder(), httptest.NewRecorder()
+		denied := goauth2.NewServerError(goauth2.ErrorCodeAccessDenied, "denied", "")
+		for _, rec := range []*httptest.ResponseRecorder{first, second} {
+			if implicit {
+				oar.ImplicitRedirect(rec, r, denied)
+			} else {
+				oar.AuthCodeRedirect(rec, r, denied)
+			}
+		}
+		uri = oar.RedirectURI.String()
+		oar.AuthCodeRedirect(w, r, nil)
+	})
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), twice)
+
+	for _, responseType := range []string{"code", "token"} {
+		req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+			ClientID:     "client1",
+			ResponseType: responseType,
+			RedirectURI:  "https://app.example.com/cb?env=prod&a=1",
+			State:        "query_test",
+		}), nil)
+		server.MasterHandler().ServeHTTP(httptest.NewRecorder(), req)
+
+		loc1, loc2 := first.Header().Get("Location"), second.Header().Get("Location")
+		if loc1 == "" || loc1 != loc2 {
+			t.Error("Redirects of the same response differ", responseType, loc1, loc2)
+		}
+		if uri != "https://app.example.com/cb?env=prod&a=1" {
+			t.Error("Redirection URI of the request was changed", responseType, uri)
+		}
+		loc, _ := url.Parse(loc1)
+		params := loc.Query()
+		if responseType == "token" {
+			if loc.RawQuery != "env=prod&a=1" {
+				t.Error("Query of the redirection URI was lost", loc)
+			}
+			params, _ = url.ParseQuery(loc.Fragment)
+		} else if q := loc.Query(); q.Get("env") != "prod" || q.Get("a") != "1" || len(q["error"]) != 1 {
+			t.Error("Bad query of the redirect", loc)
+		}
+		if params.Get("error") != "access_denied" || params.Get("state") != "query_test" {
+			t.Error("Bad error redirect", responseType, loc)
+		}
+	}
+}
@@ -3,20 +3,25 @@
 package tests
 
 import (
+	"context"
 	"fmt"
 	"github.com/yanatan16/goauth2"
 	"github.com/yanatan16/goauth2/authcache"
 	"github.com/yanatan16/goauth2/authhandler"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
 	"time"
 )
 
-// Example way to run an goauth2 server
-func ExampleRunGoauth2Server(port int) {
-	// Create your implementations of AuthCache
-	ac := authcache.NewBasicAuthCache()
-
+// Create an example goauth2 server on an AuthCache, serving the
+// authorization and token endpoints at /authorize and a protected API at
+// /api
+func NewExampleMux(ac goauth2.AuthCache) (*goauth2.Server, *http.ServeMux) {
 	// Create your implementation of AuthHandler
 	auth := authhandler.NewWhiteList("client1")
 
@@ -29,6 +34,25 @@ func ExampleRunGoauth2Server(port int) {
 
 	// You might have multiple uses, each should be wrapped using TokenVerifier
 	sm.Handle("/api", server.TokenVerifier(http.HandlerFunc(TestApiHandler)))
+	return server, sm
+}
+
+// Run the example server on a free port until the test ends, and return
+// its base URL. The server is ready when it returns.
+func StartExampleServer(t *testing.T, ac goauth2.AuthCache) string {
+	server, sm := NewExampleMux(ac)
+	ts := httptest.NewServer(sm)
+	t.Cleanup(func() {
+		ts.Close()
+		server.Close()
+	})
+	return ts.URL
+}
+
+// Example way to run an goauth2 server
+func ExampleRunGoauth2Server(port int) {
+	// Create your implementations of AuthCache, and the server
+	server, sm := NewExampleMux(authcache.NewBasicAuthCache())
 
 	// Create the http server
 	httpd := &http.Server{
@@ -39,8 +63,24 @@ func ExampleRunGoauth2Server(port int) {
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	// On SIGTERM, finish the requests in flight, then stop the background
+	// work of the server and close its AuthCache
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM)
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpd.Shutdown(ctx)
+	}()
+
 	// Start the server
-	log.Fatal(httpd.ListenAndServe())
+	if err := httpd.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		log.Println("Error closing the server", err)
+	}
 }
 
 func TestApiHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseScope(t *testing.T) {
+	valid := map[string][]string{
+		"":                 nil,
+		"read":             {"read"},
+		"read write read":  {"read", "write"},
+		"urn:x:a!#$%&'()*": {"urn:x:a!#$%&'()*"},
+	}
+	for scope, values := range valid {
+		if got, err := goauth2.ParseScope(scope); err != nil || !reflect.DeepEqual(got, values) {
+			t.Error("Bad values of", scope, got, err)
+		}
+	}
+
+	for _, scope := range []string{
+		"read\twrite", "read  write", " read", "read ", `read "write"`,
+		`read\write`, "read\nwrite", "réad", "read\x7f",
+	} {
+		if _, err := goauth2.ParseScope(scope); !errors.Is(err, goauth2.ErrInvalidScope) {
+			t.Errorf("Invalid scope %q was accepted: %v", scope, err)
+		}
+	}
+}
+
+// Authorization requests with an invalid scope are refused with a redirect
+func TestAuthorizeInvalidScope(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	for _, scope := range []string{"read\twrite", "read  write", `"read"`} {
+		req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+			ClientID:     "client1",
+			ResponseType: "code",
+			RedirectURI:  "http://localhost/redirect",
+			Scope:        scope,
+		}), nil)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusFound || loc.Query().Get("error") != "invalid_scope" {
+			t.Errorf("Invalid scope %q was not refused: %d %s", scope, w.Code, loc)
+		}
+	}
+}
+
+// Token requests with an invalid scope are refused, and valid scopes are
+// normalized
+func TestTokenInvalidScope(t *testing.T) {
+	for _, scope := range []string{"read\twrite", "read  write", `read"`} {
+		if ret, _ := exchangeScope(t, scope); ret["error"] != "invalid_scope" || ret["token"] != "" {
+			t.Errorf("Invalid scope %q was not refused: %v", scope, ret)
+		}
+	}
+	if ret, _ := exchangeScope(t, "read read"); ret["token"] == "" || ret["scope"] != "read" {
+		t.Error("Scope was not normalized", ret)
+	}
+}
@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// An AuthCache whose backend is always down
+type unavailableCache struct{}
+
+func (unavailableCache) RegisterAuthCode(code string, info goauth2.AuthCodeInfo) error {
+	return fmt.Errorf("%w: connection refused", goauth2.ErrBackendUnavailable)
+}
+func (unavailableCache) RegisterAccessToken(token string, info goauth2.TokenInfo, lifetime goauth2.TokenLifetime) (string, int64, error) {
+	return "", 0, fmt.Errorf("%w: connection refused", goauth2.ErrBackendUnavailable)
+}
+func (unavailableCache) LookupAuthCode(code string) (*goauth2.AuthCodeInfo, error) {
+	return nil, fmt.Errorf("%w: connection refused", goauth2.ErrBackendUnavailable)
+}
+func (unavailableCache) TakeAuthCode(code string) (*goauth2.AuthCodeInfo, error) {
+	return nil, fmt.Errorf("%w: connection refused", goauth2.ErrBackendUnavailable)
+}
+func (unavailableCache) LookupAccessToken(token string) (*goauth2.TokenInfo, error) {
+	return nil, fmt.Errorf("%w: connection refused", goauth2.ErrBackendUnavailable)
+}
+
+func (unavailableCache) LookupAccessTokens(tokens []string) (map[string]bool, error) {
+	return nil, fmt.Errorf("%w: connection refused", goauth2.ErrBackendUnavailable)
+}
+
+func (unavailableCache) Ping(ctx context.Context) error {
+	return fmt.Errorf("%w: connection refused", goauth2.ErrBackendUnavailable)
+}
+
+// An unreachable backend makes the API unavailable rather than unauthorized
+func TestTokenVerifierBackendUnavailable(t *testing.T) {
+	server := goauth2.NewServer(unavailableCache{}, authhandler.NewWhiteList("client1"))
+	handler := server.TokenVerifier(http.HandlerFunc(TestApiHandler))
+
+	req, _ := http.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", "sometoken")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("API response status is not service unavailable:", w.Code)
+	}
+}
+
+// The health check follows the reachability of the token backend
+func TestHealthHandler(t *testing.T) {
+	healthy := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	unhealthy := goauth2.NewServer(unavailableCache{}, authhandler.NewWhiteList("client1"))
+
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+
+	w := httptest.NewRecorder()
+	healthy.HealthHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Error("Health check of a basic cache is not OK:", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	unhealthy.HealthHandler().ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("Health check of an unreachable cache is not unavailable:", w.Code)
+	}
+}
+
+// An overloaded AuthHandler can ask the client to come back later
+func TestAuthorizeTemporarilyUnavailable(t *testing.T) {
+	overloaded := authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		err := goauth2.NewServerError(goauth2.ErrorCodeTemporarilyUnavailable,
+			"Too busy.", "").WithRetryAfter(30 * time.Second)
+		if implicit {
+			oar.ImplicitRedirect(w, r, err)
+		} else {
+			oar.AuthCodeRedirect(w, r, err)
+		}
+	})
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), overloaded)
+
+	w := clientAuthorizeRequest(server, "client1", "code")
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if loc.Query().Get("error") != "temporarily_unavailable" || w.Header().Get("Retry-After") != "30" {
+		t.Error("Code request was not redirected with a retry hint", loc, w.Header())
+	}
+
+	w = clientAuthorizeRequest(server, "client1", "token")
+	loc, _ = url.Parse(w.Header().Get("Location"))
+	if frag, _ := url.ParseQuery(loc.Fragment); frag.Get("error") != "temporarily_unavailable" || w.Header().Get("Retry-After") != "30" {
+		t.Error("Implicit request was not redirected with a retry hint", loc, w.Header())
+	}
+}
+
+// The token endpoint answers 503 when the token backend is unreachable
+func TestTokenEndpointBackendUnavailable(t *testing.T) {
+	server := goauth2.NewServer(unavailableCache{}, authhandler.NewWhiteList("client1"))
+
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType: "authorization_code",
+		Code:      "somecode",
+	})
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if w.Code != http.StatusServiceUnavailable || ret["error"] != "temporarily_unavailable" {
+		t.Error("Token response is not unavailable:", w.Code, ret)
+	}
+}
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Start a server with a login system keeping the user in a cookie, and a
+// client that keeps cookies and doesn't follow redirects
+func newSessionServer(t *testing.T) (*httptest.Server, *http.Client, *authhandler.SessionAuth) {
+	checker := func(r *http.Request) (string, bool) {
+		c, err := r.Cookie("session")
+		if err != nil {
+			return "", false
+		}
+		return c.Value, true
+	}
+	auth := authhandler.NewSessionAuth(checker, "/login", "/resume")
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), auth)
+
+	mux := http.NewServeMux()
+	mux.Handle("/oauth2", server.MasterHandler())
+	mux.Handle("/resume", auth.ResumeHandler(server))
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "user1", Path: "/"})
+		http.Redirect(w, r, r.URL.Query().Get("return_to"), http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return ts, client, auth
+}
+
+// Get a URL and return the redirect location
+func getRedirect(t *testing.T, client *http.Client, u string) *url.URL {
+	res, err := client.Get(u)
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatal("Request was not redirected", u, res.Status)
+	}
+	loc, err := res.Request.URL.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal("Bad redirect location", err)
+	}
+	return loc
+}
+
+func sessionAuthorizeURL(ts *httptest.Server) string {
+	return authorizeURL(ts.URL+"/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+		State:        "session_test",
+	})
+}
+
+// A user that isn't logged in is sent to the login page, and the request
+// resumes after logging in
+func TestSessionLogin(t *testing.T) {
+	ts, client, _ := newSessionServer(t)
+	defer ts.Close()
+
+	login := getRedirect(t, client, sessionAuthorizeURL(ts))
+	if login.Path != "/login" || login.Query().Get("return_to") == "" {
+		t.Fatal("User was not sent to the login page", login)
+	}
+
+	resume := getRedirect(t, client, login.String())
+	if resume.Path != "/resume" {
+		t.Fatal("Login did not return to the resume handler", resume)
+	}
+
+	loc := getRedirect(t, client, resume.String())
+	code := loc.Query().Get("code")
+	if loc.Host != "localhost" || code == "" || loc.Query().Get("state") != "session_test" {
+		t.Fatal("Resumed request was not redirected with a code", loc)
+	}
+
+	// The pending request can't be resumed twice
+	res, err := client.Get(resume.String())
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Pending request was resumed twice", res.Status)
+	}
+
+	// Once logged in, the request is approved right away
+	loc = getRedirect(t, client, sessionAuthorizeURL(ts))
+	if loc.Query().Get("code") == "" {
+		t.Error("Request of a logged in user was not approved", loc)
+	}
+}
+
+func TestSessionTampered(t *testing.T) {
+	ts, client, _ := newSessionServer(t)
+	defer ts.Close()
+
+	login := getRedirect(t, client, sessionAuthorizeURL(ts))
+	resume, _ := url.Parse(login.Query().Get("return_to"))
+	query := resume.Query()
+	query.Set("request", query.Get("request")+"0")
+	resume.RawQuery = query.Encode()
+
+	res, err := client.Get(ts.URL + resume.String())
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	defer res.Body.Close()
+	ret := make(map[string]string)
+	json.NewDecoder(res.Body).Decode(&ret)
+	if res.StatusCode != http.StatusForbidden || ret["error"] != "access_denied" {
+		t.Error("Tampered request was not denied", res.Status, ret)
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	ts, client, auth := newSessionServer(t)
+	defer ts.Close()
+	auth.Expiry = time.Millisecond
+
+	login := getRedirect(t, client, sessionAuthorizeURL(ts))
+	time.Sleep(10 * time.Millisecond)
+
+	resume := getRedirect(t, client, login.String())
+	res, err := client.Get(resume.String())
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Expired request was resumed", res.Status)
+	}
+}
@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStatelessServer(key string) (*goauth2.Server, *authcache.BasicAuthCache) {
+	cache := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(cache, authhandler.NewWhiteList("client1"))
+	server.Store = goauth2.NewStatelessCodeStore(cache, []byte(key))
+	return server, cache
+}
+
+func statelessExchange(server *goauth2.Server, code, redirectURI string) error {
+	_, _, _, err := server.Store.CreateAccessToken(&goauth2.AccessTokenRequest{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: redirectURI,
+	})
+	return err
+}
+
+// Stateless codes are exchanged by any server with the key, only once
+func TestStatelessCodes(t *testing.T) {
+	server, cache := newStatelessServer("key1")
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	if code == "" || len(cache.AuthCodes) != 0 {
+		t.Fatal("Stateless code was registered", code, cache.AuthCodes)
+	}
+
+	// Another server with the same key and cache
+	other := goauth2.NewServer(cache, nil)
+	other.Store = goauth2.NewStatelessCodeStore(cache, []byte("key1"))
+
+	if err := statelessExchange(other, code, "http://localhost/other"); err == nil {
+		t.Error("Stateless code was exchanged with another redirect URI")
+	}
+	code = authorizeRequest(t, server, "code").Query().Get("code")
+	if err := statelessExchange(other, code, "http://localhost/redirect"); err != nil {
+		t.Fatal("Stateless code was refused", err)
+	}
+	if len(cache.AccessTokens) != 1 {
+		t.Error("No token was issued", cache.AccessTokens)
+	}
+	if err := statelessExchange(server, code, "http://localhost/redirect"); !errors.Is(err, goauth2.ErrInvalidGrant) {
+		t.Error("Stateless code was used twice", err)
+	}
+}
+
+// Of concurrent exchanges of a stateless code, even by several servers,
+// only one gets a token
+func TestStatelessCodeConcurrentExchange(t *testing.T) {
+	server, cache := newStatelessServer("key1")
+	other := goauth2.NewServer(cache, nil)
+	other.Store = goauth2.NewStatelessCodeStore(cache, []byte("key1"))
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+
+	const requests = 8
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		s := server
+		if i%2 == 1 {
+			s = other
+		}
+		go func() { errs <- statelessExchange(s, code, "http://localhost/redirect") }()
+	}
+	issued := 0
+	for i := 0; i < requests; i++ {
+		if err := <-errs; err == nil {
+			issued++
+		} else if !errors.Is(err, goauth2.ErrInvalidGrant) {
+			t.Error("Bad error of a concurrent exchange", err)
+		}
+	}
+	if issued != 1 {
+		t.Error("Concurrent exchanges of a stateless code issued tokens", issued)
+	}
+}
+
+func TestStatelessCodeTampered(t *testing.T) {
+	server, _ := newStatelessServer("key1")
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+
+	wrongKey, _ := newStatelessServer("key2")
+	i := strings.LastIndex(code, ".")
+	for _, bad := range []string{
+		"", "garbage", code[:i], code[:i] + ".", "x" + code, code + "x",
+	} {
+		if err := statelessExchange(server, bad, "http://localhost/redirect"); !errors.Is(err, goauth2.ErrInvalidGrant) {
+			t.Error("Tampered code was not an invalid grant", bad, err)
+		}
+	}
+	if err := statelessExchange(wrongKey, code, "http://localhost/redirect"); !errors.Is(err, goauth2.ErrInvalidGrant) {
+		t.Error("Code signed with another key was accepted", err)
+	}
+
+	// Expired codes
+	server.Store.(*goauth2.StatelessCodeStore).CodeExpiry = -time.Second
+	code = authorizeRequest(t, server, "code").Query().Get("code")
+	if err := statelessExchange(server, code, "http://localhost/redirect"); !errors.Is(err, goauth2.ErrCodeExpired) {
+		t.Error("Expired code was not refused", err)
+	}
+}
+
+func newEncryptedServer(encKeys *goauth2.KeyRing) (*goauth2.Server, *goauth2.StatelessCodeStore) {
+	cache := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(cache, authhandler.NewWhiteList("client1"))
+	store := goauth2.NewEncryptedCodeStore(cache, goauth2.NewKeyRing("s1", []byte("signing key")), encKeys)
+	server.Store = store
+	return server, store
+}
+
+// Encrypted codes don't show their information, and are exchanged once
+func TestEncryptedCodes(t *testing.T) {
+	server, _ := newEncryptedServer(goauth2.NewKeyRing("e1", []byte("encryption key")))
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	for _, part := range strings.Split(code, ".") {
+		decoded, _ := base64.RawURLEncoding.DecodeString(part)
+		if strings.Contains(string(decoded), "client1") || strings.Contains(string(decoded), "localhost") {
+			t.Error("Encrypted code shows its information", string(decoded))
+		}
+	}
+
+	if err := statelessExchange(server, code, "http://localhost/redirect"); err != nil {
+		t.Fatal("Encrypted code was refused", err)
+	}
+	if err := statelessExchange(server, code, "http://localhost/redirect"); !errors.Is(err, goauth2.ErrInvalidGrant) {
+		t.Error("Encrypted code was used twice", err)
+	}
+}
+
+// Tampered, unencrypted, expired and unknown-key codes are refused, and
+// the codes of rotated keys accepted
+func TestEncryptedCodeRejections(t *testing.T) {
+	encKeys := goauth2.NewKeyRing("e1", []byte("encryption key"))
+	server, store := newEncryptedServer(encKeys)
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+
+	// Tampered ciphertexts, signed again so that only the encryption
+	// catches them
+	body := code[:strings.LastIndex(code, ".")]
+	parts := strings.SplitN(body, ".", 2)
+	sealed, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	sealed[len(sealed)-1] ^= 1
+	otherKey := base64.RawURLEncoding.EncodeToString([]byte("e2"))
+	for name, bad := range map[string]string{
+		"ciphertext":    parts[0] + "." + base64.RawURLEncoding.EncodeToString(sealed),
+		"key id":        otherKey + "." + parts[1],
+		"no encryption": base64.RawURLEncoding.EncodeToString([]byte(`{"cid":"client1","n":"x","exp":9999999999}`)),
+	} {
+		signed := bad + "." + store.KeyRing().Sign(bad)
+		if err := statelessExchange(server, signed, "http://localhost/redirect"); !errors.Is(err, goauth2.ErrInvalidGrant) {
+			t.Errorf("Code with a tampered %s was not an invalid grant: %v", name, err)
+		}
+	}
+
+	// A code of the previous key is accepted after a rotation, until the
+	// key is removed
+	encKeys.AddKey("e2", []byte("second encryption key"))
+	encKeys.SetActive("e2")
+	if err := statelessExchange(server, code, "http://localhost/redirect"); err != nil {
+		t.Error("Code of the previous key was refused", err)
+	}
+	code = authorizeRequest(t, server, "code").Query().Get("code")
+	if !strings.HasPrefix(code, otherKey+".") {
+		t.Error("Code was not encrypted with the active key", code)
+	}
+	old := authorizeRequest(t, server, "code").Query().Get("code")
+	encKeys.SetActive("e1")
+	encKeys.RemoveKey("e2")
+	if err := statelessExchange(server, old, "http://localhost/redirect"); !errors.Is(err, goauth2.ErrInvalidGrant) {
+		t.Error("Code of a removed key was accepted", err)
+	}
+
+	store.CodeExpiry = -time.Second
+	code = authorizeRequest(t, server, "code").Query().Get("code")
+	if err := statelessExchange(server, code, "http://localhost/redirect"); !errors.Is(err, goauth2.ErrCodeExpired) {
+		t.Error("Expired code was not refused", err)
+	}
+}
@@ -0,0 +1,336 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const storeTestURI = "http://localhost/redirect"
+
+// Register a code as if it was issued for an authorization request with
+// the given redirect URI, and exchange it with another
+func exchangeCode(t *testing.T, authorizeURI, tokenURI string) error {
+	ac := authcache.NewBasicAuthCache()
+	store := goauth2.NewStore(ac)
+	if err := ac.RegisterAuthCode("code1", goauth2.AuthCodeInfo{
+		ClientID:    "client1",
+		RedirectURI: authorizeURI,
+	}); err != nil {
+		t.Fatal("Error registering auth code", err)
+	}
+	_, _, _, err := store.CreateAccessToken(&goauth2.AccessTokenRequest{
+		GrantType:   "authorization_code",
+		Code:        "code1",
+		RedirectURI: tokenURI,
+	})
+	return err
+}
+
+// The redirect URI is required when it was included in the authorization request
+func TestRedirectURIPresentAtBoth(t *testing.T) {
+	if err := exchangeCode(t, storeTestURI, storeTestURI); err != nil {
+		t.Error("Matching redirect URI was rejected", err)
+	}
+	if err := exchangeCode(t, storeTestURI, storeTestURI+"/other"); err == nil {
+		t.Error("Mismatching redirect URI was accepted")
+	}
+
+	err := exchangeCode(t, storeTestURI, "")
+	if e, ok := err.(goauth2.ServerError); !ok || e.Code() != goauth2.ErrorCodeInvalidRequest {
+		t.Error("Missing redirect URI was not an invalid request", err)
+	}
+}
+
+// The redirect URI may be omitted when it was omitted from the authorization request
+func TestRedirectURIOmittedAtBoth(t *testing.T) {
+	if err := exchangeCode(t, "", ""); err != nil {
+		t.Error("Omitted redirect URI was rejected", err)
+	}
+	if err := exchangeCode(t, "", storeTestURI); err == nil {
+		t.Error("Redirect URI absent from the authorization request was accepted")
+	}
+}
+
+// Codes keep the time and address of the authorization request
+func TestAuthCodeIssueInfo(t *testing.T) {
+	ac := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(ac, nil)
+
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  storeTestURI,
+	}), nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	before := time.Now()
+	code, err := server.Store.CreateAuthCode(server.NewOAuthRequest(req))
+	if err != nil {
+		t.Fatal("Error creating auth code", err)
+	}
+
+	info, err := ac.LookupAuthCode(code)
+	if err != nil {
+		t.Fatal("Error looking up auth code", err)
+	}
+	if info.IssuedAt.Before(before) || info.IssuedAt.After(time.Now()) {
+		t.Error("Bad issue time", info.IssuedAt)
+	}
+	if info.RequestIP != "10.0.0.1" {
+		t.Error("Bad request IP", info.RequestIP)
+	}
+	if info.ClientID != "client1" || info.RedirectURI != storeTestURI {
+		t.Error("Bad auth code info", info)
+	}
+}
+
+// Exchange a code granted "read write" for a token of the given scope
+func exchangeScope(t *testing.T, scope string) (map[string]string, *authcache.BasicAuthCache) {
+	ac := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(ac, nil)
+	if err := ac.RegisterAuthCode("code1", goauth2.AuthCodeInfo{
+		ClientID: "client1",
+		Scope:    "read write",
+	}); err != nil {
+		t.Fatal("Error registering auth code", err)
+	}
+
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType: "authorization_code",
+		Code:      "code1",
+		Scope:     scope,
+	})
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	return ret, ac
+}
+
+// The token may be requested with a narrower scope than the one granted
+func TestExchangeNarrowerScope(t *testing.T) {
+	ret, ac := exchangeScope(t, "read")
+	if ret["token"] == "" || ret["scope"] != "read" {
+		t.Fatal("Narrower scope was refused", ret)
+	}
+	if scope := ac.AccessTokens[ret["token"]].Scope; scope != "read" {
+		t.Error("Token was not issued with the narrower scope", scope)
+	}
+
+	ret, ac = exchangeScope(t, "write read")
+	if ret["token"] == "" || ac.AccessTokens[ret["token"]].Scope != "write read" {
+		t.Error("Equal scope was refused", ret)
+	}
+
+	ret, ac = exchangeScope(t, "")
+	if ret["token"] == "" || ret["scope"] != "" || ac.AccessTokens[ret["token"]].Scope != "read write" {
+		t.Error("Token without a requested scope does not have the granted one", ret)
+	}
+
+	// Duplicates are dropped from the issued scope
+	ret, ac = exchangeScope(t, "read read")
+	if ret["scope"] != "read" || ac.AccessTokens[ret["token"]].Scope != "read" {
+		t.Error("Bad issued scope for duplicate values", ret)
+	}
+
+	ret, _ = exchangeScope(t, "read write admin")
+	if ret["error"] != "invalid_scope" || ret["token"] != "" {
+		t.Error("Broader scope was not refused", ret)
+	}
+}
+
+// The tokens a user authorized are listed without the tokens themselves
+func TestListUserTokens(t *testing.T) {
+	ac := authcache.NewBasicAuthCache()
+	login := authhandler.Func(func(w http.ResponseWriter, r *http.Request, oar *goauth2.OAuthRequest, implicit bool) {
+		oar.UserID = r.URL.Query().Get("user")
+		if implicit {
+			oar.ImplicitRedirect(w, r, nil)
+		} else {
+			oar.AuthCodeRedirect(w, r, nil)
+		}
+	})
+	server := goauth2.NewServer(ac, login)
+	authorize := func(user, responseType string) *url.URL {
+		req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+			ClientID:     "client1",
+			ResponseType: responseType,
+			RedirectURI:  storeTestURI,
+			Scope:        "read",
+			Extra:        url.Values{"user": {user}},
+		}), nil)
+		w := httptest.NewRecorder()
+		server.MasterHandler().ServeHTTP(w, req)
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		return loc
+	}
+
+	before := time.Now()
+	frag, _ := url.ParseQuery(authorize("user1", "token").Fragment)
+	implicitToken := frag.Get("access_token")
+	code := authorize("user1", "code").Query().Get("code")
+	token, _, _, err := server.Store.CreateAccessToken(&goauth2.AccessTokenRequest{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: storeTestURI,
+	})
+	if err != nil || implicitToken == "" {
+		t.Fatal("Error issuing tokens", err)
+	}
+	authorize("user2", "token")
+
+	tokens, err := server.Store.(*goauth2.StoreImpl).ListUserTokens("user1")
+	if err != nil || len(tokens) != 2 {
+		t.Fatal("Bad listing of user1 tokens", tokens, err)
+	}
+	for _, summary := range tokens {
+		if summary.ID != goauth2.TokenID(token) && summary.ID != goauth2.TokenID(implicitToken) {
+			t.Error("Bad token ID", summary.ID)
+		}
+		if summary.ID == token || summary.ID == implicitToken {
+			t.Error("Token was given away", summary.ID)
+		}
+		if summary.ClientID != "client1" || summary.Scope != "read" ||
+			summary.IssuedAt.Before(before) || summary.IssuedAt.After(time.Now()) {
+			t.Error("Bad token summary", summary)
+		}
+	}
+
+	if tokens, err := server.Store.(*goauth2.StoreImpl).ListUserTokens("user3"); err != nil || len(tokens) != 0 {
+		t.Error("Unknown user has tokens", tokens, err)
+	}
+}
+
+// Token identifiers are short prefixes, which never give a short token away
+func TestTokenID(t *testing.T) {
+	for token, id := range map[string]string{
+		"0123456789abcdefghij": "01234567",
+		"0123456789":           "01234",
+		"abc":                  "a",
+		"a":                    "",
+	} {
+		if got := goauth2.TokenID(token); got != id {
+			t.Errorf("Bad identifier of %q: %q", token, got)
+		}
+	}
+}
+
+// Unknown and expired codes are invalid grants with their own descriptions
+func TestExchangeInvalidGrant(t *testing.T) {
+	ac := authcache.NewBasicAuthCache()
+	store := goauth2.NewStore(ac)
+	ac.RegisterAuthCode("code1", goauth2.AuthCodeInfo{ClientID: "client1"})
+	ac.AuthCodes["code1"].ExpiresAt = time.Now().Add(-time.Second)
+
+	for code, description := range map[string]string{
+		"code1":   "The authorization code has expired.",
+		"unknown": "The authorization code is unknown or was already used.",
+	} {
+		_, _, _, err := store.CreateAccessToken(&goauth2.AccessTokenRequest{
+			GrantType: "authorization_code",
+			Code:      code,
+		})
+		var e goauth2.ServerError
+		if !errors.As(err, &e) || e.Code() != goauth2.ErrorCodeInvalidGrant || e.Description() != description {
+			t.Error("Bad error for code", code, err)
+		}
+	}
+}
+
+// A code is exchanged once, even by requests racing for it, and a request
+// rejected for another reason uses it up too
+func TestExchangeCodeOnce(t *testing.T) {
+	ac := authcache.NewBasicAuthCache()
+	store := goauth2.NewStore(ac)
+	exchange := func(code, redirectURI string) error {
+		_, _, _, err := store.CreateAccessToken(&goauth2.AccessTokenRequest{
+			GrantType:   "authorization_code",
+			Code:        code,
+			RedirectURI: redirectURI,
+		})
+		return err
+	}
+	invalidGrant := func(err error) bool {
+		var e goauth2.ServerError
+		return errors.As(err, &e) && e.Code() == goauth2.ErrorCodeInvalidGrant
+	}
+
+	ac.RegisterAuthCode("code1", goauth2.AuthCodeInfo{ClientID: "client1", RedirectURI: storeTestURI})
+	if err := exchange("code1", storeTestURI); err != nil {
+		t.Fatal("Error exchanging the code", err)
+	}
+	if err := exchange("code1", storeTestURI); !invalidGrant(err) {
+		t.Error("Code was exchanged twice", err)
+	}
+
+	ac.RegisterAuthCode("code2", goauth2.AuthCodeInfo{ClientID: "client1", RedirectURI: storeTestURI})
+	if err := exchange("code2", storeTestURI+"/other"); err == nil {
+		t.Fatal("Mismatching redirect URI was accepted")
+	}
+	if err := exchange("code2", storeTestURI); !invalidGrant(err) {
+		t.Error("Rejected code was exchanged", err)
+	}
+
+	ac.RegisterAuthCode("code3", goauth2.AuthCodeInfo{ClientID: "client1", RedirectURI: storeTestURI})
+	const requests = 8
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() { errs <- exchange("code3", storeTestURI) }()
+	}
+	issued := 0
+	for i := 0; i < requests; i++ {
+		if err := <-errs; err == nil {
+			issued++
+		} else if !invalidGrant(err) {
+			t.Error("Bad error of a concurrent exchange", err)
+		}
+	}
+	if issued != 1 {
+		t.Error("Concurrent exchanges of a code issued tokens", issued)
+	}
+}
+
+// Tokens a user authorized before the user's cutoff are no longer valid
+func TestUserCutoff(t *testing.T) {
+	cache := authcache.NewBasicAuthCache()
+	store := goauth2.NewStore(cache)
+	now := time.Now()
+	cache.RegisterAccessToken("old1", goauth2.TokenInfo{ClientID: "client1", UserID: "user1", IssuedAt: now.Add(-time.Hour)}, goauth2.TokenLifetime{})
+	cache.RegisterAccessToken("old2", goauth2.TokenInfo{ClientID: "client1", UserID: "user2", IssuedAt: now.Add(-time.Hour)}, goauth2.TokenLifetime{})
+	cache.RegisterAccessToken("unbound", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+
+	if err := store.SetUserCutoff("user1", now); err != nil {
+		t.Fatal("Error setting cutoff", err)
+	}
+	cache.RegisterAccessToken("new1", goauth2.TokenInfo{ClientID: "client1", UserID: "user1", IssuedAt: time.Now()}, goauth2.TokenLifetime{})
+
+	valid, err := store.ValidateAccessTokens([]string{"old1", "old2", "unbound", "new1"})
+	if err != nil || valid["old1"] || !valid["old2"] || !valid["unbound"] || !valid["new1"] {
+		t.Error("Bad validation after the cutoff", valid, err)
+	}
+	if ok, _ := store.ValidateAccessToken("old1"); ok {
+		t.Error("Token issued before the cutoff is valid")
+	}
+	if tokens, _ := store.ListUserTokens("user1"); len(tokens) != 1 {
+		t.Error("Token issued before the cutoff is listed", tokens)
+	}
+
+	// Cached validations are forgotten
+	caching := goauth2.NewCachingStore(goauth2.NewStore(cache), time.Minute)
+	if ok, _ := caching.ValidateAccessToken("old2"); !ok {
+		t.Fatal("Token was refused before the cutoff")
+	}
+	caching.SetUserCutoff("user2", now)
+	if ok, _ := caching.ValidateAccessToken("old2"); ok {
+		t.Error("Cached validation outlived the cutoff")
+	}
+}
@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// A server with the tenants "a" and "b", resolved by host, sharing a cache
+func newTenantServer(t *testing.T) (*goauth2.Server, *authcache.BasicAuthCache) {
+	cache := authcache.NewBasicAuthCache()
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), nil)
+	server.TenantResolver = func(r *http.Request) (string, error) {
+		return strings.TrimSuffix(r.Host, ".example.com"), nil
+	}
+	for _, name := range []string{"a", "b"} {
+		_, err := server.RegisterTenant(name, goauth2.TenantConfig{
+			Cache: cache,
+			Auth:  authhandler.NewWhiteList("client1"),
+			ErrorURIs: map[goauth2.ErrorCode]string{
+				goauth2.ErrorCodeInvalidGrant: "http://" + name + ".example.com/errors",
+			},
+		})
+		if err != nil {
+			t.Fatal("Error registering the tenant", err)
+		}
+	}
+	return server, cache
+}
+
+// Serve a request of the tenant of a host
+func tenantRequest(server *goauth2.Server, host string, req *http.Request) *httptest.ResponseRecorder {
+	req.Host = host
+	w := httptest.NewRecorder()
+	if strings.HasPrefix(req.URL.Path, "/api") {
+		server.TokenVerifier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, req)
+	} else {
+		server.MasterHandler().ServeHTTP(w, req)
+	}
+	return w
+}
+
+// Send an authorization request of client1 to a tenant, and return where
+// it redirected to
+func tenantAuthorize(t *testing.T, server *goauth2.Server, host, responseType string) *url.URL {
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: responseType,
+		RedirectURI:  "http://localhost/redirect",
+	}), nil)
+	w := tenantRequest(server, host, req)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusFound {
+		t.Fatal("Authorization request was not redirected", host, w.Code, w.Body)
+	}
+	return loc
+}
+
+// Exchange a code at a tenant
+func tenantExchange(server *goauth2.Server, host, code string) map[string]string {
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	})
+	w := tenantRequest(server, host, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	return ret
+}
+
+// The status of an API call to a tenant with a token
+func tenantAPIStatus(server *goauth2.Server, host, token string) int {
+	req, _ := http.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", token)
+	return tenantRequest(server, host, req).Code
+}
+
+// Codes and tokens of a tenant are refused by the other one, though they
+// share a cache
+func TestTenantIsolation(t *testing.T) {
+	server, cache := newTenantServer(t)
+
+	code := tenantAuthorize(t, server, "a.example.com", "code").Query().Get("code")
+	if ret := tenantExchange(server, "b.example.com", code); ret["error"] != "invalid_grant" ||
+		ret["error_uri"] != "http://b.example.com/errors" {
+		t.Error("Code of tenant a was not refused by tenant b", ret)
+	}
+	ret := tenantExchange(server, "a.example.com", code)
+	token := ret["token"]
+	if token == "" {
+		t.Fatal("Code was refused by its tenant", ret)
+	}
+
+	frag, _ := url.ParseQuery(tenantAuthorize(t, server, "b.example.com", "token").Fragment)
+	implicit := frag.Get("access_token")
+	for _, c := range []struct {
+		host, token string
+		status      int
+	}{
+		{"a.example.com", token, http.StatusOK},
+		{"b.example.com", token, http.StatusUnauthorized},
+		{"b.example.com", implicit, http.StatusOK},
+		{"a.example.com", implicit, http.StatusUnauthorized},
+		{"c.example.com", token, http.StatusUnauthorized},
+	} {
+		if status := tenantAPIStatus(server, c.host, c.token); status != c.status {
+			t.Errorf("Token at %s got %d, not %d", c.host, status, c.status)
+		}
+	}
+
+	// The tenants share the cache, with keys of their own
+	if len(cache.AccessTokens) != 2 {
+		t.Error("The tenants don't share the cache", cache.AccessTokens)
+	}
+	if _, ok := cache.AccessTokens[token]; ok {
+		t.Error("Token was kept without its tenant", cache.AccessTokens)
+	}
+
+	// Listings and revocations stay within a tenant
+	a := server.Tenant("a").Store.(*goauth2.StoreImpl)
+	if tokens, err := a.ListTokensByClient("client1"); err != nil || len(tokens) != 1 ||
+		tokens[0].ID != goauth2.TokenID(token) || tokens[0].ClientID != "client1" {
+		t.Error("Bad listing of the tokens of tenant a", tokens, err)
+	}
+	if n, err := a.RevokeByClient("client1"); n != 1 || err != nil {
+		t.Error("Bad revocation of the tokens of tenant a", n, err)
+	}
+	if status := tenantAPIStatus(server, "b.example.com", implicit); status != http.StatusOK {
+		t.Error("Revocation in tenant a revoked the tokens of tenant b", status)
+	}
+}
+
+// Unknown tenants are refused, and tenant names are checked
+func TestTenantRegistration(t *testing.T) {
+	server, _ := newTenantServer(t)
+
+	req, _ := http.NewRequest("GET", authorizeURL("/oauth2", oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code",
+		RedirectURI:  "http://localhost/redirect",
+	}), nil)
+	w := tenantRequest(server, "c.example.com", req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if ret["error"] != "invalid_request" || w.Header().Get("Location") != "" {
+		t.Error("Request of an unknown tenant was served", w.Code, w.Header(), ret)
+	}
+
+	server.TenantResolver = func(r *http.Request) (string, error) {
+		return "", errors.New("no tenant")
+	}
+	if status := tenantAPIStatus(server, "a.example.com", "token"); status != http.StatusUnauthorized {
+		t.Error("Token was accepted without a tenant", status)
+	}
+
+	cache := authcache.NewBasicAuthCache()
+	for _, name := range []string{"", "a@b", "a"} {
+		if _, err := server.RegisterTenant(name, goauth2.TenantConfig{Cache: cache}); err == nil {
+			t.Errorf("Tenant %q was registered", name)
+		}
+	}
+	if _, err := server.RegisterTenant("c", goauth2.TenantConfig{}); err == nil {
+		t.Error("Tenant without a cache was registered")
+	}
+}
@@ -2,90 +2,41 @@ package tests
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
+	"github.com/yanatan16/goauth2/oauthclient"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
-	"time"
-)
-
-const my_port int = 15698
-
-var (
-	auth_url      string
-	redirect_url  string
-	redirect_reqs chan *http.Request
-	fragments     chan string
 )
 
 // An ApiCheck function is meant to lightly access the API using
 // a verified uri with the token to make sure token verification works
 type ApiCheck func(t *testing.T, token string)
 
-func InitTests(myaddr, authUrl string) {
-	auth_url = authUrl
-	redirect_url = fmt.Sprintf("http://%s:%d/redirect", myaddr, my_port)
-
-	redirect_reqs = make(chan *http.Request, 25)
-	fragments = make(chan string, 10)
-
-	http.Handle("/redirect", http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			log.Println("Received Request for Redirect Return")
-			redirect_reqs <- r
-			w.Write([]byte("Redirect"))
-		}))
-
-	go func() {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", myaddr, my_port), nil))
-	}()
-
-	// Make sure to wait for the http servers
-	<-time.After(time.Second / 2)
-}
-
-func MakeQuery(query map[string]string, base_url string) string {
-	if len(query) == 0 {
-		return base_url
-	}
-	uri := base_url + "?"
-	for k, v := range query {
-		uri += url.QueryEscape(k) + "=" + url.QueryEscape(v) + "&"
-	}
-	uri = uri[:len(uri)-1] // Cut off last &
-	return string(uri)
+// A client stopping at the redirects, so that their Location can be read
+// without a server listening at the redirect URI
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
 }
 
-func FragmentStrippingRedirector(new *http.Request, via []*http.Request) error {
-	if len(via) >= 10 {
-		return errors.New("stopped after 10 redirects")
-	}
-	// Strip fragment
-	if len(new.URL.Fragment) > 0 {
-		fragments <- new.URL.Fragment
+// The URL of an authorization request to the endpoint at authURL. The
+// endpoints of the tests are well-formed, so errors panic.
+func authorizeURL(authURL string, p oauthclient.AuthorizeParams) string {
+	uri, err := oauthclient.BuildAuthorizeURL(authURL, p)
+	if err != nil {
+		panic(err)
 	}
-	return nil
+	return uri
 }
 
-// Test the implicit grant flow of OAuth 2.0
-func DoTestImplicitGrant(t *testing.T, checkApi ApiCheck) (token string) {
-	querymap := map[string]string{
-		"client_id":     "client1",
-		"response_type": "token", // This means use implicit auth grant
-		"redirect_uri":  redirect_url,
-		"scope":         "",                    // Not implemented right now
-		"state":         "implicit_grant_test", // Prevent's cross-site scripting
-	}
-
-	client := &http.Client{
-		CheckRedirect: FragmentStrippingRedirector,
-	}
-
-	response, err := client.Get(MakeQuery(querymap, auth_url))
+// Send an authorization request and return where the server redirected
+// to. JSON errors and responses that are not redirects fail the test.
+func authorizationRedirect(t *testing.T, authURL string, p oauthclient.AuthorizeParams) *url.URL {
+	response, err := noRedirectClient.Get(authorizeURL(authURL, p))
 	if err != nil {
 		t.Fatal("Error on http.Get", err)
 	}
@@ -109,108 +60,105 @@ func DoTestImplicitGrant(t *testing.T, checkApi ApiCheck) (token string) {
 		}
 	}
 
-	// Now look at redirect request
-	select {
-	case fragstr := <-fragments:
-		frag, err := url.ParseQuery(fragstr)
-		if err != nil {
-			t.Fatal("Error parsing URL Fragment", fragstr)
-		}
-		if errstr := frag.Get("error"); errstr != "" {
-			t.Fatal("Request Fragment contained error",
-				frag.Get("error"), frag.Get("error_description"),
-				frag.Get("error_uri"))
-		}
-		if ttype := frag.Get("token_type"); !(ttype == "bearer" || ttype == "mac") {
-			t.Fatalf("Request fragment contained bad token_type: %s / %s", ttype, fragstr)
-		}
-		exp := frag.Get("expires_in")
-		if exp != "" {
-			if _, err := strconv.ParseInt(exp, 10, 64); err != nil {
-				t.Fatal("Error parsing expires_in value into int", err)
-			}
-		}
-		if state := frag.Get("state"); state != "implicit_grant_test" {
-			t.Fatal("Request fragment contained bad state", state)
-		}
-		token = frag.Get("token")
-	case <-time.After(2 * time.Second):
-		t.Fatal("Fragment not received in time.")
+	loc, err := response.Location()
+	if err != nil {
+		t.Fatal("Authorization response is not a redirect", response.Status, err)
 	}
+	return loc
+}
 
-	// Clear Redirects
-	select {
-	case <-redirect_reqs:
-	case <-time.After(time.Second):
+// Send an authorization request and return the JSON error of the response,
+// which must not be a redirect
+func authorizationError(t *testing.T, authURL string, p oauthclient.AuthorizeParams) string {
+	response, err := noRedirectClient.Get(authorizeURL(authURL, p))
+	if err != nil {
+		t.Fatal("Error on http.Get", err)
 	}
+	defer response.Body.Close()
 
-	// Test using the access token
-	if checkApi != nil {
-		checkApi(t, token)
+	if loc := response.Header.Get("Location"); loc != "" {
+		t.Fatal("Authorization error was redirected", loc)
 	}
-
-	return token
+	ret := make(map[string]string)
+	if err := json.NewDecoder(response.Body).Decode(&ret); err != nil {
+		t.Fatal("Could not unmarshal response body.", err)
+	}
+	return ret["error"]
 }
 
-// Test the authorization code grant flow of OAuth 2.0
-func DoTestAuthCodeGrant(t *testing.T, checkApi ApiCheck) (token string) {
-	querymap := map[string]string{
-		"client_id":     "client1",
-		"response_type": "code", // This means use auth code grant
-		"redirect_uri":  redirect_url,
-		"scope":         "",                    // Not implemented right now
-		"state":         "authcode_grant_test", // Prevent's cross-site scripting
+// Test the implicit grant flow of OAuth 2.0 against the MasterHandler at
+// authURL, for client1 redirecting to redirectURL
+func DoTestImplicitGrant(t *testing.T, authURL, redirectURL string, checkApi ApiCheck) (token string) {
+	p := oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "token", // This means use implicit auth grant
+		RedirectURI:  redirectURL,
+		State:        "implicit_grant_test", // Prevent's cross-site scripting
 	}
 
-	response, err := http.Get(MakeQuery(querymap, auth_url))
+	// Now look at redirect request
+	loc := authorizationRedirect(t, authURL, p)
+	if !strings.HasPrefix(loc.String(), redirectURL) {
+		t.Fatal("Redirected to another URI", loc)
+	}
+	frag, err := url.ParseQuery(loc.Fragment)
 	if err != nil {
-		t.Fatal("Error on http.Get", err)
+		t.Fatal("Error parsing URL Fragment", loc.Fragment)
 	}
-	defer response.Body.Close()
-
-	if response.Header.Get("Content-Type") == "application/json" {
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			t.Fatal("Couldn't read response body.", err)
+	if errstr := frag.Get("error"); errstr != "" {
+		t.Fatal("Request Fragment contained error",
+			frag.Get("error"), frag.Get("error_description"),
+			frag.Get("error_uri"))
+	}
+	if ttype := frag.Get("token_type"); !(ttype == "bearer" || ttype == "mac") {
+		t.Fatalf("Request fragment contained bad token_type: %s / %s", ttype, loc.Fragment)
+	}
+	exp := frag.Get("expires_in")
+	if exp != "" {
+		if _, err := strconv.ParseInt(exp, 10, 64); err != nil {
+			t.Fatal("Error parsing expires_in value into int", err)
 		}
+	}
+	if state := frag.Get("state"); state != "implicit_grant_test" {
+		t.Fatal("Request fragment contained bad state", state)
+	}
+	token = frag.Get("access_token")
 
-		ret := make(map[string]string)
-		err = json.Unmarshal(body, &ret)
-		if err != nil {
-			t.Fatal("Could not unmarshal response body.", err)
-		}
+	// Test using the access token
+	if checkApi != nil {
+		checkApi(t, token)
+	}
 
-		if errstr, ok := ret["error"]; ok {
-			t.Fatal("Error on initial authorization query", errstr,
-				ret["error_description"], ret["error_uri"])
-		}
+	return token
+}
+
+// Test the authorization code grant flow of OAuth 2.0 against the
+// MasterHandler at authURL, for client1 redirecting to redirectURL
+func DoTestAuthCodeGrant(t *testing.T, authURL, redirectURL string, checkApi ApiCheck) (token string) {
+	p := oauthclient.AuthorizeParams{
+		ClientID:     "client1",
+		ResponseType: "code", // This means use auth code grant
+		RedirectURI:  redirectURL,
+		State:        "authcode_grant_test", // Prevent's cross-site scripting
 	}
 
 	// Now look at redirect request
-	var code string
-	select {
-	case req := <-redirect_reqs:
-		q := req.URL.Query() // Parse query
-		if errstr := q.Get("error"); errstr != "" {
-			t.Fatal("Request Fragment contained error",
-				q.Get("error"), q.Get("error_description"),
-				q.Get("error_uri"))
-		}
-		code = q.Get("code")
-	case <-time.After(2 * time.Second):
-		t.Fatal("Request not received in time.")
+	q := authorizationRedirect(t, authURL, p).Query()
+	if errstr := q.Get("error"); errstr != "" {
+		t.Fatal("Request Fragment contained error",
+			q.Get("error"), q.Get("error_description"),
+			q.Get("error_uri"))
 	}
+	code := q.Get("code")
 
 	// Perform the Access requet
-	querymap = map[string]string{
-		"grant_type":   "authorization_code", // This means use auth code grant
-		"redirect_uri": redirect_url,
-		"code":         code,
-	}
-
-	response2, err := http.Get(MakeQuery(querymap, auth_url))
+	response2, err := http.PostForm(authURL, url.Values{
+		"grant_type":   {"authorization_code"}, // This means use auth code grant
+		"redirect_uri": {redirectURL},
+		"code":         {code},
+	})
 	if err != nil {
-		t.Fatal("Error on http.Get", err)
+		t.Fatal("Error on http.PostForm", err)
 	}
 	defer response2.Body.Close()
 
@@ -261,3 +209,49 @@ func DoTestAuthCodeGrant(t *testing.T, checkApi ApiCheck) (token string) {
 
 	return token
 }
+
+// Test that the authorization code requests of client2, which is not
+// allowed, are redirected with access_denied
+func DoTestFailedAuthCodeRequest(t *testing.T, authURL, redirectURL string) {
+	p := oauthclient.AuthorizeParams{
+		ClientID:     "client2",
+		ResponseType: "code", // This means use auth code grant
+		RedirectURI:  redirectURL,
+		State:        "authcode_grant_test", // Prevent's cross-site scripting
+	}
+
+	// Now look at redirect request
+	q := authorizationRedirect(t, authURL, p).Query()
+	if errstr := q.Get("error"); errstr == "" {
+		t.Fatal("Request Redirect did not contain access_denied error!", q)
+	} else if errstr != "access_denied" {
+		t.Fatal("Request Fragment contained wrong error! ",
+			q.Get("error"), q.Get("error_description"),
+			q.Get("error_uri"))
+	}
+}
+
+// Test that the implicit grant requests of client2, which is not allowed,
+// are redirected with access_denied
+func DoTestFailedImplicitGrant(t *testing.T, authURL, redirectURL string) {
+	p := oauthclient.AuthorizeParams{
+		ClientID:     "client2",
+		ResponseType: "token", // This means use implicit auth grant
+		RedirectURI:  redirectURL,
+		State:        "implicit_grant_test", // Prevent's cross-site scripting
+	}
+
+	// Now look at redirect request
+	loc := authorizationRedirect(t, authURL, p)
+	frag, err := url.ParseQuery(loc.Fragment)
+	if err != nil {
+		t.Fatal("Error parsing URL Fragment", loc.Fragment)
+	}
+	if errstr := frag.Get("error"); errstr == "" {
+		t.Fatal("Fragment did not contain expected error!", loc.Fragment)
+	} else if errstr != "access_denied" {
+		t.Fatal("Request Fragment contained bad error",
+			frag.Get("error"), frag.Get("error_description"),
+			frag.Get("error_uri"))
+	}
+}
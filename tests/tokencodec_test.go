@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"errors"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newCodecServer(cache *authcache.BasicAuthCache) *goauth2.Server {
+	server := goauth2.NewServer(cache, authhandler.NewWhiteList("client1"))
+	server.Store.(*goauth2.StoreImpl).Codec = goauth2.NewTokenCodec([]byte("secret key"))
+	return server
+}
+
+// Issued tokens are tagged, and the backend only sees their random value
+func TestTokenCodec(t *testing.T) {
+	cache := authcache.NewBasicAuthCache()
+	server := newCodecServer(cache)
+
+	loc := authorizeRequest(t, server, "token")
+	frag, _ := url.ParseQuery(loc.Fragment)
+	token := frag.Get("access_token")
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		t.Fatal("Issued token is not tagged", token)
+	}
+	if _, ok := cache.AccessTokens[token[:i]]; !ok || len(cache.AccessTokens) != 1 {
+		t.Error("The backend does not hold the random value of the token", cache.AccessTokens)
+	}
+
+	if status := apiStatus(server, token); status != http.StatusOK {
+		t.Error("Tagged token was refused", status)
+	}
+
+	// A token can't be used without its tag, or with another one
+	for _, bad := range []string{token[:i], token[:i] + ".forged", token[:i] + "0" + token[i:]} {
+		if status := apiStatus(server, bad); status != http.StatusUnauthorized {
+			t.Error("Tampered token was accepted", bad, status)
+		}
+		if valid, err := server.Store.ValidateAccessToken(bad); valid || !errors.Is(err, goauth2.ErrInvalidToken) {
+			t.Error("Tampered token was not rejected with invalid_token", bad, err)
+		}
+	}
+
+	valid, err := server.Store.ValidateAccessTokens([]string{token, token[:i]})
+	if err != nil || !valid[token] || valid[token[:i]] {
+		t.Error("Bad batch validation of tagged tokens", valid, err)
+	}
+}
+
+// Tokens issued before the codec was set are only accepted with the flag
+func TestTokenCodecUntagged(t *testing.T) {
+	cache := authcache.NewBasicAuthCache()
+	cache.RegisterAccessToken("oldtoken", goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	server := newCodecServer(cache)
+
+	if status := apiStatus(server, "oldtoken"); status != http.StatusUnauthorized {
+		t.Error("Untagged token was accepted", status)
+	}
+
+	server.Store.(*goauth2.StoreImpl).AcceptUntagged = true
+	if status := apiStatus(server, "oldtoken"); status != http.StatusOK {
+		t.Error("Untagged token was refused with AcceptUntagged", status)
+	}
+	if status := apiStatus(server, "oldtoken.forged"); status != http.StatusUnauthorized {
+		t.Error("Tampered token was accepted with AcceptUntagged", status)
+	}
+}
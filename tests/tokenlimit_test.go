@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"encoding/json"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"github.com/yanatan16/goauth2/authhandler"
+	"github.com/yanatan16/goauth2/clientstore"
+	"github.com/yanatan16/goauth2/oauthclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// A server whose client1 may have two active tokens, with a clock telling
+// their issue times apart
+func newTokenLimitServer(t *testing.T, policy goauth2.TokenLimitPolicy) (*goauth2.Server, *fakeClock) {
+	clients := clientstore.NewBasicClientStore()
+	clients.AddClient(&goauth2.ClientImpl{
+		ClientID:         "client1",
+		ClientTokenLimit: goauth2.TokenLimit{Max: 2, Policy: policy},
+	})
+	clock := newFakeClock()
+	server, err := goauth2.NewServerOptions(
+		goauth2.WithAuthCache(authcache.NewBasicAuthCache()),
+		goauth2.WithClientStore(clients),
+		goauth2.WithAuthHandler(authhandler.NewWhiteList("client1")),
+		goauth2.WithClock(clock),
+	)
+	if err != nil {
+		t.Fatal("Error creating the server", err)
+	}
+	return server, clock
+}
+
+// Issue an implicit token, and return the redirect parameters
+func limitedImplicitToken(t *testing.T, server *goauth2.Server, clock *fakeClock) url.Values {
+	clock.Advance(time.Second)
+	frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment)
+	return frag
+}
+
+// Tokens beyond the cap are denied until one is revoked
+func TestTokenLimitDeny(t *testing.T) {
+	server, clock := newTokenLimitServer(t, goauth2.TokenLimitDeny)
+
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		frag := limitedImplicitToken(t, server, clock)
+		if frag.Get("access_token") == "" {
+			t.Fatal("Token under the cap was denied", frag)
+		}
+		tokens = append(tokens, frag.Get("access_token"))
+	}
+	if frag := limitedImplicitToken(t, server, clock); frag.Get("error") != "access_denied" ||
+		frag.Has("access_token") {
+		t.Error("Token over the cap was issued", frag)
+	}
+
+	// The code flow is capped too
+	code := authorizeRequest(t, server, "code").Query().Get("code")
+	req, _ := oauthclient.BuildTokenRequest("/oauth2", oauthclient.TokenParams{
+		GrantType:   "authorization_code",
+		Code:        code,
+		RedirectURI: "http://localhost/redirect",
+	})
+	w := httptest.NewRecorder()
+	server.MasterHandler().ServeHTTP(w, req)
+	ret := make(map[string]string)
+	json.NewDecoder(w.Body).Decode(&ret)
+	if ret["error"] != "access_denied" || ret["access_token"] != "" {
+		t.Error("Code was exchanged over the cap", ret)
+	}
+
+	for _, token := range tokens {
+		if status := apiStatus(server, token); status != http.StatusOK {
+			t.Error("Token under the cap was refused", status)
+		}
+	}
+	if err := server.Store.(*goauth2.StoreImpl).RevokeToken(tokens[0]); err != nil {
+		t.Fatal("Error revoking the token", err)
+	}
+	if frag := limitedImplicitToken(t, server, clock); frag.Get("access_token") == "" {
+		t.Error("Token was denied after a revocation", frag)
+	}
+}
+
+// Tokens beyond the cap evict the oldest ones
+func TestTokenLimitEvictOldest(t *testing.T) {
+	server, clock := newTokenLimitServer(t, goauth2.TokenLimitEvictOldest)
+
+	var tokens []string
+	for i := 0; i < 4; i++ {
+		frag := limitedImplicitToken(t, server, clock)
+		if frag.Get("access_token") == "" {
+			t.Fatal("Token was denied", frag)
+		}
+		tokens = append(tokens, frag.Get("access_token"))
+	}
+	for i, token := range tokens {
+		expected := http.StatusOK
+		if i < 2 {
+			expected = http.StatusUnauthorized
+		}
+		if status := apiStatus(server, token); status != expected {
+			t.Errorf("Token %d got %d, not %d", i, status, expected)
+		}
+	}
+}
+
+// The Store's default cap applies to clients without one, and requires a
+// backend that can count the tokens
+func TestDefaultTokenLimit(t *testing.T) {
+	server := goauth2.NewServer(authcache.NewBasicAuthCache(), authhandler.NewWhiteList("client1"))
+	server.Store.(*goauth2.StoreImpl).DefaultTokenLimit = goauth2.TokenLimit{Max: 1}
+	if frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment); frag.Get("access_token") == "" {
+		t.Fatal("Token under the cap was denied", frag)
+	}
+	if frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment); frag.Get("error") != "access_denied" {
+		t.Error("Token over the default cap was issued", frag)
+	}
+
+	store := goauth2.NewStore(plainCache{authcache.NewBasicAuthCache()})
+	store.DefaultTokenLimit = goauth2.TokenLimit{Max: 1}
+	server.Store = store
+	if frag, _ := url.ParseQuery(authorizeRequest(t, server, "token").Fragment); frag.Get("error") != "server_error" {
+		t.Error("Token was issued without counting the tokens", frag)
+	}
+}
+
+// An AuthCache without the optional interfaces
+type plainCache struct {
+	goauth2.AuthCache
+}
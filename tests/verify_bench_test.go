@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/yanatan16/goauth2"
+	"github.com/yanatan16/goauth2/authcache"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A server with a valid token in its cache, and a request bearing it
+func newVerifyServer(tb testing.TB, caching bool) (*goauth2.Server, *http.Request) {
+	cache := authcache.NewBasicAuthCache()
+	for i := 0; i < 1000; i++ {
+		cache.RegisterAccessToken(fmt.Sprintf("token%d", i), goauth2.TokenInfo{ClientID: "client1"}, goauth2.TokenLifetime{})
+	}
+	server := goauth2.NewServer(cache, nil)
+	if caching {
+		server.Store = goauth2.NewCachingStore(server.Store, time.Minute)
+	}
+
+	req, _ := http.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", "token500")
+	if err := server.VerifyToken(req); err != nil {
+		tb.Fatal("Token was refused", err)
+	}
+	return server, req
+}
+
+// Verifying a valid token with the in-memory cache doesn't allocate
+func TestVerifyTokenAllocs(t *testing.T) {
+	for _, caching := range []bool{false, true} {
+		server, req := newVerifyServer(t, caching)
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := server.VerifyToken(req); err != nil {
+				t.Fatal("Token was refused", err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("Verification allocated %v times (caching: %v)", allocs, caching)
+		}
+	}
+}
+
+func benchmarkVerifyToken(b *testing.B, caching bool) {
+	server, req := newVerifyServer(b, caching)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := server.VerifyToken(req); err != nil {
+				b.Fatal("Token was refused", err)
+			}
+		}
+	})
+}
+
+func BenchmarkVerifyToken(b *testing.B) {
+	benchmarkVerifyToken(b, false)
+}
+
+func BenchmarkVerifyTokenCaching(b *testing.B) {
+	benchmarkVerifyToken(b, true)
+}
+
+// The batch validation, for comparison
+func BenchmarkValidateAccessTokens(b *testing.B) {
+	server, _ := newVerifyServer(b, false)
+	fields := []string{"token1", "token500", "unknown"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := server.Store.ValidateAccessTokens(fields); err != nil {
+			b.Fatal("Error validating the tokens", err)
+		}
+	}
+}
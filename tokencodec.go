@@ -0,0 +1,74 @@
+package goauth2
+
+import (
+	"strings"
+)
+
+// TokenCodec turns the random values of access tokens into references
+// tagged with an HMAC, so that tokens can't be forged or altered without
+// the key, and tampered tokens are rejected before reaching the backend.
+// The backend only ever sees the untagged values.
+type TokenCodec struct {
+	keys *KeyRing
+}
+
+// Create a TokenCodec tagging tokens with key
+func NewTokenCodec(key []byte) *TokenCodec {
+	return NewTokenCodecWithKeyRing(NewKeyRing("default", key))
+}
+
+// Create a TokenCodec tagging tokens with the active key of keys, and
+// accepting the tags of all of them
+func NewTokenCodecWithKeyRing(keys *KeyRing) *TokenCodec {
+	return &TokenCodec{keys: keys}
+}
+
+// KeyRing returns the keys of the codec, to rotate them
+func (c *TokenCodec) KeyRing() *KeyRing {
+	return c.keys
+}
+
+// Encode tags the random value of a token
+func (c *TokenCodec) Encode(value string) string {
+	return value + "." + c.keys.Sign(value)
+}
+
+// Decode checks the tag of a token and returns its random value
+// Return false if the token is not tagged or was tampered with.
+func (c *TokenCodec) Decode(token string) (string, bool) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", false
+	}
+	value := token[:i]
+	if !c.keys.Verify(value, token[i+1:]) {
+		return "", false
+	}
+	return value, true
+}
+
+// ----------------------------------------------------------------------------
+
+// The access token issued for a random value
+func (s *StoreImpl) issuedToken(value string) string {
+	if s.Codec == nil {
+		return value
+	}
+	return s.Codec.Encode(value)
+}
+
+// The random value of an access token, as registered in the backend
+// Return an invalid_token error if the token's tag is missing or wrong.
+func (s *StoreImpl) tokenValue(token string) (string, error) {
+	if s.Codec == nil {
+		return token, nil
+	}
+	if value, ok := s.Codec.Decode(token); ok {
+		return value, nil
+	}
+	if s.AcceptUntagged && !strings.Contains(token, ".") {
+		// Issued before tokens were tagged
+		return token, nil
+	}
+	return "", NewServerError(ErrorCodeInvalidToken, "The Access Token is invalid.", "")
+}
@@ -0,0 +1,91 @@
+package goauth2
+
+import (
+	"context"
+	"sort"
+)
+
+// TokenLimitPolicy tells what happens to a token request of a client that
+// has as many active access tokens as it may have
+type TokenLimitPolicy int
+
+const (
+	// Deny the request with an access_denied error
+	TokenLimitDeny TokenLimitPolicy = iota
+	// Revoke the oldest tokens of the client to make room for the new one
+	TokenLimitEvictOldest
+)
+
+// TokenLimit caps the number of active access tokens of a client, to limit
+// the damage a leaked client can do. A Max of 0 doesn't cap them.
+type TokenLimit struct {
+	Max    int
+	Policy TokenLimitPolicy
+}
+
+// TokenLimitedClient is implemented by a Client whose number of active
+// access tokens is capped. ClientImpl implements it.
+type TokenLimitedClient interface {
+	Client
+	// The cap of the client, or a zero TokenLimit for the Store's default
+	TokenLimit() TokenLimit
+}
+
+// The cap of a client's tokens: its own, or the Store's default
+func (s *StoreImpl) tokenLimit(client Client) TokenLimit {
+	if c, ok := client.(TokenLimitedClient); ok {
+		if limit := c.TokenLimit(); limit.Max > 0 {
+			return limit
+		}
+	}
+	return s.DefaultTokenLimit
+}
+
+// Make room for a new access token of a client, according to its cap
+// The active tokens are counted with the backend's TokenEnumerator, and the
+// oldest are evicted with its TokenRevoker. Requests served concurrently
+// may go over the cap by the number of such requests.
+func (s *StoreImpl) enforceTokenLimit(client Client) error {
+	limit := s.tokenLimit(client)
+	if limit.Max <= 0 {
+		return nil
+	}
+	e, ok := s.Backend.(TokenEnumerator)
+	if !ok {
+		return NewServerError(ErrorCodeServerError,
+			"The active tokens of the client can't be counted.", "").WithCause(ErrNotSupported)
+	}
+	tokens, err := e.ListTokensByClient(client.ID())
+	if err != nil {
+		return err
+	}
+	excess := len(tokens) - limit.Max + 1
+	if excess <= 0 {
+		return nil
+	}
+
+	if limit.Policy != TokenLimitEvictOldest {
+		return NewServerError(ErrorCodeAccessDenied,
+			"The client has too many active tokens.", "")
+	}
+	r, ok := s.Backend.(TokenRevoker)
+	if !ok {
+		return NewServerError(ErrorCodeServerError,
+			"The oldest tokens of the client can't be revoked.", "").WithCause(ErrNotSupported)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].IssuedAt.Before(tokens[j].IssuedAt)
+	})
+	for _, info := range tokens[:excess] {
+		if err := r.RevokeToken(info.Token); err != nil {
+			return err
+		}
+		audit(s.AuditLogger, context.Background(), AuditTokenRevoked, map[string]interface{}{
+			"token_hash": AuditTokenHash(s.issuedToken(info.Token)),
+			"client_id":  info.ClientID,
+			"user_id":    info.UserID,
+			"reason":     "token_limit",
+		})
+	}
+	return nil
+}